@@ -1,12 +1,30 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
 	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
 
 	"github.com/ehotinger/pop/expr"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "gen" {
+		if err := gen(os.Args[2:]); err != nil {
+			log.Fatalf("pop gen: %v", err)
+		}
+		return
+	}
+
 	parameters := make(map[string]interface{})
 	parameters["a"] = 10
 	parameters["b"] = 2
@@ -43,3 +61,137 @@ func main() {
 
 	// log.Println("Result:", result)
 }
+
+// gen generates a Go function from an expression:
+//
+//	pop gen -func HighValue -dir ./orders -type Order 'Total * Quantity > 1000'
+//	pop gen -func Score -package rules -schema price:float64,qty:int 'price * qty'
+//
+// The expression is evaluated against the struct named by -type, declared
+// in the package in -dir, or with the parameters declared by -schema.
+func gen(args []string) error {
+	flags := flag.NewFlagSet("pop gen", flag.ExitOnError)
+	pkg := flags.String("package", "", "the package of the generated file; defaults to the package in -dir")
+	function := flags.String("func", "", "the name of the generated function")
+	output := flags.String("o", "", "the file to write; defaults to standard output")
+	schema := flags.String("schema", "", "the parameters, as comma separated name:type pairs")
+	dir := flags.String("dir", ".", "the directory of the package declaring -type")
+	typeName := flags.String("type", "", "the struct the expression is evaluated against")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("expected an expression")
+	}
+	expression := flags.Arg(0)
+
+	var parser *expr.ExpressionParser
+	var err error
+	options := expr.GenerateOptions{Package: *pkg, Function: *function}
+	if *typeName != "" {
+		var env interface{}
+		var name string
+		env, name, err = parseStruct(*dir, *typeName)
+		if err != nil {
+			return err
+		}
+		if options.Package == "" {
+			options.Package = name
+		}
+		options.Environment = *typeName
+		parser, err = expr.NewExpressionParserForStruct(expression, env)
+	} else {
+		parser, err = expr.NewExpressionParser(expression, nil)
+	}
+	if err != nil {
+		return err
+	}
+	if *schema != "" {
+		for _, declaration := range strings.Split(*schema, ",") {
+			parts := strings.Split(strings.TrimSpace(declaration), ":")
+			if len(parts) != 2 || basicTypes[parts[1]] == nil {
+				return fmt.Errorf("invalid parameter %q; expected name:type with a basic type", declaration)
+			}
+			if err := parser.Declare(parts[0], basicTypes[parts[1]]); err != nil {
+				return err
+			}
+		}
+	}
+	source, err := parser.GenerateGo(options)
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err = os.Stdout.Write(source)
+		return err
+	}
+	return ioutil.WriteFile(*output, source, 0644)
+}
+
+var basicTypes = map[string]reflect.Type{
+	"bool":    reflect.TypeOf(false),
+	"string":  reflect.TypeOf(""),
+	"int":     reflect.TypeOf(int(0)),
+	"int8":    reflect.TypeOf(int8(0)),
+	"int16":   reflect.TypeOf(int16(0)),
+	"int32":   reflect.TypeOf(int32(0)),
+	"int64":   reflect.TypeOf(int64(0)),
+	"uint":    reflect.TypeOf(uint(0)),
+	"uint8":   reflect.TypeOf(uint8(0)),
+	"uint16":  reflect.TypeOf(uint16(0)),
+	"uint32":  reflect.TypeOf(uint32(0)),
+	"uint64":  reflect.TypeOf(uint64(0)),
+	"float32": reflect.TypeOf(float32(0)),
+	"float64": reflect.TypeOf(float64(0)),
+	"byte":    reflect.TypeOf(byte(0)),
+	"rune":    reflect.TypeOf(rune(0)),
+}
+
+// parseStruct finds the declaration of a struct in the package in dir, and
+// returns a pointer to a struct with the same exported fields of basic
+// types, along with the package's name. Other fields, and the struct's
+// methods, can't be used by expressions generated from the command line.
+func parseStruct(dir string, name string) (interface{}, string, error) {
+	packages, err := parser.ParseDir(token.NewFileSet(), dir, func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, pkg := range packages {
+		for _, file := range pkg.Files {
+			object := file.Scope.Lookup(name)
+			if object == nil || object.Kind != ast.Typ {
+				continue
+			}
+			spec, ok := object.Decl.(*ast.TypeSpec)
+			if !ok {
+				continue
+			}
+			declaration, ok := spec.Type.(*ast.StructType)
+			if !ok {
+				return nil, "", fmt.Errorf("%s isn't a struct", name)
+			}
+			var fields []reflect.StructField
+			for _, field := range declaration.Fields.List {
+				ident, ok := field.Type.(*ast.Ident)
+				if !ok || basicTypes[ident.Name] == nil {
+					continue
+				}
+				var tag reflect.StructTag
+				if field.Tag != nil {
+					value, err := strconv.Unquote(field.Tag.Value)
+					if err != nil {
+						return nil, "", err
+					}
+					tag = reflect.StructTag(value)
+				}
+				for _, fieldName := range field.Names {
+					if fieldName.IsExported() {
+						fields = append(fields, reflect.StructField{Name: fieldName.Name, Type: basicTypes[ident.Name], Tag: tag})
+					}
+				}
+			}
+			return reflect.New(reflect.StructOf(fields)).Interface(), pkg.Name, nil
+		}
+	}
+	return nil, "", fmt.Errorf("can't find the struct %s in %s", name, dir)
+}
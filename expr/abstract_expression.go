@@ -16,34 +16,70 @@ func (e *AbstractExpression) String() string {
 		return "AddExpr"
 	case AddCheckedExpr:
 		return "AddCheckedExpr"
+	case AddAssignExpr:
+		return "AddAssignExpr"
 	case AndExpr:
 		return "AndExpr"
 	case AndAlsoExpr:
 		return "AndAlsoExpr"
+	case AssignExpr:
+		return "AssignExpr"
+	case BlockExpr:
+		return "BlockExpr"
+	case CallExpr:
+		return "CallExpr"
+	case ConditionalExpr:
+		return "ConditionalExpr"
 	case ConstantExpr:
 		return "ConstantExpr"
+	case DeclareExpr:
+		return "DeclareExpr"
 	case DivideExpr:
 		return "DivideExpr"
+	case DivideAssignExpr:
+		return "DivideAssignExpr"
 	case EqualExpr:
 		return "EqualExpr"
 	case ExclusiveOrExpr:
 		return "ExclusiveOrExpr"
+	case FieldExpr:
+		return "FieldExpr"
 	case GreaterThanExpr:
 		return "GreaterThanExpr"
 	case GreaterThanOrEqualExpr:
 		return "GreaterThanOrEqualExpr"
+	case IfExpr:
+		return "IfExpr"
+	case IndexExpr:
+		return "IndexExpr"
+	case IndexFromEndExpr:
+		return "IndexFromEndExpr"
+	case InExpr:
+		return "InExpr"
+	case InvokeExpr:
+		return "InvokeExpr"
+	case IsExpr:
+		return "IsExpr"
+	case LambdaExpr:
+		return "LambdaExpr"
 	case LeftShiftExpr:
 		return "LeftShiftExpr"
 	case LessThanExpr:
 		return "LessThanExpr"
 	case LessThanOrEqualExpr:
 		return "LessThanOrEqualExpr"
+	case MemberExpr:
+		return "MemberExpr"
 	case ModuloExpr:
 		return "ModuloExpr"
+	case ModuloAssignExpr:
+		return "ModuloAssignExpr"
 	case MultiplyExpr:
 		return "MultiplyExpr"
 	case MultiplyCheckedExpr:
 		return "MultiplyCheckedExpr"
+	case MultiplyAssignExpr:
+		return "MultiplyAssignExpr"
 	case NegateExpr:
 		return "NegateExpr"
 	case UnaryPlusExpr:
@@ -52,6 +88,14 @@ func (e *AbstractExpression) String() string {
 		return "NotExpr"
 	case NotEqualExpr:
 		return "NotEqualExpr"
+	case NullableMemberExpr:
+		return "NullableMemberExpr"
+	case ConvertExpr:
+		return "ConvertExpr"
+	case HasFlagExpr:
+		return "HasFlagExpr"
+	case SharedExpr:
+		return "SharedExpr"
 	case OrExpr:
 		return "OrExpr"
 	case OrElseExpr:
@@ -60,12 +104,32 @@ func (e *AbstractExpression) String() string {
 		return "ParameterExpr"
 	case PowerExpr:
 		return "PowerExpr"
+	case PostDecrementAssignExpr:
+		return "PostDecrementAssignExpr"
+	case PostIncrementAssignExpr:
+		return "PostIncrementAssignExpr"
+	case PreDecrementAssignExpr:
+		return "PreDecrementAssignExpr"
+	case PreIncrementAssignExpr:
+		return "PreIncrementAssignExpr"
+	case ProgramExpr:
+		return "ProgramExpr"
+	case RangeExpr:
+		return "RangeExpr"
+	case ReturnExpr:
+		return "ReturnExpr"
 	case RightShiftExpr:
 		return "RightShiftExpr"
+	case SequenceExpr:
+		return "SequenceExpr"
 	case SubtractExpr:
 		return "SubtractExpr"
 	case SubtractCheckedExpr:
 		return "SubtractCheckedExpr"
+	case SubtractAssignExpr:
+		return "SubtractAssignExpr"
+	case SwitchExpr:
+		return "SwitchExpr"
 	default:
 		return "UnknownExpr"
 	}
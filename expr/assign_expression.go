@@ -0,0 +1,300 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+var (
+	errNotAddressable = errors.New("value isn't addressable; pass a pointer to assign to its fields")
+)
+
+// compoundAssignments maps each compound assignment to its arithmetic operator.
+var compoundAssignments = map[ExpressionType]ExpressionType{
+	AddAssignExpr:      AddExpr,
+	SubtractAssignExpr: SubtractExpr,
+	MultiplyAssignExpr: MultiplyExpr,
+	DivideAssignExpr:   DivideExpr,
+	ModuloAssignExpr:   ModuloExpr,
+}
+
+// IsAssignment determines whether or not an expression type writes to its
+// operand.
+func IsAssignment(t ExpressionType) bool {
+	switch t {
+	case AssignExpr,
+		AddAssignExpr,
+		SubtractAssignExpr,
+		MultiplyAssignExpr,
+		DivideAssignExpr,
+		ModuloAssignExpr,
+		PreIncrementAssignExpr,
+		PreDecrementAssignExpr,
+		PostIncrementAssignExpr,
+		PostDecrementAssignExpr:
+		return true
+	}
+	return false
+}
+
+// CreateAssign creates target = value.
+func CreateAssign(target Expression, value Expression) (Expression, error) {
+	if err := validateLeftAndRight(target, value); err != nil {
+		return nil, err
+	}
+	if err := validateAssignable(target); err != nil {
+		return nil, err
+	}
+	if !isAssignableKind(value.Kind(), target.Kind()) && !isImplicitlyConvertible(value, staticTypeOf(target)) {
+		return nil, fmt.Errorf("can't assign a value of kind %v to %v of kind %v", value.Kind(), target, target.Kind())
+	}
+	return NewBinaryExpression(AssignExpr, target, value, target.Kind()), nil
+}
+
+// CreateCompoundAssign creates a compound assignment such as target += value.
+// nodeType is one of AddAssignExpr, SubtractAssignExpr, MultiplyAssignExpr,
+// DivideAssignExpr or ModuloAssignExpr.
+func CreateCompoundAssign(nodeType ExpressionType, target Expression, value Expression) (Expression, error) {
+	if err := validateLeftAndRight(target, value); err != nil {
+		return nil, err
+	}
+	if _, ok := compoundAssignments[nodeType]; !ok {
+		return nil, fmt.Errorf("%v is not a compound assignment", nodeType)
+	}
+	if err := validateAssignable(target); err != nil {
+		return nil, err
+	}
+	if o := findOperator(compoundAssignments[nodeType], target, value); o != nil {
+		e := NewBinaryExpression(nodeType, target, value, target.Kind())
+		e.operator = o
+		return e, nil
+	}
+	if !isArithmeticOrUnknown(target.Kind()) || !isArithmeticOrUnknown(value.Kind()) {
+		return nil, fmt.Errorf("invalid expression, left or right isn't arithmetic: %v, %v", target.Kind(), value.Kind())
+	}
+	return NewBinaryExpression(nodeType, target, value, target.Kind()), nil
+}
+
+func CreatePreIncrementAssign(target Expression) (Expression, error) {
+	return createIncrementOrDecrement(PreIncrementAssignExpr, target)
+}
+
+func CreatePreDecrementAssign(target Expression) (Expression, error) {
+	return createIncrementOrDecrement(PreDecrementAssignExpr, target)
+}
+
+func CreatePostIncrementAssign(target Expression) (Expression, error) {
+	return createIncrementOrDecrement(PostIncrementAssignExpr, target)
+}
+
+func CreatePostDecrementAssign(target Expression) (Expression, error) {
+	return createIncrementOrDecrement(PostDecrementAssignExpr, target)
+}
+
+func createIncrementOrDecrement(nodeType ExpressionType, target Expression) (Expression, error) {
+	if target == nil {
+		return nil, errInvalidExpression
+	}
+	if err := validateAssignable(target); err != nil {
+		return nil, err
+	}
+	if !isArithmeticOrUnknown(target.Kind()) {
+		return nil, fmt.Errorf("%v requires an arithmetic value, got %v", nodeType, target.Kind())
+	}
+	return NewUnaryExpression(target, nodeType, target.Kind()), nil
+}
+
+func validateAssignable(target Expression) error {
+	switch e := target.(type) {
+	case *ParameterExpression, *MemberExpression, *FieldExpression:
+		return nil
+	case *BinaryExpression:
+		if e.Type() == IndexExpr && e.right.Type() != RangeExpr && e.left.Kind() != reflect.String {
+			return nil
+		}
+	}
+	return fmt.Errorf("can't assign to %v", target)
+}
+
+func isAssignableKind(value reflect.Kind, target reflect.Kind) bool {
+	switch {
+	case value == target, value == reflect.Interface, target == reflect.Interface:
+		return true
+	case IsArithmetic(value) && IsArithmetic(target):
+		return true
+	}
+	return false
+}
+
+func isArithmeticOrUnknown(kind reflect.Kind) bool {
+	return IsArithmetic(kind) || kind == reflect.Interface
+}
+
+// assignTo stores a value in the parameter, field, map entry or slice element
+// described by target and returns the value as stored.
+func assignTo(target Expression, value interface{}, scope *Scope) (interface{}, error) {
+	switch e := target.(type) {
+	case *ParameterExpression:
+		if _, ok := nullableType(e.typ); ok {
+			val, err := convertValue(value, e.typ)
+			if err != nil {
+				return nil, err
+			}
+			return value, scope.Assign(e.name, val.Interface())
+		}
+		val, err := convertToKind(value, e.Kind())
+		if err != nil {
+			return nil, err
+		}
+		return val, scope.Assign(e.name, val)
+	case *MemberExpression:
+		operand, err := visitOperand(e.operand, scope)
+		if err != nil {
+			return nil, err
+		}
+		return setMember(operand, e.name, value)
+	case *FieldExpression:
+		field, err := evaluateField(e, scope)
+		if err != nil {
+			return nil, err
+		}
+		if !field.CanSet() {
+			return nil, errNotAddressable
+		}
+		val, err := convertValue(value, field.Type())
+		if err != nil {
+			return nil, err
+		}
+		field.Set(val)
+		return unwrapNullable(val.Interface()), nil
+	case *BinaryExpression:
+		if e.Type() != IndexExpr {
+			break
+		}
+		operand, err := visitOperand(e.left, scope)
+		if err != nil {
+			return nil, err
+		}
+		index, err := visitExpression(e.right, scope)
+		if err != nil {
+			return nil, err
+		}
+		return setIndex(operand, index, value)
+	}
+	return nil, fmt.Errorf("can't assign to %v", target)
+}
+
+// visitOperand evaluates the operand of an assigned member or element.
+// Addressable fields of the environment evaluate to pointers, so assigning
+// to their members or elements writes through to the environment.
+func visitOperand(operand Expression, scope *Scope) (interface{}, error) {
+	if e, ok := operand.(*FieldExpression); ok {
+		field, err := evaluateField(e, scope)
+		if err != nil {
+			return nil, err
+		}
+		if field.CanAddr() {
+			return field.Addr().Interface(), nil
+		}
+		return field.Interface(), nil
+	}
+	return visitExpression(operand, scope)
+}
+
+func setMember(operand interface{}, name string, value interface{}) (interface{}, error) {
+	v := reflect.ValueOf(operand)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, fmt.Errorf("can't assign to %s of a nil value", name)
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		field := v.FieldByName(name)
+		if !field.IsValid() || !field.CanInterface() {
+			return nil, fmt.Errorf("%v has no exported field %s", v.Type(), name)
+		}
+		if !field.CanSet() {
+			return nil, errNotAddressable
+		}
+		val, err := convertValue(value, field.Type())
+		if err != nil {
+			return nil, err
+		}
+		field.Set(val)
+		return unwrapNullable(val.Interface()), nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("%v has no member %s", v.Type(), name)
+		}
+		val, err := convertValue(value, v.Type().Elem())
+		if err != nil {
+			return nil, err
+		}
+		v.SetMapIndex(reflect.ValueOf(name).Convert(v.Type().Key()), val)
+		return unwrapNullable(val.Interface()), nil
+	}
+	return nil, fmt.Errorf("%v has no member %s", v.Type(), name)
+}
+
+func setIndex(operand interface{}, index interface{}, value interface{}) (interface{}, error) {
+	v := reflect.ValueOf(operand)
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		i, err := convertToIndex(index)
+		if err != nil {
+			return nil, err
+		}
+		offset := i.Offset(v.Len())
+		if offset < 0 || offset >= v.Len() {
+			return nil, fmt.Errorf("index %v is out of bounds for length %d", i, v.Len())
+		}
+		element := v.Index(offset)
+		if !element.CanSet() {
+			return nil, errNotAddressable
+		}
+		val, err := convertValue(value, element.Type())
+		if err != nil {
+			return nil, err
+		}
+		element.Set(val)
+		return unwrapNullable(val.Interface()), nil
+	}
+	return nil, fmt.Errorf("can't assign to an element of %T", operand)
+}
+
+// convertValue converts a value so it can be stored in a location of the
+// provided type, applying a registered implicit conversion when there's one.
+func convertValue(value interface{}, typ reflect.Type) (reflect.Value, error) {
+	if _, ok := nullableType(typ); ok && (value == nil || !reflect.TypeOf(value).AssignableTo(typ)) {
+		return wrapNullable(value, typ)
+	}
+	if value == nil {
+		switch typ.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+			return reflect.Zero(typ), nil
+		}
+		return reflect.Value{}, fmt.Errorf("can't assign nil to %v", typ)
+	}
+	v := reflect.ValueOf(value)
+	if v.Type().AssignableTo(typ) {
+		return v, nil
+	}
+	if number, ok := denormalizeValue(value, typ); ok {
+		return number, nil
+	}
+	if isNamed(v.Type()) || isNamed(typ) || !IsArithmetic(v.Kind()) || !IsArithmetic(typ.Kind()) {
+		if converted, ok, err := convertImplicitly(value, typ); ok {
+			return converted, err
+		}
+	}
+	if IsArithmetic(v.Kind()) && IsArithmetic(typ.Kind()) {
+		return v.Convert(typ), nil
+	}
+	return reflect.Value{}, fmt.Errorf("can't assign %T to %v", value, typ)
+}
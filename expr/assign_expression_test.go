@@ -0,0 +1,219 @@
+package expr
+
+import (
+	"reflect"
+	"testing"
+)
+
+type account struct {
+	Balance float64
+	Visits  int
+	Tags    map[string]string
+	hidden  int
+}
+
+func TestStatementModeEvaluation(t *testing.T) {
+	for _, test := range []struct {
+		expression string
+		parameters map[string]interface{}
+		expected   interface{}
+		after      map[string]interface{}
+	}{
+		{
+			"total += fee",
+			map[string]interface{}{"total": 10.5, "fee": 2.25},
+			12.75,
+			map[string]interface{}{"total": 12.75, "fee": 2.25},
+		},
+		{
+			"count++",
+			map[string]interface{}{"count": 4},
+			4,
+			map[string]interface{}{"count": 5},
+		},
+		{
+			"++count",
+			map[string]interface{}{"count": 4},
+			5,
+			map[string]interface{}{"count": 5},
+		},
+		{
+			"count-- * 10",
+			map[string]interface{}{"count": 4},
+			40,
+			map[string]interface{}{"count": 3},
+		},
+		{
+			"x = y * 2",
+			map[string]interface{}{"x": 0, "y": 21},
+			42,
+			map[string]interface{}{"x": 42, "y": 21},
+		},
+		{
+			"a = b = 3",
+			map[string]interface{}{"a": 1, "b": 2},
+			3,
+			map[string]interface{}{"a": 3, "b": 3},
+		},
+		{
+			"n %= 4",
+			map[string]interface{}{"n": int64(10)},
+			int64(2),
+			map[string]interface{}{"n": int64(2)},
+		},
+		{
+			"items[^1] = 9",
+			map[string]interface{}{"items": []int{1, 2, 3}},
+			9,
+			map[string]interface{}{"items": []int{1, 2, 9}},
+		},
+		{
+			"settings.limit -= 5",
+			map[string]interface{}{"settings": map[string]int{"limit": 20}},
+			15,
+			map[string]interface{}{"settings": map[string]int{"limit": 15}},
+		},
+		{
+			"let s = 1 in (s += x) * 2",
+			map[string]interface{}{"x": 4},
+			10,
+			map[string]interface{}{"x": 4},
+		},
+	} {
+		parser, err := NewExpressionParser(test.expression, test.parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		parser.SetMode(StatementMode)
+		actual, err := parser.Evaluate(nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Fatalf("%s: expected %v (%T) but got %v (%T)", test.expression, test.expected, test.expected, actual, actual)
+		}
+		if !reflect.DeepEqual(test.parameters, test.after) {
+			t.Fatalf("%s: expected parameters %v but got %v", test.expression, test.after, test.parameters)
+		}
+	}
+}
+
+func TestStatementModeStructFields(t *testing.T) {
+	acct := &account{Balance: 100, Tags: map[string]string{}}
+	parameters := map[string]interface{}{"acct": acct, "fee": 2.5}
+	for _, expression := range []string{
+		"acct.Balance -= fee",
+		"acct.Visits++",
+		"acct.Tags.tier = 'gold'",
+	} {
+		parser, err := NewExpressionParser(expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		parser.SetMode(StatementMode)
+		if _, err := parser.Evaluate(nil); err != nil {
+			t.Fatalf("%s: unexpected err: %v", expression, err)
+		}
+	}
+	expected := &account{Balance: 97.5, Visits: 1, Tags: map[string]string{"tier": "gold"}}
+	if !reflect.DeepEqual(acct, expected) {
+		t.Fatalf("expected %+v but got %+v", expected, acct)
+	}
+}
+
+func TestStatementModeEvaluatesAgainstEnvironment(t *testing.T) {
+	parser, err := NewExpressionParser("count += step", map[string]interface{}{"count": 0, "step": 0})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	parser.SetMode(StatementMode)
+	env := map[string]interface{}{"count": 1, "step": 2}
+	for i := 0; i < 3; i++ {
+		if _, err := parser.Evaluate(env); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+	if env["count"] != 7 {
+		t.Fatalf("expected %v but got %v", 7, env["count"])
+	}
+}
+
+func TestAssignmentErrors(t *testing.T) {
+	acct := account{Balance: 100}
+	for _, test := range []struct {
+		expression string
+		mode       Mode
+	}{
+		{"x += 1", 0},
+		{"x++", 0},
+		{"1 = x", StatementMode},
+		{"x + 1 = 2", StatementMode},
+		{"name += 1", StatementMode},
+		{"name++", StatementMode},
+		{"x = name", StatementMode},
+		{"name[0] = 'a'", StatementMode},
+		{"acct.hidden = 1", StatementMode},
+		{"acct.Missing = 1", StatementMode},
+		{"acct.Balance = 1", StatementMode},
+		{"x /= 0", StatementMode},
+		{"x = null", StatementMode},
+	} {
+		parser, err := NewExpressionParser(test.expression, map[string]interface{}{
+			"x":    1,
+			"name": "pop",
+			"acct": acct,
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		parser.SetMode(test.mode)
+		if _, err := parser.Evaluate(nil); err == nil {
+			t.Fatalf("expected %s to error but it didn't", test.expression)
+		}
+	}
+	if acct.Balance != 100 {
+		t.Fatalf("expected the struct passed by value to be unchanged but got %v", acct.Balance)
+	}
+
+	// Outside of StatementMode = is equality.
+	parameters := map[string]interface{}{"x": 1}
+	parser, err := NewExpressionParser("x = 2", parameters)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	actual, err := parser.Evaluate(nil)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if actual != false || parameters["x"] != 1 {
+		t.Fatalf("expected x = 2 to compare x but got %v and x = %v", actual, parameters["x"])
+	}
+}
+
+func TestMemberAccess(t *testing.T) {
+	parameters := map[string]interface{}{
+		"acct":  &account{Balance: 12.5, Tags: map[string]string{"tier": "gold"}},
+		"order": map[string]interface{}{"qty": 3},
+	}
+	for _, test := range []struct {
+		expression string
+		expected   interface{}
+	}{
+		{"acct.Balance", 12.5},
+		{"acct.Balance * 2", float64(25)},
+		{"acct.Tags.tier", "gold"},
+		{"order.qty", 3},
+	} {
+		parser, err := NewExpressionParser(test.expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		actual, err := parser.Evaluate(nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Fatalf("%s: expected %v but got %v", test.expression, test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,949 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Evaluating a batch evaluates a program for many rows at once, with each
+// parameter bound to a column of values rather than to a single value.
+// Arithmetic, comparisons, logic, conditionals and casts over float64,
+// int64, string and bool columns are evaluated a column at a time, in loops
+// over typed slices which don't box values, and nulls are tracked in
+// bitmaps. Other nodes, such as method calls and lambdas, are evaluated row
+// by row.
+//
+// Evaluating a column at a time evaluates every operand for every row, even
+// where evaluating the row would skip it, as it skips the right operand of
+// false && x. So when an operand fails for any row, such as by dividing by
+// zero, the batch is evaluated row by row instead, and produces the same
+// values and errors as evaluating each row with Evaluate would.
+
+// Bitmap is a set of rows, such as the rows of a column which are null.
+// Row i is bit i%64 of word i/64. A nil Bitmap is empty.
+type Bitmap []uint64
+
+// NewBitmap creates an empty bitmap with room for length rows.
+func NewBitmap(length int) Bitmap {
+	return make(Bitmap, (length+63)/64)
+}
+
+// Set adds a row, which must be within the bitmap's length.
+func (b Bitmap) Set(row int) {
+	b[row/64] |= 1 << uint(row%64)
+}
+
+// Has determines whether or not the bitmap contains a row.
+func (b Bitmap) Has(row int) bool {
+	return row >= 0 && row/64 < len(b) && b[row/64]&(1<<uint(row%64)) != 0
+}
+
+// any determines whether or not the bitmap contains any of the first length
+// rows.
+func (b Bitmap) any(length int) bool {
+	for i, word := range b {
+		if rest := length - i*64; rest <= 0 {
+			return false
+		} else if rest < 64 {
+			word &= 1<<uint(rest) - 1
+		}
+		if word != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// unionBitmaps returns the rows in either of two bitmaps, which is nil when
+// both are.
+func unionBitmaps(a Bitmap, b Bitmap, length int) Bitmap {
+	if a == nil && b == nil {
+		return nil
+	}
+	union := NewBitmap(length)
+	for i := range union {
+		if i < len(a) {
+			union[i] |= a[i]
+		}
+		if i < len(b) {
+			union[i] |= b[i]
+		}
+	}
+	return union
+}
+
+// Column holds the values of a parameter, or of a result, for every row of
+// a batch: float64s, int64s, strings or bools, and a Bitmap of the rows
+// which are null. The values of null rows are ignored.
+type Column struct {
+	kind    reflect.Kind
+	length  int
+	floats  []float64
+	ints    []int64
+	strings []string
+	bools   []bool
+	nulls   Bitmap
+}
+
+// NewFloat64Column creates a column of float64s. nulls may be nil.
+func NewFloat64Column(values []float64, nulls Bitmap) *Column {
+	return &Column{kind: reflect.Float64, length: len(values), floats: values, nulls: nulls}
+}
+
+// NewInt64Column creates a column of int64s, which can also be bound to int
+// parameters. nulls may be nil.
+func NewInt64Column(values []int64, nulls Bitmap) *Column {
+	return &Column{kind: reflect.Int64, length: len(values), ints: values, nulls: nulls}
+}
+
+// NewStringColumn creates a column of strings. nulls may be nil.
+func NewStringColumn(values []string, nulls Bitmap) *Column {
+	return &Column{kind: reflect.String, length: len(values), strings: values, nulls: nulls}
+}
+
+// NewBoolColumn creates a column of bools. nulls may be nil.
+func NewBoolColumn(values []bool, nulls Bitmap) *Column {
+	return &Column{kind: reflect.Bool, length: len(values), bools: values, nulls: nulls}
+}
+
+// newColumn creates a column of zero values of a kind.
+func newColumn(kind reflect.Kind, length int) *Column {
+	c := &Column{kind: kind, length: length}
+	switch kind {
+	case reflect.Float64:
+		c.floats = make([]float64, length)
+	case reflect.Int, reflect.Int64:
+		c.ints = make([]int64, length)
+	case reflect.String:
+		c.strings = make([]string, length)
+	case reflect.Bool:
+		c.bools = make([]bool, length)
+	}
+	return c
+}
+
+// isColumnKind determines whether or not values of a kind can be held by a
+// column.
+func isColumnKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Float64, reflect.Int, reflect.Int64, reflect.String, reflect.Bool:
+		return true
+	}
+	return false
+}
+
+// Kind returns the kind of the column's values: Float64, Int64, String or
+// Bool, or Int for the results of expressions producing ints, which are
+// held as int64s.
+func (c *Column) Kind() reflect.Kind {
+	return c.kind
+}
+
+// Len returns the number of rows in the column.
+func (c *Column) Len() int {
+	return c.length
+}
+
+// Nulls returns the rows of the column which are null. It may be nil.
+func (c *Column) Nulls() Bitmap {
+	return c.nulls
+}
+
+// IsNull determines whether or not a row is null.
+func (c *Column) IsNull(row int) bool {
+	return c.nulls.Has(row)
+}
+
+// Float64s returns the values of a column of float64s.
+func (c *Column) Float64s() []float64 {
+	return c.floats
+}
+
+// Int64s returns the values of a column of int64s or ints.
+func (c *Column) Int64s() []int64 {
+	return c.ints
+}
+
+// Strings returns the values of a column of strings.
+func (c *Column) Strings() []string {
+	return c.strings
+}
+
+// Bools returns the values of a column of bools.
+func (c *Column) Bools() []bool {
+	return c.bools
+}
+
+// Value returns the value of a row, or nil if it's null.
+func (c *Column) Value(row int) interface{} {
+	if c.nulls.Has(row) {
+		return nil
+	}
+	switch c.kind {
+	case reflect.Float64:
+		return c.floats[row]
+	case reflect.Int:
+		return int(c.ints[row])
+	case reflect.Int64:
+		return c.ints[row]
+	case reflect.String:
+		return c.strings[row]
+	}
+	return c.bools[row]
+}
+
+// set stores the value of a row, which is converted to the column's kind.
+func (c *Column) set(row int, val interface{}) error {
+	if val == nil {
+		if c.nulls == nil {
+			c.nulls = NewBitmap(c.length)
+		}
+		c.nulls.Set(row)
+		return nil
+	}
+	v := reflect.ValueOf(val)
+	switch {
+	case c.kind == reflect.Float64 && isFloatKind(v.Kind()):
+		c.floats[row] = v.Float()
+	case c.isInt() && IsInteger(v.Kind()) && !IsUnsigned(v.Kind()):
+		c.ints[row] = v.Int()
+	case c.kind == reflect.String && v.Kind() == reflect.String:
+		c.strings[row] = v.String()
+	case c.kind == reflect.Bool && v.Kind() == reflect.Bool:
+		c.bools[row] = v.Bool()
+	default:
+		return fmt.Errorf("expected a %v but got %T", c.kind, val)
+	}
+	return nil
+}
+
+func (c *Column) isInt() bool {
+	return c.kind == reflect.Int || c.kind == reflect.Int64
+}
+
+func (c *Column) isNumber() bool {
+	return c.kind == reflect.Float64 || c.isInt()
+}
+
+// asFloats returns the values of a column of numbers as float64s.
+func (c *Column) asFloats() []float64 {
+	if c.kind == reflect.Float64 {
+		return c.floats
+	}
+	floats := make([]float64, c.length)
+	for i, x := range c.ints {
+		floats[i] = float64(x)
+	}
+	return floats
+}
+
+// withKind returns the column, or a copy of it sharing its values, with a
+// different kind of the same representation, such as an int64 column bound
+// to an int parameter.
+func (c *Column) withKind(kind reflect.Kind) *Column {
+	if c.kind == kind {
+		return c
+	}
+	copied := *c
+	copied.kind = kind
+	return &copied
+}
+
+// batch is what a batch is evaluated against.
+type batch struct {
+	length  int
+	columns map[string]*Column
+	// shared holds the columns of shared subexpressions once they've been
+	// evaluated.
+	shared map[int]*Column
+	slots  int
+	// assigns is set when the program can assign to parameters, so each row
+	// is evaluated with its own parameters.
+	assigns bool
+}
+
+// eachRow calls fn with the frame each row is evaluated against.
+func (b *batch) eachRow(fn func(row int, f frame) error) error {
+	parameters := make(map[string]interface{}, len(b.columns))
+	for row := 0; row < b.length; row++ {
+		if b.assigns && row > 0 {
+			parameters = make(map[string]interface{}, len(b.columns))
+		}
+		for name, column := range b.columns {
+			parameters[name] = column.Value(row)
+		}
+		f := frame{parameters: parameters}
+		if b.slots > 0 {
+			f.shared = newSharedValues(b.slots)
+		}
+		if err := fn(row, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchNode evaluates a node for every row of a batch.
+type batchNode func(*batch) (*Column, error)
+
+// errBatchRow reports that a node failed for a row, or can't be evaluated a
+// column at a time with the values it was given, so the batch must be
+// evaluated row by row.
+var errBatchRow = errors.New("a row of the batch must be evaluated on its own")
+
+// EvaluateBatch evaluates the program for every row of a batch, binding each
+// parameter to the column of the same name. The program should declare its
+// parameters with a schema, using nullable types for those whose columns
+// have nulls. The columns must all have the same number of rows, and the
+// program must produce float64s, ints, int64s, strings or bools, which are
+// returned in a column of the same kind. Values of named types, such as a
+// Celsius, are returned as values of their basic types.
+//
+// The result may share its values with the columns, such as when the
+// program is a parameter. When the program fails for a row, its error is
+// returned along with the row's number.
+func (p *Program) EvaluateBatch(columns map[string]*Column) (*Column, error) {
+	names := make([]string, 0, len(columns))
+	for name := range columns {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, errors.New("a batch needs at least one column")
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if p.bound[name] {
+			return nil, fmt.Errorf("parameter %s was bound by value when parsing, so it can't be a column; declare it instead", name)
+		}
+	}
+	b := &batch{
+		length:  -1,
+		columns: columns,
+		shared:  make(map[int]*Column),
+		slots:   p.slots,
+		assigns: p.assigns,
+	}
+	for _, name := range names {
+		column := columns[name]
+		if column == nil {
+			return nil, fmt.Errorf("column %s is nil", name)
+		}
+		if b.length >= 0 && column.length != b.length {
+			return nil, fmt.Errorf("column %s has %d rows but column %s has %d", name, column.length, names[0], b.length)
+		}
+		b.length = column.length
+	}
+	kind := p.root.kind
+	if !isColumnKind(kind) {
+		return nil, fmt.Errorf("a batch can't produce values of kind %v", kind)
+	}
+	p.batchOnce.Do(func() {
+		p.batch, p.batchErr = compileBatch(p.expression)
+	})
+	if p.batchErr != nil {
+		return nil, p.batchErr
+	}
+	result, err := p.batch(b)
+	if err == errBatchRow {
+		return p.evaluateRows(b, kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result.withKind(kind), nil
+}
+
+// evaluateRows evaluates a batch row by row.
+func (p *Program) evaluateRows(b *batch, kind reflect.Kind) (*Column, error) {
+	result := newColumn(kind, b.length)
+	err := b.eachRow(func(row int, f frame) error {
+		val, err := p.root.value(f)
+		if err == nil {
+			err = result.set(row, val)
+		}
+		if err != nil {
+			return fmt.Errorf("row %d: %v", row, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// compileBatch compiles a node for evaluating batches, a column at a time
+// where it can be and row by row otherwise. It returns nil for nodes whose
+// values can't be held by a column, which their parents evaluate row by
+// row.
+func compileBatch(node Expression) (batchNode, error) {
+	fn, err := compileColumns(node)
+	if err != nil || fn != nil {
+		return fn, err
+	}
+	if !isColumnKind(node.Kind()) {
+		return nil, nil
+	}
+	c, err := compile(node)
+	if err != nil {
+		return nil, err
+	}
+	return batchRows(node.Kind(), c), nil
+}
+
+// batchRows evaluates a compiled node row by row.
+func batchRows(kind reflect.Kind, c *compiled) batchNode {
+	return func(b *batch) (*Column, error) {
+		result := newColumn(kind, b.length)
+		err := b.eachRow(func(row int, f frame) error {
+			val, err := c.value(f)
+			if err != nil {
+				return err
+			}
+			return result.set(row, val)
+		})
+		if err != nil {
+			return nil, errBatchRow
+		}
+		return result, nil
+	}
+}
+
+// compileColumns compiles a node to be evaluated a column at a time. It
+// returns nil for nodes which can't be.
+func compileColumns(node Expression) (batchNode, error) {
+	switch e := node.(type) {
+	case *ConstantExpression:
+		return batchConstant(e), nil
+	case *ParameterExpression:
+		return batchParameter(e), nil
+	case *BinaryExpression:
+		return batchBinary(e)
+	case *UnaryExpression:
+		return batchUnary(e)
+	case *ConditionalExpression:
+		return batchConditional(e)
+	case *ConvertExpression:
+		return batchConvert(e)
+	case *SharedExpression:
+		operand, err := compileBatch(e.operand)
+		if err != nil || operand == nil {
+			return nil, err
+		}
+		slot := e.slot
+		return func(b *batch) (*Column, error) {
+			if column, ok := b.shared[slot]; ok {
+				return column, nil
+			}
+			column, err := operand(b)
+			if err != nil {
+				return nil, err
+			}
+			b.shared[slot] = column
+			return column, nil
+		}, nil
+	}
+	return nil, nil
+}
+
+// compileOperands compiles the operands of a node for evaluating batches,
+// returning nil unless they all can be.
+func compileOperands(operands ...Expression) ([]batchNode, error) {
+	fns := make([]batchNode, len(operands))
+	for i, operand := range operands {
+		fn, err := compileBatch(operand)
+		if err != nil || fn == nil {
+			return nil, err
+		}
+		fns[i] = fn
+	}
+	return fns, nil
+}
+
+// batchConstant repeats a constant for every row. Integers are held as
+// int64s, like compileConstant evaluates them, and null is a column of
+// nulls with no values, which only compares with other columns.
+func batchConstant(e *ConstantExpression) batchNode {
+	if e.value == nil {
+		return func(b *batch) (*Column, error) {
+			c := newColumn(reflect.Interface, b.length)
+			c.nulls = NewBitmap(b.length)
+			for i := range c.nulls {
+				c.nulls[i] = math.MaxUint64
+			}
+			return c, nil
+		}
+	}
+	if isNamed(reflect.TypeOf(e.value)) {
+		return nil
+	}
+	var fill func(*Column)
+	var kind reflect.Kind
+	switch v := reflect.ValueOf(e.value); {
+	case v.Kind() == reflect.Bool:
+		x := v.Bool()
+		kind, fill = reflect.Bool, func(c *Column) {
+			for i := range c.bools {
+				c.bools[i] = x
+			}
+		}
+	case v.Kind() == reflect.String:
+		x := v.String()
+		kind, fill = reflect.String, func(c *Column) {
+			for i := range c.strings {
+				c.strings[i] = x
+			}
+		}
+	case isFloatKind(v.Kind()):
+		x := v.Float()
+		kind, fill = reflect.Float64, func(c *Column) {
+			for i := range c.floats {
+				c.floats[i] = x
+			}
+		}
+	case IsInteger(v.Kind()):
+		var x int64
+		if IsUnsigned(v.Kind()) {
+			if v.Uint() > math.MaxInt64 {
+				return nil
+			}
+			x = int64(v.Uint())
+		} else {
+			x = v.Int()
+		}
+		kind, fill = reflect.Int64, func(c *Column) {
+			for i := range c.ints {
+				c.ints[i] = x
+			}
+		}
+	default:
+		return nil
+	}
+	return func(b *batch) (*Column, error) {
+		c := newColumn(kind, b.length)
+		fill(c)
+		return c, nil
+	}
+}
+
+// batchParameter binds a parameter to its column. Only parameters declared
+// with basic types, or nullable basic types, are bound a column at a time.
+func batchParameter(e *ParameterExpression) batchNode {
+	typ, nullable := e.typ, false
+	if elem, ok := nullableType(typ); ok {
+		typ, nullable = elem, true
+	}
+	kind := e.Kind()
+	if !isColumnKind(kind) || typ != typeOfKind(kind) {
+		return nil
+	}
+	name := e.name
+	return func(b *batch) (*Column, error) {
+		column, ok := b.columns[name]
+		if !ok {
+			return nil, fmt.Errorf("unbound parameter: %s", name)
+		}
+		if column.kind != kind && !(column.isInt() && (kind == reflect.Int || kind == reflect.Int64)) {
+			return nil, fmt.Errorf("parameter %s is a %v but its column holds %vs", name, typ, column.kind)
+		}
+		if !nullable && column.nulls.any(b.length) {
+			return nil, fmt.Errorf("parameter %s isn't nullable but its column has nulls", name)
+		}
+		return column.withKind(kind), nil
+	}
+}
+
+func batchBinary(e *BinaryExpression) (batchNode, error) {
+	if e.operator != nil || IsAssignment(e.Type()) {
+		return nil, nil
+	}
+	operands, err := compileOperands(e.left, e.right)
+	if err != nil || operands == nil {
+		return nil, err
+	}
+	left, right := operands[0], operands[1]
+	var apply func(b *batch, l *Column, r *Column) (*Column, error)
+	switch nodeType, kind := e.Type(), e.Kind(); nodeType {
+	case AndAlsoExpr, OrElseExpr:
+		apply = func(b *batch, l *Column, r *Column) (*Column, error) {
+			return batchLogical(nodeType == OrElseExpr, l, r, b.length)
+		}
+	case AddExpr, SubtractExpr, MultiplyExpr, DivideExpr, ModuloExpr:
+		if !isNumberKind(kind) {
+			return nil, nil
+		}
+		apply = func(b *batch, l *Column, r *Column) (*Column, error) {
+			return batchArithmetic(nodeType, kind, l, r, b.length)
+		}
+	case LessThanExpr, LessThanOrEqualExpr, GreaterThanExpr, GreaterThanOrEqualExpr, EqualExpr, NotEqualExpr:
+		apply = func(b *batch, l *Column, r *Column) (*Column, error) {
+			return batchComparison(nodeType, l, r, b.length)
+		}
+	default:
+		return nil, nil
+	}
+	return func(b *batch) (*Column, error) {
+		l, err := left(b)
+		if err != nil {
+			return nil, err
+		}
+		r, err := right(b)
+		if err != nil {
+			return nil, err
+		}
+		return apply(b, l, r)
+	}, nil
+}
+
+// batchLogical applies && or ||. Rows whose operands are null fail when
+// they're evaluated, which they may not be, so they're evaluated row by
+// row.
+func batchLogical(or bool, l *Column, r *Column, length int) (*Column, error) {
+	if l.kind != reflect.Bool || r.kind != reflect.Bool || l.nulls.any(length) || r.nulls.any(length) {
+		return nil, errBatchRow
+	}
+	result := newColumn(reflect.Bool, length)
+	x, y, out := l.bools, r.bools, result.bools
+	if or {
+		for i := range out {
+			out[i] = x[i] || y[i]
+		}
+	} else {
+		for i := range out {
+			out[i] = x[i] && y[i]
+		}
+	}
+	return result, nil
+}
+
+// batchArithmetic applies an arithmetic operator, which like
+// evaluateArithmetic is computed with float64s when the result is a float
+// and with integers otherwise. Rows where either operand is null are null.
+func batchArithmetic(nodeType ExpressionType, kind reflect.Kind, l *Column, r *Column, length int) (*Column, error) {
+	if !l.isNumber() || !r.isNumber() {
+		return nil, errBatchRow
+	}
+	nulls := unionBitmaps(l.nulls, r.nulls, length)
+	if kind == reflect.Float64 {
+		result := newColumn(kind, length)
+		result.nulls = nulls
+		x, y, out := l.asFloats(), r.asFloats(), result.floats
+		switch nodeType {
+		case AddExpr:
+			for i := range out {
+				out[i] = x[i] + y[i]
+			}
+		case SubtractExpr:
+			for i := range out {
+				out[i] = x[i] - y[i]
+			}
+		case MultiplyExpr:
+			for i := range out {
+				out[i] = x[i] * y[i]
+			}
+		case DivideExpr:
+			for i := range out {
+				out[i] = x[i] / y[i]
+			}
+		default:
+			for i := range out {
+				out[i] = math.Mod(x[i], y[i])
+			}
+		}
+		return result, nil
+	}
+	if !l.isInt() || !r.isInt() {
+		return nil, errBatchRow
+	}
+	result := newColumn(kind, length)
+	result.nulls = nulls
+	x, y, out := l.ints, r.ints, result.ints
+	switch nodeType {
+	case AddExpr:
+		for i := range out {
+			out[i] = x[i] + y[i]
+		}
+	case SubtractExpr:
+		for i := range out {
+			out[i] = x[i] - y[i]
+		}
+	case MultiplyExpr:
+		for i := range out {
+			out[i] = x[i] * y[i]
+		}
+	default:
+		for i := range out {
+			if y[i] == 0 {
+				if nulls.Has(i) {
+					continue
+				}
+				return nil, errBatchRow
+			}
+			if nodeType == DivideExpr {
+				out[i] = x[i] / y[i]
+			} else {
+				out[i] = x[i] % y[i]
+			}
+		}
+	}
+	return result, nil
+}
+
+// comparisonResults returns the result of a comparison for each result of
+// comparing its operands, -1, 0, 1 or unordered, at the index one greater.
+func comparisonResults(nodeType ExpressionType) [unordered + 2]bool {
+	var results [unordered + 2]bool
+	for c := -1; c <= unordered; c++ {
+		results[c+1] = comparisonHolds(nodeType, c)
+	}
+	return results
+}
+
+// batchComparison applies a comparison, or == or !=. Like the visitors,
+// numbers compare by value, comparisons with null are false, and null only
+// equals null.
+func batchComparison(nodeType ExpressionType, l *Column, r *Column, length int) (*Column, error) {
+	equality := nodeType == EqualExpr || nodeType == NotEqualExpr
+	results := comparisonResults(nodeType)
+	result := newColumn(reflect.Bool, length)
+	out := result.bools
+	switch {
+	case l.isInt() && r.isInt():
+		x, y := l.ints, r.ints
+		for i := range out {
+			out[i] = results[compareInt64s(x[i], y[i])+1]
+		}
+	case l.isNumber() && r.isNumber():
+		x, y := l.asFloats(), r.asFloats()
+		for i := range out {
+			out[i] = results[compareFloats(x[i], y[i])+1]
+		}
+	case l.kind == reflect.String && r.kind == reflect.String:
+		x, y := l.strings, r.strings
+		for i := range out {
+			out[i] = results[strings.Compare(x[i], y[i])+1]
+		}
+	case l.kind == reflect.Bool && r.kind == reflect.Bool && equality:
+		x, y := l.bools, r.bools
+		for i := range out {
+			out[i] = (x[i] == y[i]) == (nodeType == EqualExpr)
+		}
+	case equality:
+		// Values of different types are never equal.
+		for i := range out {
+			out[i] = nodeType == NotEqualExpr
+		}
+	default:
+		return nil, errBatchRow
+	}
+	if nulls := unionBitmaps(l.nulls, r.nulls, length); nulls != nil {
+		for i := range out {
+			if !nulls.Has(i) {
+				continue
+			}
+			if equality {
+				out[i] = (l.nulls.Has(i) && r.nulls.Has(i)) == (nodeType == EqualExpr)
+			} else {
+				out[i] = false
+			}
+		}
+	}
+	return result, nil
+}
+
+func compareInt64s(x int64, y int64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// batchUnary applies -, + and !, which like arithmetic are null for null
+// operands.
+func batchUnary(e *UnaryExpression) (batchNode, error) {
+	if e.operator != nil {
+		return nil, nil
+	}
+	nodeType, kind := e.Type(), e.Kind()
+	switch {
+	case nodeType == NotExpr && kind == reflect.Bool:
+	case (nodeType == NegateExpr || nodeType == UnaryPlusExpr) && isNumberKind(kind):
+	default:
+		return nil, nil
+	}
+	operand, err := compileBatch(e.operand)
+	if err != nil || operand == nil {
+		return nil, err
+	}
+	return func(b *batch) (*Column, error) {
+		c, err := operand(b)
+		if err != nil {
+			return nil, err
+		}
+		switch nodeType {
+		case NotExpr:
+			if c.kind != reflect.Bool {
+				return nil, errBatchRow
+			}
+			result := newColumn(kind, b.length)
+			result.nulls = c.nulls
+			for i, x := range c.bools {
+				result.bools[i] = !x
+			}
+			return result, nil
+		case UnaryPlusExpr:
+			return convertColumn(c, kind, b.length)
+		}
+		if kind == reflect.Float64 && c.isNumber() {
+			result := newColumn(kind, b.length)
+			result.nulls = c.nulls
+			for i, x := range c.asFloats() {
+				// Negation subtracts from zero, like evaluateUnary.
+				result.floats[i] = 0 - x
+			}
+			return result, nil
+		}
+		if !c.isInt() {
+			return nil, errBatchRow
+		}
+		result := newColumn(kind, b.length)
+		result.nulls = c.nulls
+		for i, x := range c.ints {
+			result.ints[i] = -x
+		}
+		return result, nil
+	}, nil
+}
+
+// convertColumn converts a column of numbers to the numeric kind of a node.
+// Integers convert to float64s, and floats to integers of the same kind.
+func convertColumn(c *Column, kind reflect.Kind, length int) (*Column, error) {
+	switch {
+	case kind == reflect.Float64 && c.isNumber():
+		result := newColumn(kind, length)
+		result.nulls = c.nulls
+		copy(result.floats, c.asFloats())
+		return result, nil
+	case c.isInt():
+		return c.withKind(kind), nil
+	}
+	return nil, errBatchRow
+}
+
+// batchConditional selects the value of one of the branches for each row.
+// Rows whose tests are null fail, so they're evaluated row by row.
+func batchConditional(e *ConditionalExpression) (batchNode, error) {
+	kind := e.Kind()
+	if !isColumnKind(kind) {
+		return nil, nil
+	}
+	operands, err := compileOperands(e.test, e.ifTrue, e.ifFalse)
+	if err != nil || operands == nil {
+		return nil, err
+	}
+	return func(b *batch) (*Column, error) {
+		columns := make([]*Column, len(operands))
+		for i, operand := range operands {
+			c, err := operand(b)
+			if err != nil {
+				return nil, err
+			}
+			columns[i] = c
+		}
+		test, ifTrue, ifFalse := columns[0], columns[1], columns[2]
+		if test.kind != reflect.Bool || test.nulls.any(b.length) {
+			return nil, errBatchRow
+		}
+		result := newColumn(kind, b.length)
+		switch {
+		case kind == reflect.Float64 && ifTrue.isNumber() && ifFalse.isNumber():
+			x, y := ifTrue.asFloats(), ifFalse.asFloats()
+			for i, t := range test.bools {
+				if t {
+					result.floats[i] = x[i]
+				} else {
+					result.floats[i] = y[i]
+				}
+			}
+		case result.isInt() && ifTrue.isInt() && ifFalse.isInt():
+			x, y := ifTrue.ints, ifFalse.ints
+			for i, t := range test.bools {
+				if t {
+					result.ints[i] = x[i]
+				} else {
+					result.ints[i] = y[i]
+				}
+			}
+		case kind == reflect.String && ifTrue.kind == reflect.String && ifFalse.kind == reflect.String:
+			x, y := ifTrue.strings, ifFalse.strings
+			for i, t := range test.bools {
+				if t {
+					result.strings[i] = x[i]
+				} else {
+					result.strings[i] = y[i]
+				}
+			}
+		case kind == reflect.Bool && ifTrue.kind == reflect.Bool && ifFalse.kind == reflect.Bool:
+			x, y := ifTrue.bools, ifFalse.bools
+			for i, t := range test.bools {
+				if t {
+					result.bools[i] = x[i]
+				} else {
+					result.bools[i] = y[i]
+				}
+			}
+		default:
+			return nil, errBatchRow
+		}
+		if ifTrue.nulls != nil || ifFalse.nulls != nil {
+			for i, t := range test.bools {
+				if (t && ifTrue.nulls.Has(i)) || (!t && ifFalse.nulls.Has(i)) {
+					if result.nulls == nil {
+						result.nulls = NewBitmap(b.length)
+					}
+					result.nulls.Set(i)
+				}
+			}
+		}
+		return result, nil
+	}, nil
+}
+
+// batchConvert applies casts between numeric basic types. Casts to named
+// types and user-defined conversions are evaluated row by row.
+func batchConvert(e *ConvertExpression) (batchNode, error) {
+	kind := e.Kind()
+	if e.conversion != nil || isNamed(e.typ) || !isNumberKind(kind) {
+		return nil, nil
+	}
+	operand, err := compileBatch(e.operand)
+	if err != nil || operand == nil {
+		return nil, err
+	}
+	return func(b *batch) (*Column, error) {
+		c, err := operand(b)
+		if err != nil {
+			return nil, err
+		}
+		if kind != reflect.Float64 && c.kind == reflect.Float64 {
+			result := newColumn(kind, b.length)
+			result.nulls = c.nulls
+			for i, x := range c.floats {
+				if kind == reflect.Int {
+					result.ints[i] = int64(int(x))
+				} else {
+					result.ints[i] = int64(x)
+				}
+			}
+			return result, nil
+		}
+		return convertColumn(c, kind, b.length)
+	}, nil
+}
@@ -0,0 +1,241 @@
+package expr
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var batchSchema = Schema{
+	"price":    reflect.TypeOf(float64(0)),
+	"qty":      reflect.TypeOf(0),
+	"count":    reflect.TypeOf(int64(0)),
+	"active":   reflect.TypeOf(false),
+	"name":     reflect.TypeOf(""),
+	"discount": reflect.TypeOf((*float64)(nil)),
+	"indoor":   reflect.TypeOf(celsius(0)),
+}
+
+// batchValues are the rows of batchColumns. The discount of the second
+// row is null.
+var batchValues = []map[string]interface{}{
+	{"price": 12.5, "qty": 3, "count": int64(7), "active": true, "name": "widget", "discount": 0.5, "indoor": 21.0},
+	{"price": 1.5, "qty": 1, "count": int64(-2), "active": false, "name": "", "discount": nil, "indoor": -4.0},
+	{"price": 4.0, "qty": 2, "count": int64(9), "active": true, "name": "gadget", "discount": 0.25, "indoor": 18.5},
+}
+
+func batchColumns() map[string]*Column {
+	discounts := NewBitmap(3)
+	discounts.Set(1)
+	return map[string]*Column{
+		"price":    NewFloat64Column([]float64{12.5, 1.5, 4}, nil),
+		"qty":      NewInt64Column([]int64{3, 1, 2}, nil),
+		"count":    NewInt64Column([]int64{7, -2, 9}, nil),
+		"active":   NewBoolColumn([]bool{true, false, true}, nil),
+		"name":     NewStringColumn([]string{"widget", "", "gadget"}, nil),
+		"discount": NewFloat64Column([]float64{0.5, 0, 0.25}, discounts),
+		"indoor":   NewFloat64Column([]float64{21, -4, 18.5}, nil),
+	}
+}
+
+func TestEvaluateBatchMatchesPrograms(t *testing.T) {
+	for _, expression := range []string{
+		"price * qty > 30 && active",
+		"price * qty",
+		"qty + count",
+		"count / qty",
+		"count % 3",
+		"-price + +qty",
+		"-count",
+		"!active || qty == 3",
+		"price == qty",
+		"price != 12.5",
+		"active == true",
+		"name == 'widget'",
+		"name != name",
+		"name < 'h'",
+		"qty >= count ? price : qty",
+		"active ? count : qty",
+		"active ? name : 'none'",
+		"discount * price",
+		"discount > 0.1",
+		"discount == null",
+		"discount == discount",
+		"!(discount > 0.1) ? -discount : discount",
+		"float64(count) / 4",
+		"int64(price) + count",
+		"int(price * 2)",
+		"indoor > 20",
+		"indoor + 1.5",
+		"let x = qty * 2 in x + count",
+		"qty switch { 3 => 'three', _ => 'other' }",
+		"price is float64",
+		// The right operand divides by zero in rows it isn't evaluated for.
+		"count - 7 != 0 && price / (count - 7) > 0",
+		"count == 7 || 1 / (count - 7) > 0",
+	} {
+		parser, err := NewExpressionParserWithSchema(expression, batchSchema)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", expression, err)
+		}
+		program, err := parser.Compile()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", expression, err)
+		}
+		result, err := program.EvaluateBatch(batchColumns())
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", expression, err)
+		}
+		if result.Len() != len(batchValues) || result.Kind() != program.Expression().Kind() {
+			t.Fatalf("%s: expected %d %vs but got %d %vs", expression, len(batchValues), program.Expression().Kind(), result.Len(), result.Kind())
+		}
+		for row, values := range batchValues {
+			expected, err := program.Evaluate(values)
+			if err != nil {
+				t.Fatalf("%s with %v: unexpected err: %v", expression, values, err)
+			}
+			actual := result.Value(row)
+			if result.IsNull(row) != (expected == nil) || !valuesEqual(actual, expected) {
+				t.Fatalf("%s with %v: expected %v (%T) but got %v (%T)", expression, values, expected, expected, actual, actual)
+			}
+		}
+	}
+}
+
+func TestEvaluateBatchColumns(t *testing.T) {
+	parser, err := NewExpressionParserWithSchema("discount * price", batchSchema)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	program, err := parser.Compile()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	result, err := program.EvaluateBatch(batchColumns())
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if result.Kind() != reflect.Float64 || result.Float64s()[0] != 6.25 || result.Float64s()[2] != 1 {
+		t.Fatalf("expected 6.25 and 1 but got %v", result.Float64s())
+	}
+	if !result.IsNull(1) || result.IsNull(0) || result.IsNull(2) || result.Value(1) != nil {
+		t.Fatalf("expected only row 1 to be null but got %v", result.Nulls())
+	}
+
+	// Columns don't need to be a multiple of 64 rows long.
+	const length = 1000
+	values := make([]int64, length)
+	for i := range values {
+		values[i] = int64(i)
+	}
+	parser, err = NewExpressionParserWithSchema("count % 7 == 0 ? count / 7 : -1", batchSchema)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	program, err = parser.Compile()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	result, err = program.EvaluateBatch(map[string]*Column{"count": NewInt64Column(values, nil)})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	for i, x := range result.Int64s() {
+		expected := int64(-1)
+		if i%7 == 0 {
+			expected = int64(i / 7)
+		}
+		if x != expected {
+			t.Fatalf("row %d: expected %d but got %d", i, expected, x)
+		}
+	}
+}
+
+func TestEvaluateBatchErrors(t *testing.T) {
+	for _, test := range []struct {
+		expression string
+		columns    map[string]*Column
+		err        string
+	}{
+		{"count / (qty - 1)", batchColumns(), "row 1: division by zero"},
+		{"price * qty", nil, "a batch needs at least one column"},
+		{"price * qty", map[string]*Column{"price": NewFloat64Column([]float64{1}, nil)}, "unbound parameter: qty"},
+		{"price * 2", map[string]*Column{"price": NewStringColumn([]string{"a"}, nil)}, "parameter price is a float64 but its column holds strings"},
+		{"price * 2", map[string]*Column{"price": NewFloat64Column([]float64{1}, NewBitmap(1))}, ""},
+		{"price * 2", map[string]*Column{"price": NewFloat64Column([]float64{1}, Bitmap{1})}, "parameter price isn't nullable but its column has nulls"},
+		{"price * qty", map[string]*Column{
+			"price": NewFloat64Column([]float64{1, 2}, nil),
+			"qty":   NewInt64Column([]int64{1}, nil),
+		}, "column qty has 1 rows but column price has 2"},
+		{"float32(price)", batchColumns(), "a batch can't produce values of kind float32"},
+	} {
+		parser, err := NewExpressionParserWithSchema(test.expression, batchSchema)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		program, err := parser.Compile()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		_, err = program.EvaluateBatch(test.columns)
+		if test.err == "" {
+			if err != nil {
+				t.Fatalf("%s: unexpected err: %v", test.expression, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("%s: expected error %q but got %v", test.expression, test.err, err)
+		}
+	}
+}
+
+func TestBitmap(t *testing.T) {
+	b := NewBitmap(130)
+	if len(b) != 3 || b.any(130) {
+		t.Fatalf("expected 3 empty words but got %v", b)
+	}
+	b.Set(0)
+	b.Set(64)
+	b.Set(129)
+	for row, expected := range map[int]bool{0: true, 1: false, 63: false, 64: true, 129: true, 130: false, -1: false} {
+		if b.Has(row) != expected {
+			t.Fatalf("row %d: expected %v", row, expected)
+		}
+	}
+	if !b.any(1) || Bitmap(nil).any(math.MaxInt32) || (Bitmap{1 << 10}).any(10) {
+		t.Fatalf("any doesn't respect the length")
+	}
+}
+
+// BenchmarkBatchRule evaluates benchmarkRule for a batch of rows, reporting
+// the time per row so it compares with BenchmarkCompiledRule.
+func BenchmarkBatchRule(b *testing.B) {
+	parser, err := NewExpressionParserWithSchema(benchmarkRule, compileSchema)
+	if err != nil {
+		b.Fatalf("unexpected err: %v", err)
+	}
+	program, err := parser.Compile()
+	if err != nil {
+		b.Fatalf("unexpected err: %v", err)
+	}
+	const length = 4096
+	prices, quantities, counts, active := make([]float64, length), make([]int64, length), make([]int64, length), make([]bool, length)
+	for i := 0; i < length; i++ {
+		prices[i], quantities[i], counts[i], active[i] = float64(i%100)/4, int64(i%7), int64(i), i%3 == 0
+	}
+	columns := map[string]*Column{
+		"price":  NewFloat64Column(prices, nil),
+		"qty":    NewInt64Column(quantities, nil),
+		"count":  NewInt64Column(counts, nil),
+		"active": NewBoolColumn(active, nil),
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += length {
+		if _, err := program.EvaluateBatch(columns); err != nil {
+			b.Fatalf("unexpected err: %v", err)
+		}
+	}
+}
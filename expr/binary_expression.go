@@ -15,6 +15,11 @@ type BinaryExpression struct {
 	left  Expression
 	right Expression
 	self  *AbstractExpression
+	// operator is the user-defined implementation of the operator, if any.
+	operator *Operator
+	// constant is set for builtin arithmetic on untyped constants, which is
+	// itself an untyped constant.
+	constant bool
 }
 
 func NewBinaryExpression(nodeType ExpressionType, left Expression, right Expression, kind reflect.Kind) *BinaryExpression {
@@ -25,6 +30,7 @@ func NewBinaryExpression(nodeType ExpressionType, left Expression, right Express
 			nodeType: nodeType,
 			kind:     kind,
 		},
+		constant: isConstantOperator(nodeType) && isConstant(left) && isConstant(right),
 	}
 }
 
@@ -36,6 +42,12 @@ func (e *BinaryExpression) Right() Expression {
 	return e.right
 }
 
+// Operator returns the user-defined implementation of the operator, or nil
+// if it's built in.
+func (e *BinaryExpression) Operator() *Operator {
+	return e.operator
+}
+
 func (e *BinaryExpression) Kind() reflect.Kind {
 	return e.self.kind
 }
@@ -52,6 +64,9 @@ func (e *BinaryExpression) String() string {
 	if e == nil {
 		return "<nil>"
 	}
+	if e.self.nodeType == IndexExpr {
+		return fmt.Sprintf("%v[%v]", e.left, e.right)
+	}
 	operator := e.GetOperator()
 	if operator == "" {
 		return fmt.Sprintf("%v (%v, %v)", e.self, e.left, e.right)
@@ -111,15 +126,58 @@ func (e *BinaryExpression) GetOperator() string {
 		return "<<"
 	case RightShiftExpr:
 		return ">>"
+	case InExpr:
+		return inIdentifier
+	case AssignExpr:
+		return "="
+	case AddAssignExpr:
+		return "+="
+	case SubtractAssignExpr:
+		return "-="
+	case MultiplyAssignExpr:
+		return "*="
+	case DivideAssignExpr:
+		return "/="
+	case ModuloAssignExpr:
+		return "%="
 	default:
 		return ""
 	}
 }
 
+// CreateAndAlso creates left && right, which only evaluates right when left
+// is true.
+func CreateAndAlso(left Expression, right Expression) (Expression, error) {
+	return createLogical(AndAlsoExpr, left, right)
+}
+
+// CreateOrElse creates left || right, which only evaluates right when left
+// is false.
+func CreateOrElse(left Expression, right Expression) (Expression, error) {
+	return createLogical(OrElseExpr, left, right)
+}
+
+func createLogical(nodeType ExpressionType, left Expression, right Expression) (Expression, error) {
+	if err := validateLeftAndRight(left, right); err != nil {
+		return nil, err
+	}
+	if !isBoolOrUnknown(left.Kind()) || !isBoolOrUnknown(right.Kind()) {
+		return nil, fmt.Errorf("invalid expression, left or right isn't a bool: %v, %v", left.Kind(), right.Kind())
+	}
+	return NewBinaryExpression(nodeType, left, right, reflect.Bool), nil
+}
+
+func isBoolOrUnknown(kind reflect.Kind) bool {
+	return kind == reflect.Bool || kind == reflect.Interface
+}
+
 func CreateEqual(left Expression, right Expression) (Expression, error) {
 	if err := validateLeftAndRight(left, right); err != nil {
 		return nil, err
 	}
+	if e := createUserDefinedBinary(EqualExpr, left, right); e != nil {
+		return e, nil
+	}
 	return NewBinaryExpression(EqualExpr, left, right, reflect.Bool), nil
 }
 
@@ -127,6 +185,9 @@ func CreateNotEqual(left Expression, right Expression) (Expression, error) {
 	if err := validateLeftAndRight(left, right); err != nil {
 		return nil, err
 	}
+	if e := createUserDefinedBinary(NotEqualExpr, left, right); e != nil {
+		return e, nil
+	}
 	return NewBinaryExpression(NotEqualExpr, left, right, reflect.Bool), nil
 }
 
@@ -134,6 +195,9 @@ func CreateGreaterThan(left Expression, right Expression) (Expression, error) {
 	if err := validateLeftAndRight(left, right); err != nil {
 		return nil, err
 	}
+	if e := createUserDefinedBinary(GreaterThanExpr, left, right); e != nil {
+		return e, nil
+	}
 	return NewBinaryExpression(GreaterThanExpr, left, right, reflect.Bool), nil
 }
 
@@ -141,6 +205,9 @@ func CreateGreaterThanOrEqual(left Expression, right Expression) (Expression, er
 	if err := validateLeftAndRight(left, right); err != nil {
 		return nil, err
 	}
+	if e := createUserDefinedBinary(GreaterThanOrEqualExpr, left, right); e != nil {
+		return e, nil
+	}
 	return NewBinaryExpression(GreaterThanOrEqualExpr, left, right, reflect.Bool), nil
 }
 
@@ -148,6 +215,9 @@ func CreateLessThan(left Expression, right Expression) (Expression, error) {
 	if err := validateLeftAndRight(left, right); err != nil {
 		return nil, err
 	}
+	if e := createUserDefinedBinary(LessThanExpr, left, right); e != nil {
+		return e, nil
+	}
 	return NewBinaryExpression(LessThanExpr, left, right, reflect.Bool), nil
 }
 
@@ -155,6 +225,9 @@ func CreateLessThanOrEqual(left Expression, right Expression) (Expression, error
 	if err := validateLeftAndRight(left, right); err != nil {
 		return nil, err
 	}
+	if e := createUserDefinedBinary(LessThanOrEqualExpr, left, right); e != nil {
+		return e, nil
+	}
 	return NewBinaryExpression(LessThanOrEqualExpr, left, right, reflect.Bool), nil
 }
 
@@ -162,9 +235,12 @@ func CreateAdd(left Expression, right Expression) (Expression, error) {
 	if err := validateLeftAndRight(left, right); err != nil {
 		return nil, err
 	}
+	if e := createUserDefinedBinary(AddExpr, left, right); e != nil {
+		return e, nil
+	}
 	// TODO: String concat
-	if IsArithmetic(left.Kind()) && IsArithmetic(right.Kind()) {
-		return NewBinaryExpression(AddExpr, left, right, left.Kind()), nil
+	if isArithmeticOrUnknown(left.Kind()) && isArithmeticOrUnknown(right.Kind()) {
+		return NewBinaryExpression(AddExpr, left, right, arithmeticKind(left, right)), nil
 	}
 	return nil, fmt.Errorf("invalid expression, left or right isn't arithmetic: %v, %v", left.Kind(), right.Kind())
 }
@@ -173,28 +249,75 @@ func CreateSubtract(left Expression, right Expression) (Expression, error) {
 	if err := validateLeftAndRight(left, right); err != nil {
 		return nil, err
 	}
-	return NewBinaryExpression(SubtractExpr, left, right, left.Kind()), nil
+	if e := createUserDefinedBinary(SubtractExpr, left, right); e != nil {
+		return e, nil
+	}
+	return NewBinaryExpression(SubtractExpr, left, right, arithmeticKind(left, right)), nil
 }
 
 func CreateMultiply(left Expression, right Expression) (Expression, error) {
 	if err := validateLeftAndRight(left, right); err != nil {
 		return nil, err
 	}
-	return NewBinaryExpression(MultiplyExpr, left, right, left.Kind()), nil
+	if e := createUserDefinedBinary(MultiplyExpr, left, right); e != nil {
+		return e, nil
+	}
+	return NewBinaryExpression(MultiplyExpr, left, right, arithmeticKind(left, right)), nil
 }
 
 func CreateDivide(left Expression, right Expression) (Expression, error) {
 	if err := validateLeftAndRight(left, right); err != nil {
 		return nil, err
 	}
-	return NewBinaryExpression(DivideExpr, left, right, left.Kind()), nil
+	if e := createUserDefinedBinary(DivideExpr, left, right); e != nil {
+		return e, nil
+	}
+	return NewBinaryExpression(DivideExpr, left, right, arithmeticKind(left, right)), nil
 }
 
 func CreateModulus(left Expression, right Expression) (Expression, error) {
 	if err := validateLeftAndRight(left, right); err != nil {
 		return nil, err
 	}
-	return NewBinaryExpression(ModuloExpr, left, right, left.Kind()), nil
+	if e := createUserDefinedBinary(ModuloExpr, left, right); e != nil {
+		return e, nil
+	}
+	return NewBinaryExpression(ModuloExpr, left, right, arithmeticKind(left, right)), nil
+}
+
+// createUserDefinedBinary creates a binary operation implemented by one of
+// its operands' types, or returns nil if it's not.
+func createUserDefinedBinary(nodeType ExpressionType, left Expression, right Expression) *BinaryExpression {
+	o := findOperator(nodeType, left, right)
+	if o == nil {
+		return nil
+	}
+	e := NewBinaryExpression(nodeType, left, right, valueKind(o.ResultType()))
+	e.operator, e.constant = o, false
+	return e
+}
+
+// arithmeticKind returns the kind of an arithmetic operation. Operands of an
+// unknown kind, such as untyped function parameters, make the result unknown.
+// An untyped constant takes the kind of the other operand, as in 1 + price
+// or 2 * 60 * 60 * price. Otherwise operands of different numeric kinds are
+// promoted to their common kind, a float64 if either is a float and an int64
+// otherwise, as in qty * price.
+func arithmeticKind(left Expression, right Expression) reflect.Kind {
+	l, r := left.Kind(), right.Kind()
+	if l == reflect.Interface || r == reflect.Interface {
+		return reflect.Interface
+	}
+	switch lc, rc := isUntyped(left), isUntyped(right); {
+	case lc && !rc:
+		return r
+	case rc && !lc:
+		return l
+	}
+	if l != r && IsArithmetic(l) && IsArithmetic(r) {
+		return commonKind(l, r)
+	}
+	return l
 }
 
 func validateLeftAndRight(left Expression, right Expression) error {
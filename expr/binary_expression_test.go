@@ -59,3 +59,43 @@ func TestBinaryExpressionToString(t *testing.T) {
 		}
 	}
 }
+
+func TestComparisonAndLogicalEvaluation(t *testing.T) {
+	parameters := map[string]interface{}{
+		"amount": 150.5,
+		"qty":    3,
+		"name":   "pop",
+		"items":  []int{1, 2, 3},
+	}
+	for _, test := range []struct {
+		expression string
+		expected   bool
+	}{
+		{"amount > 100", true},
+		{"amount <= 100", false},
+		{"qty >= 3", true},
+		{"qty < -1", false},
+		{"qty == 3.0", true},
+		{"qty != 3", false},
+		{"name = 'pop'", true},
+		{"name < 'zed'", true},
+		{"qty > 1 && amount > 100", true},
+		{"qty > 5 and amount > 100", false},
+		{"qty > 5 || name == 'pop'", true},
+		{"qty > 5 or !(qty > 1)", false},
+		{"qty > 5 && items[10] == 1", false},
+		{"qty < 5 || items[10] == 1", true},
+	} {
+		parser, err := NewExpressionParser(test.expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		actual, err := parser.Evaluate(nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if actual != test.expected {
+			t.Fatalf("%s: expected %v but got %v", test.expression, test.expected, actual)
+		}
+	}
+}
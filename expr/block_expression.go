@@ -0,0 +1,87 @@
+package expr
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Binding binds the value of an expression to a local variable.
+type Binding struct {
+	Variable *ParameterExpression
+	Value    Expression
+}
+
+func (b *Binding) String() string {
+	return fmt.Sprintf("%v = %v", b.Variable, b.Value)
+}
+
+// BlockExpression introduces local variables which are visible to the
+// bindings after them and to its body. Both let x = 1 in x + 1 and
+// { var x = 1; x + 1 } create a BlockExpression.
+type BlockExpression struct {
+	self     *AbstractExpression
+	bindings []*Binding
+	body     Expression
+}
+
+func NewBlockExpression(bindings []*Binding, body Expression) *BlockExpression {
+	return &BlockExpression{
+		self: &AbstractExpression{
+			nodeType: BlockExpr,
+			kind:     body.Kind(),
+		},
+		bindings: bindings,
+		body:     body,
+	}
+}
+
+func (e *BlockExpression) Bindings() []*Binding {
+	return e.bindings
+}
+
+func (e *BlockExpression) Body() Expression {
+	return e.body
+}
+
+func (e *BlockExpression) Kind() reflect.Kind {
+	return e.self.kind
+}
+
+func (e *BlockExpression) Type() ExpressionType {
+	return e.self.nodeType
+}
+
+func (e *BlockExpression) NodeType() string {
+	return "BlockExpression"
+}
+
+func (e *BlockExpression) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	var bindings []string
+	for _, binding := range e.bindings {
+		bindings = append(bindings, binding.String())
+	}
+	return fmt.Sprintf("(let %s in %v)", strings.Join(bindings, ", "), e.body)
+}
+
+// CreateBlock creates a block expression. Each variable must be unique
+// within the block.
+func CreateBlock(bindings []*Binding, body Expression) (Expression, error) {
+	if body == nil {
+		return nil, errInvalidExpression
+	}
+	names := make(map[string]bool)
+	for _, binding := range bindings {
+		if binding.Variable == nil || binding.Value == nil {
+			return nil, errInvalidExpression
+		}
+		if names[binding.Variable.name] {
+			return nil, fmt.Errorf("variable %s is already defined in this block", binding.Variable.name)
+		}
+		names[binding.Variable.name] = true
+	}
+	return NewBlockExpression(bindings, body), nil
+}
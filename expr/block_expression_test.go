@@ -0,0 +1,120 @@
+package expr
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBlockEvaluation(t *testing.T) {
+	parameters := map[string]interface{}{
+		"qty":      3,
+		"price":    10,
+		"discount": 2,
+		"x":        100,
+		"items":    []int{1, 2, 3},
+	}
+	for _, test := range []struct {
+		expression string
+		expected   interface{}
+	}{
+		{"let subtotal = qty * price in subtotal - subtotal / discount", 15},
+		{"let a = 1, b = a + 1 in a + b", 3},
+		{"let x = x + 1 in x", 101},
+		{"let x = 1 in let x = x + 1 in x * 10", 20},
+		{"let d = 0 - 5 in d < 0", true},
+		{"(let x = 1 in x) + x", 101},
+		{"let found = (2 in items) in found", true},
+		{"let n = 2 in n in items", true},
+		{"{ var s = qty * price; s * 2 }", 60},
+		{"{ var a = 1; var b = a + 2; a + b; }", 4},
+		{"{ var x = 2; { var y = x * 3; y + x } }", 8},
+		{"{ var found = 3 in items; found }", true},
+		{"{ qty }", 3},
+	} {
+		parser, err := NewExpressionParser(test.expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expression, err := parser.ParseExpression()
+		if err != nil {
+			t.Fatalf("%s: unexpected parse err: %v", test.expression, err)
+		}
+		visitor, err := CreateVisitorFromExpression(expression)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		actual, err := visitor.Visit()
+		if err != nil {
+			t.Fatalf("%s: unexpected evaluation err: %v", test.expression, err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Fatalf("%s: expected %v but got %v", test.expression, test.expected, actual)
+		}
+	}
+}
+
+func TestBlockInfersVariableKinds(t *testing.T) {
+	parser, err := NewExpressionParser(`let name = "pop", n = 1.5 in name`, nil)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	expression, err := parser.ParseExpression()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	block, ok := expression.(*BlockExpression)
+	if !ok {
+		t.Fatalf("expected a BlockExpression but got %v", expression.NodeType())
+	}
+	for i, expected := range []reflect.Kind{reflect.String, reflect.Float64} {
+		if actual := block.Bindings()[i].Variable.Kind(); actual != expected {
+			t.Fatalf("expected %v but got %v", expected, actual)
+		}
+	}
+}
+
+func TestBlockParseErrors(t *testing.T) {
+	for _, expression := range []string{
+		"let x = 1",
+		"let x = 1, x = 2 in x",
+		"let = 1 in 2",
+		"let x 1 in x",
+		"(let x = 1 in x) + x",
+		"{ var x = 1 x }",
+		"{ var x = 1; x",
+		"{ var x = 1; var x = 2; x }",
+	} {
+		parser, err := NewExpressionParser(expression, nil)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, err := parser.ParseExpression(); err == nil {
+			t.Fatalf("expected %s to error but it didn't", expression)
+		}
+	}
+}
+
+func TestScope(t *testing.T) {
+	outer := NewScope(nil)
+	outer.Define("a", 1)
+	outer.Define("b", 2)
+	inner := NewScope(outer)
+	inner.Define("a", 3)
+	for _, test := range []struct {
+		scope    *Scope
+		name     string
+		expected interface{}
+		ok       bool
+	}{
+		{inner, "a", 3, true},
+		{inner, "b", 2, true},
+		{outer, "a", 1, true},
+		{inner, "c", nil, false},
+		{nil, "a", nil, false},
+	} {
+		actual, ok := test.scope.Lookup(test.name)
+		if ok != test.ok || !reflect.DeepEqual(actual, test.expected) {
+			t.Fatalf("expected %v, %v but got %v, %v", test.expected, test.ok, actual, ok)
+		}
+	}
+}
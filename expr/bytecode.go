@@ -0,0 +1,932 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// Bytecode is an expression compiled for a stack machine, an alternative to
+// compiling it to closures with Compile. Unlike a Program, bytecode can be
+// serialised with MarshalBinary and loaded with LoadBytecode, so rules can
+// be compiled ahead of time.
+//
+// Each instruction is an opcode followed by its operands, which are 16-bit
+// indexes into the bytecode's tables, jump targets or kinds. Numbers and
+// bools are kept on the stack unboxed where their types are known, and
+// typed opcodes such as add.int64 and add.float64 operate on them directly.
+type Bytecode struct {
+	code      []byte
+	constants []interface{}
+	// params, fields and methods are the parameters, environment fields and
+	// environment methods the bytecode refers to by index.
+	params   []*ParameterExpression
+	fields   []*FieldExpression
+	methods  []*CallExpression
+	maxStack int
+	// result is how the result is left on the stack, and kind is its kind.
+	result representation
+	kind   reflect.Kind
+	// typ is the named type the type checker found for the result, if any.
+	typ reflect.Type
+	// environment and parameters are those of the parser the bytecode was
+	// compiled from.
+	environment *Environment
+	parameters  map[string]interface{}
+	// bound holds the names of the parameters whose values were bound when
+	// parsing.
+	bound map[string]bool
+}
+
+// Opcode is a bytecode instruction.
+type Opcode byte
+
+const (
+	OpConst Opcode = iota
+	OpConstInt
+	OpConstFloat
+	OpTrue
+	OpFalse
+	OpParam
+	OpParamInt
+	OpParamFloat
+	OpParamBool
+	OpField
+	OpFieldInt
+	OpFieldFloat
+	OpFieldBool
+	// OpCallHost calls a method of the environment.
+	OpCallHost
+	OpAddInt
+	OpSubtractInt
+	OpMultiplyInt
+	OpDivideInt
+	OpModuloInt
+	OpNegateInt
+	OpAddFloat
+	OpSubtractFloat
+	OpMultiplyFloat
+	OpDivideFloat
+	OpModuloFloat
+	OpNegateFloat
+	OpEqualInt
+	OpLessInt
+	OpLessOrEqualInt
+	OpGreaterInt
+	OpGreaterOrEqualInt
+	OpEqualFloat
+	OpLessFloat
+	OpLessOrEqualFloat
+	OpGreaterFloat
+	OpGreaterOrEqualFloat
+	OpEqualBool
+	OpNot
+	OpIntToFloat
+	OpFloatToInt
+	OpBoxInt
+	OpBoxFloat
+	OpBoxBool
+	OpUnboxBool
+	OpUnboxFloat
+	// The remaining operators apply to boxed values, and evaluate like the
+	// visitors.
+	OpAdd
+	OpSubtract
+	OpMultiply
+	OpDivide
+	OpModulo
+	OpEqual
+	OpNotEqual
+	OpLess
+	OpLessOrEqual
+	OpGreater
+	OpGreaterOrEqual
+	OpIndex
+	OpIn
+	OpOr
+	OpNegate
+	OpPlus
+	OpNotBoxed
+	OpConvert
+	OpToKind
+	OpJump
+	OpJumpIfFalse
+	OpJumpIfFalseOrPop
+	OpJumpIfTrueOrPop
+	// OpLoadShared pushes the value of a shared subexpression and jumps
+	// over the code evaluating it, if it's been evaluated.
+	OpLoadShared
+	// OpStoreShared stores the value of a shared subexpression, leaving it
+	// on the stack.
+	OpStoreShared
+	opcodeCount
+)
+
+// opcodeInfo describes an opcode's mnemonic, its operands and how many
+// values it pops and pushes. Instructions with a variable effect, such as
+// calls, are accounted for where they're emitted.
+var opcodeInfo = [opcodeCount]struct {
+	name     string
+	operands int
+	pop      int
+	push     int
+}{
+	OpConst:               {"const", 1, 0, 1},
+	OpConstInt:            {"const.int64", 1, 0, 1},
+	OpConstFloat:          {"const.float64", 1, 0, 1},
+	OpTrue:                {"true", 0, 0, 1},
+	OpFalse:               {"false", 0, 0, 1},
+	OpParam:               {"param", 1, 0, 1},
+	OpParamInt:            {"param.int64", 1, 0, 1},
+	OpParamFloat:          {"param.float64", 1, 0, 1},
+	OpParamBool:           {"param.bool", 1, 0, 1},
+	OpField:               {"field", 1, 0, 1},
+	OpFieldInt:            {"field.int64", 1, 0, 1},
+	OpFieldFloat:          {"field.float64", 1, 0, 1},
+	OpFieldBool:           {"field.bool", 1, 0, 1},
+	OpCallHost:            {"call.host", 2, 0, 1},
+	OpAddInt:              {"add.int64", 0, 2, 1},
+	OpSubtractInt:         {"sub.int64", 0, 2, 1},
+	OpMultiplyInt:         {"mul.int64", 0, 2, 1},
+	OpDivideInt:           {"div.int64", 0, 2, 1},
+	OpModuloInt:           {"mod.int64", 0, 2, 1},
+	OpNegateInt:           {"neg.int64", 0, 1, 1},
+	OpAddFloat:            {"add.float64", 0, 2, 1},
+	OpSubtractFloat:       {"sub.float64", 0, 2, 1},
+	OpMultiplyFloat:       {"mul.float64", 0, 2, 1},
+	OpDivideFloat:         {"div.float64", 0, 2, 1},
+	OpModuloFloat:         {"mod.float64", 0, 2, 1},
+	OpNegateFloat:         {"neg.float64", 0, 1, 1},
+	OpEqualInt:            {"eq.int64", 0, 2, 1},
+	OpLessInt:             {"lt.int64", 0, 2, 1},
+	OpLessOrEqualInt:      {"le.int64", 0, 2, 1},
+	OpGreaterInt:          {"gt.int64", 0, 2, 1},
+	OpGreaterOrEqualInt:   {"ge.int64", 0, 2, 1},
+	OpEqualFloat:          {"eq.float64", 0, 2, 1},
+	OpLessFloat:           {"lt.float64", 0, 2, 1},
+	OpLessOrEqualFloat:    {"le.float64", 0, 2, 1},
+	OpGreaterFloat:        {"gt.float64", 0, 2, 1},
+	OpGreaterOrEqualFloat: {"ge.float64", 0, 2, 1},
+	OpEqualBool:           {"eq.bool", 0, 2, 1},
+	OpNot:                 {"not.bool", 0, 1, 1},
+	OpIntToFloat:          {"int64.to.float64", 0, 1, 1},
+	OpFloatToInt:          {"float64.to.int64", 0, 1, 1},
+	OpBoxInt:              {"box.int64", 1, 1, 1},
+	OpBoxFloat:            {"box.float64", 0, 1, 1},
+	OpBoxBool:             {"box.bool", 0, 1, 1},
+	OpUnboxBool:           {"unbox.bool", 0, 1, 1},
+	OpUnboxFloat:          {"unbox.float64", 0, 1, 1},
+	OpAdd:                 {"add", 1, 2, 1},
+	OpSubtract:            {"sub", 1, 2, 1},
+	OpMultiply:            {"mul", 1, 2, 1},
+	OpDivide:              {"div", 1, 2, 1},
+	OpModulo:              {"mod", 1, 2, 1},
+	OpEqual:               {"eq", 0, 2, 1},
+	OpNotEqual:            {"ne", 0, 2, 1},
+	OpLess:                {"lt", 0, 2, 1},
+	OpLessOrEqual:         {"le", 0, 2, 1},
+	OpGreater:             {"gt", 0, 2, 1},
+	OpGreaterOrEqual:      {"ge", 0, 2, 1},
+	OpIndex:               {"index", 0, 2, 1},
+	OpIn:                  {"in", 0, 2, 1},
+	OpOr:                  {"or", 1, 2, 1},
+	OpNegate:              {"neg", 1, 1, 1},
+	OpPlus:                {"plus", 1, 1, 1},
+	OpNotBoxed:            {"not", 0, 1, 1},
+	OpConvert:             {"convert", 1, 1, 1},
+	OpToKind:              {"to.kind", 1, 1, 1},
+	OpJump:                {"jump", 1, 0, 0},
+	OpJumpIfFalse:         {"jump.if.false", 1, 1, 0},
+	OpJumpIfFalseOrPop:    {"jump.if.false.or.pop", 1, 1, 0},
+	OpJumpIfTrueOrPop:     {"jump.if.true.or.pop", 1, 1, 0},
+	OpLoadShared:          {"load.shared", 2, 0, 0},
+	OpStoreShared:         {"store.shared", 1, 1, 1},
+}
+
+// boxedOpcodes maps the operators applied to boxed values to their
+// expression types.
+var boxedOpcodes = map[Opcode]ExpressionType{
+	OpAdd:            AddExpr,
+	OpSubtract:       SubtractExpr,
+	OpMultiply:       MultiplyExpr,
+	OpDivide:         DivideExpr,
+	OpModulo:         ModuloExpr,
+	OpEqual:          EqualExpr,
+	OpNotEqual:       NotEqualExpr,
+	OpLess:           LessThanExpr,
+	OpLessOrEqual:    LessThanOrEqualExpr,
+	OpGreater:        GreaterThanExpr,
+	OpGreaterOrEqual: GreaterThanOrEqualExpr,
+	OpIndex:          IndexExpr,
+	OpIn:             InExpr,
+	OpOr:             OrExpr,
+}
+
+var boxedOpcodeOf = func() map[ExpressionType]Opcode {
+	m := make(map[ExpressionType]Opcode)
+	for op, nodeType := range boxedOpcodes {
+		m[nodeType] = op
+	}
+	return m
+}()
+
+func (op Opcode) String() string {
+	if op < opcodeCount {
+		return opcodeInfo[op].name
+	}
+	return fmt.Sprintf("Opcode(%d)", byte(op))
+}
+
+// maxOperand is the largest operand, which limits the size of the code and
+// of the bytecode's tables.
+const maxOperand = math.MaxUint16
+
+var errBytecodeTooLarge = errors.New("expression is too large to compile to bytecode")
+
+// maxSharedSlots is the number of shared subexpressions whose values the VM
+// stores.
+const maxSharedSlots = 64
+
+// representation is how a value is kept on the stack.
+type representation byte
+
+const (
+	boxed representation = iota
+	unboxedInt
+	unboxedFloat
+	unboxedBool
+)
+
+func (r representation) isNumber() bool {
+	return r == unboxedInt || r == unboxedFloat
+}
+
+// CompileBytecode compiles an expression, which should have been type
+// checked with CheckTypes, to bytecode. Only expressions over constants,
+// parameters and the environment's fields and methods compile: statements,
+// lambdas, members and registered operators and conversions don't.
+func CompileBytecode(expression Expression) (*Bytecode, error) {
+	if expression == nil {
+		return nil, errInvalidExpression
+	}
+	c := &bytecodeCompiler{
+		b:         &Bytecode{},
+		constants: make(map[interface{}]int),
+		params:    make(map[string]int),
+		fields:    make(map[string]int),
+		methods:   make(map[string]int),
+	}
+	result, err := c.representationOf(expression)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.emit(expression, result); err != nil {
+		return nil, err
+	}
+	if len(c.b.code) > maxOperand {
+		return nil, errBytecodeTooLarge
+	}
+	c.b.result = result
+	c.b.kind = expression.Kind()
+	return c.b, nil
+}
+
+// CompileBytecode parses, type checks, optimizes and compiles the
+// expression to bytecode.
+func (ep *ExpressionParser) CompileBytecode() (*Bytecode, error) {
+	expression, typ, err := ep.optimize()
+	if err != nil {
+		return nil, err
+	}
+	b, err := CompileBytecode(expression)
+	if err != nil {
+		return nil, err
+	}
+	b.typ = typ
+	b.environment = ep.environment
+	b.parameters = ep.tokenizer.parameters
+	b.bound = ep.tokenizer.boundNames()
+	return b, nil
+}
+
+type bytecodeCompiler struct {
+	b     *Bytecode
+	depth int
+	// constants, params, fields and methods index the bytecode's tables.
+	constants map[interface{}]int
+	params    map[string]int
+	fields    map[string]int
+	methods   map[string]int
+}
+
+// representationOf returns how a node's value is naturally kept on the
+// stack, and fails for nodes which don't compile to bytecode.
+func (c *bytecodeCompiler) representationOf(node Expression) (representation, error) {
+	switch e := node.(type) {
+	case *ConstantExpression:
+		return constantRepresentation(e), nil
+	case *ParameterExpression:
+		return typedRepresentation(e.typ, e.Kind()), nil
+	case *FieldExpression:
+		return typedRepresentation(e.typ, e.Kind()), nil
+	case *CallExpression:
+		return boxed, nil
+	case *SharedExpression:
+		return c.representationOf(e.operand)
+	case *BinaryExpression:
+		if IsAssignment(e.Type()) || e.operator != nil {
+			break
+		}
+		left, err := c.representationOf(e.left)
+		if err != nil {
+			return boxed, err
+		}
+		right, err := c.representationOf(e.right)
+		if err != nil {
+			return boxed, err
+		}
+		switch e.Type() {
+		case AndAlsoExpr, OrElseExpr,
+			EqualExpr, NotEqualExpr,
+			LessThanExpr, LessThanOrEqualExpr, GreaterThanExpr, GreaterThanOrEqualExpr:
+			return unboxedBool, nil
+		case AddExpr, SubtractExpr, MultiplyExpr, DivideExpr, ModuloExpr:
+			if !left.isNumber() || !right.isNumber() || !isNumberKind(e.Kind()) {
+				return boxed, nil
+			}
+			if e.Kind() == reflect.Float64 {
+				return unboxedFloat, nil
+			}
+			return unboxedInt, nil
+		case IndexExpr, InExpr, OrExpr:
+			return boxed, nil
+		}
+	case *UnaryExpression:
+		if e.operator != nil {
+			break
+		}
+		operand, err := c.representationOf(e.operand)
+		if err != nil {
+			return boxed, err
+		}
+		switch e.Type() {
+		case NotExpr:
+			if operand == unboxedBool {
+				return unboxedBool, nil
+			}
+			return boxed, nil
+		case NegateExpr, UnaryPlusExpr:
+			switch {
+			case e.Kind() == reflect.Float64 && operand == unboxedFloat:
+				return unboxedFloat, nil
+			case isNumberKind(e.Kind()) && e.Kind() == e.operand.Kind() && operand == unboxedInt:
+				return unboxedInt, nil
+			}
+			return boxed, nil
+		}
+	case *ConditionalExpression:
+		if _, err := c.representationOf(e.test); err != nil {
+			return boxed, err
+		}
+		ifTrue, err := c.representationOf(e.ifTrue)
+		if err != nil {
+			return boxed, err
+		}
+		ifFalse, err := c.representationOf(e.ifFalse)
+		if err != nil {
+			return boxed, err
+		}
+		switch kind := e.Kind(); {
+		case kind == reflect.Float64 && ifTrue.isNumber() && ifFalse.isNumber():
+			return unboxedFloat, nil
+		case kind == reflect.Bool && ifTrue == unboxedBool && ifFalse == unboxedBool:
+			return unboxedBool, nil
+		case isNumberKind(kind) && ifTrue == unboxedInt && ifFalse == unboxedInt:
+			return unboxedInt, nil
+		}
+		return boxed, nil
+	case *ConvertExpression:
+		if e.conversion != nil || e.typ != typeOfKind(e.typ.Kind()) || e.typ.Kind() == reflect.Interface {
+			break
+		}
+		operand, err := c.representationOf(e.operand)
+		if err != nil {
+			return boxed, err
+		}
+		switch {
+		case !operand.isNumber():
+			return boxed, nil
+		case e.Kind() == reflect.Float64:
+			return unboxedFloat, nil
+		case isNumberKind(e.Kind()):
+			return unboxedInt, nil
+		}
+		return boxed, nil
+	}
+	return boxed, fmt.Errorf("%v can't be compiled to bytecode", node)
+}
+
+// constantRepresentation keeps the values of numeric and bool constants of
+// basic types unboxed.
+func constantRepresentation(e *ConstantExpression) representation {
+	if e.typ != nil || e.value == nil || isNamed(reflect.TypeOf(e.value)) {
+		return boxed
+	}
+	switch v := reflect.ValueOf(e.value); {
+	case v.Kind() == reflect.Bool:
+		return unboxedBool
+	case isFloatKind(v.Kind()):
+		return unboxedFloat
+	case IsUnsigned(v.Kind()):
+		if v.Uint() <= math.MaxInt64 {
+			return unboxedInt
+		}
+	case IsInteger(v.Kind()):
+		return unboxedInt
+	}
+	return boxed
+}
+
+// typedRepresentation keeps the values of parameters and fields unboxed
+// when they're exactly int, int64, float64 or bool.
+func typedRepresentation(typ reflect.Type, kind reflect.Kind) representation {
+	if !isTyped(typ, kind) {
+		return boxed
+	}
+	switch kind {
+	case reflect.Float64:
+		return unboxedFloat
+	case reflect.Bool:
+		return unboxedBool
+	}
+	return unboxedInt
+}
+
+// emit emits the code which leaves the value of node on the stack in the
+// wanted representation.
+func (c *bytecodeCompiler) emit(node Expression, want representation) error {
+	natural, err := c.representationOf(node)
+	if err != nil {
+		return err
+	}
+	switch e := node.(type) {
+	case *ConstantExpression:
+		return c.emitConstant(e, natural, want)
+	case *ParameterExpression:
+		index, err := c.index(c.params, e.name, func() int {
+			c.b.params = append(c.b.params, e)
+			return len(c.b.params) - 1
+		})
+		if err != nil {
+			return err
+		}
+		c.op(loadOpcode(natural, OpParam, OpParamInt, OpParamFloat, OpParamBool), index)
+	case *FieldExpression:
+		index, err := c.index(c.fields, e.name, func() int {
+			c.b.fields = append(c.b.fields, e)
+			return len(c.b.fields) - 1
+		})
+		if err != nil {
+			return err
+		}
+		c.op(loadOpcode(natural, OpField, OpFieldInt, OpFieldFloat, OpFieldBool), index)
+	case *CallExpression:
+		for _, argument := range e.arguments {
+			if err := c.emit(argument, boxed); err != nil {
+				return err
+			}
+		}
+		index, err := c.index(c.methods, e.name, func() int {
+			c.b.methods = append(c.b.methods, e)
+			return len(c.b.methods) - 1
+		})
+		if err != nil {
+			return err
+		}
+		c.op(OpCallHost, index, len(e.arguments))
+		c.adjust(-len(e.arguments))
+	case *BinaryExpression:
+		if err := c.emitBinary(e, natural); err != nil {
+			return err
+		}
+	case *UnaryExpression:
+		if err := c.emitUnary(e, natural); err != nil {
+			return err
+		}
+	case *ConditionalExpression:
+		if err := c.emitConditional(e, natural); err != nil {
+			return err
+		}
+	case *SharedExpression:
+		if err := c.emitShared(e, natural); err != nil {
+			return err
+		}
+	case *ConvertExpression:
+		if natural == boxed {
+			if err := c.emit(e.operand, boxed); err != nil {
+				return err
+			}
+			c.op(OpConvert, int(e.Kind()))
+			break
+		}
+		if err := c.emit(e.operand, natural); err != nil {
+			return err
+		}
+	}
+	return c.convert(natural, want, node.Kind())
+}
+
+// emitShared emits a shared subexpression, which is evaluated by the first
+// occurrence reached and loaded by the others. Subexpressions beyond the
+// slots the VM has are evaluated by every occurrence.
+func (c *bytecodeCompiler) emitShared(e *SharedExpression, natural representation) error {
+	if e.slot >= maxSharedSlots {
+		return c.emit(e.operand, natural)
+	}
+	c.op(OpLoadShared, 0, e.slot)
+	load := len(c.b.code) - 4
+	if err := c.emit(e.operand, natural); err != nil {
+		return err
+	}
+	c.op(OpStoreShared, e.slot)
+	return c.patch(load)
+}
+
+func loadOpcode(r representation, boxedOp, intOp, floatOp, boolOp Opcode) Opcode {
+	switch r {
+	case unboxedInt:
+		return intOp
+	case unboxedFloat:
+		return floatOp
+	case unboxedBool:
+		return boolOp
+	}
+	return boxedOp
+}
+
+func (c *bytecodeCompiler) emitConstant(e *ConstantExpression, natural representation, want representation) error {
+	if natural == boxed || want == boxed {
+		index, err := c.constant(e.value)
+		if err != nil {
+			return err
+		}
+		c.op(OpConst, index)
+		return c.convert(boxed, want, e.Kind())
+	}
+	v := reflect.ValueOf(e.value)
+	switch {
+	case want == unboxedBool && natural == unboxedBool:
+		if v.Bool() {
+			c.op(OpTrue)
+		} else {
+			c.op(OpFalse)
+		}
+		return nil
+	case want == unboxedFloat && natural.isNumber():
+		x, _ := convertToFloat64(e.value)
+		index, err := c.constant(x)
+		if err != nil {
+			return err
+		}
+		c.op(OpConstFloat, index)
+		return nil
+	case want == unboxedInt && natural == unboxedInt:
+		var x int64
+		if IsUnsigned(v.Kind()) {
+			x = int64(v.Uint())
+		} else {
+			x = v.Int()
+		}
+		index, err := c.constant(x)
+		if err != nil {
+			return err
+		}
+		c.op(OpConstInt, index)
+		return nil
+	}
+	return fmt.Errorf("can't compile %v as %v", e, want)
+}
+
+func (c *bytecodeCompiler) emitBinary(e *BinaryExpression, natural representation) error {
+	switch e.Type() {
+	case AndAlsoExpr, OrElseExpr:
+		if err := c.emit(e.left, unboxedBool); err != nil {
+			return err
+		}
+		op := OpJumpIfFalseOrPop
+		if e.Type() == OrElseExpr {
+			op = OpJumpIfTrueOrPop
+		}
+		jump := c.jump(op)
+		if err := c.emit(e.right, unboxedBool); err != nil {
+			return err
+		}
+		return c.patch(jump)
+	}
+	left, _ := c.representationOf(e.left)
+	right, _ := c.representationOf(e.right)
+	if left.isNumber() && right.isNumber() {
+		operands := unboxedInt
+		if left == unboxedFloat || right == unboxedFloat || natural == unboxedFloat {
+			operands = unboxedFloat
+		}
+		var op Opcode
+		negate := false
+		switch e.Type() {
+		case AddExpr:
+			op = pick(operands, OpAddInt, OpAddFloat)
+		case SubtractExpr:
+			op = pick(operands, OpSubtractInt, OpSubtractFloat)
+		case MultiplyExpr:
+			op = pick(operands, OpMultiplyInt, OpMultiplyFloat)
+		case DivideExpr:
+			op = pick(operands, OpDivideInt, OpDivideFloat)
+		case ModuloExpr:
+			op = pick(operands, OpModuloInt, OpModuloFloat)
+		case EqualExpr:
+			op = pick(operands, OpEqualInt, OpEqualFloat)
+		case NotEqualExpr:
+			op, negate = pick(operands, OpEqualInt, OpEqualFloat), true
+		case LessThanExpr:
+			op = pick(operands, OpLessInt, OpLessFloat)
+		case LessThanOrEqualExpr:
+			op = pick(operands, OpLessOrEqualInt, OpLessOrEqualFloat)
+		case GreaterThanExpr:
+			op = pick(operands, OpGreaterInt, OpGreaterFloat)
+		case GreaterThanOrEqualExpr:
+			op = pick(operands, OpGreaterOrEqualInt, OpGreaterOrEqualFloat)
+		}
+		if natural != boxed {
+			if err := c.emit(e.left, operands); err != nil {
+				return err
+			}
+			if err := c.emit(e.right, operands); err != nil {
+				return err
+			}
+			c.op(op)
+			if negate {
+				c.op(OpNot)
+			}
+			if operands == unboxedFloat && natural == unboxedInt {
+				c.op(OpFloatToInt)
+			}
+			return nil
+		}
+	}
+	if left == unboxedBool && right == unboxedBool && (e.Type() == EqualExpr || e.Type() == NotEqualExpr) {
+		if err := c.emit(e.left, unboxedBool); err != nil {
+			return err
+		}
+		if err := c.emit(e.right, unboxedBool); err != nil {
+			return err
+		}
+		c.op(OpEqualBool)
+		if e.Type() == NotEqualExpr {
+			c.op(OpNot)
+		}
+		return nil
+	}
+	if err := c.emit(e.left, boxed); err != nil {
+		return err
+	}
+	if err := c.emit(e.right, boxed); err != nil {
+		return err
+	}
+	op, ok := boxedOpcodeOf[e.Type()]
+	if !ok {
+		return fmt.Errorf("%v can't be compiled to bytecode", e)
+	}
+	if opcodeInfo[op].operands == 1 {
+		c.op(op, int(e.Kind()))
+	} else {
+		c.op(op)
+	}
+	if natural == unboxedBool {
+		c.op(OpUnboxBool)
+	}
+	return nil
+}
+
+// pick returns the opcode for operands of the provided representation.
+func pick(operands representation, intOp Opcode, floatOp Opcode) Opcode {
+	if operands == unboxedFloat {
+		return floatOp
+	}
+	return intOp
+}
+
+func (c *bytecodeCompiler) emitUnary(e *UnaryExpression, natural representation) error {
+	if natural == boxed {
+		if err := c.emit(e.operand, boxed); err != nil {
+			return err
+		}
+		switch e.Type() {
+		case NegateExpr:
+			c.op(OpNegate, int(e.Kind()))
+		case UnaryPlusExpr:
+			c.op(OpPlus, int(e.Kind()))
+		default:
+			c.op(OpNotBoxed)
+		}
+		return nil
+	}
+	if err := c.emit(e.operand, natural); err != nil {
+		return err
+	}
+	switch {
+	case e.Type() == NotExpr:
+		c.op(OpNot)
+	case e.Type() == NegateExpr:
+		c.op(pick(natural, OpNegateInt, OpNegateFloat))
+	}
+	return nil
+}
+
+func (c *bytecodeCompiler) emitConditional(e *ConditionalExpression, natural representation) error {
+	if err := c.emit(e.test, unboxedBool); err != nil {
+		return err
+	}
+	ifFalse := c.jump(OpJumpIfFalse)
+	if err := c.emit(e.ifTrue, natural); err != nil {
+		return err
+	}
+	end := c.jump(OpJump)
+	// Only one branch is evaluated, so the other's value isn't on the stack.
+	c.adjust(-1)
+	if err := c.patch(ifFalse); err != nil {
+		return err
+	}
+	if err := c.emit(e.ifFalse, natural); err != nil {
+		return err
+	}
+	if err := c.patch(end); err != nil {
+		return err
+	}
+	if natural == boxed {
+		c.op(OpToKind, int(e.Kind()))
+	}
+	return nil
+}
+
+// convert emits the code which converts the value on top of the stack from
+// one representation to another.
+func (c *bytecodeCompiler) convert(from representation, to representation, kind reflect.Kind) error {
+	switch {
+	case from == to:
+	case to == boxed && from == unboxedInt:
+		c.op(OpBoxInt, int(kind))
+	case to == boxed && from == unboxedFloat:
+		c.op(OpBoxFloat)
+	case to == boxed && from == unboxedBool:
+		c.op(OpBoxBool)
+	case to == unboxedFloat && from == unboxedInt:
+		c.op(OpIntToFloat)
+	case to == unboxedInt && from == unboxedFloat:
+		c.op(OpFloatToInt)
+	case to == unboxedFloat && from == boxed:
+		c.op(OpUnboxFloat)
+	case to == unboxedBool && from == boxed:
+		c.op(OpUnboxBool)
+	default:
+		return fmt.Errorf("can't convert a value of kind %v to %v", kind, to)
+	}
+	return nil
+}
+
+func (r representation) String() string {
+	switch r {
+	case unboxedInt:
+		return "int64"
+	case unboxedFloat:
+		return "float64"
+	case unboxedBool:
+		return "bool"
+	}
+	return "boxed"
+}
+
+// op appends an instruction and tracks the depth of the stack.
+func (c *bytecodeCompiler) op(op Opcode, operands ...int) {
+	c.b.code = append(c.b.code, byte(op))
+	for _, operand := range operands {
+		c.b.code = append(c.b.code, byte(operand>>8), byte(operand))
+	}
+	c.adjust(opcodeInfo[op].push - opcodeInfo[op].pop)
+}
+
+func (c *bytecodeCompiler) adjust(n int) {
+	c.depth += n
+	if c.depth > c.b.maxStack {
+		c.b.maxStack = c.depth
+	}
+}
+
+// jump appends a jump whose target is patched once it's known, and returns
+// the position of its operand.
+func (c *bytecodeCompiler) jump(op Opcode) int {
+	c.op(op, 0)
+	return len(c.b.code) - 2
+}
+
+// patch points a jump at the end of the code.
+func (c *bytecodeCompiler) patch(operand int) error {
+	target := len(c.b.code)
+	if target > maxOperand {
+		return errBytecodeTooLarge
+	}
+	c.b.code[operand], c.b.code[operand+1] = byte(target>>8), byte(target)
+	return nil
+}
+
+// constant returns the index of a value in the constants table, adding it
+// if it isn't there.
+func (c *bytecodeCompiler) constant(value interface{}) (int, error) {
+	add := func() int {
+		c.b.constants = append(c.b.constants, value)
+		return len(c.b.constants) - 1
+	}
+	if value == nil || !reflect.TypeOf(value).Comparable() {
+		if len(c.b.constants) >= maxOperand {
+			return 0, errBytecodeTooLarge
+		}
+		return add(), nil
+	}
+	if index, ok := c.constants[value]; ok {
+		return index, nil
+	}
+	if len(c.b.constants) >= maxOperand {
+		return 0, errBytecodeTooLarge
+	}
+	index := add()
+	c.constants[value] = index
+	return index, nil
+}
+
+// index returns the index of a name in one of the tables, adding it if it
+// isn't there.
+func (c *bytecodeCompiler) index(table map[string]int, name string, add func() int) (int, error) {
+	if index, ok := table[name]; ok {
+		return index, nil
+	}
+	if len(table) >= maxOperand {
+		return 0, errBytecodeTooLarge
+	}
+	table[name] = add()
+	return table[name], nil
+}
+
+// Disassemble returns a listing of the bytecode's instructions, one per
+// line, with the offset of each and its operands.
+func (b *Bytecode) Disassemble() string {
+	var sb strings.Builder
+	for pc := 0; pc < len(b.code); {
+		op := Opcode(b.code[pc])
+		fmt.Fprintf(&sb, "%04d  %v", pc, op)
+		if op >= opcodeCount || pc+2*opcodeInfo[op].operands >= len(b.code) {
+			// The rest of the code can't be decoded.
+			sb.WriteString("\n")
+			break
+		}
+		var operands []string
+		for i := 0; i < opcodeInfo[op].operands; i++ {
+			operands = append(operands, fmt.Sprint(int(b.code[pc+1+2*i])<<8|int(b.code[pc+2+2*i])))
+		}
+		if len(operands) > 0 {
+			fmt.Fprintf(&sb, "%*s%s", 22-len(op.String()), "", strings.Join(operands, ", "))
+			operand := int(b.code[pc+1])<<8 | int(b.code[pc+2])
+			if comment := b.describe(op, operand); comment != "" {
+				fmt.Fprintf(&sb, " (%s)", comment)
+			}
+		}
+		sb.WriteString("\n")
+		pc += 1 + 2*opcodeInfo[op].operands
+	}
+	return sb.String()
+}
+
+// describe explains an operand in a disassembly.
+func (b *Bytecode) describe(op Opcode, operand int) string {
+	switch op {
+	case OpConst, OpConstInt, OpConstFloat:
+		if operand < len(b.constants) {
+			return fmt.Sprintf("%#v", b.constants[operand])
+		}
+	case OpParam, OpParamInt, OpParamFloat, OpParamBool:
+		if operand < len(b.params) {
+			return b.params[operand].name
+		}
+	case OpField, OpFieldInt, OpFieldFloat, OpFieldBool:
+		if operand < len(b.fields) {
+			return b.fields[operand].name
+		}
+	case OpCallHost:
+		if operand < len(b.methods) {
+			return b.methods[operand].name
+		}
+	case OpBoxInt, OpAdd, OpSubtract, OpMultiply, OpDivide, OpModulo, OpOr, OpNegate, OpPlus, OpConvert, OpToKind:
+		return reflect.Kind(operand).String()
+	}
+	return ""
+}
@@ -0,0 +1,584 @@
+package expr
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Serialised bytecode starts with a magic number and a format version.
+// Bytecode refers to types by the names LookupTypeName resolves, and to the
+// fields and methods of the environment by name, so it loads against any
+// build of the same rules and environment.
+const (
+	bytecodeMagic   = "popb"
+	bytecodeVersion = 1
+)
+
+var errTruncatedBytecode = errors.New("truncated bytecode")
+
+// MarshalBinary serialises the bytecode. Its constants and the types of its
+// parameters and result must be basic types, or types registered with
+// RegisterTypeName.
+func (b *Bytecode) MarshalBinary() ([]byte, error) {
+	e := &bytecodeEncoder{buf: []byte(bytecodeMagic)}
+	e.uvarint(bytecodeVersion)
+	e.uvarint(uint64(b.result))
+	e.uvarint(uint64(b.kind))
+	if err := e.typ(b.typ); err != nil {
+		return nil, err
+	}
+	e.uvarint(uint64(len(b.constants)))
+	for _, constant := range b.constants {
+		if err := e.constant(constant); err != nil {
+			return nil, err
+		}
+	}
+	e.uvarint(uint64(len(b.params)))
+	for _, p := range b.params {
+		e.string(p.name)
+		e.uvarint(uint64(p.Kind()))
+		if err := e.typ(p.typ); err != nil {
+			return nil, fmt.Errorf("parameter %s: %v", p.name, err)
+		}
+	}
+	e.uvarint(uint64(len(b.fields)))
+	for _, field := range b.fields {
+		e.string(field.name)
+		e.uvarint(uint64(field.Kind()))
+	}
+	e.uvarint(uint64(len(b.methods)))
+	for _, method := range b.methods {
+		e.string(method.name)
+	}
+	e.string(string(b.code))
+	return e.buf, nil
+}
+
+// LoadBytecode loads bytecode serialised with MarshalBinary. The fields and
+// methods it refers to are resolved against env, which may be nil if it
+// doesn't refer to any. The bytecode is verified before it's returned, so
+// corrupt bytecode fails to load rather than to evaluate.
+func LoadBytecode(data []byte, env *Environment) (*Bytecode, error) {
+	if !strings.HasPrefix(string(data), bytecodeMagic) {
+		return nil, errors.New("not bytecode")
+	}
+	d := &bytecodeDecoder{buf: data[len(bytecodeMagic):]}
+	if version := d.uvarint(); d.err == nil && version != bytecodeVersion {
+		return nil, fmt.Errorf("unsupported bytecode version %d", version)
+	}
+	b := &Bytecode{
+		result:      representation(d.uvarint()),
+		kind:        reflect.Kind(d.uvarint()),
+		typ:         d.typ(),
+		environment: env,
+	}
+	for i, n := 0, d.length(); i < n; i++ {
+		b.constants = append(b.constants, d.constant())
+	}
+	for i, n := 0, d.length(); i < n; i++ {
+		name, kind, typ := d.string(), reflect.Kind(d.uvarint()), d.typ()
+		p := NewParameterExpression(name, kind)
+		if typ != nil {
+			p = NewTypedParameterExpression(name, typ)
+		}
+		b.params = append(b.params, p)
+	}
+	for i, n := 0, d.length(); i < n && d.err == nil; i++ {
+		name, kind := d.string(), reflect.Kind(d.uvarint())
+		if env == nil {
+			return nil, fmt.Errorf("the bytecode reads field %s, but no environment was provided", name)
+		}
+		field, err := CreateField(env, name)
+		if err != nil {
+			return nil, err
+		}
+		if field.Kind() != kind {
+			return nil, fmt.Errorf("field %s of %v is a %v, but the bytecode was compiled for a %v", name, env.typ, field.Kind(), kind)
+		}
+		b.fields = append(b.fields, field.(*FieldExpression))
+	}
+	for i, n := 0, d.length(); i < n && d.err == nil; i++ {
+		name := d.string()
+		if env == nil {
+			return nil, fmt.Errorf("the bytecode calls method %s, but no environment was provided", name)
+		}
+		method, ok := env.methods[name]
+		if !ok {
+			return nil, fmt.Errorf("%v has no method %s", env.typ, name)
+		}
+		b.methods = append(b.methods, NewCallExpression(name, method, nil))
+	}
+	b.code = []byte(d.string())
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(d.buf) > 0 {
+		return nil, errors.New("unexpected data after bytecode")
+	}
+	if err := b.verify(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// verify checks that every instruction is valid, that its operands are in
+// range and that the values it pops are in the representations it expects,
+// and computes the depth of the stack. Jumps only go forwards, so one pass
+// over the code finds the representations on the stack at each instruction.
+func (b *Bytecode) verify() error {
+	if b.result > unboxedBool {
+		return fmt.Errorf("invalid result representation %d", b.result)
+	}
+	targets := make(map[int][]representation)
+	// slots holds the representation of each shared slot stored so far.
+	slots := make(map[int]representation)
+	var stack []representation
+	maxDepth := 0
+	reachable := true
+	for pc := 0; pc < len(b.code); {
+		if s, ok := targets[pc]; ok {
+			if reachable && !sameRepresentations(s, stack) {
+				return fmt.Errorf("inconsistent stack at %d", pc)
+			}
+			stack, reachable = s, true
+			delete(targets, pc)
+		}
+		if !reachable {
+			return fmt.Errorf("unreachable code at %d", pc)
+		}
+		op := Opcode(b.code[pc])
+		if op >= opcodeCount {
+			return fmt.Errorf("invalid opcode %d at %d", byte(op), pc)
+		}
+		info := opcodeInfo[op]
+		if pc+1+2*info.operands > len(b.code) {
+			return errTruncatedBytecode
+		}
+		var operands []int
+		for i := 0; i < info.operands; i++ {
+			operands = append(operands, int(b.code[pc+1+2*i])<<8|int(b.code[pc+2+2*i]))
+		}
+		if err := b.verifyOperands(op, operands); err != nil {
+			return fmt.Errorf("%v at %d: %v", op, pc, err)
+		}
+		pops, push := stackEffect(op)
+		switch {
+		case op == OpCallHost:
+			pops = make([]representation, operands[1])
+		case op == OpStoreShared && len(stack) > 0:
+			pops = []representation{stack[len(stack)-1]}
+			push = pops
+		case op == OpStoreShared:
+			pops = []representation{boxed}
+		}
+		if len(stack) < len(pops) {
+			return fmt.Errorf("%v at %d pops an empty stack", op, pc)
+		}
+		for i, want := range pops {
+			if got := stack[len(stack)-len(pops)+i]; got != want {
+				return fmt.Errorf("%v at %d expects a %v but got a %v", op, pc, want, got)
+			}
+		}
+		// Limit the capacity, so that pushing doesn't overwrite the stacks
+		// recorded for jump targets.
+		n := len(stack) - len(pops)
+		stack = stack[:n:n]
+		next := pc + 1 + 2*info.operands
+		switch op {
+		case OpJump, OpJumpIfFalse, OpJumpIfFalseOrPop, OpJumpIfTrueOrPop, OpLoadShared:
+			target := operands[0]
+			if target <= pc || target > len(b.code) {
+				return fmt.Errorf("%v at %d jumps to %d", op, pc, target)
+			}
+			atTarget, taken := stack, true
+			switch op {
+			case OpJumpIfFalseOrPop, OpJumpIfTrueOrPop:
+				atTarget = append(atTarget, unboxedBool)
+			case OpLoadShared:
+				// The jump is only taken once code before it has stored the
+				// slot, so it can't be taken if none has.
+				var r representation
+				r, taken = slots[operands[1]]
+				atTarget = append(atTarget, r)
+			}
+			if s, ok := targets[target]; ok && taken && !sameRepresentations(s, atTarget) {
+				return fmt.Errorf("inconsistent stack at %d", target)
+			}
+			if taken {
+				targets[target] = atTarget
+			}
+		case OpStoreShared:
+			if r, ok := slots[operands[0]]; ok && r != pops[0] {
+				return fmt.Errorf("%v at %d stores a %v in a slot holding a %v", op, pc, pops[0], r)
+			}
+			slots[operands[0]] = pops[0]
+		}
+		stack = append(stack, push...)
+		if len(stack) > maxDepth {
+			maxDepth = len(stack)
+		}
+		reachable = op != OpJump
+		pc = next
+	}
+	if s, ok := targets[len(b.code)]; ok {
+		if reachable && !sameRepresentations(s, stack) {
+			return errors.New("inconsistent stack at the end of the bytecode")
+		}
+		stack, reachable = s, true
+		delete(targets, len(b.code))
+	}
+	// Targets which remain are in the middle of instructions.
+	if len(targets) > 0 {
+		var pcs []int
+		for target := range targets {
+			pcs = append(pcs, target)
+		}
+		sort.Ints(pcs)
+		return fmt.Errorf("a jump to %d is in the middle of an instruction", pcs[0])
+	}
+	if !reachable || len(stack) != 1 {
+		return fmt.Errorf("the bytecode leaves %d values on the stack", len(stack))
+	}
+	if stack[0] != b.result {
+		return fmt.Errorf("the bytecode leaves a %v but its result is a %v", stack[0], b.result)
+	}
+	b.maxStack = maxDepth
+	return nil
+}
+
+// stackEffect returns the representations of the values an instruction
+// pops, from the bottom of the stack up, and of those it pushes. The
+// arguments of calls are accounted for by the caller, and store.shared
+// leaves the value on top of the stack, whatever its representation.
+func stackEffect(op Opcode) (pops []representation, push []representation) {
+	switch op {
+	case OpConst, OpParam, OpField:
+		return nil, []representation{boxed}
+	case OpConstInt, OpParamInt, OpFieldInt:
+		return nil, []representation{unboxedInt}
+	case OpConstFloat, OpParamFloat, OpFieldFloat:
+		return nil, []representation{unboxedFloat}
+	case OpTrue, OpFalse, OpParamBool, OpFieldBool:
+		return nil, []representation{unboxedBool}
+	case OpCallHost:
+		return nil, []representation{boxed}
+	case OpAddInt, OpSubtractInt, OpMultiplyInt, OpDivideInt, OpModuloInt:
+		return []representation{unboxedInt, unboxedInt}, []representation{unboxedInt}
+	case OpNegateInt:
+		return []representation{unboxedInt}, []representation{unboxedInt}
+	case OpAddFloat, OpSubtractFloat, OpMultiplyFloat, OpDivideFloat, OpModuloFloat:
+		return []representation{unboxedFloat, unboxedFloat}, []representation{unboxedFloat}
+	case OpNegateFloat:
+		return []representation{unboxedFloat}, []representation{unboxedFloat}
+	case OpEqualInt, OpLessInt, OpLessOrEqualInt, OpGreaterInt, OpGreaterOrEqualInt:
+		return []representation{unboxedInt, unboxedInt}, []representation{unboxedBool}
+	case OpEqualFloat, OpLessFloat, OpLessOrEqualFloat, OpGreaterFloat, OpGreaterOrEqualFloat:
+		return []representation{unboxedFloat, unboxedFloat}, []representation{unboxedBool}
+	case OpEqualBool:
+		return []representation{unboxedBool, unboxedBool}, []representation{unboxedBool}
+	case OpNot:
+		return []representation{unboxedBool}, []representation{unboxedBool}
+	case OpIntToFloat:
+		return []representation{unboxedInt}, []representation{unboxedFloat}
+	case OpFloatToInt:
+		return []representation{unboxedFloat}, []representation{unboxedInt}
+	case OpBoxInt:
+		return []representation{unboxedInt}, []representation{boxed}
+	case OpBoxFloat:
+		return []representation{unboxedFloat}, []representation{boxed}
+	case OpBoxBool:
+		return []representation{unboxedBool}, []representation{boxed}
+	case OpUnboxBool:
+		return []representation{boxed}, []representation{unboxedBool}
+	case OpUnboxFloat:
+		return []representation{boxed}, []representation{unboxedFloat}
+	case OpNegate, OpPlus, OpNotBoxed, OpConvert, OpToKind:
+		return []representation{boxed}, []representation{boxed}
+	case OpJumpIfFalse, OpJumpIfFalseOrPop, OpJumpIfTrueOrPop:
+		return []representation{unboxedBool}, nil
+	case OpJump, OpLoadShared, OpStoreShared:
+		return nil, nil
+	}
+	// The remaining operators apply to boxed values.
+	return []representation{boxed, boxed}, []representation{boxed}
+}
+
+func sameRepresentations(a []representation, b []representation) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyOperands checks that an instruction's operands refer to entries of
+// the bytecode's tables which it can use.
+func (b *Bytecode) verifyOperands(op Opcode, operands []int) error {
+	switch op {
+	case OpConst:
+		if operands[0] >= len(b.constants) {
+			return errors.New("no such constant")
+		}
+	case OpConstInt, OpConstFloat:
+		if operands[0] >= len(b.constants) {
+			return errors.New("no such constant")
+		}
+		_, isInt := b.constants[operands[0]].(int64)
+		_, isFloat := b.constants[operands[0]].(float64)
+		if (op == OpConstInt && !isInt) || (op == OpConstFloat && !isFloat) {
+			return fmt.Errorf("constant %v has the wrong type", b.constants[operands[0]])
+		}
+	case OpParam, OpParamInt, OpParamFloat, OpParamBool:
+		if operands[0] >= len(b.params) {
+			return errors.New("no such parameter")
+		}
+		p := b.params[operands[0]]
+		if op != OpParam && op != loadOpcode(typedRepresentation(p.typ, p.Kind()), OpParam, OpParamInt, OpParamFloat, OpParamBool) {
+			return fmt.Errorf("parameter %s isn't a %v", p.name, p.typ)
+		}
+	case OpField, OpFieldInt, OpFieldFloat, OpFieldBool:
+		if operands[0] >= len(b.fields) {
+			return errors.New("no such field")
+		}
+		field := b.fields[operands[0]]
+		if op != OpField && op != loadOpcode(typedRepresentation(field.typ, field.Kind()), OpField, OpFieldInt, OpFieldFloat, OpFieldBool) {
+			return fmt.Errorf("field %s isn't a %v", field.name, field.typ)
+		}
+	case OpConvert:
+		if typeOfKind(reflect.Kind(operands[0])) == nil {
+			return fmt.Errorf("can't convert to %v", reflect.Kind(operands[0]))
+		}
+	case OpLoadShared, OpStoreShared:
+		if slot := operands[len(operands)-1]; slot >= maxSharedSlots {
+			return fmt.Errorf("no such shared slot %d", slot)
+		}
+	case OpCallHost:
+		if operands[0] >= len(b.methods) {
+			return errors.New("no such method")
+		}
+		method := b.methods[operands[0]]
+		if in := method.method.method.Type.NumIn() - 1; operands[1] != in {
+			return fmt.Errorf("%s takes %d arguments but got %d", method.name, in, operands[1])
+		}
+	}
+	return nil
+}
+
+// typeName returns the name a type is serialised with.
+func typeName(typ reflect.Type) (string, error) {
+	switch {
+	case typ == nil:
+		return "", nil
+	case typ == objectType:
+		return "object", nil
+	case typ.Kind() == reflect.Ptr:
+		name, err := typeName(typ.Elem())
+		return "*" + name, err
+	case typ.Kind() == reflect.Slice:
+		name, err := typeName(typ.Elem())
+		return "[]" + name, err
+	case typeNames[typ.String()] == typ:
+		return typ.String(), nil
+	}
+	typeNamesMu.RLock()
+	defer typeNamesMu.RUnlock()
+	var names []string
+	for name, registered := range registeredTypes {
+		if registered == typ {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("%v can't be serialised; register it with RegisterTypeName", typ)
+	}
+	sort.Strings(names)
+	return names[0], nil
+}
+
+// parseTypeName returns the type a name serialised by typeName refers to.
+func parseTypeName(name string) (reflect.Type, error) {
+	switch {
+	case name == "":
+		return nil, nil
+	case name == "*" || name == "[]":
+		return nil, fmt.Errorf("invalid type name %s", name)
+	case strings.HasPrefix(name, "*"):
+		elem, err := parseTypeName(name[1:])
+		if err != nil {
+			return nil, err
+		}
+		return reflect.PtrTo(elem), nil
+	case strings.HasPrefix(name, "[]"):
+		elem, err := parseTypeName(name[2:])
+		if err != nil {
+			return nil, err
+		}
+		return reflect.SliceOf(elem), nil
+	}
+	typ, ok := LookupTypeName(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown type %s", name)
+	}
+	return typ, nil
+}
+
+type bytecodeEncoder struct {
+	buf []byte
+}
+
+func (e *bytecodeEncoder) uvarint(x uint64) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf = append(e.buf, b[:binary.PutUvarint(b[:], x)]...)
+}
+
+func (e *bytecodeEncoder) varint(x int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf = append(e.buf, b[:binary.PutVarint(b[:], x)]...)
+}
+
+func (e *bytecodeEncoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *bytecodeEncoder) typ(typ reflect.Type) error {
+	name, err := typeName(typ)
+	if err != nil {
+		return err
+	}
+	e.string(name)
+	return nil
+}
+
+// constant encodes a constant as its type followed by its value. Only nil,
+// bools, numbers and strings can be encoded.
+func (e *bytecodeEncoder) constant(value interface{}) error {
+	if value == nil {
+		e.string("")
+		return nil
+	}
+	v := reflect.ValueOf(value)
+	switch {
+	case v.Kind() == reflect.Bool, v.Kind() == reflect.String, IsArithmetic(v.Kind()):
+	default:
+		return fmt.Errorf("constant %v of type %T can't be serialised", value, value)
+	}
+	if err := e.typ(v.Type()); err != nil {
+		return err
+	}
+	switch {
+	case v.Kind() == reflect.Bool:
+		e.uvarint(boolBits(v.Bool()))
+	case v.Kind() == reflect.String:
+		e.string(v.String())
+	case IsUnsigned(v.Kind()):
+		e.uvarint(v.Uint())
+	case IsInteger(v.Kind()):
+		e.varint(v.Int())
+	default:
+		e.uvarint(math.Float64bits(v.Float()))
+	}
+	return nil
+}
+
+// bytecodeDecoder decodes serialised bytecode. The first error is kept, and
+// later reads return zero values.
+type bytecodeDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *bytecodeDecoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *bytecodeDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail(errTruncatedBytecode)
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return x
+}
+
+func (d *bytecodeDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.fail(errTruncatedBytecode)
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return x
+}
+
+// length decodes the length of a table, which can't be longer than the
+// remaining data or than an operand can index.
+func (d *bytecodeDecoder) length() int {
+	n := d.uvarint()
+	if n > uint64(len(d.buf)) || n > maxOperand {
+		d.fail(errTruncatedBytecode)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *bytecodeDecoder) string() string {
+	n := d.uvarint()
+	if n > uint64(len(d.buf)) {
+		d.fail(errTruncatedBytecode)
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+func (d *bytecodeDecoder) typ() reflect.Type {
+	typ, err := parseTypeName(d.string())
+	if err != nil {
+		d.fail(err)
+	}
+	return typ
+}
+
+func (d *bytecodeDecoder) constant() interface{} {
+	typ := d.typ()
+	if typ == nil {
+		return nil
+	}
+	v := reflect.New(typ).Elem()
+	switch {
+	case v.Kind() == reflect.Bool:
+		v.SetBool(d.uvarint() != 0)
+	case v.Kind() == reflect.String:
+		v.SetString(d.string())
+	case IsUnsigned(v.Kind()):
+		v.SetUint(d.uvarint())
+	case IsInteger(v.Kind()):
+		v.SetInt(d.varint())
+	case isFloatKind(v.Kind()):
+		v.SetFloat(math.Float64frombits(d.uvarint()))
+	default:
+		d.fail(fmt.Errorf("constants of type %v can't be loaded", typ))
+		return nil
+	}
+	return v.Interface()
+}
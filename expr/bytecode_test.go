@@ -0,0 +1,421 @@
+package expr
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBytecodeMatchesVisitors(t *testing.T) {
+	half := 0.5
+	parameters := []map[string]interface{}{
+		{"price": 12.5, "qty": 3, "count": int64(7), "active": true, "name": "widget", "discount": &half, "indoor": celsius(21), "tags": []string{"a", "b"}},
+		{"price": 1.5, "qty": 0, "count": int64(-2), "active": false, "name": "", "discount": (*float64)(nil), "indoor": celsius(-4), "tags": []string{"c"}},
+		{"price": 4, "qty": int64(2), "count": 9, "active": true, "name": "gadget", "discount": 0.25, "indoor": 18.5, "tags": []string{"b"}},
+	}
+	for _, expression := range []string{
+		"price * qty > 30 && active",
+		"price * qty",
+		"qty + count",
+		"count / qty",
+		"count % qty",
+		"qty / 2",
+		"price / qty",
+		"-price + +qty",
+		"-count",
+		"!active || qty == 3",
+		"!(discount > 0.1)",
+		"price == qty",
+		"price != 12.5",
+		"active == true",
+		"active != (qty > 1)",
+		"name == 'widget'",
+		"name != 'widget' && name != 'gadget'",
+		"qty >= count ? price : qty",
+		"active ? 1 : 2",
+		"active ? count : qty",
+		"active ? name : 'none'",
+		"discount * price",
+		"discount > 0.1",
+		"discount == null",
+		"-discount",
+		"indoor + 1.5",
+		"indoor > 20",
+		"'b' in tags",
+		"tags[0]",
+		"int64(price) + count",
+		"float64(qty) / 4",
+		"int32(count)",
+		"qty * 2 + 1 > count || price < 2 && !active",
+	} {
+		for _, values := range parameters {
+			parser, err := NewExpressionParserWithSchema(expression, compileSchema)
+			if err != nil {
+				t.Fatalf("%s: unexpected err: %v", expression, err)
+			}
+			expected, expectedErr := parser.Evaluate(values)
+			b, err := parser.CompileBytecode()
+			if err != nil {
+				t.Fatalf("%s: unexpected err: %v", expression, err)
+			}
+			actual, err := b.Evaluate(values)
+			if (err == nil) != (expectedErr == nil) || (err != nil && err.Error() != expectedErr.Error()) {
+				t.Fatalf("%s with %v: expected error %v but got %v\n%s", expression, values, expectedErr, err, b.Disassemble())
+			}
+			if !reflect.DeepEqual(actual, expected) {
+				t.Fatalf("%s with %v: expected %v (%T) but got %v (%T)\n%s", expression, values, expected, expected, actual, actual, b.Disassemble())
+			}
+		}
+	}
+}
+
+func TestBytecodeUnsupported(t *testing.T) {
+	for _, expression := range []string{
+		"let x = qty in x + 1",
+		"price is float64",
+		"qty switch { 3 => 'three', _ => 'other' }",
+	} {
+		parser, err := NewExpressionParserWithSchema(expression, compileSchema)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", expression, err)
+		}
+		if _, err := parser.CompileBytecode(); err == nil || !strings.Contains(err.Error(), "can't be compiled to bytecode") {
+			t.Fatalf("%s: expected an error but got %v", expression, err)
+		}
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	parser, err := NewExpressionParserWithSchema("price * qty > 30 && active", compileSchema)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	b, err := parser.CompileBytecode()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	expected := strings.Join([]string{
+		"0000  param.float64         0 (price)",
+		"0003  param.int64           1 (qty)",
+		"0006  int64.to.float64",
+		"0007  mul.float64",
+		"0008  const.float64         0 (30)",
+		"0011  gt.float64",
+		"0012  jump.if.false.or.pop  18",
+		"0015  param.bool            2 (active)",
+		"",
+	}, "\n")
+	if actual := b.Disassemble(); actual != expected {
+		t.Fatalf("expected\n%s\nbut got\n%s", expected, actual)
+	}
+}
+
+func TestBytecodeSerialization(t *testing.T) {
+	if err := RegisterTypeName("celsius", reflect.TypeOf(celsius(0))); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	values := map[string]interface{}{"price": 12.5, "qty": 3, "count": int64(7), "active": true, "name": "widget", "indoor": celsius(21), "tags": []string{"a"}}
+	for _, expression := range []string{
+		"price * qty > 30 && active",
+		"name == 'widget' ? count : -count",
+		"indoor + 1.5",
+		"'a' in tags && tags[0] != name",
+	} {
+		parser, err := NewExpressionParserWithSchema(expression, compileSchema)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", expression, err)
+		}
+		b, err := parser.CompileBytecode()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", expression, err)
+		}
+		data, err := b.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", expression, err)
+		}
+		loaded, err := LoadBytecode(data, nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", expression, err)
+		}
+		if loaded.Disassemble() != b.Disassemble() {
+			t.Fatalf("%s: expected\n%s\nbut loaded\n%s", expression, b.Disassemble(), loaded.Disassemble())
+		}
+		expected, err := b.Evaluate(values)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", expression, err)
+		}
+		actual, err := loaded.Evaluate(values)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", expression, err)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("%s: expected %v (%T) but got %v (%T)", expression, expected, expected, actual, actual)
+		}
+		for i := range data {
+			if _, err := LoadBytecode(data[:i], nil); err == nil {
+				t.Fatalf("%s: expected loading %d bytes to fail", expression, i)
+			}
+		}
+	}
+}
+
+func TestBytecodeStruct(t *testing.T) {
+	parser, err := NewExpressionParserForStruct("amount * 2 > 50 && ItemCount() > 1 && Checked(100)", request{})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	b, err := parser.CompileBytecode()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	data, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := LoadBytecode(data, nil); err == nil {
+		t.Fatalf("expected loading without an environment to fail")
+	}
+	env, err := NewEnvironment(request{})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	loaded, err := LoadBytecode(data, env)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	for _, test := range []struct {
+		env      request
+		expected bool
+	}{
+		{request{Total: 30, Items: []string{"a", "b"}}, true},
+		{request{Total: 20, Items: []string{"a", "b"}}, false},
+		{request{Total: 300, Items: []string{"a", "b"}}, false},
+	} {
+		actual, err := loaded.EvaluateStructBool(test.env)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if actual != test.expected {
+			t.Fatalf("%+v: expected %v but got %v", test.env, test.expected, actual)
+		}
+	}
+}
+
+func TestLoadBytecodeErrors(t *testing.T) {
+	parser, err := NewExpressionParserWithSchema("active ? price : 1.5", compileSchema)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	b, err := parser.CompileBytecode()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	data, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	for _, test := range []struct {
+		name     string
+		corrupt  func(code []byte)
+		expected string
+	}{
+		{"opcode", func(code []byte) { code[0] = byte(opcodeCount) }, "invalid opcode"},
+		{"parameter", func(code []byte) { code[2] = 9 }, "no such parameter"},
+		{"jump", func(code []byte) { code[5] = 1 }, "jumps to"},
+		{"stack", func(code []byte) { code[len(code)-3] = byte(OpAddFloat) }, "pops an empty stack"},
+		{"representation", func(code []byte) { code[len(code)-3] = byte(OpConst) }, "inconsistent stack"},
+		{"target", func(code []byte) { code[11]-- }, "in the middle of an instruction"},
+	} {
+		corrupted := append([]byte(nil), data...)
+		test.corrupt(corrupted[len(corrupted)-len(b.code):])
+		if _, err := LoadBytecode(corrupted, nil); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("%s: expected an error containing %q but got %v", test.name, test.expected, err)
+		}
+	}
+	if _, err := LoadBytecode([]byte("nope"), nil); err == nil {
+		t.Fatalf("expected loading garbage to fail")
+	}
+	parser, err = NewExpressionParserWithSchema("members[0] == null", Schema{"members": reflect.TypeOf([]*member(nil))})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if b, err = parser.CompileBytecode(); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := b.MarshalBinary(); err == nil || !strings.Contains(err.Error(), "register it with RegisterTypeName") {
+		t.Fatalf("expected serialising an unregistered type to fail but got %v", err)
+	}
+}
+
+func TestBytecodeDoesNotAllocate(t *testing.T) {
+	parameters := map[string]interface{}{"price": 12.5, "qty": 3, "count": int64(7), "active": true}
+	for _, expression := range []string{
+		"price * qty > 30 && active || count % 2 == 0",
+		"(price - 2.5) * (qty + count) / 4 > 1",
+		"(active ? price * 2 : -price) < 100",
+	} {
+		parser, err := NewExpressionParserWithSchema(expression, compileSchema)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		b, err := parser.CompileBytecode()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", expression, err)
+		}
+		allocs := testing.AllocsPerRun(100, func() {
+			if _, err := b.EvaluateBool(parameters); err != nil {
+				t.Fatalf("%s: unexpected err: %v", expression, err)
+			}
+		})
+		if allocs != 0 {
+			t.Fatalf("%s: expected no allocations but got %v", expression, allocs)
+		}
+	}
+}
+
+func BenchmarkBytecodeRule(b *testing.B) {
+	parser, err := NewExpressionParserWithSchema(benchmarkRule, compileSchema)
+	if err != nil {
+		b.Fatalf("unexpected err: %v", err)
+	}
+	bytecode, err := parser.CompileBytecode()
+	if err != nil {
+		b.Fatalf("unexpected err: %v", err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bytecode.EvaluateBool(benchmarkParameters); err != nil {
+			b.Fatalf("unexpected err: %v", err)
+		}
+	}
+}
+
+const benchmarkArithmetic = "(price - 2.5) * (qty + count) / 4 + (active ? 1.5 : 0.5)"
+
+func BenchmarkVisitArithmetic(b *testing.B) {
+	parser, err := NewExpressionParserWithSchema(benchmarkArithmetic, compileSchema)
+	if err != nil {
+		b.Fatalf("unexpected err: %v", err)
+	}
+	expression, _, err := parser.Check()
+	if err != nil {
+		b.Fatalf("unexpected err: %v", err)
+	}
+	scope := NewScopeFromMap(benchmarkParameters)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := visitExpression(expression, scope); err != nil {
+			b.Fatalf("unexpected err: %v", err)
+		}
+	}
+}
+
+func BenchmarkCompiledArithmetic(b *testing.B) {
+	parser, err := NewExpressionParserWithSchema(benchmarkArithmetic, compileSchema)
+	if err != nil {
+		b.Fatalf("unexpected err: %v", err)
+	}
+	program, err := parser.Compile()
+	if err != nil {
+		b.Fatalf("unexpected err: %v", err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := program.EvaluateFloat64(benchmarkParameters); err != nil {
+			b.Fatalf("unexpected err: %v", err)
+		}
+	}
+}
+
+func BenchmarkBytecodeArithmetic(b *testing.B) {
+	parser, err := NewExpressionParserWithSchema(benchmarkArithmetic, compileSchema)
+	if err != nil {
+		b.Fatalf("unexpected err: %v", err)
+	}
+	bytecode, err := parser.CompileBytecode()
+	if err != nil {
+		b.Fatalf("unexpected err: %v", err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bytecode.EvaluateFloat64(benchmarkParameters); err != nil {
+			b.Fatalf("unexpected err: %v", err)
+		}
+	}
+}
+
+// TestCorruptBytecode changes a few bytes of serialised bytecode at random
+// and checks that it either fails to load or evaluates without panicking.
+func TestCorruptBytecode(t *testing.T) {
+	if err := RegisterTypeName("celsius", reflect.TypeOf(celsius(0))); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	env, err := NewEnvironment(request{})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	random := rand.New(rand.NewSource(1))
+	values := map[string]interface{}{"price": 12.5, "qty": 3, "count": int64(7), "active": true, "name": "widget", "indoor": celsius(21), "tags": []string{"a"}}
+	for _, test := range []struct {
+		expression string
+		env        interface{}
+	}{
+		{"price * qty > 30 && active", nil},
+		{"name == 'widget' ? count : -count", nil},
+		{"(qty * 2 + count) * (qty * 2 + count) > 10 || !active", nil},
+		{"indoor * 2 + 1.5", nil},
+		{"price > 10 ? 'warm' : name", nil},
+		{"'a' in tags && tags[0] != name", nil},
+		{"float64(count) / 4 + price", nil},
+		{"int(price * 2) % 3 == 1 || name == ''", nil},
+		{"amount * 2 > 50 && ItemCount() > 1 && Checked(100)", request{}},
+	} {
+		var parser *ExpressionParser
+		if test.env != nil {
+			parser, err = NewExpressionParserForStruct(test.expression, test.env)
+		} else {
+			parser, err = NewExpressionParserWithSchema(test.expression, compileSchema)
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		b, err := parser.CompileBytecode()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		data, err := b.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		for i := 0; i < 5000; i++ {
+			corrupted := append([]byte(nil), data...)
+			for n := 1 + random.Intn(3); n > 0; n-- {
+				corrupted[len(bytecodeMagic)+random.Intn(len(corrupted)-len(bytecodeMagic))] = byte(random.Intn(256))
+			}
+			loaded, err := LoadBytecode(corrupted, env)
+			if err != nil {
+				continue
+			}
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Fatalf("%s: evaluating corrupt bytecode panicked: %v\n%s", test.expression, r, loaded.Disassemble())
+					}
+				}()
+				if test.env != nil {
+					loaded.EvaluateStruct(&request{Total: 30, Items: []string{"a", "b"}})
+					loaded.EvaluateStructBool(request{Total: 30})
+					return
+				}
+				loaded.Evaluate(values)
+				loaded.EvaluateBool(values)
+				loaded.EvaluateFloat64(values)
+			}()
+		}
+	}
+}
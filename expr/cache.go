@@ -0,0 +1,187 @@
+package expr
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ProgramCache compiles expressions into Programs and keeps the most
+// recently used ones, so that rules evaluated often are parsed once per
+// process rather than once per evaluation. It's safe for concurrent use:
+// when several goroutines ask for an expression which isn't cached, it's
+// compiled once and they all receive the same Program.
+//
+// Programs are cached by their expression text and options. Operators,
+// conversions, enums and library functions registered after an expression
+// was compiled don't affect its cached Program.
+type ProgramCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[cacheKey]*list.Element
+	// order holds the entries from the most to the least recently used.
+	order *list.List
+	// types numbers the types of schemas, so keys can refer to them.
+	types  map[reflect.Type]int
+	hits   uint64
+	misses uint64
+}
+
+// CompileOptions describe how a cached expression is parsed.
+type CompileOptions struct {
+	// Schema declares the expression's parameters.
+	Schema Schema
+	// Environment is a value of the struct, or a nil pointer to one, whose
+	// fields and methods are the expression's identifiers, as with
+	// NewExpressionParserForStruct. It's optional.
+	Environment interface{}
+	Mode        Mode
+	// Library provides functions the expression can call. It's optional.
+	Library *Library
+}
+
+// cacheKey identifies a cached Program.
+type cacheKey struct {
+	expression  string
+	schema      string
+	environment reflect.Type
+	mode        Mode
+	library     *Library
+}
+
+type cacheEntry struct {
+	key cacheKey
+	// ready is closed once the expression has been compiled.
+	ready   chan struct{}
+	program *Program
+	err     error
+}
+
+// NewProgramCache creates a cache which keeps up to capacity compiled
+// programs.
+func NewProgramCache(capacity int) (*ProgramCache, error) {
+	if capacity <= 0 {
+		return nil, errors.New("a program cache needs a positive capacity")
+	}
+	return &ProgramCache{
+		capacity: capacity,
+		entries:  make(map[cacheKey]*list.Element),
+		order:    list.New(),
+		types:    make(map[reflect.Type]int),
+	}, nil
+}
+
+// Compile returns the compiled program for an expression, compiling it if
+// it isn't cached. Expressions which fail to compile aren't cached.
+func (c *ProgramCache) Compile(expression string, options CompileOptions) (*Program, error) {
+	c.mu.Lock()
+	key := c.key(expression, options)
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		c.hits++
+		entry := element.Value.(*cacheEntry)
+		c.mu.Unlock()
+		<-entry.ready
+		return entry.program, entry.err
+	}
+	c.misses++
+	entry := &cacheEntry{key: key, ready: make(chan struct{})}
+	c.entries[key] = c.order.PushFront(entry)
+	c.mu.Unlock()
+
+	entry.program, entry.err = compileWithOptions(expression, options)
+	close(entry.ready)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry.err != nil {
+		if element, ok := c.entries[key]; ok && element.Value == entry {
+			c.remove(element)
+		}
+		return nil, entry.err
+	}
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+	}
+	return entry.program, nil
+}
+
+// Len returns the number of cached programs.
+func (c *ProgramCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// Stats returns the number of times Compile found a program in the cache
+// and the number of times it didn't.
+func (c *ProgramCache) Stats() (hits uint64, misses uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// remove removes an entry. Goroutines waiting for it to be compiled still
+// receive its program.
+func (c *ProgramCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*cacheEntry).key)
+}
+
+// key returns the key of an expression compiled with the provided options.
+// Schemas are described by their names and the numbers of their types.
+func (c *ProgramCache) key(expression string, options CompileOptions) cacheKey {
+	names := make([]string, 0, len(options.Schema))
+	for name := range options.Schema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var schema strings.Builder
+	for _, name := range names {
+		typ := options.Schema[name]
+		id, ok := c.types[typ]
+		if !ok {
+			id = len(c.types)
+			c.types[typ] = id
+		}
+		fmt.Fprintf(&schema, "%s:%d;", name, id)
+	}
+	environment := reflect.TypeOf(options.Environment)
+	for environment != nil && environment.Kind() == reflect.Ptr {
+		environment = environment.Elem()
+	}
+	return cacheKey{
+		expression:  expression,
+		schema:      schema.String(),
+		environment: environment,
+		mode:        options.Mode,
+		library:     options.Library,
+	}
+}
+
+// compileWithOptions parses and compiles an expression.
+func compileWithOptions(expression string, options CompileOptions) (*Program, error) {
+	var ep *ExpressionParser
+	var err error
+	if options.Environment != nil {
+		ep, err = NewExpressionParserForStruct(expression, options.Environment)
+	} else {
+		ep, err = NewExpressionParser(expression, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for name, typ := range options.Schema {
+		if err := ep.Declare(name, typ); err != nil {
+			return nil, err
+		}
+	}
+	ep.SetMode(options.Mode)
+	if options.Library != nil {
+		ep.SetLibrary(options.Library)
+	}
+	return ep.Compile()
+}
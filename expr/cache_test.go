@@ -0,0 +1,201 @@
+package expr
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestProgramCache(t *testing.T) {
+	cache, err := NewProgramCache(2)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	ints := CompileOptions{Schema: Schema{"x": reflect.TypeOf(0)}}
+	floats := CompileOptions{Schema: Schema{"x": reflect.TypeOf(0.0)}}
+	first, err := cache.Compile("x * 2", ints)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if again, _ := cache.Compile("x * 2", CompileOptions{Schema: Schema{"x": reflect.TypeOf(0)}}); again != first {
+		t.Fatalf("expected the cached program to be reused")
+	}
+	other, err := cache.Compile("x * 2", floats)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if other == first {
+		t.Fatalf("expected a schema with other types to compile another program")
+	}
+	if actual, _ := other.Evaluate(map[string]interface{}{"x": 1.25}); actual != 2.5 {
+		t.Fatalf("expected %v but got %v", 2.5, actual)
+	}
+	if hits, misses := cache.Stats(); hits != 1 || misses != 2 {
+		t.Fatalf("expected 1 hit and 2 misses but got %d and %d", hits, misses)
+	}
+
+	// Using the int program makes the float one the least recently used,
+	// so it's evicted.
+	cache.Compile("x * 2", ints)
+	cache.Compile("x + 1", ints)
+	if cache.Len() != 2 {
+		t.Fatalf("expected 2 programs but got %d", cache.Len())
+	}
+	if again, _ := cache.Compile("x * 2", ints); again != first {
+		t.Fatalf("expected the most recently used program to be kept")
+	}
+	if again, _ := cache.Compile("x * 2", floats); again == other {
+		t.Fatalf("expected the least recently used program to be evicted")
+	}
+
+	if _, err := cache.Compile("x +", ints); err == nil {
+		t.Fatalf("expected an invalid expression to fail")
+	}
+	if cache.Len() != 2 {
+		t.Fatalf("expected failures not to be cached but got %d programs", cache.Len())
+	}
+
+	byValue, err := cache.Compile("amount > 10", CompileOptions{Environment: request{}})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if byPointer, _ := cache.Compile("amount > 10", CompileOptions{Environment: (*request)(nil)}); byPointer != byValue {
+		t.Fatalf("expected a struct and a pointer to it to share programs")
+	}
+	if _, err := NewProgramCache(0); err == nil {
+		t.Fatalf("expected a cache without capacity to fail")
+	}
+}
+
+func TestProgramCacheOptions(t *testing.T) {
+	cache, err := NewProgramCache(8)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	library := NewLibrary()
+	if err := library.Define("def double(x) = x * 2", nil); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	program, err := cache.Compile("count += double(step)", CompileOptions{
+		Schema:  Schema{"count": reflect.TypeOf(0), "step": reflect.TypeOf(0)},
+		Mode:    StatementMode,
+		Library: library,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	parameters := map[string]interface{}{"count": 1, "step": 2}
+	if actual, err := program.Evaluate(parameters); err != nil || actual != 5 {
+		t.Fatalf("expected 5 but got %v, %v", actual, err)
+	}
+	if parameters["count"] != 5 {
+		t.Fatalf("expected the assignment to be written back but got %v", parameters["count"])
+	}
+	if _, err := cache.Compile("count += double(step)", CompileOptions{
+		Schema: Schema{"count": reflect.TypeOf(0), "step": reflect.TypeOf(0)},
+		Mode:   StatementMode,
+	}); err == nil {
+		t.Fatalf("expected compiling without the library to fail")
+	}
+}
+
+// The concurrency tests are meant to be run with the race detector, as in
+// go test -race.
+
+func TestProgramCacheConcurrency(t *testing.T) {
+	cache, err := NewProgramCache(4)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	options := CompileOptions{Schema: compileSchema}
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			expression := fmt.Sprintf("qty * %d + count", i%3)
+			program, err := cache.Compile(expression, options)
+			if err != nil {
+				errs <- err
+				return
+			}
+			actual, err := program.Evaluate(map[string]interface{}{"qty": i, "count": int64(1)})
+			if err != nil {
+				errs <- err
+				return
+			}
+			if expected := int64(i*(i%3) + 1); actual != expected {
+				errs <- fmt.Errorf("%s: expected %v but got %v", expression, expected, actual)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, misses := cache.Stats(); misses != 3 {
+		t.Fatalf("expected each expression to be compiled once but got %d misses", misses)
+	}
+}
+
+func TestProgramConcurrentEvaluation(t *testing.T) {
+	parser, err := NewExpressionParserForStruct("Discounted(Total()) > 2 || Total() == 7 ? Total() : Rate", cart{})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	program, err := parser.Compile()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	b, err := parser.CompileBytecode()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	statements, err := NewExpressionParser("count += 1", map[string]interface{}{"count": 1})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	statements.SetMode(StatementMode)
+	counter, err := statements.Compile()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3*32)
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			calls := 0
+			env := cart{Items: []float64{float64(i), 1}, Rate: 0.5, calls: &calls}
+			expected := env.Rate
+			if float64(i+1)*0.5 > 2 || i+1 == 7 {
+				expected = float64(i + 1)
+			}
+			for _, evaluate := range []func(interface{}) (interface{}, error){program.EvaluateStruct, b.EvaluateStruct} {
+				if actual, err := evaluate(&env); err != nil || actual != expected {
+					errs <- fmt.Errorf("%d: expected %v but got %v, %v", i, expected, actual, err)
+				}
+			}
+			// Each evaluation assigns to its own copy of the parser's
+			// parameters.
+			if actual, err := counter.Evaluate(nil); err != nil || actual != 2 {
+				errs <- fmt.Errorf("expected 2 but got %v, %v", actual, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	var messages []string
+	for err := range errs {
+		messages = append(messages, err.Error())
+	}
+	if len(messages) > 0 {
+		t.Fatalf("unexpected errors:\n%s", strings.Join(messages, "\n"))
+	}
+}
@@ -48,3 +48,11 @@ func IsUnsigned(t reflect.Kind) bool {
 	}
 	return false
 }
+
+func IsInteger(t reflect.Kind) bool {
+	switch t {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return IsUnsigned(t)
+}
@@ -78,3 +78,25 @@ func TestIsUnsigned(t *testing.T) {
 		}
 	}
 }
+
+func TestIsInteger(t *testing.T) {
+	for _, test := range []struct {
+		kind     reflect.Kind
+		expected bool
+	}{
+		{reflect.Int, true},
+		{reflect.Int8, true},
+		{reflect.Int64, true},
+		{reflect.Uint, true},
+		{reflect.Uint64, true},
+
+		{reflect.Float32, false},
+		{reflect.Float64, false},
+		{reflect.String, false},
+		{reflect.Struct, false},
+	} {
+		if actual := IsInteger(test.kind); actual != test.expected {
+			t.Fatalf("expected %v but got %v", test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,582 @@
+package expr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"math"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Generating Go turns an expression into the source of a Go function which
+// evaluates it, so the hottest rules can be compiled into a program and
+// called directly. The function takes a pointer to the parser's struct
+// environment, if it has one, followed by the declared parameters in order
+// of their names, and returns a value of the basic type of the expression's
+// kind and an error, as in
+//
+//	func HighValue(env *Order, discount float64) (bool, error)
+//
+// Arithmetic, comparisons, logic, conditionals, casts between basic types,
+// fields and method calls are generated, and evaluate with the same results
+// as the visitors. Integer division by zero and method calls fail with the
+// same errors. Other expressions, and those involving nullable values, named
+// types other than those of fields and method results, or user-defined
+// operators and conversions, can't be generated.
+
+// GenerateOptions describe the Go source generated for an expression.
+type GenerateOptions struct {
+	// Package is the package the generated file belongs to. It defaults to
+	// the package of the struct environment.
+	Package string
+	// Function is the name of the generated function.
+	Function string
+	// Environment is the name the generated function refers to the struct
+	// environment by. It defaults to the struct's name, so the function
+	// should be generated in the package the struct is declared in.
+	Environment string
+}
+
+// GenerateGo parses, type checks and optimizes the expression, and returns
+// the formatted source of a Go file declaring a function which evaluates
+// it.
+func (ep *ExpressionParser) GenerateGo(options GenerateOptions) ([]byte, error) {
+	if options.Function == "" || !isGoIdentifier(options.Function) {
+		return nil, fmt.Errorf("%q isn't a valid function name", options.Function)
+	}
+	expression, _, err := ep.Check()
+	if err != nil {
+		return nil, err
+	}
+	optimized, err := Optimize(expression)
+	if err != nil {
+		return nil, err
+	}
+	g := &generator{
+		environment: ep.environment,
+		imports:     make(map[string]bool),
+	}
+	var signature []string
+	if g.environment != nil {
+		typ := g.environment.typ
+		name := options.Environment
+		if name == "" {
+			name = typ.Name()
+		}
+		if name == "" {
+			return nil, fmt.Errorf("the environment %v has no name; provide one in the options", typ)
+		}
+		if options.Package == "" && typ.PkgPath() != "" {
+			options.Package = path.Base(typ.PkgPath())
+		}
+		g.environmentName = name
+		signature = append(signature, "env *"+name)
+	}
+	if options.Package == "" || !isGoIdentifier(options.Package) {
+		return nil, fmt.Errorf("%q isn't a valid package name", options.Package)
+	}
+	declarations := ep.tokenizer.Declarations()
+	names := make([]string, 0, len(declarations))
+	for name := range declarations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		typ := declarations[name]
+		if !isGoIdentifier(name) || isReservedGoName(name) {
+			return nil, fmt.Errorf("the parameter %s can't be named %s in Go", name, name)
+		}
+		if !isGeneratedType(typ) || isNamed(typ) {
+			return nil, fmt.Errorf("can't generate Go for the parameter %s of type %v", name, typ)
+		}
+		signature = append(signature, name+" "+typ.String())
+	}
+	kind := optimized.Kind()
+	if !isGeneratedKind(kind) {
+		return nil, fmt.Errorf("can't generate Go for a result of kind %v", kind)
+	}
+	g.zero = zeroLiteral(kind)
+	if g.environment != nil {
+		g.imports["errors"] = true
+		g.printf("if env == nil {\nreturn %s, errors.New(%q)\n}\n", g.zero, "the environment is a nil *"+g.environmentName)
+	}
+	result, err := g.generate(optimized)
+	if err != nil {
+		return nil, err
+	}
+	result, err = g.convert(result, optimized, kind)
+	if err != nil {
+		return nil, err
+	}
+	g.printf("return %s, nil\n", result)
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by pop gen. DO NOT EDIT.\n\npackage %s\n\n", options.Package)
+	var imports []string
+	for name := range g.imports {
+		imports = append(imports, strconv.Quote(name))
+	}
+	sort.Strings(imports)
+	switch len(imports) {
+	case 0:
+	case 1:
+		fmt.Fprintf(&out, "import %s\n\n", imports[0])
+	default:
+		fmt.Fprintf(&out, "import (\n%s\n)\n\n", strings.Join(imports, "\n"))
+	}
+	fmt.Fprintf(&out, "// %s evaluates the expression\n//\n", options.Function)
+	for _, line := range strings.Split(ep.tokenizer.text, "\n") {
+		fmt.Fprintf(&out, "//\t%s\n", line)
+	}
+	fmt.Fprintf(&out, "func %s(%s) (%s, error) {\n%s}\n", options.Function, strings.Join(signature, ", "), typeOfKind(kind), g.body.String())
+	return format.Source(out.Bytes())
+}
+
+type generator struct {
+	environment     *Environment
+	environmentName string
+	body            bytes.Buffer
+	imports         map[string]bool
+	// zero is the value the function returns along with an error.
+	zero  string
+	temps int
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.body, format, args...)
+}
+
+// temp returns the name of a new temporary variable.
+func (g *generator) temp() string {
+	g.temps++
+	return fmt.Sprintf("tmp%d", g.temps)
+}
+
+// generate returns a Go expression for the value of a node, printing the
+// statements which must run first. The expression has the basic type of
+// the node's kind, or is an untyped constant, and can't fail or have side
+// effects: method calls and anything which can fail are statements, so
+// nodes are evaluated in the same order as the visitors evaluate them.
+func (g *generator) generate(node Expression) (string, error) {
+	switch e := node.(type) {
+	case *ConstantExpression:
+		return g.constant(e)
+	case *ParameterExpression:
+		if e.typ == nil {
+			return "", fmt.Errorf("can't generate Go for the undeclared parameter %s", e.name)
+		}
+		return e.name, nil
+	case *FieldExpression:
+		return g.field(e)
+	case *CallExpression:
+		return g.call(e)
+	case *BinaryExpression:
+		if e.operator != nil {
+			break
+		}
+		switch e.Type() {
+		case AndAlsoExpr, OrElseExpr:
+			return g.logical(e)
+		case AddExpr, SubtractExpr, MultiplyExpr, DivideExpr, ModuloExpr:
+			return g.arithmetic(e)
+		case EqualExpr, NotEqualExpr, LessThanExpr, LessThanOrEqualExpr, GreaterThanExpr, GreaterThanOrEqualExpr:
+			return g.comparison(e)
+		}
+	case *UnaryExpression:
+		if e.operator == nil {
+			return g.unary(e)
+		}
+	case *ConditionalExpression:
+		return g.conditional(e)
+	case *ConvertExpression:
+		if e.conversion == nil && !isNamed(e.typ) && isGeneratedKind(e.Kind()) {
+			operand, err := g.generate(e.operand)
+			if err != nil {
+				return "", err
+			}
+			return g.convert(operand, e.operand, e.Kind())
+		}
+	}
+	return "", fmt.Errorf("can't generate Go for %v", node)
+}
+
+// constant returns the literal of a constant's value.
+func (g *generator) constant(e *ConstantExpression) (string, error) {
+	if e.value == nil {
+		return "", errors.New("can't generate Go for null")
+	}
+	v := reflect.ValueOf(e.value)
+	switch kind := v.Kind(); {
+	case kind == reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case kind == reflect.String:
+		return strconv.Quote(v.String()), nil
+	case IsUnsigned(kind):
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case IsInteger(kind):
+		return strconv.FormatInt(v.Int(), 10), nil
+	case isFloatKind(kind):
+		x := v.Float()
+		switch {
+		case math.IsNaN(x):
+			g.imports["math"] = true
+			return "math.NaN()", nil
+		case math.IsInf(x, 0):
+			g.imports["math"] = true
+			return fmt.Sprintf("math.Inf(%d)", int(math.Copysign(1, x))), nil
+		}
+		literal := strconv.FormatFloat(x, 'g', -1, 64)
+		if !strings.ContainsAny(literal, ".eE") {
+			// Keep the constant a float, so float64(1) / 2 isn't 0.
+			literal += ".0"
+		}
+		return literal, nil
+	}
+	return "", fmt.Errorf("can't generate Go for the constant %v", e)
+}
+
+// field returns a field of the environment, converted to its basic type.
+func (g *generator) field(e *FieldExpression) (string, error) {
+	if g.environment == nil || !isGeneratedType(e.typ) {
+		return "", fmt.Errorf("can't generate Go for the field %s of type %v", e.name, e.typ)
+	}
+	var names []string
+	typ := g.environment.typ
+	for _, i := range e.index {
+		field := typ.Field(i)
+		names = append(names, field.Name)
+		typ = field.Type
+	}
+	value := "env." + strings.Join(names, ".")
+	if isNamed(e.typ) {
+		return fmt.Sprintf("%s(%s)", typeOfKind(e.Kind()), value), nil
+	}
+	return value, nil
+}
+
+// call calls a method of the environment, storing its result in a
+// temporary variable. Arguments are converted to the method's parameter
+// types like callMethod converts them.
+func (g *generator) call(e *CallExpression) (string, error) {
+	typ := e.method.method.Type
+	if g.environment == nil || !isGeneratedType(typ.Out(0)) {
+		return "", fmt.Errorf("can't generate Go for the call %v", e)
+	}
+	args := make([]string, len(e.arguments))
+	for i, argument := range e.arguments {
+		arg, err := g.generate(argument)
+		if err != nil {
+			return "", err
+		}
+		parameter := typ.In(i + 1)
+		switch {
+		case isNamed(parameter) && parameter.PkgPath() == g.environment.typ.PkgPath() && isGeneratedKind(parameter.Kind()):
+			arg = fmt.Sprintf("%s(%s)", parameter.Name(), arg)
+		case isGeneratedType(parameter) && !isNamed(parameter):
+			if arg, err = g.convert(arg, argument, parameter.Kind()); err != nil {
+				return "", err
+			}
+		default:
+			return "", fmt.Errorf("can't generate Go for argument %d of %s, of type %v", i+1, e.name, parameter)
+		}
+		args[i] = arg
+	}
+	result := g.temp()
+	call := fmt.Sprintf("env.%s(%s)", e.method.method.Name, strings.Join(args, ", "))
+	if typ.NumOut() == 2 {
+		g.printf("%s, err := %s\nif err != nil {\nreturn %s, err\n}\n", result, call, g.zero)
+	} else {
+		g.printf("%s := %s\n", result, call)
+	}
+	if isNamed(typ.Out(0)) {
+		return fmt.Sprintf("%s(%s)", typeOfKind(e.Kind()), result), nil
+	}
+	return result, nil
+}
+
+// logical generates && and ||, whose right operand is only evaluated when
+// the left one doesn't decide the result.
+func (g *generator) logical(e *BinaryExpression) (string, error) {
+	operator := "&&"
+	if e.Type() == OrElseExpr {
+		operator = "||"
+	}
+	left, err := g.generate(e.left)
+	if err != nil {
+		return "", err
+	}
+	// The right operand is generated on its own, so that when it needs no
+	// statements the operator can be used as it is.
+	body := g.body
+	g.body = bytes.Buffer{}
+	right, err := g.generate(e.right)
+	statements := g.body
+	g.body = body
+	if err != nil {
+		return "", err
+	}
+	if statements.Len() == 0 {
+		return fmt.Sprintf("(%s %s %s)", left, operator, right), nil
+	}
+	result := g.temp()
+	g.printf("%s := %s\n", result, left)
+	if operator == "&&" {
+		g.printf("if %s {\n", result)
+	} else {
+		g.printf("if !%s {\n", result)
+	}
+	g.body.Write(statements.Bytes())
+	g.printf("%s = %s\n}\n", result, right)
+	return result, nil
+}
+
+var goOperators = map[ExpressionType]string{
+	AddExpr:                "+",
+	SubtractExpr:           "-",
+	MultiplyExpr:           "*",
+	DivideExpr:             "/",
+	ModuloExpr:             "%",
+	EqualExpr:              "==",
+	NotEqualExpr:           "!=",
+	LessThanExpr:           "<",
+	LessThanOrEqualExpr:    "<=",
+	GreaterThanExpr:        ">",
+	GreaterThanOrEqualExpr: ">=",
+}
+
+// arithmetic generates arithmetic, which like evaluateArithmetic is
+// computed with float64s when either operand or the result is a float and
+// with integers otherwise. Integer division checks for zero.
+func (g *generator) arithmetic(e *BinaryExpression) (string, error) {
+	kind := e.Kind()
+	if !isGeneratedKind(kind) || kind == reflect.String || kind == reflect.Bool {
+		return "", fmt.Errorf("can't generate Go for %v", e)
+	}
+	left, err := g.generate(e.left)
+	if err != nil {
+		return "", err
+	}
+	right, err := g.generate(e.right)
+	if err != nil {
+		return "", err
+	}
+	operator := goOperators[e.Type()]
+	if isFloatKind(kind) || isFloatKind(e.left.Kind()) || isFloatKind(e.right.Kind()) {
+		if left, err = g.convert(left, e.left, reflect.Float64); err != nil {
+			return "", err
+		}
+		if right, err = g.convert(right, e.right, reflect.Float64); err != nil {
+			return "", err
+		}
+		value := fmt.Sprintf("(%s %s %s)", left, operator, right)
+		if e.Type() == ModuloExpr {
+			g.imports["math"] = true
+			value = fmt.Sprintf("math.Mod(%s, %s)", left, right)
+		}
+		return g.convertKind(value, reflect.Float64, kind), nil
+	}
+	if !IsInteger(kind) || IsUnsigned(kind) {
+		return "", fmt.Errorf("can't generate Go for %v", e)
+	}
+	if left, err = g.convert(left, e.left, kind); err != nil {
+		return "", err
+	}
+	if right, err = g.convert(right, e.right, kind); err != nil {
+		return "", err
+	}
+	if e.Type() != DivideExpr && e.Type() != ModuloExpr {
+		return fmt.Sprintf("(%s %s %s)", left, operator, right), nil
+	}
+	if _, ok := e.right.(*ConstantExpression); ok {
+		if isConstantNumber(e.right, 0) {
+			return "", fmt.Errorf("can't generate Go for %v, which divides by zero", e)
+		}
+		return fmt.Sprintf("(%s %s %s)", left, operator, right), nil
+	}
+	divisor := g.temp()
+	g.imports["errors"] = true
+	g.printf("%s := %s\nif %s == 0 {\nreturn %s, errors.New(%q)\n}\n", divisor, right, divisor, g.zero, errDivideByZero.Error())
+	return fmt.Sprintf("(%s %s %s)", left, operator, divisor), nil
+}
+
+// comparison generates a comparison, or == or !=. Numbers compare by value
+// and strings lexically.
+func (g *generator) comparison(e *BinaryExpression) (string, error) {
+	left, err := g.generate(e.left)
+	if err != nil {
+		return "", err
+	}
+	right, err := g.generate(e.right)
+	if err != nil {
+		return "", err
+	}
+	lk, rk := e.left.Kind(), e.right.Kind()
+	equality := e.Type() == EqualExpr || e.Type() == NotEqualExpr
+	switch {
+	case IsArithmetic(lk) && IsArithmetic(rk):
+		common := reflect.Float64
+		if IsInteger(lk) && IsInteger(rk) {
+			common = reflect.Int64
+		}
+		if left, err = g.convert(left, e.left, common); err != nil {
+			return "", err
+		}
+		if right, err = g.convert(right, e.right, common); err != nil {
+			return "", err
+		}
+	case lk == reflect.String && rk == reflect.String:
+	case lk == reflect.Bool && rk == reflect.Bool && equality:
+	default:
+		return "", fmt.Errorf("can't generate Go for %v", e)
+	}
+	return fmt.Sprintf("(%s %s %s)", left, goOperators[e.Type()], right), nil
+}
+
+func (g *generator) unary(e *UnaryExpression) (string, error) {
+	kind := e.Kind()
+	switch e.Type() {
+	case NotExpr, NegateExpr, UnaryPlusExpr:
+	default:
+		return "", fmt.Errorf("can't generate Go for %v", e)
+	}
+	operand, err := g.generate(e.operand)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case e.Type() == NotExpr && kind == reflect.Bool:
+		return fmt.Sprintf("(!%s)", operand), nil
+	case e.Type() == UnaryPlusExpr:
+		return g.convert(operand, e.operand, kind)
+	case isFloatKind(kind) || isFloatKind(e.operand.Kind()):
+		if operand, err = g.convert(operand, e.operand, reflect.Float64); err != nil {
+			return "", err
+		}
+		// Negation subtracts from zero, like evaluateUnary.
+		return g.convertKind(fmt.Sprintf("(0 - %s)", operand), reflect.Float64, kind), nil
+	case IsInteger(kind) && !IsUnsigned(kind):
+		if operand, err = g.convert(operand, e.operand, kind); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(-%s)", operand), nil
+	}
+	return "", fmt.Errorf("can't generate Go for %v", e)
+}
+
+// conditional generates a conditional, whose branches are only evaluated
+// when they're selected.
+func (g *generator) conditional(e *ConditionalExpression) (string, error) {
+	kind := e.Kind()
+	if !isGeneratedKind(kind) {
+		return "", fmt.Errorf("can't generate Go for %v", e)
+	}
+	test, err := g.generate(e.test)
+	if err != nil {
+		return "", err
+	}
+	result := g.temp()
+	g.printf("var %s %s\nif %s {\n", result, typeOfKind(kind), test)
+	for i, branch := range []Expression{e.ifTrue, e.ifFalse} {
+		if i == 1 {
+			g.printf("} else {\n")
+		}
+		value, err := g.generate(branch)
+		if err != nil {
+			return "", err
+		}
+		if value, err = g.convert(value, branch, kind); err != nil {
+			return "", err
+		}
+		g.printf("%s = %s\n", result, value)
+	}
+	g.printf("}\n")
+	return result, nil
+}
+
+// convert converts the Go expression for a node's value to a basic kind,
+// like convertToKind converts values.
+func (g *generator) convert(value string, node Expression, kind reflect.Kind) (string, error) {
+	from := node.Kind()
+	if _, ok := node.(*ConstantExpression); ok && from != reflect.Bool && from != reflect.String {
+		// Constants are untyped, so they're converted even when their kinds
+		// match.
+		return fmt.Sprintf("%s(%s)", typeOfKind(kind), value), nil
+	}
+	switch {
+	case from == kind:
+		return value, nil
+	case IsArithmetic(from) && IsArithmetic(kind) && isGeneratedKind(kind):
+		return g.convertKind(value, from, kind), nil
+	}
+	return "", fmt.Errorf("can't generate Go converting %v to %v", node, kind)
+}
+
+// convertKind converts a Go expression of one basic kind to another.
+func (g *generator) convertKind(value string, from reflect.Kind, to reflect.Kind) string {
+	if from == to {
+		return value
+	}
+	return fmt.Sprintf("%s(%s)", typeOfKind(to), value)
+}
+
+// isGeneratedKind determines whether or not values of a kind can be
+// generated.
+func isGeneratedKind(kind reflect.Kind) bool {
+	return kind == reflect.Bool || kind == reflect.String || (IsArithmetic(kind) && typeOfKind(kind) != nil)
+}
+
+// isGeneratedType determines whether or not values of a type, which may be
+// named, can be generated.
+func isGeneratedType(typ reflect.Type) bool {
+	return typ != nil && isGeneratedKind(typ.Kind()) && typ.PkgPath() == "" || (isNamed(typ) && isGeneratedKind(typ.Kind()))
+}
+
+func zeroLiteral(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Bool:
+		return "false"
+	case reflect.String:
+		return `""`
+	}
+	return "0"
+}
+
+func isGoIdentifier(name string) bool {
+	for i, r := range name {
+		if r != '_' && !('a' <= r && r <= 'z') && !('A' <= r && r <= 'Z') && (i == 0 || !('0' <= r && r <= '9')) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// reservedGoNames are the Go keywords and the predeclared names generated
+// code uses, which parameters can't be named.
+var reservedGoNames = map[string]bool{
+	"break": true, "case": true, "chan": true, "const": true, "continue": true, "default": true,
+	"defer": true, "else": true, "fallthrough": true, "for": true, "func": true, "go": true,
+	"goto": true, "if": true, "import": true, "interface": true, "map": true, "package": true,
+	"range": true, "return": true, "select": true, "struct": true, "switch": true, "type": true,
+	"var": true, "bool": true, "string": true, "int": true, "int8": true, "int16": true,
+	"int32": true, "int64": true, "uint": true, "uint8": true, "uint16": true, "uint32": true,
+	"uint64": true, "uintptr": true, "float32": true, "float64": true, "byte": true, "rune": true,
+	"true": true, "false": true, "nil": true, "env": true, "err": true, "errors": true, "math": true,
+}
+
+// isReservedGoName determines whether or not a parameter's name would
+// clash with a name generated code uses.
+func isReservedGoName(name string) bool {
+	if reservedGoNames[name] {
+		return true
+	}
+	if strings.HasPrefix(name, "tmp") {
+		_, err := strconv.Atoi(name[3:])
+		return err == nil
+	}
+	return false
+}
@@ -0,0 +1,255 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type zone int32
+
+type shipment struct {
+	Weight  float64
+	Boxes   int
+	Zone    zone
+	Carrier string `expr:"carrier"`
+	Express bool
+}
+
+func (s shipment) Rate(boxes int64) float64 {
+	return float64(boxes)*1.5 + s.Weight
+}
+
+func (s *shipment) Insure(value float64) (bool, error) {
+	if value < 0 {
+		return false, errors.New("a negative value can't be insured")
+	}
+	return value > 100, nil
+}
+
+// shipmentSource declares shipment and its methods for the generated code,
+// and has to be kept in step with the declarations above.
+const shipmentSource = `
+type zone int32
+
+type shipment struct {
+	Weight  float64
+	Boxes   int
+	Zone    zone
+	Carrier string
+	Express bool
+}
+
+func (s shipment) Rate(boxes int64) float64 {
+	return float64(boxes)*1.5 + s.Weight
+}
+
+func (s *shipment) Insure(value float64) (bool, error) {
+	if value < 0 {
+		return false, errors.New("a negative value can't be insured")
+	}
+	return value > 100, nil
+}
+`
+
+var (
+	shipments = []shipment{
+		{Weight: 12.5, Boxes: 3, Zone: 2, Carrier: "ups", Express: true},
+		{Weight: -4, Boxes: 2, Zone: -1, Carrier: "dhl", Express: false},
+		{Weight: 30, Boxes: 0, Zone: 7, Carrier: "ups", Express: false},
+	}
+	shipmentExpressions = []string{
+		"Weight * Boxes > 30 && Express",
+		"Zone + 1",
+		"-Zone * 2",
+		"Rate(Boxes) + Weight",
+		"Insure(Weight) || Rate(Boxes) > 3",
+		"Insure(Weight * 10) ? carrier : 'ground'",
+		"Boxes % 3 == 1 || Weight >= 2.5",
+		"-Weight + +Boxes",
+		"float64(Boxes) / 4",
+		"carrier == 'ups' && !Express",
+		"Boxes / (Boxes - 2)",
+		"Weight % 7 + 0.5",
+		"Boxes > 1 ? Weight : Boxes",
+	}
+	generateSchema = Schema{
+		"price":  reflect.TypeOf(float64(0)),
+		"qty":    reflect.TypeOf(0),
+		"count":  reflect.TypeOf(int64(0)),
+		"active": reflect.TypeOf(false),
+		"name":   reflect.TypeOf(""),
+	}
+	generateParameters = []map[string]interface{}{
+		{"price": 12.5, "qty": 3, "count": int64(7), "active": true, "name": "widget"},
+		{"price": -1.5, "qty": 0, "count": int64(-2), "active": false, "name": ""},
+	}
+	schemaExpressions = []string{
+		"price * qty > 30 && active",
+		"count / qty",
+		"count % qty",
+		"qty + count",
+		"qty >= count ? price : qty",
+		"int64(price) + count",
+		"name == 'widget' || name < 'a'",
+		"-count",
+		// 0 / 0 is NaN, which is unordered.
+		"(price - price) / (price - price) >= 0",
+		"(price - price) / (price - price) != (price - price) / (price - price)",
+	}
+)
+
+// TestGenerateGoMatchesVisitors generates functions for expressions, runs
+// them with the go tool, and compares their results with the visitors'.
+func TestGenerateGoMatchesVisitors(t *testing.T) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("the go tool isn't available")
+	}
+	dir, err := ioutil.TempDir("", "popgen")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var main strings.Builder
+	var expected []string
+	generate := func(i int, parser *ExpressionParser) {
+		source, err := parser.GenerateGo(GenerateOptions{Package: "main", Function: fmt.Sprintf("Rule%d", i)})
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", parser.tokenizer.text, err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("rule%d.go", i)), source, 0644); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+	// result formats a result the way the generated main prints it.
+	result := func(val interface{}, err error) string {
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return fmt.Sprintf("%v %v", typeOfKind(reflect.TypeOf(val).Kind()), val)
+	}
+	for i, expression := range shipmentExpressions {
+		parser, err := NewExpressionParserForStruct(expression, shipment{})
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", expression, err)
+		}
+		generate(i, parser)
+		for j := range shipments {
+			fmt.Fprintf(&main, "report(Rule%d(&shipments[%d]))\n", i, j)
+			expected = append(expected, expression+": "+result(parser.EvaluateStruct(&shipments[j])))
+		}
+	}
+	for i, expression := range schemaExpressions {
+		parser, err := NewExpressionParserWithSchema(expression, generateSchema)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", expression, err)
+		}
+		generate(len(shipmentExpressions)+i, parser)
+		for _, parameters := range generateParameters {
+			fmt.Fprintf(&main, "report(Rule%d(%#v, %#v, %#v, %#v, %#v))\n", len(shipmentExpressions)+i,
+				parameters["active"], parameters["count"], parameters["name"], parameters["price"], parameters["qty"])
+			expected = append(expected, expression+": "+result(parser.Evaluate(parameters)))
+		}
+	}
+	var records []string
+	for _, s := range shipments {
+		records = append(records, fmt.Sprintf("%#v", s))
+	}
+	program := fmt.Sprintf(`package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+%s
+var shipments = []shipment{%s}
+
+func report(val interface{}, err error) {
+	if err != nil {
+		fmt.Println("error: " + err.Error())
+		return
+	}
+	fmt.Printf("%%T %%v\n", val, val)
+}
+
+func main() {
+%s}
+`, shipmentSource, strings.Replace(strings.Join(records, ", "), "expr.", "", -1), main.String())
+	for name, contents := range map[string]string{"main.go": program, "go.mod": "module popgen\n\ngo 1.12\n"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+	cmd := exec.Command(goTool, "run", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GO111MODULE=on", "GOFLAGS=-mod=mod")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("running the generated code failed: %v\n%s", err, output)
+	}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d results but got %d:\n%s", len(expected), len(lines), output)
+	}
+	for i, line := range lines {
+		if want := expected[i]; !strings.HasSuffix(want, ": "+line) {
+			t.Fatalf("expected %s but the generated code produced %s", want, line)
+		}
+	}
+}
+
+func TestGenerateGo(t *testing.T) {
+	parser, err := NewExpressionParserForStruct("Insure(Weight) && Boxes / (Boxes - 2) > 1", shipment{})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	source, err := parser.GenerateGo(GenerateOptions{Function: "Insured", Environment: "Shipment"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	for _, expected := range []string{
+		"// Code generated by pop gen. DO NOT EDIT.\n\npackage expr\n\nimport \"errors\"\n",
+		"// Insured evaluates the expression\n//\n//\tInsure(Weight) && Boxes / (Boxes - 2) > 1\n",
+		"func Insured(env *Shipment) (bool, error) {\n",
+		"tmp1, err := env.Insure(env.Weight)\n",
+		"return false, errors.New(\"division by zero\")",
+	} {
+		if !strings.Contains(string(source), expected) {
+			t.Fatalf("expected the source to contain %q:\n%s", expected, source)
+		}
+	}
+}
+
+func TestGenerateGoErrors(t *testing.T) {
+	for _, test := range []struct {
+		expression string
+		schema     Schema
+		options    GenerateOptions
+		err        string
+	}{
+		{"price * 2", generateSchema, GenerateOptions{Function: "Rule"}, `"" isn't a valid package name`},
+		{"price * 2", generateSchema, GenerateOptions{Package: "rules"}, `"" isn't a valid function name`},
+		{"price * 2", generateSchema, GenerateOptions{Package: "rules", Function: "2x"}, `"2x" isn't a valid function name`},
+		{"price * 2", compileSchema, GenerateOptions{Package: "rules", Function: "Rule"}, "can't generate Go for the parameter discount of type *float64"},
+		{"env * 2", Schema{"env": reflect.TypeOf(0)}, GenerateOptions{Package: "rules", Function: "Rule"}, "the parameter env can't be named env in Go"},
+		{"qty / 0", generateSchema, GenerateOptions{Package: "rules", Function: "Rule"}, "can't generate Go for (qty / value(0)), which divides by zero"},
+		{"let x = qty * 2 in x + count", generateSchema, GenerateOptions{Package: "rules", Function: "Rule"}, "can't generate Go for "},
+	} {
+		parser, err := NewExpressionParserWithSchema(test.expression, test.schema)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if _, err := parser.GenerateGo(test.options); err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Fatalf("%s: expected error %q but got %v", test.expression, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,921 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+)
+
+// Compiling an expression resolves everything about it that doesn't depend
+// on the values it's evaluated with, such as which visitor evaluates each
+// node and how its operands convert, into a tree of closures. Nodes which
+// are known to produce non-null int, int64, float64 or bool values also
+// evaluate without boxing their values in interfaces, so numeric and boolean
+// expressions over declared parameters and environment fields evaluate
+// without allocating. Nodes which aren't compiled, such as statements and
+// lambdas, are evaluated by the visitors.
+
+// Program is a compiled expression, which evaluates with the same results
+// as visiting the expression. Programs are immutable, so many goroutines can
+// evaluate one concurrently, each with its own parameters or environment.
+type Program struct {
+	expression Expression
+	root       *compiled
+	// typ is the named type the type checker found for the result, if any.
+	typ         reflect.Type
+	environment *Environment
+	// parameters are used when Evaluate isn't given any.
+	parameters map[string]interface{}
+	// bound holds the names of the parameters whose values were bound when
+	// parsing, which can't be provided when evaluating.
+	bound map[string]bool
+	// slots is the number of shared subexpressions.
+	slots int
+	// assigns is set when the expression can assign to parameters.
+	assigns bool
+	// batch evaluates batches. It's compiled the first time one is.
+	batchOnce sync.Once
+	batch     batchNode
+	batchErr  error
+}
+
+// frame holds what a compiled expression is evaluated against. It's passed
+// by value, so evaluating doesn't allocate.
+type frame struct {
+	parameters  map[string]interface{}
+	environment reflect.Value
+	// shared is only set when the expression has shared subexpressions.
+	shared *sharedValues
+}
+
+// scope creates a root scope for evaluating a node with the visitors.
+func (f frame) scope() *Scope {
+	scope := NewScopeFromMap(f.parameters)
+	scope.environment = f.environment
+	scope.shared = f.shared
+	return scope
+}
+
+// compiled is a compiled node. value is always set; float, int and bool are
+// set when the node's value is known to be a non-null value of that kind,
+// and evaluate it without boxing.
+type compiled struct {
+	node  Expression
+	kind  reflect.Kind
+	value func(frame) (interface{}, error)
+	float func(frame) (float64, error)
+	int   func(frame) (int64, error)
+	bool  func(frame) (bool, error)
+}
+
+// Compile compiles an expression, which should have been type checked with
+// CheckTypes, into a Program.
+func Compile(expression Expression) (*Program, error) {
+	if expression == nil {
+		return nil, errInvalidExpression
+	}
+	root, err := compile(expression)
+	if err != nil {
+		return nil, err
+	}
+	return &Program{
+		expression: expression,
+		root:       root,
+		slots:      sharedSlots(expression),
+	}, nil
+}
+
+// Compile parses, type checks, optimizes and compiles the expression,
+// sharing its common subexpressions. The program evaluates with the same
+// results as Evaluate and EvaluateStruct.
+func (ep *ExpressionParser) Compile() (*Program, error) {
+	expression, typ, err := ep.optimize()
+	if err != nil {
+		return nil, err
+	}
+	program, err := Compile(expression)
+	if err != nil {
+		return nil, err
+	}
+	program.typ = typ
+	program.environment = ep.environment
+	program.parameters = ep.tokenizer.parameters
+	program.bound = ep.tokenizer.boundNames()
+	program.assigns = ep.tokenizer.statementMode()
+	return program, nil
+}
+
+// optimize parses, type checks and optimizes the expression for compiling,
+// returning the type of its result. Subexpressions are only shared when the
+// expression can't assign to anything.
+func (ep *ExpressionParser) optimize() (Expression, reflect.Type, error) {
+	expression, info, err := ep.Check()
+	if err != nil {
+		return nil, nil, err
+	}
+	optimized, err := Optimize(expression)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ep.tokenizer.allowsAssignment() {
+		if optimized, err = ShareSubexpressions(optimized); err != nil {
+			return nil, nil, err
+		}
+	}
+	return optimized, info.TypeOf(expression), nil
+}
+
+// Expression returns the expression the program was compiled from.
+func (p *Program) Expression() Expression {
+	return p.expression
+}
+
+// Evaluate evaluates the program with the provided parameters. As with
+// ExpressionParser.Evaluate, when they're nil the parameters the parser was
+// created with are used, and in StatementMode assignments to parameters are
+// written back to the map. Unlike the parser, a program assigns to a copy of
+// its parser's parameters, so that it can be evaluated concurrently. Values
+// of parameters which were bound when parsing are compiled into the program,
+// so providing them is an error.
+func (p *Program) Evaluate(parameters map[string]interface{}) (interface{}, error) {
+	if err := checkUnbound(p.bound, parameters); err != nil {
+		return nil, err
+	}
+	result, err := p.root.value(p.frame(parameters))
+	if err != nil {
+		return nil, err
+	}
+	return convertToNamedType(result, p.typ), nil
+}
+
+// EvaluateStruct evaluates the program against a value of the struct it was
+// compiled for, or a pointer to one.
+func (p *Program) EvaluateStruct(env interface{}) (interface{}, error) {
+	f, err := p.structFrame(env)
+	if err != nil {
+		return nil, err
+	}
+	result, err := p.root.value(f)
+	if err != nil {
+		return nil, err
+	}
+	return convertToNamedType(result, p.typ), nil
+}
+
+// EvaluateBool evaluates a program which produces a bool, such as a rule.
+func (p *Program) EvaluateBool(parameters map[string]interface{}) (bool, error) {
+	if err := checkUnbound(p.bound, parameters); err != nil {
+		return false, err
+	}
+	return p.root.asBool()(p.frame(parameters))
+}
+
+// EvaluateStructBool evaluates a program which produces a bool against a
+// value of the struct it was compiled for, or a pointer to one.
+func (p *Program) EvaluateStructBool(env interface{}) (bool, error) {
+	f, err := p.structFrame(env)
+	if err != nil {
+		return false, err
+	}
+	return p.root.asBool()(f)
+}
+
+// EvaluateFloat64 evaluates a program which produces a number, converting
+// it to a float64.
+func (p *Program) EvaluateFloat64(parameters map[string]interface{}) (float64, error) {
+	if err := checkUnbound(p.bound, parameters); err != nil {
+		return 0, err
+	}
+	return p.root.asFloat()(p.frame(parameters))
+}
+
+func (p *Program) frame(parameters map[string]interface{}) frame {
+	if parameters == nil {
+		parameters = p.parameters
+		if p.assigns {
+			parameters = make(map[string]interface{}, len(p.parameters))
+			for name, val := range p.parameters {
+				parameters[name] = val
+			}
+		}
+	}
+	f := frame{parameters: parameters}
+	if p.slots > 0 {
+		f.shared = newSharedValues(p.slots)
+	}
+	return f
+}
+
+func (p *Program) structFrame(env interface{}) (frame, error) {
+	if p.environment == nil {
+		return frame{}, errNoEnvironment
+	}
+	v, err := p.environment.value(env)
+	if err != nil {
+		return frame{}, err
+	}
+	f := frame{environment: v}
+	if p.slots > 0 {
+		f.shared = newSharedValues(p.slots)
+	}
+	return f, nil
+}
+
+// compile compiles a node and its operands.
+func compile(node Expression) (*compiled, error) {
+	c, err := compileNode(node)
+	if err != nil {
+		return nil, err
+	}
+	c.node = node
+	return c, nil
+}
+
+func compileNode(node Expression) (*compiled, error) {
+	switch e := node.(type) {
+	case *ConstantExpression:
+		return compileConstant(e), nil
+	case *ParameterExpression:
+		return compileParameter(e), nil
+	case *FieldExpression:
+		return compileField(e), nil
+	case *BinaryExpression:
+		return compileBinary(e)
+	case *UnaryExpression:
+		return compileUnary(e)
+	case *ConditionalExpression:
+		return compileConditional(e)
+	case *SharedExpression:
+		return compileShared(e)
+	case *ConvertExpression:
+		operand, err := compile(e.operand)
+		if err != nil {
+			return nil, err
+		}
+		return compileGeneric(e.Kind(), func(f frame) (interface{}, error) {
+			val, err := operand.value(f)
+			if err != nil {
+				return nil, err
+			}
+			return evaluateConvert(e, val)
+		}), nil
+	}
+	if node.Type() == UnknownExpr {
+		return nil, errors.New("unable to compile unknown expression")
+	}
+	return compileVisited(node), nil
+}
+
+// compileVisited compiles a node which is evaluated by its visitor.
+func compileVisited(node Expression) *compiled {
+	return compileGeneric(node.Kind(), func(f frame) (interface{}, error) {
+		return visitExpression(node, f.scope())
+	})
+}
+
+// compileGeneric compiles a node whose value is always boxed.
+func compileGeneric(kind reflect.Kind, value func(frame) (interface{}, error)) *compiled {
+	return &compiled{
+		kind:  kind,
+		value: value,
+	}
+}
+
+// compileFloat compiles a node producing a float64.
+func compileFloat(fn func(frame) (float64, error)) *compiled {
+	return &compiled{
+		kind:  reflect.Float64,
+		float: fn,
+		value: func(f frame) (interface{}, error) {
+			x, err := fn(f)
+			if err != nil {
+				return nil, err
+			}
+			return x, nil
+		},
+	}
+}
+
+// compileInt compiles a node producing an int or an int64, which is boxed
+// as a value of that kind.
+func compileInt(kind reflect.Kind, fn func(frame) (int64, error)) *compiled {
+	c := &compiled{
+		kind: kind,
+		int:  fn,
+	}
+	c.value = func(f frame) (interface{}, error) {
+		x, err := fn(f)
+		if err != nil {
+			return nil, err
+		}
+		if kind == reflect.Int64 {
+			return x, nil
+		}
+		return int(x), nil
+	}
+	return c
+}
+
+// compileBool compiles a node producing a bool.
+func compileBool(fn func(frame) (bool, error)) *compiled {
+	return &compiled{
+		kind: reflect.Bool,
+		bool: fn,
+		value: func(f frame) (interface{}, error) {
+			b, err := fn(f)
+			if err != nil {
+				return nil, err
+			}
+			return b, nil
+		},
+	}
+}
+
+// isTyped determines whether or not values of typ can be evaluated unboxed
+// as values of kind. Named types are boxed, so they keep their types.
+func isTyped(typ reflect.Type, kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int64, reflect.Float64, reflect.Bool:
+		return typ != nil && typ == typeOfKind(kind)
+	}
+	return false
+}
+
+// compileConstant compiles a constant, whose value is boxed once. Numeric
+// constants of basic types, such as untyped literals, also evaluate unboxed,
+// so they combine with typed operands without boxing them.
+func compileConstant(e *ConstantExpression) *compiled {
+	value := e.value
+	c := compileGeneric(e.Kind(), nil)
+	if e.typ == nil && value != nil && !isNamed(reflect.TypeOf(value)) {
+		switch v := reflect.ValueOf(value); {
+		case v.Kind() == reflect.Bool:
+			b := v.Bool()
+			c = compileBool(func(frame) (bool, error) { return b, nil })
+		case isFloatKind(v.Kind()):
+			x := v.Float()
+			c = compileFloat(func(frame) (float64, error) { return x, nil })
+		case IsUnsigned(v.Kind()) && v.Uint() <= math.MaxInt64:
+			x := int64(v.Uint())
+			c = compileInt(e.Kind(), func(frame) (int64, error) { return x, nil })
+		case IsInteger(v.Kind()) && !IsUnsigned(v.Kind()):
+			x := v.Int()
+			c = compileInt(e.Kind(), func(frame) (int64, error) { return x, nil })
+		}
+	}
+	c.kind = e.Kind()
+	c.value = func(frame) (interface{}, error) {
+		return value, nil
+	}
+	return c
+}
+
+// compileParameter compiles a parameter, which is read from the parameters
+// the program is evaluated with. Values of exactly the parameter's type are
+// read without converting them.
+func compileParameter(e *ParameterExpression) *compiled {
+	name := e.name
+	lookup := func(f frame) (interface{}, error) {
+		val, ok := f.parameters[name]
+		if !ok {
+			return nil, fmt.Errorf("unbound parameter: %s", name)
+		}
+		return evaluateParameter(e, val)
+	}
+	if !isTyped(e.typ, e.Kind()) {
+		return compileGeneric(e.Kind(), lookup)
+	}
+	switch e.Kind() {
+	case reflect.Float64:
+		return compileFloat(func(f frame) (float64, error) {
+			if x, ok := f.parameters[name].(float64); ok {
+				return x, nil
+			}
+			val, err := lookup(f)
+			if err != nil {
+				return 0, err
+			}
+			return val.(float64), nil
+		})
+	case reflect.Bool:
+		return compileBool(func(f frame) (bool, error) {
+			if b, ok := f.parameters[name].(bool); ok {
+				return b, nil
+			}
+			val, err := lookup(f)
+			if err != nil {
+				return false, err
+			}
+			return val.(bool), nil
+		})
+	case reflect.Int64:
+		return compileInt(reflect.Int64, func(f frame) (int64, error) {
+			if x, ok := f.parameters[name].(int64); ok {
+				return x, nil
+			}
+			val, err := lookup(f)
+			if err != nil {
+				return 0, err
+			}
+			return val.(int64), nil
+		})
+	}
+	return compileInt(reflect.Int, func(f frame) (int64, error) {
+		if x, ok := f.parameters[name].(int); ok {
+			return int64(x), nil
+		}
+		val, err := lookup(f)
+		if err != nil {
+			return 0, err
+		}
+		return int64(val.(int)), nil
+	})
+}
+
+// compileShared compiles a shared subexpression, whose value is stored the
+// first time it's evaluated. Values are stored boxed.
+func compileShared(e *SharedExpression) (*compiled, error) {
+	operand, err := compile(e.operand)
+	if err != nil {
+		return nil, err
+	}
+	slot := e.slot
+	value := func(f frame) (interface{}, error) {
+		if val, ok := f.shared.get(slot); ok {
+			return val, nil
+		}
+		val, err := operand.value(f)
+		if err != nil {
+			return nil, err
+		}
+		f.shared.set(slot, val)
+		return val, nil
+	}
+	c := compileGeneric(operand.kind, value)
+	switch {
+	case operand.float != nil:
+		c = compileFloat(func(f frame) (float64, error) {
+			val, err := value(f)
+			if err != nil {
+				return 0, err
+			}
+			return val.(float64), nil
+		})
+	case operand.bool != nil:
+		c = compileBool(func(f frame) (bool, error) {
+			val, err := value(f)
+			if err != nil {
+				return false, err
+			}
+			return val.(bool), nil
+		})
+	case operand.int != nil:
+		c = compileInt(operand.kind, func(f frame) (int64, error) {
+			val, err := value(f)
+			if err != nil {
+				return 0, err
+			}
+			// Only constants produce unboxed ints of other kinds, and they
+			// aren't shared.
+			if x, ok := val.(int); ok {
+				return int64(x), nil
+			}
+			return val.(int64), nil
+		})
+	}
+	c.value = value
+	return c, nil
+}
+
+// compileField compiles a field of the environment.
+func compileField(e *FieldExpression) *compiled {
+	if !isTyped(e.typ, e.Kind()) {
+		return compileGeneric(e.Kind(), func(f frame) (interface{}, error) {
+			field, err := fieldOf(f.environment, e)
+			if err != nil {
+				return nil, err
+			}
+			return unwrapNullable(normalizeValue(field.Interface())), nil
+		})
+	}
+	switch e.Kind() {
+	case reflect.Float64:
+		return compileFloat(func(f frame) (float64, error) {
+			field, err := fieldOf(f.environment, e)
+			if err != nil {
+				return 0, err
+			}
+			return field.Float(), nil
+		})
+	case reflect.Bool:
+		return compileBool(func(f frame) (bool, error) {
+			field, err := fieldOf(f.environment, e)
+			if err != nil {
+				return false, err
+			}
+			return field.Bool(), nil
+		})
+	}
+	return compileInt(e.Kind(), func(f frame) (int64, error) {
+		field, err := fieldOf(f.environment, e)
+		if err != nil {
+			return 0, err
+		}
+		return field.Int(), nil
+	})
+}
+
+func compileBinary(e *BinaryExpression) (*compiled, error) {
+	if IsAssignment(e.Type()) {
+		return compileVisited(e), nil
+	}
+	left, err := compile(e.left)
+	if err != nil {
+		return nil, err
+	}
+	right, err := compile(e.right)
+	if err != nil {
+		return nil, err
+	}
+	if e.operator == nil {
+		switch e.Type() {
+		case AndAlsoExpr, OrElseExpr:
+			return compileLogical(e, left, right), nil
+		case AddExpr, SubtractExpr, MultiplyExpr, DivideExpr, ModuloExpr:
+			if c := compileArithmetic(e.Type(), e.Kind(), left, right); c != nil {
+				return c, nil
+			}
+		case LessThanExpr, LessThanOrEqualExpr, GreaterThanExpr, GreaterThanOrEqualExpr:
+			return compileComparison(e.Type(), left, right), nil
+		case EqualExpr, NotEqualExpr:
+			return compileEquality(e.Type() == NotEqualExpr, left, right), nil
+		}
+	}
+	return compileGeneric(e.Kind(), func(f frame) (interface{}, error) {
+		lVal, err := left.value(f)
+		if err != nil {
+			return nil, err
+		}
+		rVal, err := right.value(f)
+		if err != nil {
+			return nil, err
+		}
+		return evaluateBinary(e, lVal, rVal)
+	}), nil
+}
+
+// compileLogical compiles && and ||, which only evaluate the right operand
+// when the left one doesn't decide the result.
+func compileLogical(e *BinaryExpression, left *compiled, right *compiled) *compiled {
+	l, r := left.asBool(), right.asBool()
+	if e.Type() == OrElseExpr {
+		return compileBool(func(f frame) (bool, error) {
+			b, err := l(f)
+			if err != nil || b {
+				return b, err
+			}
+			return r(f)
+		})
+	}
+	return compileBool(func(f frame) (bool, error) {
+		b, err := l(f)
+		if err != nil || !b {
+			return b, err
+		}
+		return r(f)
+	})
+}
+
+// compileArithmetic compiles arithmetic on typed operands producing
+// a typed result. It returns nil for anything else, which is evaluated like
+// the visitors evaluate it.
+func compileArithmetic(nodeType ExpressionType, kind reflect.Kind, left *compiled, right *compiled) *compiled {
+	if !left.isNumber() || !right.isNumber() || !isNumberKind(kind) {
+		return nil
+	}
+	if kind == reflect.Float64 || left.int == nil || right.int == nil {
+		l, r := left.asFloat(), right.asFloat()
+		fn := func(f frame) (float64, error) {
+			x, err := l(f)
+			if err != nil {
+				return 0, err
+			}
+			y, err := r(f)
+			if err != nil {
+				return 0, err
+			}
+			switch nodeType {
+			case AddExpr:
+				return x + y, nil
+			case SubtractExpr:
+				return x - y, nil
+			case MultiplyExpr:
+				return x * y, nil
+			case DivideExpr:
+				return x / y, nil
+			}
+			return math.Mod(x, y), nil
+		}
+		if kind == reflect.Float64 {
+			return compileFloat(fn)
+		}
+		return compileInt(kind, func(f frame) (int64, error) {
+			x, err := fn(f)
+			return int64(x), err
+		})
+	}
+	l, r := left.int, right.int
+	return compileInt(kind, func(f frame) (int64, error) {
+		x, err := l(f)
+		if err != nil {
+			return 0, err
+		}
+		y, err := r(f)
+		if err != nil {
+			return 0, err
+		}
+		switch nodeType {
+		case AddExpr:
+			return x + y, nil
+		case SubtractExpr:
+			return x - y, nil
+		case MultiplyExpr:
+			return x * y, nil
+		}
+		if y == 0 {
+			return 0, errDivideByZero
+		}
+		if nodeType == DivideExpr {
+			return x / y, nil
+		}
+		return x % y, nil
+	})
+}
+
+// compileComparison compiles <, <=, > and >=.
+func compileComparison(nodeType ExpressionType, left *compiled, right *compiled) *compiled {
+	if !left.isNumber() || !right.isNumber() {
+		return compileBool(func(f frame) (bool, error) {
+			lVal, err := left.value(f)
+			if err != nil {
+				return false, err
+			}
+			rVal, err := right.value(f)
+			if err != nil {
+				return false, err
+			}
+			return evaluateComparison(nodeType, lVal, rVal)
+		})
+	}
+	compare := compileCompare(left, right)
+	return compileBool(func(f frame) (bool, error) {
+		c, err := compare(f)
+		if err != nil {
+			return false, err
+		}
+		return comparisonHolds(nodeType, c), nil
+	})
+}
+
+// compileEquality compiles == and, when negate is set, !=.
+func compileEquality(negate bool, left *compiled, right *compiled) *compiled {
+	switch {
+	case left.isNumber() && right.isNumber():
+		compare := compileCompare(left, right)
+		return compileBool(func(f frame) (bool, error) {
+			c, err := compare(f)
+			return (c == 0) != negate, err
+		})
+	case left.bool != nil && right.bool != nil:
+		l, r := left.bool, right.bool
+		return compileBool(func(f frame) (bool, error) {
+			x, err := l(f)
+			if err != nil {
+				return false, err
+			}
+			y, err := r(f)
+			return (x == y) != negate, err
+		})
+	}
+	return compileBool(func(f frame) (bool, error) {
+		lVal, err := left.value(f)
+		if err != nil {
+			return false, err
+		}
+		rVal, err := right.value(f)
+		if err != nil {
+			return false, err
+		}
+		return valuesEqual(lVal, rVal) != negate, nil
+	})
+}
+
+// compileCompare compiles the comparison of two typed numbers, returning
+// -1, 0, 1 or unordered like compareValues. Integers are compared as
+// integers, and anything else as floats.
+func compileCompare(left *compiled, right *compiled) func(frame) (int, error) {
+	if left.int != nil && right.int != nil {
+		l, r := left.int, right.int
+		return func(f frame) (int, error) {
+			x, err := l(f)
+			if err != nil {
+				return 0, err
+			}
+			y, err := r(f)
+			if err != nil {
+				return 0, err
+			}
+			switch {
+			case x < y:
+				return -1, nil
+			case x > y:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	l, r := left.asFloat(), right.asFloat()
+	return func(f frame) (int, error) {
+		x, err := l(f)
+		if err != nil {
+			return 0, err
+		}
+		y, err := r(f)
+		if err != nil {
+			return 0, err
+		}
+		return compareFloats(x, y), nil
+	}
+}
+
+func compileUnary(e *UnaryExpression) (*compiled, error) {
+	switch e.Type() {
+	case NegateExpr, UnaryPlusExpr, NotExpr:
+	default:
+		return compileVisited(e), nil
+	}
+	operand, err := compile(e.operand)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case e.operator != nil:
+	case e.Type() == NotExpr && operand.bool != nil:
+		b := operand.bool
+		return compileBool(func(f frame) (bool, error) {
+			x, err := b(f)
+			return !x, err
+		}), nil
+	case e.Kind() == reflect.Float64 && operand.float != nil:
+		x := operand.float
+		if e.Type() == UnaryPlusExpr {
+			return compileFloat(x), nil
+		}
+		return compileFloat(func(f frame) (float64, error) {
+			y, err := x(f)
+			return -y, err
+		}), nil
+	case isNumberKind(e.Kind()) && e.Kind() == operand.kind && operand.int != nil:
+		x := operand.int
+		if e.Type() == UnaryPlusExpr {
+			return compileInt(e.Kind(), x), nil
+		}
+		return compileInt(e.Kind(), func(f frame) (int64, error) {
+			y, err := x(f)
+			return -y, err
+		}), nil
+	}
+	return compileGeneric(e.Kind(), func(f frame) (interface{}, error) {
+		val, err := operand.value(f)
+		if err != nil {
+			return nil, err
+		}
+		return evaluateUnary(e, val)
+	}), nil
+}
+
+func compileConditional(e *ConditionalExpression) (*compiled, error) {
+	test, err := compile(e.test)
+	if err != nil {
+		return nil, err
+	}
+	ifTrue, err := compile(e.ifTrue)
+	if err != nil {
+		return nil, err
+	}
+	ifFalse, err := compile(e.ifFalse)
+	if err != nil {
+		return nil, err
+	}
+	cond := test.asBool()
+	switch kind := e.Kind(); {
+	case kind == reflect.Float64 && ifTrue.isNumber() && ifFalse.isNumber():
+		t, u := ifTrue.asFloat(), ifFalse.asFloat()
+		return compileFloat(func(f frame) (float64, error) {
+			b, err := cond(f)
+			if err != nil {
+				return 0, err
+			}
+			if b {
+				return t(f)
+			}
+			return u(f)
+		}), nil
+	case kind == reflect.Bool && ifTrue.bool != nil && ifFalse.bool != nil:
+		t, u := ifTrue.bool, ifFalse.bool
+		return compileBool(func(f frame) (bool, error) {
+			b, err := cond(f)
+			if err != nil {
+				return false, err
+			}
+			if b {
+				return t(f)
+			}
+			return u(f)
+		}), nil
+	case isNumberKind(kind) && ifTrue.int != nil && ifFalse.int != nil:
+		t, u := ifTrue.int, ifFalse.int
+		return compileInt(kind, func(f frame) (int64, error) {
+			b, err := cond(f)
+			if err != nil {
+				return 0, err
+			}
+			if b {
+				return t(f)
+			}
+			return u(f)
+		}), nil
+	}
+	return compileGeneric(e.Kind(), func(f frame) (interface{}, error) {
+		b, err := cond(f)
+		if err != nil {
+			return nil, err
+		}
+		branch := ifFalse
+		if b {
+			branch = ifTrue
+		}
+		val, err := branch.value(f)
+		if err != nil {
+			return nil, err
+		}
+		return convertToKind(val, e.Kind())
+	}), nil
+}
+
+// isNumberKind determines whether or not values of a kind are evaluated as
+// unboxed numbers.
+func isNumberKind(kind reflect.Kind) bool {
+	return kind == reflect.Int || kind == reflect.Int64 || kind == reflect.Float64
+}
+
+// isNumber determines whether or not the node evaluates to an unboxed
+// number.
+func (c *compiled) isNumber() bool {
+	return c.float != nil || c.int != nil
+}
+
+// asBool returns a function evaluating the node as a bool, which fails for
+// values of any other type.
+func (c *compiled) asBool() func(frame) (bool, error) {
+	if c.bool != nil {
+		return c.bool
+	}
+	return func(f frame) (bool, error) {
+		val, err := c.value(f)
+		if err != nil {
+			return false, err
+		}
+		b, ok := val.(bool)
+		if !ok {
+			return false, fmt.Errorf("expected a bool but got %T: %v", val, c.node)
+		}
+		return b, nil
+	}
+}
+
+// asFloat returns a function evaluating the node as a float64, which fails
+// for values which aren't numbers.
+func (c *compiled) asFloat() func(frame) (float64, error) {
+	switch {
+	case c.float != nil:
+		return c.float
+	case c.int != nil:
+		return func(f frame) (float64, error) {
+			x, err := c.int(f)
+			return float64(x), err
+		}
+	}
+	return func(f frame) (float64, error) {
+		val, err := c.value(f)
+		if err != nil {
+			return 0, err
+		}
+		if val == nil {
+			return 0, errors.New("expected a number but got null")
+		}
+		return convertToFloat64(val)
+	}
+}
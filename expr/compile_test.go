@@ -0,0 +1,352 @@
+package expr
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+var compileSchema = Schema{
+	"price":    reflect.TypeOf(float64(0)),
+	"qty":      reflect.TypeOf(0),
+	"count":    reflect.TypeOf(int64(0)),
+	"active":   reflect.TypeOf(false),
+	"name":     reflect.TypeOf(""),
+	"discount": reflect.TypeOf((*float64)(nil)),
+	"indoor":   reflect.TypeOf(celsius(0)),
+	"tags":     reflect.TypeOf([]string(nil)),
+}
+
+func TestCompileMatchesVisitors(t *testing.T) {
+	half := 0.5
+	parameters := []map[string]interface{}{
+		{"price": 12.5, "qty": 3, "count": int64(7), "active": true, "name": "widget", "discount": &half, "indoor": celsius(21), "tags": []string{"a", "b"}},
+		{"price": 1.5, "qty": 0, "count": int64(-2), "active": false, "name": "", "discount": (*float64)(nil), "indoor": celsius(-4), "tags": []string{}},
+		// Values of other types are converted like the visitors convert them.
+		{"price": 4, "qty": int64(2), "count": 9, "active": true, "name": "gadget", "discount": 0.25, "indoor": 18.5, "tags": []string{"b"}},
+	}
+	for _, expression := range []string{
+		"price * qty > 30 && active",
+		"price * qty",
+		"qty + count",
+		"count / qty",
+		"count % qty",
+		"qty / 2",
+		"price / qty",
+		"-price + +qty",
+		"-count",
+		"!active || qty == 3",
+		"price == qty",
+		"price != 12.5",
+		"active == true",
+		"name == 'widget'",
+		"qty >= count ? price : qty",
+		"active ? 1 : 2",
+		"active ? count : qty",
+		"discount * price",
+		"discount > 0.1",
+		"discount == null",
+		"indoor + 1.5",
+		"indoor > 20",
+		"'b' in tags",
+		"tags[0]",
+		"int64(price) + count",
+		"let x = qty * 2 in x + count",
+		"def twice(x) = x * 2; twice(price)",
+		"qty switch { 3 => 'three', _ => 'other' }",
+		"price is float64",
+	} {
+		for _, values := range parameters {
+			parser, err := NewExpressionParserWithSchema(expression, compileSchema)
+			if err != nil {
+				t.Fatalf("%s: unexpected err: %v", expression, err)
+			}
+			expected, expectedErr := parser.Evaluate(values)
+			program, err := parser.Compile()
+			if err != nil {
+				t.Fatalf("%s: unexpected err: %v", expression, err)
+			}
+			actual, err := program.Evaluate(values)
+			if (err == nil) != (expectedErr == nil) || (err != nil && err.Error() != expectedErr.Error()) {
+				t.Fatalf("%s with %v: expected error %v but got %v", expression, values, expectedErr, err)
+			}
+			if !reflect.DeepEqual(actual, expected) {
+				t.Fatalf("%s with %v: expected %v (%T) but got %v (%T)", expression, values, expected, expected, actual, actual)
+			}
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, test := range []struct {
+		expression string
+		parameters map[string]interface{}
+		expected   string
+	}{
+		{"count / qty", map[string]interface{}{"count": int64(1), "qty": 0}, "division by zero"},
+		{"price > 1", map[string]interface{}{}, "unbound parameter: price"},
+		{"qty + 1", map[string]interface{}{"qty": "three"}, "parameter qty: can't assign string to int"},
+	} {
+		parser, err := NewExpressionParserWithSchema(test.expression, compileSchema)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		program, err := parser.Compile()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if _, err := program.Evaluate(test.parameters); err == nil || err.Error() != test.expected {
+			t.Fatalf("%s: expected error %q but got %v", test.expression, test.expected, err)
+		}
+	}
+	if _, err := Compile(nil); err == nil {
+		t.Fatalf("expected compiling nil to fail")
+	}
+}
+
+func TestCompileStruct(t *testing.T) {
+	parser, err := NewExpressionParserForStruct("amount * 2 > 50 && ItemCount() > 1 && Account.Tier >= 2", request{})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	program, err := parser.Compile()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	for _, test := range []struct {
+		env      request
+		expected bool
+	}{
+		{request{Total: 30, Items: []string{"a", "b"}, Account: member{Tier: 2}}, true},
+		{request{Total: 20, Items: []string{"a", "b"}, Account: member{Tier: 2}}, false},
+		{request{Total: 30, Items: []string{"a"}, Account: member{Tier: 3}}, false},
+	} {
+		actual, err := program.EvaluateStructBool(test.env)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if actual != test.expected {
+			t.Fatalf("%+v: expected %v but got %v", test.env, test.expected, actual)
+		}
+		result, err := program.EvaluateStruct(&test.env)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if result != test.expected {
+			t.Fatalf("%+v: expected %v but got %v", test.env, test.expected, result)
+		}
+	}
+	if _, err := program.EvaluateStructBool(1); err == nil {
+		t.Fatalf("expected evaluating against an int to fail")
+	}
+}
+
+func TestCompileStatements(t *testing.T) {
+	parser, err := NewExpressionParser("count += step", map[string]interface{}{"count": 0, "step": 0})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	parser.SetMode(StatementMode)
+	program, err := parser.Compile()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	env := map[string]interface{}{"count": 1, "step": 2}
+	for i := 0; i < 3; i++ {
+		if _, err := program.Evaluate(env); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+	if env["count"] != 7 {
+		t.Fatalf("expected %v but got %v", 7, env["count"])
+	}
+}
+
+func TestCompileBoundValues(t *testing.T) {
+	parser, err := NewExpressionParser("price * qty", map[string]interface{}{"price": 2.5, "qty": 4})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if err := parser.Declare("qty", reflect.TypeOf(0)); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	program, err := parser.Compile()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	bytecode, err := parser.CompileBytecode()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	// qty is declared, so it's read when evaluating, but price is compiled in.
+	for _, evaluate := range []func(map[string]interface{}) (interface{}, error){program.Evaluate, bytecode.Evaluate} {
+		if actual, err := evaluate(map[string]interface{}{"qty": 2}); err != nil || actual != 5.0 {
+			t.Fatalf("expected 5 but got %v, %v", actual, err)
+		}
+		expected := "parameter price was bound by value when parsing, so it can't be provided when evaluating; declare it to provide it then"
+		if _, err := evaluate(map[string]interface{}{"price": 1.0, "qty": 2}); err == nil || err.Error() != expected {
+			t.Fatalf("expected %q but got %v", expected, err)
+		}
+	}
+	if _, err := program.EvaluateBatch(map[string]*Column{"price": NewFloat64Column([]float64{1}, nil)}); err == nil {
+		t.Fatalf("expected an error for a column of a bound parameter")
+	}
+}
+
+func TestCompileDoesNotAllocate(t *testing.T) {
+	parameters := map[string]interface{}{"price": 12.5, "qty": 3, "count": int64(7), "active": true}
+	for _, test := range []struct {
+		expression string
+		evaluate   func(*Program) error
+	}{
+		{"price * qty > 30 && active || count % 2 == 0", func(p *Program) error {
+			_, err := p.EvaluateBool(parameters)
+			return err
+		}},
+		{"(price - 2.5) * (qty + count) / 4", func(p *Program) error {
+			_, err := p.EvaluateFloat64(parameters)
+			return err
+		}},
+		{"active ? price * 2 : -price", func(p *Program) error {
+			_, err := p.EvaluateFloat64(parameters)
+			return err
+		}},
+	} {
+		parser, err := NewExpressionParserWithSchema(test.expression, compileSchema)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		program, err := parser.Compile()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		allocs := testing.AllocsPerRun(100, func() {
+			if err := test.evaluate(program); err != nil {
+				t.Fatalf("%s: unexpected err: %v", test.expression, err)
+			}
+		})
+		if allocs != 0 {
+			t.Fatalf("%s: expected no allocations but got %v", test.expression, allocs)
+		}
+	}
+}
+
+const benchmarkRule = "price * qty > 30 && active || count % 2 == 0"
+
+var benchmarkParameters = map[string]interface{}{"price": 12.5, "qty": 3, "count": int64(7), "active": true}
+
+func BenchmarkVisitRule(b *testing.B) {
+	parser, err := NewExpressionParserWithSchema(benchmarkRule, compileSchema)
+	if err != nil {
+		b.Fatalf("unexpected err: %v", err)
+	}
+	expression, _, err := parser.Check()
+	if err != nil {
+		b.Fatalf("unexpected err: %v", err)
+	}
+	scope := NewScopeFromMap(benchmarkParameters)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := visitExpression(expression, scope); err != nil {
+			b.Fatalf("unexpected err: %v", err)
+		}
+	}
+}
+
+func BenchmarkCompiledRule(b *testing.B) {
+	parser, err := NewExpressionParserWithSchema(benchmarkRule, compileSchema)
+	if err != nil {
+		b.Fatalf("unexpected err: %v", err)
+	}
+	program, err := parser.Compile()
+	if err != nil {
+		b.Fatalf("unexpected err: %v", err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := program.EvaluateBool(benchmarkParameters); err != nil {
+			b.Fatalf("unexpected err: %v", err)
+		}
+	}
+}
+
+// TestNaNComparisons checks that NaN is unordered on every back end: only
+// != holds for it, as in Go.
+func TestNaNComparisons(t *testing.T) {
+	schema := Schema{"price": reflect.TypeOf(float64(0)), "qty": reflect.TypeOf(0)}
+	values := map[string]interface{}{"price": math.NaN(), "qty": 5}
+	columns := map[string]*Column{
+		"price": NewFloat64Column([]float64{math.NaN()}, nil),
+		"qty":   NewInt64Column([]int64{5}, nil),
+	}
+	for _, test := range []struct {
+		expression string
+		expected   bool
+	}{
+		{"price == 5", false},
+		{"price != 5", true},
+		{"price < 5", false},
+		{"price <= 5", false},
+		{"price > 5", false},
+		{"price >= 5", false},
+		{"price == price", false},
+		{"price != price", true},
+		{"price >= qty", false},
+		{"price <= qty", false},
+		{"qty > price || qty < price || qty == price", false},
+	} {
+		parser, err := NewExpressionParserWithSchema(test.expression, schema)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		check := func(backEnd string, actual interface{}, err error) {
+			if err != nil {
+				t.Fatalf("%s: unexpected err from the %s: %v", test.expression, backEnd, err)
+			}
+			if actual != test.expected {
+				t.Fatalf("%s: expected the %s to return %v but got %v", test.expression, backEnd, test.expected, actual)
+			}
+		}
+		actual, err := parser.Evaluate(values)
+		check("visitors", actual, err)
+		program, err := parser.Compile()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		actual, err = program.Evaluate(values)
+		check("program", actual, err)
+		bytecode, err := parser.CompileBytecode()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		actual, err = bytecode.Evaluate(values)
+		check("bytecode", actual, err)
+		incremental, err := parser.CompileIncremental()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		actual, err = incremental.Evaluate(values)
+		check("incremental evaluator", actual, err)
+		column, err := program.EvaluateBatch(columns)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		check("batch", column.Value(0), nil)
+	}
+	// Ranges and patterns can't be compiled to bytecode.
+	for _, expression := range []string{
+		"price in 1.. || price in ..1",
+		"price switch { < 5 => true, <= 5 => true, _ => false }",
+		"price switch { < 5 => true, >= 5 => true, _ => false }",
+	} {
+		parser, err := NewExpressionParserWithSchema(expression, schema)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", expression, err)
+		}
+		if actual, err := parser.Evaluate(values); err != nil || actual != false {
+			t.Fatalf("%s: expected false but got %v, %v", expression, actual, err)
+		}
+	}
+}
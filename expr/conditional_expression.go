@@ -0,0 +1,70 @@
+package expr
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// ConditionalExpression is the ternary test ? ifTrue : ifFalse. Only the
+// selected branch is evaluated.
+type ConditionalExpression struct {
+	self    *AbstractExpression
+	test    Expression
+	ifTrue  Expression
+	ifFalse Expression
+}
+
+func NewConditionalExpression(test Expression, ifTrue Expression, ifFalse Expression, kind reflect.Kind) *ConditionalExpression {
+	return &ConditionalExpression{
+		self: &AbstractExpression{
+			nodeType: ConditionalExpr,
+			kind:     kind,
+		},
+		test:    test,
+		ifTrue:  ifTrue,
+		ifFalse: ifFalse,
+	}
+}
+
+func (e *ConditionalExpression) Test() Expression {
+	return e.test
+}
+
+func (e *ConditionalExpression) IfTrue() Expression {
+	return e.ifTrue
+}
+
+func (e *ConditionalExpression) IfFalse() Expression {
+	return e.ifFalse
+}
+
+func (e *ConditionalExpression) Kind() reflect.Kind {
+	return e.self.kind
+}
+
+func (e *ConditionalExpression) Type() ExpressionType {
+	return e.self.nodeType
+}
+
+func (e *ConditionalExpression) NodeType() string {
+	return "ConditionalExpression"
+}
+
+func (e *ConditionalExpression) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("(%v ? %v : %v)", e.test, e.ifTrue, e.ifFalse)
+}
+
+// CreateConditional creates test ? ifTrue : ifFalse. The result has the
+// common kind of both branches.
+func CreateConditional(test Expression, ifTrue Expression, ifFalse Expression) (Expression, error) {
+	if test == nil || ifTrue == nil || ifFalse == nil {
+		return nil, errInvalidExpression
+	}
+	if !isBoolOrUnknown(test.Kind()) {
+		return nil, fmt.Errorf("the condition of ?: must be a bool, got %v", test.Kind())
+	}
+	return NewConditionalExpression(test, ifTrue, ifFalse, commonKind(ifTrue.Kind(), ifFalse.Kind())), nil
+}
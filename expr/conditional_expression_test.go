@@ -0,0 +1,46 @@
+package expr
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConditionalEvaluation(t *testing.T) {
+	parameters := map[string]interface{}{
+		"amount": 150.0,
+		"qty":    3,
+		"items":  []int{1, 2, 3},
+	}
+	for _, test := range []struct {
+		expression string
+		expected   interface{}
+	}{
+		{"amount > 100 ? 'large' : 'small'", "large"},
+		{"qty > 5 ? 1 : 2.5", 2.5},
+		{"qty > 1 ? 1 : 2.5", 1.0},
+		{"qty > 5 ? 1 : qty > 2 ? 2 : 3", 2},
+		{"qty < 5 ? 0 : items[10]", 0},
+	} {
+		parser, err := NewExpressionParser(test.expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		actual, err := parser.Evaluate(nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Fatalf("%s: expected %v (%T) but got %v (%T)", test.expression, test.expected, test.expected, actual, actual)
+		}
+	}
+}
+
+func TestConditionalRequiresBool(t *testing.T) {
+	parser, err := NewExpressionParser("qty ? 1 : 2", map[string]interface{}{"qty": 3})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := parser.ParseExpression(); err == nil {
+		t.Fatalf("expected a non-bool condition to fail")
+	}
+}
@@ -8,6 +8,12 @@ import (
 type ConstantExpression struct {
 	self  *AbstractExpression
 	value interface{}
+	// literal is set for constants written in the source, which are untyped:
+	// numeric literals take the type of the values they're used with.
+	literal bool
+	// typ is the type of a nullable parameter's value, which the constant
+	// holds unwrapped.
+	typ reflect.Type
 }
 
 func NewConstantExpression(value interface{}, kind reflect.Kind) *ConstantExpression {
@@ -20,6 +26,12 @@ func NewConstantExpression(value interface{}, kind reflect.Kind) *ConstantExpres
 	}
 }
 
+// IsLiteral determines whether or not the constant was written in the source
+// rather than being the value of a parameter.
+func (e *ConstantExpression) IsLiteral() bool {
+	return e.literal
+}
+
 func (e *ConstantExpression) Kind() reflect.Kind {
 	return e.self.kind
 }
@@ -44,3 +56,49 @@ func (e *ConstantExpression) String() string {
 		return fmt.Sprintf("%v", e.value)
 	}
 }
+
+func isLiteral(expr Expression) bool {
+	c, ok := expr.(*ConstantExpression)
+	return ok && c.literal
+}
+
+// isConstant determines whether or not an expression is an untyped numeric
+// constant: a numeric literal, or arithmetic on them such as 2 * 60 * 60.
+// Like single literals, constants take the type of the values they're used
+// with. Operations record whether they're constants when they're created, so
+// this doesn't walk the expression.
+func isConstant(expr Expression) bool {
+	switch e := expr.(type) {
+	case *ConstantExpression:
+		return e.literal && e.value != nil && IsArithmetic(e.Kind())
+	case *BinaryExpression:
+		return e.constant
+	case *UnaryExpression:
+		return e.constant
+	}
+	return false
+}
+
+// isConstantOperator determines whether or not a binary operator keeps its
+// operands untyped when they're constants.
+func isConstantOperator(nodeType ExpressionType) bool {
+	switch nodeType {
+	case AddExpr, SubtractExpr, MultiplyExpr, DivideExpr, ModuloExpr:
+		return true
+	}
+	return false
+}
+
+// isUntyped determines whether or not an expression is a literal, including
+// null, or an untyped numeric constant.
+func isUntyped(expr Expression) bool {
+	return isLiteral(expr) || isConstant(expr)
+}
+
+// constantValue returns the value of an untyped constant.
+func constantValue(expr Expression) (interface{}, error) {
+	if c, ok := expr.(*ConstantExpression); ok {
+		return c.value, nil
+	}
+	return visitExpression(expr, NewScopeFromMap(nil))
+}
@@ -0,0 +1,378 @@
+package expr
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// ConversionKind determines where a registered conversion applies.
+type ConversionKind int
+
+const (
+	// ExplicitConversion conversions only apply to casts such as
+	// duration(x).
+	ExplicitConversion ConversionKind = iota
+	// ImplicitConversion conversions also apply wherever a value is
+	// assigned, passed as an argument or used as the operand of
+	// a user-defined operator.
+	ImplicitConversion
+)
+
+func (k ConversionKind) String() string {
+	if k == ImplicitConversion {
+		return "implicit"
+	}
+	return "explicit"
+}
+
+var (
+	conversionsMu sync.RWMutex
+	conversions   []*Conversion
+
+	typeNamesMu     sync.RWMutex
+	registeredTypes = make(map[string]reflect.Type)
+)
+
+// Conversion is a user-defined conversion between two types, registered with
+// RegisterConversion.
+type Conversion struct {
+	from reflect.Type
+	to   reflect.Type
+	kind ConversionKind
+	fn   reflect.Value
+}
+
+// RegisterConversion registers a function converting values of its parameter's
+// type to its result's type, such as func(string) (time.Time, error) or
+// func(int64) time.Duration. Functions may also return an error. Only one
+// conversion between the same two types can be registered.
+func RegisterConversion(fn interface{}, kind ConversionKind) error {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return fmt.Errorf("expected a conversion function but got %T", fn)
+	}
+	typ := v.Type()
+	if typ.NumIn() != 1 || typ.IsVariadic() || !returnsValue(typ) {
+		return fmt.Errorf("a conversion must take 1 value and return a value, optionally followed by an error; got %v", typ)
+	}
+	if kind != ImplicitConversion && kind != ExplicitConversion {
+		return fmt.Errorf("unknown conversion kind %d", kind)
+	}
+	c := &Conversion{
+		from: typ.In(0),
+		to:   typ.Out(0),
+		kind: kind,
+		fn:   v,
+	}
+	if c.from == c.to {
+		return fmt.Errorf("a conversion from %v to itself can't be registered", c.from)
+	}
+	conversionsMu.Lock()
+	defer conversionsMu.Unlock()
+	for _, registered := range conversions {
+		if registered.from == c.from && registered.to == c.to {
+			return fmt.Errorf("a conversion from %v to %v is already registered", c.from, c.to)
+		}
+	}
+	conversions = append(conversions, c)
+	return nil
+}
+
+// RegisterTypeName makes a type usable by name in casts, type patterns and
+// function parameters, such as time for time.Time. Names are case
+// insensitive and can't be keywords or the names of other types.
+func RegisterTypeName(name string, typ reflect.Type) error {
+	if typ == nil || !isValidName(name) {
+		return errInvalidExpression
+	}
+	if isKeyword(name) {
+		return fmt.Errorf("%s is a keyword", name)
+	}
+	typeNamesMu.Lock()
+	defer typeNamesMu.Unlock()
+	key := strings.ToLower(name)
+	if existing, ok := typeNames[key]; ok {
+		return fmt.Errorf("%s already names %v", name, existing)
+	}
+	if existing, ok := registeredTypes[key]; ok && existing != typ {
+		return fmt.Errorf("%s already names %v", name, existing)
+	}
+	registeredTypes[key] = typ
+	return nil
+}
+
+func isValidName(name string) bool {
+	for i, r := range name {
+		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// From returns the type the conversion converts from.
+func (c *Conversion) From() reflect.Type {
+	return c.from
+}
+
+// To returns the type the conversion converts to.
+func (c *Conversion) To() reflect.Type {
+	return c.to
+}
+
+// Kind returns whether the conversion is implicit or explicit.
+func (c *Conversion) Kind() ConversionKind {
+	return c.kind
+}
+
+func (c *Conversion) String() string {
+	return fmt.Sprintf("%v conversion from %v to %v", c.kind, c.from, c.to)
+}
+
+// call converts a value, which must be assignable or convertible to the
+// conversion's source type.
+func (c *Conversion) call(val interface{}) (interface{}, error) {
+	in, err := convertValue(val, c.from)
+	if err != nil {
+		return nil, err
+	}
+	out := c.fn.Call([]reflect.Value{in})
+	if len(out) == 2 && !out[1].IsNil() {
+		return nil, out[1].Interface().(error)
+	}
+	return out[0].Interface(), nil
+}
+
+// lookupConversion returns the registered conversion of values of type from
+// to type to, or nil if there isn't one. literal is the value being
+// converted when it's a numeric literal, which converts to any type that can
+// represent it. When several conversions apply, the one whose source type
+// matches most closely is chosen: an exact match, then for literals one of
+// the same numeric class, then any other. Several conversions which match
+// equally well are ambiguous.
+func lookupConversion(from reflect.Type, literal Expression, to reflect.Type, explicit bool) (*Conversion, error) {
+	conversionsMu.RLock()
+	defer conversionsMu.RUnlock()
+	var best []*Conversion
+	bestCost := -1
+	for _, c := range conversions {
+		if c.to != to || (c.kind == ExplicitConversion && !explicit) {
+			continue
+		}
+		cost := conversionCost(from, literal, c.from)
+		switch {
+		case cost < 0:
+		case bestCost < 0 || cost < bestCost:
+			best, bestCost = []*Conversion{c}, cost
+		case cost == bestCost:
+			best = append(best, c)
+		}
+	}
+	switch len(best) {
+	case 0:
+		return nil, nil
+	case 1:
+		return best[0], nil
+	}
+	var sources []string
+	for _, c := range best {
+		sources = append(sources, c.from.String())
+	}
+	return nil, fmt.Errorf("ambiguous conversion from %v to %v: conversions from %s all apply", from, to, strings.Join(sources, ", "))
+}
+
+// conversionCost ranks how closely a value of type from matches the source
+// type of a conversion, where lower is closer and -1 doesn't match.
+func conversionCost(from reflect.Type, literal Expression, source reflect.Type) int {
+	switch {
+	case from == source:
+		return 0
+	case literal != nil && IsArithmetic(from.Kind()) && IsArithmetic(source.Kind()):
+		if !representable(literal, source) {
+			return -1
+		}
+		if isFloatKind(from.Kind()) == isFloatKind(source.Kind()) {
+			return 1
+		}
+		return 2
+	case widens(from, source), from.AssignableTo(source):
+		return 2
+	}
+	return -1
+}
+
+// widens determines whether or not every value of a basic numeric type can
+// be converted to another without losing information.
+func widens(from reflect.Type, to reflect.Type) bool {
+	switch {
+	case !IsArithmetic(from.Kind()) || !IsArithmetic(to.Kind()), isNamed(from), isNamed(to):
+		return false
+	case isFloatKind(to.Kind()):
+		return !isFloatKind(from.Kind()) || from.Size() <= to.Size()
+	case isFloatKind(from.Kind()):
+		return false
+	case IsUnsigned(from.Kind()) == IsUnsigned(to.Kind()):
+		return from.Size() <= to.Size()
+	case IsUnsigned(from.Kind()):
+		return from.Size() < to.Size()
+	}
+	return false
+}
+
+// isBuiltinConversion determines whether or not values of one type can be
+// cast to another without a registered conversion: numbers convert to any
+// numeric type, and strings to any string type.
+func isBuiltinConversion(from reflect.Type, to reflect.Type) bool {
+	switch {
+	case from.AssignableTo(to):
+		return true
+	case IsArithmetic(from.Kind()) && IsArithmetic(to.Kind()):
+		return true
+	}
+	return from.Kind() == reflect.String && to.Kind() == reflect.String
+}
+
+// isImplicitlyConvertible determines whether or not a registered implicit
+// conversion converts value to typ. Ambiguous conversions count, so that
+// they're reported where they're used.
+func isImplicitlyConvertible(value Expression, typ reflect.Type) bool {
+	from := lift(staticTypeOf(value))
+	if from == nil {
+		from = typeOfKind(value.Kind())
+	}
+	if typ == nil || isDynamic(from) {
+		return false
+	}
+	conversion, err := lookupConversion(from, literalOf(value), typ, false)
+	return conversion != nil || err != nil
+}
+
+// convertImplicitly applies the registered implicit conversion of a value to
+// a type. ok is false when there isn't one.
+func convertImplicitly(val interface{}, typ reflect.Type) (result reflect.Value, ok bool, err error) {
+	conversion, err := lookupConversion(reflect.TypeOf(val), nil, typ, false)
+	if conversion == nil {
+		return reflect.Value{}, err != nil, err
+	}
+	converted, err := conversion.call(val)
+	if err != nil {
+		return reflect.Value{}, true, err
+	}
+	return reflect.ValueOf(converted), true, nil
+}
+
+// ConvertExpression casts its operand to a type, as in int64(x) or
+// time('2024-01-02'). Casts use a registered conversion when there's one,
+// and otherwise convert between numeric types or between string types.
+type ConvertExpression struct {
+	self       *AbstractExpression
+	operand    Expression
+	typ        reflect.Type
+	conversion *Conversion
+}
+
+func NewConvertExpression(operand Expression, typ reflect.Type, conversion *Conversion) *ConvertExpression {
+	return &ConvertExpression{
+		self: &AbstractExpression{
+			nodeType: ConvertExpr,
+			kind:     typ.Kind(),
+		},
+		operand:    operand,
+		typ:        typ,
+		conversion: conversion,
+	}
+}
+
+func (e *ConvertExpression) Operand() Expression {
+	return e.operand
+}
+
+// ValueType returns the type the operand is converted to.
+func (e *ConvertExpression) ValueType() reflect.Type {
+	return e.typ
+}
+
+// Conversion returns the registered conversion the cast applies, which is
+// nil for built-in conversions and for operands whose type is only known
+// when they're evaluated.
+func (e *ConvertExpression) Conversion() *Conversion {
+	return e.conversion
+}
+
+func (e *ConvertExpression) Kind() reflect.Kind {
+	return e.self.kind
+}
+
+func (e *ConvertExpression) Type() ExpressionType {
+	return e.self.nodeType
+}
+
+func (e *ConvertExpression) NodeType() string {
+	return "ConvertExpression"
+}
+
+func (e *ConvertExpression) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%v(%v)", e.typ, e.operand)
+}
+
+// CreateConvert creates a cast of operand to typ. Registered conversions,
+// explicit or implicit, take precedence over built-in ones.
+func CreateConvert(operand Expression, typ reflect.Type) (Expression, error) {
+	if operand == nil || typ == nil {
+		return nil, errInvalidExpression
+	}
+	from := lift(staticTypeOf(operand))
+	if from == nil {
+		from = typeOfKind(operand.Kind())
+	}
+	if isDynamic(from) || from.AssignableTo(typ) {
+		return NewConvertExpression(operand, typ, nil), nil
+	}
+	conversion, err := lookupConversion(from, literalOf(operand), typ, true)
+	if err != nil {
+		return nil, err
+	}
+	if conversion == nil && !isBuiltinConversion(from, typ) {
+		return nil, fmt.Errorf("can't convert %v to %v", from, typ)
+	}
+	return NewConvertExpression(operand, typ, conversion), nil
+}
+
+// literalOf returns expr when it's a literal, and otherwise nil.
+func literalOf(expr Expression) Expression {
+	if isLiteral(expr) {
+		return expr
+	}
+	return nil
+}
+
+// evaluateConvert casts the value of the operand. Casts of null are null.
+func evaluateConvert(e *ConvertExpression, val interface{}) (interface{}, error) {
+	if val == nil {
+		return nil, nil
+	}
+	if e.conversion != nil {
+		return e.conversion.call(val)
+	}
+	v := reflect.ValueOf(val)
+	if v.Type().AssignableTo(e.typ) {
+		return val, nil
+	}
+	conversion, err := lookupConversion(v.Type(), nil, e.typ, true)
+	if err != nil {
+		return nil, err
+	}
+	if conversion != nil {
+		return conversion.call(val)
+	}
+	if !isBuiltinConversion(v.Type(), e.typ) {
+		return nil, fmt.Errorf("can't convert %T to %v", val, e.typ)
+	}
+	return v.Convert(e.typ).Interface(), nil
+}
@@ -0,0 +1,141 @@
+package expr
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type kelvin float64
+
+func init() {
+	for name, typ := range map[string]reflect.Type{
+		"date":     reflect.TypeOf(time.Time{}),
+		"duration": reflect.TypeOf(time.Duration(0)),
+		"kelvin":   reflect.TypeOf(kelvin(0)),
+	} {
+		if err := RegisterTypeName(name, typ); err != nil {
+			panic(err)
+		}
+	}
+	for _, conversion := range []struct {
+		fn   interface{}
+		kind ConversionKind
+	}{
+		{func(s string) (time.Time, error) { return time.Parse("2006-01-02", s) }, ImplicitConversion},
+		{func(seconds int64) time.Duration { return time.Duration(seconds) * time.Second }, ExplicitConversion},
+		{func(k int32) kelvin { return kelvin(k) }, ExplicitConversion},
+		{func(k float32) kelvin { return kelvin(k) }, ExplicitConversion},
+	} {
+		if err := RegisterConversion(conversion.fn, conversion.kind); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	parameters := map[string]interface{}{
+		"seconds":  int64(90),
+		"qty":      3,
+		"price":    2.5,
+		"deadline": time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		"small":    int32(5),
+	}
+	for _, test := range []struct {
+		expression string
+		expected   interface{}
+	}{
+		{"date('2024-03-01')", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"duration(seconds)", 90 * time.Second},
+		{"duration(90)", 90 * time.Second},
+		{"float64(qty) / 2", 1.5},
+		{"int(price)", 2},
+		{"kelvin(small)", kelvin(5)},
+		{"kelvin(300)", kelvin(300)},
+		{"deadline == '2024-03-01'", true},
+		{"def later(date d) = d; later('2024-03-02')", time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)},
+	} {
+		parser, err := NewExpressionParser(test.expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		actual, err := parser.Evaluate(nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Fatalf("%s: expected %v (%T) but got %v (%T)", test.expression, test.expected, test.expected, actual, actual)
+		}
+	}
+}
+
+func TestImplicitConversionOfDeclaredParameters(t *testing.T) {
+	parser, err := NewExpressionParserWithSchema("due == date('2024-03-01')", Schema{
+		"due": reflect.TypeOf(time.Time{}),
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	expression, info, err := parser.Check()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if typ := info.TypeOf(expression); typ != reflect.TypeOf(false) {
+		t.Fatalf("expected a bool but got %v", typ)
+	}
+	actual, err := parser.Evaluate(map[string]interface{}{"due": "2024-03-01"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if actual != true {
+		t.Fatalf("expected the string to be converted to a date but got %v", actual)
+	}
+}
+
+func TestConvertErrors(t *testing.T) {
+	parameters := map[string]interface{}{
+		"seconds": int64(90),
+		"tiny":    int16(5),
+		"name":    "ada",
+	}
+	for _, test := range []struct {
+		expression string
+		expected   string
+	}{
+		{"duration(name)", "can't convert string to time.Duration"},
+		{"kelvin(tiny)", "ambiguous conversion from int16 to expr.kelvin"},
+		{"date('yesterday')", "cannot parse"},
+		{"int64(1, 2)", "takes 1 argument"},
+		{"def wait(duration d) = d; wait(seconds)", "can't pass int64"},
+	} {
+		parser, err := NewExpressionParser(test.expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		_, err = parser.Evaluate(nil)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("%s: expected an error containing %q but got %v", test.expression, test.expected, err)
+		}
+	}
+}
+
+func TestRegisterConversionErrors(t *testing.T) {
+	for _, fn := range []interface{}{
+		nil,
+		"date",
+		func(a, b string) time.Time { return time.Time{} },
+		func(s string) {},
+		func(s string) string { return s },
+		func(s string) (time.Time, error) { return time.Time{}, nil },
+	} {
+		if err := RegisterConversion(fn, ImplicitConversion); err == nil {
+			t.Fatalf("expected registering %T to fail", fn)
+		}
+	}
+	for _, name := range []string{"", "int", "null", "Date", "2x"} {
+		if err := RegisterTypeName(name, reflect.TypeOf(time.Month(0))); err == nil {
+			t.Fatalf("expected registering the type name %q to fail", name)
+		}
+	}
+}
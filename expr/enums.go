@@ -0,0 +1,301 @@
+package expr
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const hasFlagMember = "HasFlag"
+
+var (
+	enumsMu     sync.RWMutex
+	enums       = make(map[string]*Enum)
+	enumsByType = make(map[reflect.Type]*Enum)
+)
+
+// Enum is a named set of constants of one type, such as the values of
+// type OrderStatus int, which expressions refer to as OrderStatus.Shipped.
+type Enum struct {
+	name    string
+	typ     reflect.Type
+	members map[string]interface{}
+	flags   bool
+}
+
+// RegisterEnum registers a set of constants, which must all have the same
+// integer or string type, under a name. Each type can only be registered
+// once.
+func RegisterEnum(name string, members map[string]interface{}) error {
+	return registerEnum(name, members, false)
+}
+
+// RegisterFlags registers a set of integer constants whose values are bit
+// flags, such as Read = 1, Write = 2 and Execute = 4. Flags are combined
+// with | and tested with HasFlag, as in perm.HasFlag(Perm.Write).
+func RegisterFlags(name string, members map[string]interface{}) error {
+	return registerEnum(name, members, true)
+}
+
+func registerEnum(name string, members map[string]interface{}, flags bool) error {
+	if !isValidName(name) || isKeyword(name) {
+		return fmt.Errorf("%q isn't a valid enum name", name)
+	}
+	if len(members) == 0 {
+		return fmt.Errorf("enum %s has no members", name)
+	}
+	e := &Enum{
+		name:    name,
+		members: make(map[string]interface{}),
+		flags:   flags,
+	}
+	for member, value := range members {
+		if !isValidName(member) {
+			return fmt.Errorf("%q isn't a valid member name of %s", member, name)
+		}
+		typ := reflect.TypeOf(value)
+		if typ == nil {
+			return fmt.Errorf("%s.%s can't be nil", name, member)
+		}
+		if e.typ != nil && typ != e.typ {
+			return fmt.Errorf("the members of %s must have the same type, got %v and %v", name, e.typ, typ)
+		}
+		e.typ = typ
+		e.members[member] = value
+	}
+	switch {
+	case flags && !IsInteger(e.typ.Kind()):
+		return fmt.Errorf("the members of flags enum %s must be integers, got %v", name, e.typ)
+	case !IsInteger(e.typ.Kind()) && e.typ.Kind() != reflect.String:
+		return fmt.Errorf("the members of enum %s must be integers or strings, got %v", name, e.typ)
+	}
+	enumsMu.Lock()
+	defer enumsMu.Unlock()
+	if _, ok := enums[name]; ok {
+		return fmt.Errorf("enum %s is already registered", name)
+	}
+	if existing, ok := enumsByType[e.typ]; ok {
+		return fmt.Errorf("%v is already registered as enum %s", e.typ, existing.name)
+	}
+	enums[name] = e
+	enumsByType[e.typ] = e
+	return nil
+}
+
+// LookupEnum returns the enum registered under a name.
+func LookupEnum(name string) (*Enum, bool) {
+	enumsMu.RLock()
+	defer enumsMu.RUnlock()
+	e, ok := enums[name]
+	return e, ok
+}
+
+// enumOf returns the enum whose members have the provided type.
+func enumOf(typ reflect.Type) (*Enum, bool) {
+	enumsMu.RLock()
+	defer enumsMu.RUnlock()
+	e, ok := enumsByType[typ]
+	return e, ok
+}
+
+// enumNames returns the names of the registered enums in sorted order.
+func enumNames() []string {
+	enumsMu.RLock()
+	defer enumsMu.RUnlock()
+	var names []string
+	for name := range enums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Name returns the name the enum is registered under.
+func (e *Enum) Name() string {
+	return e.name
+}
+
+// Type returns the type of the enum's members.
+func (e *Enum) Type() reflect.Type {
+	return e.typ
+}
+
+// IsFlags determines whether or not the enum's members are bit flags.
+func (e *Enum) IsFlags() bool {
+	return e.flags
+}
+
+// Members returns the names of the enum's members in sorted order.
+func (e *Enum) Members() []string {
+	var names []string
+	for name := range e.members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Value returns the value of the named member.
+func (e *Enum) Value(member string) (interface{}, bool) {
+	value, ok := e.members[member]
+	return value, ok
+}
+
+// HasFlagExpression tests whether an enum value has all the bits of a flag
+// set, as in perm.HasFlag(Perm.Write).
+type HasFlagExpression struct {
+	self    *AbstractExpression
+	operand Expression
+	flag    Expression
+}
+
+func NewHasFlagExpression(operand Expression, flag Expression) *HasFlagExpression {
+	return &HasFlagExpression{
+		self: &AbstractExpression{
+			nodeType: HasFlagExpr,
+			kind:     reflect.Bool,
+		},
+		operand: operand,
+		flag:    flag,
+	}
+}
+
+func (e *HasFlagExpression) Operand() Expression {
+	return e.operand
+}
+
+func (e *HasFlagExpression) Flag() Expression {
+	return e.flag
+}
+
+func (e *HasFlagExpression) Kind() reflect.Kind {
+	return e.self.kind
+}
+
+func (e *HasFlagExpression) Type() ExpressionType {
+	return e.self.nodeType
+}
+
+func (e *HasFlagExpression) NodeType() string {
+	return "HasFlagExpression"
+}
+
+func (e *HasFlagExpression) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%v.%s(%v)", e.operand, hasFlagMember, e.flag)
+}
+
+// CreateHasFlag creates a test of whether operand, a value of a flags enum,
+// has flag set. flag must be a value of the same enum.
+func CreateHasFlag(operand Expression, flag Expression) (Expression, error) {
+	if err := validateLeftAndRight(operand, flag); err != nil {
+		return nil, err
+	}
+	typ := staticTypeOf(operand)
+	if e, ok := enumOf(typ); !ok || !e.flags {
+		return nil, fmt.Errorf("%s is only defined for flags enums, not %v", hasFlagMember, operand)
+	}
+	if flagType := staticTypeOf(flag); flagType != typ {
+		return nil, fmt.Errorf("the flag of %v must be a %v, got %v", operand, typ, flag)
+	}
+	return NewHasFlagExpression(operand, flag), nil
+}
+
+// CreateOr creates a bitwise or, which combines the flags of a flags enum
+// or the bits of integers.
+func CreateOr(left Expression, right Expression) (Expression, error) {
+	if err := validateLeftAndRight(left, right); err != nil {
+		return nil, err
+	}
+	for _, operand := range []Expression{left, right} {
+		if !IsInteger(operand.Kind()) && operand.Kind() != reflect.Interface {
+			return nil, fmt.Errorf("operator | requires integers, got %v of kind %v", operand, operand.Kind())
+		}
+		if e, ok := enumOf(staticTypeOf(operand)); ok && !e.flags {
+			return nil, fmt.Errorf("operator | isn't defined for %s, which isn't a flags enum", e.name)
+		}
+	}
+	return NewBinaryExpression(OrExpr, left, right, arithmeticKind(left, right)), nil
+}
+
+// bitsOf returns the bits of an integer value.
+func bitsOf(val interface{}) (uint64, error) {
+	v := reflect.ValueOf(val)
+	switch {
+	case IsUnsigned(v.Kind()):
+		return v.Uint(), nil
+	case IsInteger(v.Kind()):
+		return uint64(v.Int()), nil
+	}
+	return 0, fmt.Errorf("expected an integer but got %T", val)
+}
+
+// evaluateOr combines the bits of two integers into a value of the provided
+// kind, or of the left operand's type when the kind isn't known.
+func evaluateOr(lVal interface{}, rVal interface{}, kind reflect.Kind) (interface{}, error) {
+	if lVal == nil || rVal == nil {
+		return nil, nil
+	}
+	l, err := bitsOf(lVal)
+	if err != nil {
+		return nil, err
+	}
+	r, err := bitsOf(rVal)
+	if err != nil {
+		return nil, err
+	}
+	typ := typeOfKind(kind)
+	if !IsInteger(kind) {
+		typ = reflect.TypeOf(lVal)
+	}
+	result := reflect.New(typ).Elem()
+	if IsUnsigned(typ.Kind()) {
+		result.SetUint(l | r)
+	} else {
+		result.SetInt(int64(l | r))
+	}
+	return result.Interface(), nil
+}
+
+// evaluateHasFlag determines whether or not all the bits of flag are set in
+// val.
+func evaluateHasFlag(val interface{}, flag interface{}) (interface{}, error) {
+	if val == nil || flag == nil {
+		return false, nil
+	}
+	v, err := bitsOf(val)
+	if err != nil {
+		return nil, err
+	}
+	f, err := bitsOf(flag)
+	if err != nil {
+		return nil, err
+	}
+	return v&f == f, nil
+}
+
+// createEnumMember creates a constant holding a member of an enum,
+// suggesting the closest member when there's none with that name.
+func createEnumMember(e *Enum, member string) (Expression, error) {
+	value, ok := e.members[member]
+	if !ok {
+		return nil, fmt.Errorf("enum %s has no member %s%s", e.name, member, suggest(member, e.Members()))
+	}
+	return createParameterValue(value), nil
+}
+
+// enumCompletions returns the qualified names of the members of an enum
+// which start with prefix.
+func enumCompletions(e *Enum, prefix string) []string {
+	var completions []string
+	for _, member := range e.Members() {
+		if strings.HasPrefix(member, prefix) {
+			completions = append(completions, e.name+"."+member)
+		}
+	}
+	return completions
+}
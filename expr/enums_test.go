@@ -0,0 +1,146 @@
+package expr
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type orderStatus int
+
+const (
+	pending orderStatus = iota
+	shipped
+	delivered
+)
+
+type permission uint8
+
+const (
+	readPermission permission = 1 << iota
+	writePermission
+	executePermission
+)
+
+func init() {
+	if err := RegisterEnum("OrderStatus", map[string]interface{}{
+		"Pending":   pending,
+		"Shipped":   shipped,
+		"Delivered": delivered,
+	}); err != nil {
+		panic(err)
+	}
+	if err := RegisterFlags("Perm", map[string]interface{}{
+		"Read":    readPermission,
+		"Write":   writePermission,
+		"Execute": executePermission,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+func TestEnums(t *testing.T) {
+	parameters := map[string]interface{}{
+		"status": shipped,
+		"perm":   readPermission | writePermission,
+		"mask":   6,
+	}
+	for _, test := range []struct {
+		expression string
+		expected   interface{}
+	}{
+		{"status == OrderStatus.Shipped", true},
+		{"status != OrderStatus.Pending && status < OrderStatus.Delivered", true},
+		{"OrderStatus.Delivered", delivered},
+		{"perm.HasFlag(Perm.Write)", true},
+		{"perm.HasFlag(Perm.Write | Perm.Execute)", false},
+		{"(perm | Perm.Execute).HasFlag(Perm.Write | Perm.Execute)", true},
+		{"Perm.Read | Perm.Execute", readPermission | executePermission},
+		{"perm == (Perm.Read | Perm.Write)", true},
+		{"mask | 1", 7},
+	} {
+		parser, err := NewExpressionParser(test.expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		actual, err := parser.Evaluate(nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Fatalf("%s: expected %v (%T) but got %v (%T)", test.expression, test.expected, test.expected, actual, actual)
+		}
+	}
+}
+
+func TestEnumErrors(t *testing.T) {
+	parameters := map[string]interface{}{
+		"status":   shipped,
+		"perm":     readPermission,
+		"quantity": 3,
+	}
+	for _, test := range []struct {
+		expression string
+		expected   string
+	}{
+		{"status == OrderStatus.Shiped", "enum OrderStatus has no member Shiped; did you mean Shipped?"},
+		{"OrderStatus", "OrderStatus is an enum"},
+		{"OrderStatus.Shipped | OrderStatus.Pending", "isn't a flags enum"},
+		{"status.HasFlag(OrderStatus.Shipped)", "has no member HasFlag"},
+		{"perm.HasFlag(1)", "must be a expr.permission"},
+		{"perm.HasFlag", "must be called"},
+		{"quantiy > 1", "unknown identifier: quantiy; did you mean quantity?"},
+		{"OrdrStatus.Shipped", "did you mean OrderStatus?"},
+		{"zzz", "unknown identifier: zzz"},
+		{"'a' | 1", "requires integers"},
+		{"perm | status", "isn't a flags enum"},
+		{"perm == Perm.Read | Perm.Write", "requires integers"},
+	} {
+		parser, err := NewExpressionParser(test.expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		_, err = parser.Evaluate(nil)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("%s: expected an error containing %q but got %v", test.expression, test.expected, err)
+		}
+	}
+}
+
+func TestCompletions(t *testing.T) {
+	parser, err := NewExpressionParser("1", map[string]interface{}{"ordered": 1, "perm": 2})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	for prefix, expected := range map[string][]string{
+		"Ord":          {"OrderStatus"},
+		"ord":          {"ordered"},
+		"Pe":           {"Perm"},
+		"OrderStatus.": {"OrderStatus.Delivered", "OrderStatus.Pending", "OrderStatus.Shipped"},
+		"Perm.E":       {"Perm.Execute"},
+		"Missing.":     nil,
+	} {
+		if actual := parser.Completions(prefix); !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("%s: expected %v but got %v", prefix, expected, actual)
+		}
+	}
+}
+
+func TestRegisterEnumErrors(t *testing.T) {
+	for name, members := range map[string]map[string]interface{}{
+		"OrderStatus": {"Cancelled": orderStatus(3)},
+		"Statuses":    {"Pending": pending},
+		"Empty":       {},
+		"Mixed":       {"A": 1, "B": "b"},
+		"Floats":      {"Half": 0.5},
+		"null":        {"A": 1},
+		"Bad":         {"1st": 1},
+	} {
+		if err := RegisterEnum(name, members); err == nil {
+			t.Fatalf("expected registering %s to fail", name)
+		}
+	}
+	if err := RegisterFlags("Colors", map[string]interface{}{"Red": "red"}); err == nil {
+		t.Fatalf("expected string flags to fail")
+	}
+}
@@ -0,0 +1,203 @@
+package expr
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// environmentTag is the struct tag which renames an environment's field, as
+// in `expr:"total"`, or hides it, as in `expr:"-"`.
+const environmentTag = "expr"
+
+var (
+	errorType    = reflect.TypeOf((*error)(nil)).Elem()
+	environments sync.Map
+)
+
+// Environment describes a struct whose exported fields and methods are the
+// identifiers of an expression, as an alternative to a parameter map. Fields
+// and methods are resolved once, when the expression is parsed, so
+// evaluating it against each value of the struct is cheap.
+type Environment struct {
+	typ     reflect.Type
+	fields  map[string]*environmentField
+	methods map[string]*environmentMethod
+}
+
+type environmentField struct {
+	index []int
+	typ   reflect.Type
+}
+
+type environmentMethod struct {
+	method reflect.Method
+	// pointer is set when the method has a pointer receiver.
+	pointer bool
+	// pure is set when the method is listed by PureMethods.
+	pure bool
+}
+
+// PureEnvironment is implemented by environments which have pure methods:
+// methods whose results only depend on the receiver and arguments, and
+// which don't change anything. Calls of pure methods which occur more than
+// once in an expression can be evaluated once; see ShareSubexpressions.
+// PureMethods is called on the struct's zero value, and isn't callable from
+// expressions itself.
+type PureEnvironment interface {
+	PureMethods() []string
+}
+
+var pureEnvironmentType = reflect.TypeOf((*PureEnvironment)(nil)).Elem()
+
+// NewEnvironment returns the environment for a struct or pointer to a
+// struct, such as (*Request)(nil). Environments are cached by type.
+func NewEnvironment(env interface{}) (*Environment, error) {
+	typ := reflect.TypeOf(env)
+	if typ == nil {
+		return nil, errInvalidExpression
+	}
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("an environment must be a struct, got %v", typ)
+	}
+	if cached, ok := environments.Load(typ); ok {
+		return cached.(*Environment), nil
+	}
+	e := &Environment{
+		typ:     typ,
+		fields:  make(map[string]*environmentField),
+		methods: make(map[string]*environmentMethod),
+	}
+	e.addFields(typ, nil)
+	if err := e.addMethods(); err != nil {
+		return nil, err
+	}
+	if err := e.addPurity(); err != nil {
+		return nil, err
+	}
+	cached, _ := environments.LoadOrStore(typ, e)
+	return cached.(*Environment), nil
+}
+
+// addFields adds the exported fields of typ. The fields of embedded structs
+// are promoted, unless a field of an outer struct has the same name.
+func (e *Environment) addFields(typ reflect.Type, index []int) {
+	var embedded []reflect.StructField
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag := field.Tag.Get(environmentTag)
+		if tag == "-" {
+			continue
+		}
+		if field.Anonymous && tag == "" && field.Type.Kind() == reflect.Struct {
+			embedded = append(embedded, field)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Name
+		if tag != "" {
+			name = strings.Split(tag, ",")[0]
+		}
+		if _, ok := e.fields[name]; ok {
+			continue
+		}
+		e.fields[name] = &environmentField{
+			index: append(append([]int(nil), index...), field.Index...),
+			typ:   field.Type,
+		}
+	}
+	for _, field := range embedded {
+		e.addFields(field.Type, append(append([]int(nil), index...), field.Index...))
+	}
+}
+
+// addMethods adds the exported methods which return a value, optionally
+// followed by an error.
+func (e *Environment) addMethods() error {
+	pointer := reflect.PtrTo(e.typ)
+	for i := 0; i < pointer.NumMethod(); i++ {
+		method := pointer.Method(i)
+		if method.Type.IsVariadic() || !returnsValue(method.Type) {
+			continue
+		}
+		if method.Name == "PureMethods" && pointer.Implements(pureEnvironmentType) {
+			continue
+		}
+		if _, ok := e.fields[method.Name]; ok {
+			return fmt.Errorf("%v has both a field and a method named %s", e.typ, method.Name)
+		}
+		m := &environmentMethod{method: method, pointer: true}
+		if value, ok := e.typ.MethodByName(method.Name); ok {
+			m.method, m.pointer = value, false
+		}
+		e.methods[method.Name] = m
+	}
+	return nil
+}
+
+// addPurity marks the methods listed by PureMethods as pure.
+func (e *Environment) addPurity() error {
+	env, ok := reflect.New(e.typ).Interface().(PureEnvironment)
+	if !ok {
+		return nil
+	}
+	for _, name := range env.PureMethods() {
+		method, ok := e.methods[name]
+		if !ok {
+			return fmt.Errorf("%v has no method %s to be pure", e.typ, name)
+		}
+		method.pure = true
+	}
+	return nil
+}
+
+func returnsValue(method reflect.Type) bool {
+	switch method.NumOut() {
+	case 1:
+		return method.Out(0) != errorType
+	case 2:
+		return method.Out(1) == errorType
+	}
+	return false
+}
+
+// Type returns the struct type the environment describes.
+func (e *Environment) Type() reflect.Type {
+	return e.typ
+}
+
+// Names returns the identifiers the environment defines in sorted order.
+func (e *Environment) Names() []string {
+	var names []string
+	for name := range e.fields {
+		names = append(names, name)
+	}
+	for name := range e.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// value returns the struct an environment value refers to, which is
+// addressable when env is a pointer.
+func (e *Environment) value(env interface{}) (reflect.Value, error) {
+	v := reflect.ValueOf(env)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return reflect.Value{}, fmt.Errorf("the environment is a nil %T", env)
+		}
+		v = v.Elem()
+	}
+	if v.Type() != e.typ {
+		return reflect.Value{}, fmt.Errorf("expected an environment of type %v but got %T", e.typ, env)
+	}
+	return v, nil
+}
@@ -0,0 +1,199 @@
+package expr
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// FieldExpression reads a field of the environment struct, which is
+// located by its index rather than by name.
+type FieldExpression struct {
+	self  *AbstractExpression
+	name  string
+	index []int
+	typ   reflect.Type
+}
+
+func NewFieldExpression(name string, index []int, typ reflect.Type) *FieldExpression {
+	return &FieldExpression{
+		self: &AbstractExpression{
+			nodeType: FieldExpr,
+			kind:     valueKind(typ),
+		},
+		name:  name,
+		index: index,
+		typ:   typ,
+	}
+}
+
+func (e *FieldExpression) Name() string {
+	return e.name
+}
+
+// ValueType returns the type of the field's normalised values, or nil if
+// it's only known once the field is read.
+func (e *FieldExpression) ValueType() reflect.Type {
+	return e.typ
+}
+
+func (e *FieldExpression) Kind() reflect.Kind {
+	return e.self.kind
+}
+
+func (e *FieldExpression) Type() ExpressionType {
+	return e.self.nodeType
+}
+
+func (e *FieldExpression) NodeType() string {
+	return "FieldExpression"
+}
+
+func (e *FieldExpression) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	return e.name
+}
+
+// CallExpression calls a method of the environment struct.
+type CallExpression struct {
+	self      *AbstractExpression
+	name      string
+	method    *environmentMethod
+	arguments []Expression
+}
+
+func NewCallExpression(name string, method *environmentMethod, arguments []Expression) *CallExpression {
+	return &CallExpression{
+		self: &AbstractExpression{
+			nodeType: CallExpr,
+			kind:     valueKind(method.method.Type.Out(0)),
+		},
+		name:      name,
+		method:    method,
+		arguments: arguments,
+	}
+}
+
+func (e *CallExpression) Name() string {
+	return e.name
+}
+
+func (e *CallExpression) Arguments() []Expression {
+	return e.arguments
+}
+
+// ValueType returns the type of the method's result.
+func (e *CallExpression) ValueType() reflect.Type {
+	return e.method.method.Type.Out(0)
+}
+
+func (e *CallExpression) Kind() reflect.Kind {
+	return e.self.kind
+}
+
+func (e *CallExpression) Type() ExpressionType {
+	return e.self.nodeType
+}
+
+func (e *CallExpression) NodeType() string {
+	return "CallExpression"
+}
+
+func (e *CallExpression) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	var arguments []string
+	for _, argument := range e.arguments {
+		arguments = append(arguments, argument.String())
+	}
+	return fmt.Sprintf("%s(%s)", e.name, strings.Join(arguments, ", "))
+}
+
+// CreateField creates a read of the named field of an environment.
+func CreateField(env *Environment, name string) (Expression, error) {
+	if env == nil {
+		return nil, errInvalidExpression
+	}
+	field, ok := env.fields[name]
+	if !ok {
+		return nil, fmt.Errorf("%v has no field %s", env.typ, name)
+	}
+	return NewFieldExpression(name, field.index, normalizeType(field.typ)), nil
+}
+
+// CreateCall creates a call of the named method of an environment. Arguments
+// must be assignable to the method's parameters.
+func CreateCall(env *Environment, name string, arguments []Expression) (Expression, error) {
+	if env == nil {
+		return nil, errInvalidExpression
+	}
+	method, ok := env.methods[name]
+	if !ok {
+		return nil, fmt.Errorf("%v has no method %s", env.typ, name)
+	}
+	// The first input of a method's function is its receiver.
+	typ := method.method.Type
+	if len(arguments) != typ.NumIn()-1 {
+		return nil, fmt.Errorf("%s takes %d arguments but got %d", name, typ.NumIn()-1, len(arguments))
+	}
+	for i, argument := range arguments {
+		if argument == nil {
+			return nil, errInvalidExpression
+		}
+		if parameter := typ.In(i + 1); !isAssignableKind(argument.Kind(), parameter.Kind()) && !isImplicitlyConvertible(argument, parameter) {
+			return nil, fmt.Errorf("can't pass a value of kind %v as argument %d of %s, which is %v", argument.Kind(), i+1, name, parameter)
+		}
+	}
+	return NewCallExpression(name, method, arguments), nil
+}
+
+// evaluateField reads a field of the environment.
+func evaluateField(e *FieldExpression, scope *Scope) (reflect.Value, error) {
+	return fieldOf(scope.Environment(), e)
+}
+
+// fieldOf returns the field of env which e refers to.
+func fieldOf(env reflect.Value, e *FieldExpression) (reflect.Value, error) {
+	if !env.IsValid() {
+		return reflect.Value{}, fmt.Errorf("%s is a field of an environment, but none was provided", e.name)
+	}
+	// Only fields of embedded structs, not of embedded pointers, are
+	// promoted, so this can't panic.
+	return env.FieldByIndex(e.index), nil
+}
+
+// evaluateCall calls a method of the environment with the provided
+// arguments. A non-nil error returned by the method is the call's error.
+func evaluateCall(e *CallExpression, scope *Scope, args []interface{}) (interface{}, error) {
+	return callMethod(scope.Environment(), e, args)
+}
+
+// callMethod calls a method of the environment env.
+func callMethod(receiver reflect.Value, e *CallExpression, args []interface{}) (interface{}, error) {
+	if !receiver.IsValid() {
+		return nil, fmt.Errorf("%s is a method of an environment, but none was provided", e.name)
+	}
+	if e.method.pointer {
+		if !receiver.CanAddr() {
+			return nil, fmt.Errorf("%s has a pointer receiver; pass a pointer to the environment to call it", e.name)
+		}
+		receiver = receiver.Addr()
+	}
+	typ := e.method.method.Type
+	in := []reflect.Value{receiver}
+	for i, arg := range args {
+		val, err := convertValue(arg, typ.In(i+1))
+		if err != nil {
+			return nil, fmt.Errorf("argument %d of %s: %v", i+1, e.name, err)
+		}
+		in = append(in, val)
+	}
+	out := e.method.method.Func.Call(in)
+	if len(out) == 2 && !out[1].IsNil() {
+		return nil, out[1].Interface().(error)
+	}
+	return unwrapNullable(normalizeValue(out[0].Interface())), nil
+}
@@ -0,0 +1,153 @@
+package expr
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type member struct {
+	Name string
+	Tier int
+}
+
+type audit struct {
+	Source string
+}
+
+type request struct {
+	audit
+	Account  member
+	Items    []string
+	Total    float64 `expr:"amount"`
+	Secret   string  `expr:"-"`
+	Discount float64
+	internal int
+}
+
+func (r request) ItemCount() int {
+	return len(r.Items)
+}
+
+func (r *request) Apply(rate float64) float64 {
+	r.Discount = r.Total * rate
+	return r.Discount
+}
+
+func (r request) Checked(limit float64) (bool, error) {
+	if limit < 0 {
+		return false, errors.New("negative limit")
+	}
+	return r.Total <= limit, nil
+}
+
+func (r request) Log(string) {}
+
+func TestEnvironment(t *testing.T) {
+	env, err := NewEnvironment((*request)(nil))
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	expected := []string{"Account", "Apply", "Checked", "Discount", "ItemCount", "Items", "Source", "amount"}
+	if names := env.Names(); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %v but got %v", expected, names)
+	}
+	if cached, _ := NewEnvironment(request{}); cached != env {
+		t.Fatalf("expected environments to be cached by type")
+	}
+	if _, err := NewEnvironment(1); err == nil {
+		t.Fatalf("expected an int environment to fail")
+	}
+}
+
+func TestEvaluateStruct(t *testing.T) {
+	r := &request{
+		audit:   audit{Source: "web"},
+		Account: member{Name: "ada", Tier: 2},
+		Items:   []string{"a", "b", "c"},
+		Total:   150,
+	}
+	for _, test := range []struct {
+		expression string
+		expected   interface{}
+	}{
+		{"amount > 100 && Account.Tier >= 2", true},
+		{"Account.Name == 'ada'", true},
+		{"ItemCount() * 2", 6},
+		{"'b' in Items", true},
+		{"Source", "web"},
+		{"Checked(200)", true},
+		{"amount - Apply(0.1)", 135.0},
+	} {
+		parser, err := NewExpressionParserForStruct(test.expression, r)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		actual, err := parser.EvaluateStruct(r)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Fatalf("%s: expected %v (%T) but got %v (%T)", test.expression, test.expected, test.expected, actual, actual)
+		}
+	}
+	if r.Discount != 15 {
+		t.Fatalf("expected Apply to set the discount to 15 but got %v", r.Discount)
+	}
+}
+
+func TestEvaluateStructAssignment(t *testing.T) {
+	parser, err := NewExpressionParserForStruct("Discount = amount * 0.2; Account.Tier += 1", (*request)(nil))
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	parser.SetMode(StatementMode | ProgramMode)
+	r := &request{Total: 50, Account: member{Tier: 1}}
+	if _, err := parser.EvaluateStruct(r); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if r.Discount != 10 || r.Account.Tier != 2 {
+		t.Fatalf("expected the fields to be assigned but got %+v", r)
+	}
+	if _, err := parser.EvaluateStruct(*r); err != errNotAddressable {
+		t.Fatalf("expected assigning to a struct value to fail but got %v", err)
+	}
+}
+
+func TestEvaluateStructErrors(t *testing.T) {
+	for _, test := range []struct {
+		expression string
+		expected   string
+	}{
+		{"Secret == ''", "undeclared identifier: Secret"},
+		{"Total > 1", "undeclared identifier: Total"},
+		{"internal", "undeclared identifier: internal"},
+		{"Log('x')", "undeclared identifier: Log"},
+		{"ItemCount", "must be called"},
+		{"ItemCount(1)", "takes 0 arguments"},
+		{"Checked('a')", "can't pass"},
+		{"Checked(-1)", "negative limit"},
+		{"Apply(0.5)", "pointer receiver"},
+	} {
+		parser, err := NewExpressionParserForStruct(test.expression, request{})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		_, err = parser.EvaluateStruct(request{Total: 10})
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("%s: expected an error containing %q but got %v", test.expression, test.expected, err)
+		}
+	}
+
+	parser, err := NewExpressionParserForStruct("amount", request{})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := parser.EvaluateStruct(member{}); err == nil {
+		t.Fatalf("expected evaluating against another struct to fail")
+	}
+	if _, err := parser.EvaluateStruct((*request)(nil)); err == nil {
+		t.Fatalf("expected evaluating against a nil pointer to fail")
+	}
+}
@@ -9,63 +9,127 @@ type ExpressionType int
 const (
 	AddExpr ExpressionType = iota
 	AddCheckedExpr
+	AddAssignExpr
 	AndExpr
-	AndAlsoExpr // TODO: Short circuiting
+	AndAlsoExpr
+	AssignExpr
+	BlockExpr
+	CallExpr
+	ConditionalExpr
 	ConstantExpr
+	DeclareExpr
 	DivideExpr
+	DivideAssignExpr
 	EqualExpr
 	ExclusiveOrExpr
+	FieldExpr
 	GreaterThanExpr
 	GreaterThanOrEqualExpr
+	IfExpr
+	IndexExpr
+	IndexFromEndExpr
+	InExpr
+	InvokeExpr
+	IsExpr
+	LambdaExpr
 	LeftShiftExpr
 	LessThanExpr
 	LessThanOrEqualExpr
+	MemberExpr
 	ModuloExpr
+	ModuloAssignExpr
 	MultiplyExpr
 	MultiplyCheckedExpr
+	MultiplyAssignExpr
 	NegateExpr
 	UnaryPlusExpr // TODO: support this?
 	NotExpr
 	NotEqualExpr
+	NullableMemberExpr
+	ConvertExpr
+	HasFlagExpr
+	SharedExpr
 	OrExpr
-	OrElseExpr // TODO: Short circuiting
+	OrElseExpr
 	ParameterExpr
 	PowerExpr
+	PostDecrementAssignExpr
+	PostIncrementAssignExpr
+	PreDecrementAssignExpr
+	PreIncrementAssignExpr
+	ProgramExpr
+	RangeExpr
+	ReturnExpr
 	RightShiftExpr
+	SequenceExpr
 	SubtractExpr
 	SubtractCheckedExpr
+	SubtractAssignExpr
+	SwitchExpr
 	UnknownExpr
 )
 
 const (
-	AddExprString                = "AddExpr"
-	AddCheckedExprString         = "AddCheckedExpr"
-	AndExprString                = "AndExpr"
-	AndAlsoExprString            = "AndAlsoExpr"
-	ConstantExprString           = "ConstantExpr"
-	DivideExprString             = "DivideExpr"
-	EqualExprString              = "EqualExpr"
-	ExclusiveOrExprString        = "ExclusiveOrExpr"
-	GreaterThanExprString        = "GreaterThanExpr"
-	GreaterThanOrEqualExprString = "GreaterThanOrEqualExpr"
-	LeftShiftExprString          = "LeftShiftExpr"
-	LessThanExprString           = "LessThanExpr"
-	LessThanOrEqualExprString    = "LessThanOrEqualExpr"
-	ModuloExprString             = "ModuloExpr"
-	MultiplyExprString           = "MultiplyExpr"
-	MultiplyCheckedExprString    = "MultiplyCheckedExpr"
-	NegateExprString             = "NegateExpr"
-	UnaryPlusExprString          = "UnaryPlusExpr"
-	NotExprString                = "NotExpr"
-	NotEqualExprString           = "NotEqualExpr"
-	OrExprString                 = "OrExpr"
-	OrElseExprString             = "OrElseExpr"
-	ParameterExprString          = "ParameterExpr"
-	PowerExprString              = "PowerExpr"
-	RightShiftExprString         = "RightShiftExpr"
-	SubtractExprString           = "SubtractExpr"
-	SubtractCheckedExprString    = "SubtractCheckedExpr"
-	UnknownExprString            = "UnknownExpr"
+	AddExprString                 = "AddExpr"
+	AddCheckedExprString          = "AddCheckedExpr"
+	AddAssignExprString           = "AddAssignExpr"
+	AndExprString                 = "AndExpr"
+	AndAlsoExprString             = "AndAlsoExpr"
+	AssignExprString              = "AssignExpr"
+	BlockExprString               = "BlockExpr"
+	CallExprString                = "CallExpr"
+	ConditionalExprString         = "ConditionalExpr"
+	ConstantExprString            = "ConstantExpr"
+	DeclareExprString             = "DeclareExpr"
+	DivideExprString              = "DivideExpr"
+	DivideAssignExprString        = "DivideAssignExpr"
+	EqualExprString               = "EqualExpr"
+	ExclusiveOrExprString         = "ExclusiveOrExpr"
+	FieldExprString               = "FieldExpr"
+	GreaterThanExprString         = "GreaterThanExpr"
+	GreaterThanOrEqualExprString  = "GreaterThanOrEqualExpr"
+	IfExprString                  = "IfExpr"
+	IndexExprString               = "IndexExpr"
+	IndexFromEndExprString        = "IndexFromEndExpr"
+	InExprString                  = "InExpr"
+	InvokeExprString              = "InvokeExpr"
+	IsExprString                  = "IsExpr"
+	LambdaExprString              = "LambdaExpr"
+	LeftShiftExprString           = "LeftShiftExpr"
+	LessThanExprString            = "LessThanExpr"
+	LessThanOrEqualExprString     = "LessThanOrEqualExpr"
+	MemberExprString              = "MemberExpr"
+	ModuloExprString              = "ModuloExpr"
+	ModuloAssignExprString        = "ModuloAssignExpr"
+	MultiplyExprString            = "MultiplyExpr"
+	MultiplyCheckedExprString     = "MultiplyCheckedExpr"
+	MultiplyAssignExprString      = "MultiplyAssignExpr"
+	NegateExprString              = "NegateExpr"
+	UnaryPlusExprString           = "UnaryPlusExpr"
+	NotExprString                 = "NotExpr"
+	NotEqualExprString            = "NotEqualExpr"
+	NullableMemberExprString      = "NullableMemberExpr"
+	ConvertExprString             = "ConvertExpr"
+	HasFlagExprString             = "HasFlagExpr"
+	SharedExprString              = "SharedExpr"
+	OrExprString                  = "OrExpr"
+	OrElseExprString              = "OrElseExpr"
+	ParameterExprString           = "ParameterExpr"
+	PowerExprString               = "PowerExpr"
+	PostDecrementAssignExprString = "PostDecrementAssignExpr"
+	PostIncrementAssignExprString = "PostIncrementAssignExpr"
+	PreDecrementAssignExprString  = "PreDecrementAssignExpr"
+	PreIncrementAssignExprString  = "PreIncrementAssignExpr"
+	ProgramExprString             = "ProgramExpr"
+	RangeExprString               = "RangeExpr"
+	ReturnExprString              = "ReturnExpr"
+	RightShiftExprString          = "RightShiftExpr"
+	SequenceExprString            = "SequenceExpr"
+	SubtractExprString            = "SubtractExpr"
+	SubtractCheckedExprString     = "SubtractCheckedExpr"
+	SubtractAssignExprString      = "SubtractAssignExpr"
+	SwitchExprString              = "SwitchExpr"
+	UnknownExprString             = "UnknownExpr"
 )
 
 func (t ExpressionType) String() string {
@@ -74,34 +138,70 @@ func (t ExpressionType) String() string {
 		return AddExprString
 	case AddCheckedExpr:
 		return AddCheckedExprString
+	case AddAssignExpr:
+		return AddAssignExprString
 	case AndExpr:
 		return AndExprString
 	case AndAlsoExpr:
 		return AndAlsoExprString
+	case AssignExpr:
+		return AssignExprString
+	case BlockExpr:
+		return BlockExprString
+	case CallExpr:
+		return CallExprString
+	case ConditionalExpr:
+		return ConditionalExprString
 	case ConstantExpr:
 		return ConstantExprString
+	case DeclareExpr:
+		return DeclareExprString
 	case DivideExpr:
 		return DivideExprString
+	case DivideAssignExpr:
+		return DivideAssignExprString
 	case EqualExpr:
 		return EqualExprString
 	case ExclusiveOrExpr:
 		return ExclusiveOrExprString
+	case FieldExpr:
+		return FieldExprString
 	case GreaterThanExpr:
 		return GreaterThanExprString
 	case GreaterThanOrEqualExpr:
 		return GreaterThanOrEqualExprString
+	case IfExpr:
+		return IfExprString
+	case IndexExpr:
+		return IndexExprString
+	case IndexFromEndExpr:
+		return IndexFromEndExprString
+	case InExpr:
+		return InExprString
+	case InvokeExpr:
+		return InvokeExprString
+	case IsExpr:
+		return IsExprString
+	case LambdaExpr:
+		return LambdaExprString
 	case LeftShiftExpr:
 		return LeftShiftExprString
 	case LessThanExpr:
 		return LessThanExprString
 	case LessThanOrEqualExpr:
 		return LessThanOrEqualExprString
+	case MemberExpr:
+		return MemberExprString
 	case ModuloExpr:
 		return ModuloExprString
+	case ModuloAssignExpr:
+		return ModuloAssignExprString
 	case MultiplyExpr:
 		return MultiplyExprString
 	case MultiplyCheckedExpr:
 		return MultiplyCheckedExprString
+	case MultiplyAssignExpr:
+		return MultiplyAssignExprString
 	case NegateExpr:
 		return NegateExprString
 	case UnaryPlusExpr:
@@ -110,6 +210,14 @@ func (t ExpressionType) String() string {
 		return NotExprString
 	case NotEqualExpr:
 		return NotEqualExprString
+	case NullableMemberExpr:
+		return NullableMemberExprString
+	case ConvertExpr:
+		return ConvertExprString
+	case HasFlagExpr:
+		return HasFlagExprString
+	case SharedExpr:
+		return SharedExprString
 	case OrExpr:
 		return OrExprString
 	case OrElseExpr:
@@ -118,12 +226,32 @@ func (t ExpressionType) String() string {
 		return ParameterExprString
 	case PowerExpr:
 		return PowerExprString
+	case PostDecrementAssignExpr:
+		return PostDecrementAssignExprString
+	case PostIncrementAssignExpr:
+		return PostIncrementAssignExprString
+	case PreDecrementAssignExpr:
+		return PreDecrementAssignExprString
+	case PreIncrementAssignExpr:
+		return PreIncrementAssignExprString
+	case ProgramExpr:
+		return ProgramExprString
+	case RangeExpr:
+		return RangeExprString
+	case ReturnExpr:
+		return ReturnExprString
 	case RightShiftExpr:
 		return RightShiftExprString
+	case SequenceExpr:
+		return SequenceExprString
 	case SubtractExpr:
 		return SubtractExprString
 	case SubtractCheckedExpr:
 		return SubtractCheckedExprString
+	case SubtractAssignExpr:
+		return SubtractAssignExprString
+	case SwitchExpr:
+		return SwitchExprString
 	default:
 		return UnknownExprString
 	}
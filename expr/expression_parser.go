@@ -1,8 +1,16 @@
 package expr
 
+import (
+	"errors"
+	"reflect"
+)
+
+var errNoEnvironment = errors.New("the parser has no struct environment; use NewExpressionParserForStruct")
+
 type ExpressionParser struct {
-	tokenizer *Tokenizer
-	tokens    []*Token
+	tokenizer   *Tokenizer
+	tokens      []*Token
+	environment *Environment
 }
 
 func NewExpressionParser(expression string, parameters map[string]interface{}) (ep *ExpressionParser, err error) {
@@ -16,6 +24,63 @@ func NewExpressionParser(expression string, parameters map[string]interface{}) (
 	return ep, err
 }
 
+// Schema declares parameters by name and type.
+type Schema map[string]reflect.Type
+
+// NewExpressionParserWithSchema creates a parser for an expression whose
+// parameters are declared by a schema rather than provided as values, so it
+// can be validated before any data arrives. Identifiers which aren't
+// declared are rejected when parsing.
+func NewExpressionParserWithSchema(expression string, schema Schema) (*ExpressionParser, error) {
+	ep, err := NewExpressionParser(expression, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, typ := range schema {
+		if err := ep.Declare(name, typ); err != nil {
+			return nil, err
+		}
+	}
+	return ep, nil
+}
+
+// NewExpressionParserForStruct creates a parser for an expression whose
+// identifiers are the exported fields and methods of a struct, described by
+// a sample value or a nil pointer such as (*Request)(nil). Fields can be
+// renamed with a tag such as `expr:"total"` or hidden with `expr:"-"`.
+// Evaluate it against values of the struct with EvaluateStruct.
+func NewExpressionParserForStruct(expression string, env interface{}) (*ExpressionParser, error) {
+	environment, err := NewEnvironment(env)
+	if err != nil {
+		return nil, err
+	}
+	ep, err := NewExpressionParser(expression, nil)
+	if err != nil {
+		return nil, err
+	}
+	ep.environment = environment
+	ep.tokenizer.SetEnvironment(environment)
+	return ep, nil
+}
+
+// Declare declares a parameter by name and type, such as
+// Declare("price", reflect.TypeOf(float64(0))). Its value is provided when
+// evaluating.
+func (ep *ExpressionParser) Declare(name string, typ reflect.Type) error {
+	return ep.tokenizer.Declare(name, typ)
+}
+
+// Completions returns the identifiers which start with prefix, including
+// the names of registered enums and, after a dot, their members.
+func (ep *ExpressionParser) Completions(prefix string) []string {
+	return ep.tokenizer.Completions(prefix)
+}
+
+// SetMode sets the grammar accepted by the parser. See StatementMode.
+func (ep *ExpressionParser) SetMode(mode Mode) {
+	ep.tokenizer.SetMode(mode)
+}
+
 func (ep *ExpressionParser) GetTokens() []*Token {
 	return ep.tokens
 }
@@ -27,15 +92,102 @@ func (ep *ExpressionParser) parseTokens() ([]*Token, error) {
 		if err != nil {
 			return tokens, err
 		}
-		tokens = append(tokens, ep.tokenizer.token)
+		token := ep.tokenizer.token
+		tokens = append(tokens, &token)
 	}
 	return tokens, nil
 }
 
+// Evaluate parses and evaluates the expression. In StatementMode parameters
+// are read from, and assignments written back to, the provided map; when
+// it's nil the parameters the parser was created with are used. Otherwise
+// the values of parameters are bound when parsing, so the expression is
+// parsed with the provided map's values in place of those the parser was
+// created with.
+// The expression is type checked first, and isn't evaluated if it has type
+// errors.
 func (ep *ExpressionParser) Evaluate(parameters map[string]interface{}) (interface{}, error) {
-	return nil, nil
+	if parameters != nil && len(ep.tokenizer.boundNames()) > 0 {
+		values := ep.tokenizer.parameters
+		ep.tokenizer.parameters = parameters
+		defer func() { ep.tokenizer.parameters = values }()
+	}
+	expression, info, err := ep.Check()
+	if err != nil {
+		return nil, err
+	}
+	if parameters == nil {
+		parameters = ep.tokenizer.parameters
+	}
+	visitor, err := CreateVisitorWithScope(expression, NewScopeFromMap(parameters))
+	if err != nil {
+		return nil, err
+	}
+	result, err := visitor.Visit()
+	if err != nil {
+		return nil, err
+	}
+	return convertToNamedType(result, info.TypeOf(expression)), nil
+}
+
+// EvaluateStruct parses and evaluates the expression against a value of the
+// parser's struct, or a pointer to one. In StatementMode assignments to
+// fields write back to it, which requires a pointer.
+func (ep *ExpressionParser) EvaluateStruct(env interface{}) (interface{}, error) {
+	if ep.environment == nil {
+		return nil, errNoEnvironment
+	}
+	expression, info, err := ep.Check()
+	if err != nil {
+		return nil, err
+	}
+	scope, err := NewScopeFromStruct(ep.environment, env)
+	if err != nil {
+		return nil, err
+	}
+	visitor, err := CreateVisitorWithScope(expression, scope)
+	if err != nil {
+		return nil, err
+	}
+	result, err := visitor.Visit()
+	if err != nil {
+		return nil, err
+	}
+	return convertToNamedType(result, info.TypeOf(expression)), nil
+}
+
+// Check parses the expression and checks its types. See CheckTypes.
+func (ep *ExpressionParser) Check() (Expression, *TypeInfo, error) {
+	expression, err := ep.ParseExpression()
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := CheckTypes(expression, ep.tokenizer.Positions())
+	if err != nil {
+		return nil, nil, err
+	}
+	return expression, info, nil
+}
+
+// convertToNamedType converts a result to the named type the type checker
+// found for it, such as a Celsius computed by the arithmetic visitors as a
+// float64. Other values are returned unchanged.
+func convertToNamedType(val interface{}, typ reflect.Type) interface{} {
+	if val == nil || typ == nil || !isNamed(typ) {
+		return val
+	}
+	v := reflect.ValueOf(val)
+	if v.Type() == typ || v.Kind() != typ.Kind() || !v.Type().ConvertibleTo(typ) {
+		return val
+	}
+	return v.Convert(typ).Interface()
 }
 
 func (ep *ExpressionParser) ParseExpression() (Expression, error) {
 	return ep.tokenizer.Parse()
 }
+
+// SetLibrary makes the functions of a library callable from the expression.
+func (ep *ExpressionParser) SetLibrary(library *Library) {
+	ep.tokenizer.SetLibrary(library)
+}
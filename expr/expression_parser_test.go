@@ -1,6 +1,10 @@
 package expr
 
-import "testing"
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
 
 // TestNewExpressionParser tests creating a new ExpressionParser and validates
 // that the corresponding tokens generated are correct.
@@ -182,6 +186,36 @@ func TestNewExpressionParser(t *testing.T) {
 				},
 			},
 		},
+		{
+			"ranges",
+			"1..5 ^1 ..",
+			[]*Token{
+				{
+					Type: IntegerLiteral,
+					Text: "1",
+				},
+				{
+					Type: DoubleDot,
+					Text: "..",
+				},
+				{
+					Type: IntegerLiteral,
+					Text: "5",
+				},
+				{
+					Type: Caret,
+					Text: "^",
+				},
+				{
+					Type: IntegerLiteral,
+					Text: "1",
+				},
+				{
+					Type: DoubleDot,
+					Text: "..",
+				},
+			},
+		},
 	} {
 		parser, err := NewExpressionParser(test.expression, nil)
 		if err != nil {
@@ -202,3 +236,147 @@ func TestNewExpressionParser(t *testing.T) {
 		}
 	}
 }
+
+func TestEvaluateRebindsValues(t *testing.T) {
+	parser, err := NewExpressionParser("price * qty", map[string]interface{}{"price": 2.5, "qty": 4})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	for _, test := range []struct {
+		parameters map[string]interface{}
+		expected   interface{}
+	}{
+		{nil, 10.0},
+		{map[string]interface{}{"price": 1.0, "qty": 1}, 1.0},
+		// The values the parser was created with are used again.
+		{nil, 10.0},
+	} {
+		if actual, err := parser.Evaluate(test.parameters); err != nil || actual != test.expected {
+			t.Fatalf("%v: expected %v but got %v, %v", test.parameters, test.expected, actual, err)
+		}
+	}
+	if _, err := parser.Evaluate(map[string]interface{}{"price": 1.0}); err == nil || !strings.HasPrefix(err.Error(), "unknown identifier: qty") {
+		t.Fatalf("expected qty to be unknown but got %v", err)
+	}
+}
+
+func TestTrailingTokens(t *testing.T) {
+	for _, test := range []struct {
+		expression string
+		mode       Mode
+		expected   string
+	}{
+		{"x ^ 2", 0, `got "^" at position 2`},
+		{"x 2", 0, `got "2" at position 2`},
+		{"(x + 1))", 0, `got ")" at position 7`},
+		{"x = 1; x", StatementMode, `got ";" at position 5`},
+	} {
+		parser, err := NewExpressionParserWithSchema(test.expression, Schema{"x": reflect.TypeOf(0)})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		parser.SetMode(test.mode)
+		if _, err := parser.Evaluate(map[string]interface{}{"x": 3}); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("%s: expected an error containing %q but got %v", test.expression, test.expected, err)
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+	schema := Schema{
+		"price":  reflect.TypeOf(float64(0)),
+		"qty":    reflect.TypeOf(int(0)),
+		"name":   reflect.TypeOf(""),
+		"indoor": reflect.TypeOf(celsius(0)),
+	}
+	for _, test := range []struct {
+		expression string
+		values     map[string]interface{}
+		expected   interface{}
+	}{
+		{"price * qty", map[string]interface{}{"price": 2.5, "qty": 4}, 10.0},
+		{"price * qty", map[string]interface{}{"price": 2, "qty": uint8(4)}, 8.0},
+		{"name == 'widget' && qty > 1", map[string]interface{}{"name": "widget", "qty": 3}, true},
+		{"indoor + 1.5", map[string]interface{}{"indoor": 20.0}, celsius(21.5)},
+		{"let total = price * qty in total > 10", map[string]interface{}{"price": 5.0, "qty": 3}, true},
+	} {
+		parser, err := NewExpressionParserWithSchema(test.expression, schema)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, _, err := parser.Check(); err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		actual, err := parser.Evaluate(test.values)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Fatalf("%s: expected %v (%T) but got %v (%T)", test.expression, test.expected, test.expected, actual, actual)
+		}
+	}
+}
+
+func TestSchemaErrors(t *testing.T) {
+	schema := Schema{
+		"price": reflect.TypeOf(float64(0)),
+		"qty":   reflect.TypeOf(int(0)),
+	}
+	for _, test := range []struct {
+		expression string
+		expected   string
+	}{
+		{"price * discount", "undeclared identifier: discount"},
+		{"qty + 1.5", "constant 1.5 is truncated to int"},
+		{"price == 'cheap'", "mismatched types"},
+	} {
+		parser, err := NewExpressionParserWithSchema(test.expression, schema)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		_, _, err = parser.Check()
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("%s: expected an error containing %q but got %v", test.expression, test.expected, err)
+		}
+	}
+
+	parser, err := NewExpressionParserWithSchema("price > 1", schema)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := parser.Evaluate(map[string]interface{}{"price": "cheap"}); err == nil || !strings.Contains(err.Error(), "parameter price") {
+		t.Fatalf("expected a value of the wrong type to fail but got %v", err)
+	}
+	if _, err := parser.Evaluate(map[string]interface{}{}); err == nil || !strings.Contains(err.Error(), "unbound parameter") {
+		t.Fatalf("expected a missing value to fail but got %v", err)
+	}
+	if err := parser.Declare("price", reflect.TypeOf("")); err == nil {
+		t.Fatalf("expected redeclaring price as a string to fail")
+	}
+	if err := parser.Declare("let", reflect.TypeOf("")); err == nil {
+		t.Fatalf("expected declaring a keyword to fail")
+	}
+}
+
+func TestSchemaAssignment(t *testing.T) {
+	parser, err := NewExpressionParserWithSchema("total += price", Schema{
+		"total": reflect.TypeOf(float64(0)),
+		"price": reflect.TypeOf(float64(0)),
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	parser.SetMode(StatementMode)
+	values := map[string]interface{}{"total": 10.0, "price": 2.5}
+	if _, err := parser.Evaluate(values); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if values["total"] != 12.5 {
+		t.Fatalf("expected total to be 12.5 but got %v", values["total"])
+	}
+
+	parser.SetMode(ProgramMode)
+	if _, err := parser.Evaluate(values); err == nil || !strings.Contains(err.Error(), "only be assigned in StatementMode") {
+		t.Fatalf("expected assigning a parameter outside of StatementMode to fail but got %v", err)
+	}
+}
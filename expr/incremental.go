@@ -0,0 +1,294 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Evaluating an expression incrementally keeps the value of every node
+// between evaluations, so that when some of the parameters change only the
+// nodes which depend on them are evaluated again. The nodes which depend on
+// each parameter are found once, from the expression's tree, and indexed by
+// the parameter's name.
+//
+// Arithmetic, comparisons, logic, conditionals and casts are evaluated a
+// node at a time. Other nodes, such as member accesses, lambdas and
+// switches, are evaluated whole with the visitors, and since the evaluator
+// doesn't look inside them, they're evaluated again whenever any parameter
+// changes. Expressions which assign to parameters can't be evaluated
+// incrementally, since assigning would change values the evaluator keeps.
+
+// IncrementalEvaluator evaluates an expression, and evaluates it again when
+// some of its parameters change. It isn't safe for concurrent use.
+type IncrementalEvaluator struct {
+	root *incrementalNode
+	// typ is the named type of the result, if any.
+	typ        reflect.Type
+	parameters map[string]interface{}
+	// dependents holds the nodes which depend on each parameter.
+	dependents map[string][]*incrementalNode
+	// volatile holds the nodes which are evaluated again after any change.
+	volatile    []*incrementalNode
+	evaluations uint64
+}
+
+type incrementalNode struct {
+	node     Expression
+	operands []*incrementalNode
+	// visited is set for nodes which are evaluated by their visitors.
+	visited bool
+	valid   bool
+	value   interface{}
+	err     error
+}
+
+// NewIncrementalEvaluator creates an incremental evaluator for an
+// expression, which should have been type checked with CheckTypes and
+// mustn't assign to anything.
+func NewIncrementalEvaluator(expression Expression) (*IncrementalEvaluator, error) {
+	if expression == nil {
+		return nil, errInvalidExpression
+	}
+	ie := &IncrementalEvaluator{
+		parameters: make(map[string]interface{}),
+		dependents: make(map[string][]*incrementalNode),
+	}
+	root, _, _, err := ie.index(expression)
+	if err != nil {
+		return nil, err
+	}
+	ie.root = root
+	return ie, nil
+}
+
+// CompileIncremental parses, type checks and optimizes the expression for
+// evaluating it incrementally. The parser's mode mustn't allow assignments,
+// and its parameters must be declared rather than bound by value, since
+// values bound when parsing are constants which updates can't change.
+func (ep *ExpressionParser) CompileIncremental() (*IncrementalEvaluator, error) {
+	if ep.tokenizer.allowsAssignment() {
+		return nil, errors.New("expressions which can assign to parameters can't be evaluated incrementally")
+	}
+	if bound := ep.tokenizer.boundNames(); len(bound) > 0 {
+		var names []string
+		for name := range bound {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("parameter %s was bound by value when parsing, so it can't be updated; declare it instead", names[0])
+	}
+	expression, info, err := ep.Check()
+	if err != nil {
+		return nil, err
+	}
+	optimized, err := Optimize(expression)
+	if err != nil {
+		return nil, err
+	}
+	ie, err := NewIncrementalEvaluator(optimized)
+	if err != nil {
+		return nil, err
+	}
+	ie.typ = info.TypeOf(expression)
+	return ie, nil
+}
+
+// index creates the node for an expression and its operands, adding it to
+// the dependents of the parameters it reads. It returns those parameters
+// and whether or not the node is volatile.
+func (ie *IncrementalEvaluator) index(e Expression) (*incrementalNode, map[string]bool, bool, error) {
+	if IsAssignment(e.Type()) || isIncrement(e.Type()) {
+		return nil, nil, false, fmt.Errorf("can't evaluate the assignment %v incrementally", e)
+	}
+	n := &incrementalNode{node: e}
+	parameters := make(map[string]bool)
+	var operands []Expression
+	switch x := e.(type) {
+	case *ConstantExpression:
+	case *ParameterExpression:
+		parameters[x.name] = true
+	case *BinaryExpression:
+		operands = []Expression{x.left, x.right}
+	case *UnaryExpression:
+		switch x.Type() {
+		case NegateExpr, UnaryPlusExpr, NotExpr:
+			operands = []Expression{x.operand}
+		default:
+			n.visited = true
+		}
+	case *ConditionalExpression:
+		operands = []Expression{x.test, x.ifTrue, x.ifFalse}
+	case *ConvertExpression:
+		operands = []Expression{x.operand}
+	default:
+		n.visited = true
+	}
+	volatile := n.visited
+	for _, operand := range operands {
+		child, reads, v, err := ie.index(operand)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		n.operands = append(n.operands, child)
+		for name := range reads {
+			parameters[name] = true
+		}
+		volatile = volatile || v
+	}
+	for name := range parameters {
+		ie.dependents[name] = append(ie.dependents[name], n)
+	}
+	if volatile {
+		ie.volatile = append(ie.volatile, n)
+	}
+	return n, parameters, volatile, nil
+}
+
+// Dependencies returns the names of the parameters the expression reads,
+// other than those read by nodes evaluated by their visitors.
+func (ie *IncrementalEvaluator) Dependencies() []string {
+	names := make([]string, 0, len(ie.dependents))
+	for name := range ie.dependents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Evaluations returns the number of nodes which have been evaluated, which
+// shows how much of the expression each update evaluated again.
+func (ie *IncrementalEvaluator) Evaluations() uint64 {
+	return ie.evaluations
+}
+
+// Evaluate evaluates the whole expression with the provided parameters,
+// which replace any it was evaluated with before. The evaluator keeps a copy
+// of them.
+func (ie *IncrementalEvaluator) Evaluate(parameters map[string]interface{}) (interface{}, error) {
+	ie.parameters = make(map[string]interface{}, len(parameters))
+	for name, val := range parameters {
+		ie.parameters[name] = val
+	}
+	ie.invalidate(ie.root)
+	return ie.result()
+}
+
+// Update changes the values of some of the parameters and evaluates the
+// expression again, evaluating only the nodes which depend on them.
+func (ie *IncrementalEvaluator) Update(changed map[string]interface{}) (interface{}, error) {
+	for name, val := range changed {
+		ie.parameters[name] = val
+		for _, n := range ie.dependents[name] {
+			n.valid = false
+		}
+	}
+	if len(changed) > 0 {
+		for _, n := range ie.volatile {
+			n.valid = false
+		}
+	}
+	return ie.result()
+}
+
+// invalidate forgets the values of a node and its operands.
+func (ie *IncrementalEvaluator) invalidate(n *incrementalNode) {
+	n.valid = false
+	for _, operand := range n.operands {
+		ie.invalidate(operand)
+	}
+}
+
+func (ie *IncrementalEvaluator) result() (interface{}, error) {
+	result, err := ie.value(ie.root)
+	if err != nil {
+		return nil, err
+	}
+	return convertToNamedType(result, ie.typ), nil
+}
+
+// value returns the value of a node, evaluating it if it isn't known.
+func (ie *IncrementalEvaluator) value(n *incrementalNode) (interface{}, error) {
+	if !n.valid {
+		n.value, n.err = ie.evaluate(n)
+		n.valid = true
+		ie.evaluations++
+	}
+	return n.value, n.err
+}
+
+// evaluate evaluates a node from the values of its operands, like its
+// visitor evaluates it.
+func (ie *IncrementalEvaluator) evaluate(n *incrementalNode) (interface{}, error) {
+	if n.visited {
+		return visitExpression(n.node, NewScopeFromMap(ie.parameters))
+	}
+	switch e := n.node.(type) {
+	case *ConstantExpression:
+		return e.value, nil
+	case *ParameterExpression:
+		val, ok := ie.parameters[e.name]
+		if !ok {
+			return nil, fmt.Errorf("unbound parameter: %s", e.name)
+		}
+		return evaluateParameter(e, val)
+	case *BinaryExpression:
+		if e.Type() == AndAlsoExpr || e.Type() == OrElseExpr {
+			left, err := ie.boolValue(n.operands[0])
+			if err != nil || left == (e.Type() == OrElseExpr) {
+				return left, err
+			}
+			return ie.boolValue(n.operands[1])
+		}
+		left, err := ie.value(n.operands[0])
+		if err != nil {
+			return nil, err
+		}
+		right, err := ie.value(n.operands[1])
+		if err != nil {
+			return nil, err
+		}
+		return evaluateBinary(e, left, right)
+	case *UnaryExpression:
+		val, err := ie.value(n.operands[0])
+		if err != nil {
+			return nil, err
+		}
+		return evaluateUnary(e, val)
+	case *ConditionalExpression:
+		test, err := ie.boolValue(n.operands[0])
+		if err != nil {
+			return nil, err
+		}
+		branch := n.operands[2]
+		if test {
+			branch = n.operands[1]
+		}
+		val, err := ie.value(branch)
+		if err != nil {
+			return nil, err
+		}
+		return convertToKind(val, e.Kind())
+	case *ConvertExpression:
+		val, err := ie.value(n.operands[0])
+		if err != nil {
+			return nil, err
+		}
+		return evaluateConvert(e, val)
+	}
+	return nil, fmt.Errorf("unknown expression type: %v", n.node.Type())
+}
+
+// boolValue returns the value of a node which must produce a bool.
+func (ie *IncrementalEvaluator) boolValue(n *incrementalNode) (bool, error) {
+	val, err := ie.value(n)
+	if err != nil {
+		return false, err
+	}
+	b, ok := val.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected a bool but got %T: %v", val, n.node)
+	}
+	return b, nil
+}
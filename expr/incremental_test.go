@@ -0,0 +1,155 @@
+package expr
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIncrementalEvaluatorMatchesVisitors(t *testing.T) {
+	updates := []map[string]interface{}{
+		{"price": 12.5, "qty": 3, "count": int64(7), "active": true, "name": "widget", "discount": 0.5, "indoor": celsius(21), "tags": []string{"a", "b"}},
+		{"qty": 0},
+		{"active": false, "discount": nil},
+		{"price": 40.0, "tags": []string{"b"}},
+		{"count": int64(-2), "qty": 2, "indoor": celsius(-4)},
+		{},
+	}
+	for _, expression := range []string{
+		"price * qty > 30 && active",
+		"price * qty + count * 2",
+		"count / qty",
+		"-price + +qty",
+		"!active || qty == 3",
+		"qty >= count ? price : qty",
+		"discount * price",
+		"discount == null",
+		"indoor + 1.5",
+		"'b' in tags && price > 20",
+		"let x = qty * 2 in x + count",
+		"qty switch { 3 => 'three', _ => 'other' }",
+		"int64(price) + count",
+	} {
+		parser, err := NewExpressionParserWithSchema(expression, compileSchema)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", expression, err)
+		}
+		ie, err := parser.CompileIncremental()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", expression, err)
+		}
+		values := make(map[string]interface{})
+		for i, update := range updates {
+			for name, val := range update {
+				values[name] = val
+			}
+			expected, expectedErr := parser.Evaluate(values)
+			var actual interface{}
+			if i == 0 {
+				actual, err = ie.Evaluate(update)
+			} else {
+				actual, err = ie.Update(update)
+			}
+			if (err == nil) != (expectedErr == nil) || (err != nil && err.Error() != expectedErr.Error()) {
+				t.Fatalf("%s with %v: expected error %v but got %v", expression, values, expectedErr, err)
+			}
+			if !reflect.DeepEqual(actual, expected) {
+				t.Fatalf("%s with %v: expected %v (%T) but got %v (%T)", expression, values, expected, expected, actual, actual)
+			}
+		}
+	}
+}
+
+func TestIncrementalEvaluatorUpdates(t *testing.T) {
+	parser, err := NewExpressionParserWithSchema("price * qty + count * 2 > 30 && active", compileSchema)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	ie, err := parser.CompileIncremental()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if dependencies := ie.Dependencies(); !reflect.DeepEqual(dependencies, []string{"active", "count", "price", "qty"}) {
+		t.Fatalf("unexpected dependencies %v", dependencies)
+	}
+	result, err := ie.Evaluate(map[string]interface{}{"price": 1.0, "qty": 2, "count": int64(3), "active": true})
+	if err != nil || result != false {
+		t.Fatalf("expected false but got %v, %v", result, err)
+	}
+	for _, test := range []struct {
+		changed     map[string]interface{}
+		expected    bool
+		evaluations uint64
+	}{
+		{nil, false, 0},
+		// count, count * 2, the sum, the comparison and &&, which evaluates
+		// active for the first time.
+		{map[string]interface{}{"count": int64(20)}, true, 6},
+		{map[string]interface{}{"active": false}, false, 2},
+		// price, price * qty, the sum, the comparison and &&, whose right
+		// operand is known.
+		{map[string]interface{}{"price": 2.0}, false, 5},
+		{map[string]interface{}{"active": true, "qty": 0}, true, 6},
+	} {
+		before := ie.Evaluations()
+		result, err := ie.Update(test.changed)
+		if err != nil || result != test.expected {
+			t.Fatalf("%v: expected %v but got %v, %v", test.changed, test.expected, result, err)
+		}
+		if evaluations := ie.Evaluations() - before; evaluations != test.evaluations {
+			t.Fatalf("%v: expected %d evaluations but got %d", test.changed, test.evaluations, evaluations)
+		}
+	}
+}
+
+func TestIncrementalEvaluatorErrors(t *testing.T) {
+	parser, err := NewExpressionParserWithSchema("price = 2", compileSchema)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	parser.SetMode(StatementMode)
+	if _, err := parser.CompileIncremental(); err == nil {
+		t.Fatalf("expected an error for an expression which can assign")
+	}
+	parser, err = NewExpressionParser("price * qty", map[string]interface{}{"price": 2.5, "qty": 3})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := parser.CompileIncremental(); err == nil || !strings.Contains(err.Error(), "parameter price was bound by value") {
+		t.Fatalf("expected an error for parameters bound by value but got %v", err)
+	}
+	if err := parser.Declare("price", reflect.TypeOf(0.0)); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if err := parser.Declare("qty", reflect.TypeOf(0)); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	ie, err := parser.CompileIncremental()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := ie.Evaluate(map[string]interface{}{"price": 2.5, "qty": 3}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if actual, err := ie.Update(map[string]interface{}{"qty": 4}); err != nil || actual != 10.0 {
+		t.Fatalf("expected 10 but got %v, %v", actual, err)
+	}
+	if _, err := NewIncrementalEvaluator(nil); err != errInvalidExpression {
+		t.Fatalf("expected %v but got %v", errInvalidExpression, err)
+	}
+
+	parser, err = NewExpressionParserWithSchema("price * 2", compileSchema)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	ie, err = parser.CompileIncremental()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := ie.Evaluate(nil); err == nil || err.Error() != "unbound parameter: price" {
+		t.Fatalf("expected an unbound parameter but got %v", err)
+	}
+	if result, err := ie.Update(map[string]interface{}{"price": 4.0}); err != nil || result != 8.0 {
+		t.Fatalf("expected 8 but got %v, %v", result, err)
+	}
+}
@@ -0,0 +1,64 @@
+package expr
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// IsExpression tests a value against a pattern, as in x is > 5 and < 10.
+type IsExpression struct {
+	self    *AbstractExpression
+	operand Expression
+	pattern Pattern
+}
+
+func NewIsExpression(operand Expression, pattern Pattern) *IsExpression {
+	return &IsExpression{
+		self: &AbstractExpression{
+			nodeType: IsExpr,
+			kind:     reflect.Bool,
+		},
+		operand: operand,
+		pattern: pattern,
+	}
+}
+
+func (e *IsExpression) Operand() Expression {
+	return e.operand
+}
+
+func (e *IsExpression) Pattern() Pattern {
+	return e.pattern
+}
+
+func (e *IsExpression) Kind() reflect.Kind {
+	return e.self.kind
+}
+
+func (e *IsExpression) Type() ExpressionType {
+	return e.self.nodeType
+}
+
+func (e *IsExpression) NodeType() string {
+	return "IsExpression"
+}
+
+func (e *IsExpression) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("(%v is %v)", e.operand, e.pattern)
+}
+
+// CreateIs creates an is expression. Patterns which can never match a value
+// of the operand's kind are an error.
+func CreateIs(operand Expression, pattern Pattern) (Expression, error) {
+	if operand == nil || pattern == nil {
+		return nil, errInvalidExpression
+	}
+	analysis := AnalyzeSwitch(operand.Kind(), []*SwitchArm{{Pattern: pattern}})
+	if len(analysis.Unreachable) > 0 {
+		return nil, fmt.Errorf("a value of kind %v never matches the pattern %v", operand.Kind(), pattern)
+	}
+	return NewIsExpression(operand, pattern), nil
+}
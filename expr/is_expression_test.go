@@ -0,0 +1,81 @@
+package expr
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIsEvaluation(t *testing.T) {
+	parameters := map[string]interface{}{
+		"x":      7,
+		"name":   "pop",
+		"values": []interface{}{int64(12), nil, "twelve"},
+	}
+	for _, test := range []struct {
+		expression string
+		expected   interface{}
+	}{
+		{"x is > 5 and < 10", true},
+		{"x is > 5 and < 7", false},
+		{"x is 7", true},
+		{"x is not 7", false},
+		{"x is 1 or 2 or 7", true},
+		{"x is (< 0 or > 100)", false},
+		{"x is int", true},
+		{`name is "pop"`, true},
+		{`name is >= "a" and < "q"`, true},
+		{"values[0] is int64", true},
+		{"values[0] is string", false},
+		{"values[2] is string", true},
+		{"values[0] is not null", true},
+		{"values[1] is null", true},
+		{"values[1] is > 5", false},
+		{"values[0] is double", false},
+	} {
+		parser, err := NewExpressionParser(test.expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expression, err := parser.ParseExpression()
+		if err != nil {
+			t.Fatalf("%s: unexpected parse err: %v", test.expression, err)
+		}
+		if expression.Kind() != reflect.Bool {
+			t.Fatalf("%s: expected %v but got %v", test.expression, reflect.Bool, expression.Kind())
+		}
+		visitor, err := CreateVisitorFromExpression(expression)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		actual, err := visitor.Visit()
+		if err != nil {
+			t.Fatalf("%s: unexpected evaluation err: %v", test.expression, err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Fatalf("%s: expected %v but got %v", test.expression, test.expected, actual)
+		}
+	}
+}
+
+func TestIsParseErrors(t *testing.T) {
+	parameters := map[string]interface{}{
+		"x":    7,
+		"name": "pop",
+	}
+	for _, expression := range []string{
+		"x is string",
+		"x is null",
+		"x is > 5 and < 3",
+		`x is "seven"`,
+		"name is < 5",
+		"x is",
+	} {
+		parser, err := NewExpressionParser(expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, err := parser.ParseExpression(); err == nil {
+			t.Fatalf("expected %s to error but it didn't", expression)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package expr
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// MaxCallDepth limits how deeply user-defined functions can call each other,
+// so runaway recursion fails rather than exhausting the stack.
+const MaxCallDepth = 256
+
+// LambdaExpression is a user-defined function, as in def tax(x) = x * 0.2.
+// Evaluating it creates a Closure over the current scope.
+type LambdaExpression struct {
+	self       *AbstractExpression
+	name       string
+	parameters []*ParameterExpression
+	body       Expression
+}
+
+func NewLambdaExpression(name string, parameters []*ParameterExpression, body Expression) *LambdaExpression {
+	return &LambdaExpression{
+		self: &AbstractExpression{
+			nodeType: LambdaExpr,
+			kind:     reflect.Func,
+		},
+		name:       name,
+		parameters: parameters,
+		body:       body,
+	}
+}
+
+func (e *LambdaExpression) Name() string {
+	return e.name
+}
+
+func (e *LambdaExpression) Parameters() []*ParameterExpression {
+	return e.parameters
+}
+
+func (e *LambdaExpression) Body() Expression {
+	return e.body
+}
+
+// ReturnKind returns the kind of the function's result. It's unknown while
+// the body of a recursive function is being parsed.
+func (e *LambdaExpression) ReturnKind() reflect.Kind {
+	if e.body == nil {
+		return reflect.Interface
+	}
+	return e.body.Kind()
+}
+
+func (e *LambdaExpression) Kind() reflect.Kind {
+	return e.self.kind
+}
+
+func (e *LambdaExpression) Type() ExpressionType {
+	return e.self.nodeType
+}
+
+func (e *LambdaExpression) NodeType() string {
+	return "LambdaExpression"
+}
+
+func (e *LambdaExpression) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	var parameters []string
+	for _, parameter := range e.parameters {
+		parameters = append(parameters, parameter.String())
+	}
+	return fmt.Sprintf("%s(%s) => %v", e.name, strings.Join(parameters, ", "), e.body)
+}
+
+// Closure is the value of a function: its definition along with the scope
+// it was defined in, which its body can refer to.
+type Closure struct {
+	lambda *LambdaExpression
+	scope  *Scope
+}
+
+func (c *Closure) Lambda() *LambdaExpression {
+	return c.lambda
+}
+
+func (c *Closure) String() string {
+	return c.lambda.String()
+}
+
+// Call calls the function with the provided arguments.
+func (c *Closure) Call(args ...interface{}) (interface{}, error) {
+	return c.call(args, 0)
+}
+
+func (c *Closure) call(args []interface{}, depth int) (interface{}, error) {
+	if depth >= MaxCallDepth {
+		return nil, fmt.Errorf("calling %s exceeded the maximum call depth of %d", c.lambda.name, MaxCallDepth)
+	}
+	if len(args) != len(c.lambda.parameters) {
+		return nil, fmt.Errorf("%s takes %d arguments but got %d", c.lambda.name, len(c.lambda.parameters), len(args))
+	}
+	scope := NewScope(c.scope)
+	scope.depth = depth + 1
+	for i, parameter := range c.lambda.parameters {
+		val, err := convertToKind(args[i], parameter.Kind())
+		if err != nil {
+			return nil, err
+		}
+		scope.Define(parameter.name, val)
+	}
+	result, err := visitExpression(c.lambda.body, scope)
+	if err != nil {
+		return nil, err
+	}
+	return convertToKind(result, c.lambda.ReturnKind())
+}
+
+// InvokeExpression calls a user-defined function. Its target evaluates to
+// the Closure being called.
+type InvokeExpression struct {
+	self      *AbstractExpression
+	target    Expression
+	lambda    *LambdaExpression
+	arguments []Expression
+}
+
+func NewInvokeExpression(target Expression, lambda *LambdaExpression, arguments []Expression) *InvokeExpression {
+	return &InvokeExpression{
+		self: &AbstractExpression{
+			nodeType: InvokeExpr,
+			kind:     lambda.ReturnKind(),
+		},
+		target:    target,
+		lambda:    lambda,
+		arguments: arguments,
+	}
+}
+
+func (e *InvokeExpression) Target() Expression {
+	return e.target
+}
+
+func (e *InvokeExpression) Lambda() *LambdaExpression {
+	return e.lambda
+}
+
+func (e *InvokeExpression) Arguments() []Expression {
+	return e.arguments
+}
+
+func (e *InvokeExpression) Kind() reflect.Kind {
+	return e.self.kind
+}
+
+func (e *InvokeExpression) Type() ExpressionType {
+	return e.self.nodeType
+}
+
+func (e *InvokeExpression) NodeType() string {
+	return "InvokeExpression"
+}
+
+func (e *InvokeExpression) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	var arguments []string
+	for _, argument := range e.arguments {
+		arguments = append(arguments, argument.String())
+	}
+	return fmt.Sprintf("%s(%s)", e.lambda.name, strings.Join(arguments, ", "))
+}
+
+// CreateLambda creates a function. Parameter names must be unique.
+func CreateLambda(name string, parameters []*ParameterExpression, body Expression) (*LambdaExpression, error) {
+	if body == nil {
+		return nil, errInvalidExpression
+	}
+	if err := validateParameters(name, parameters); err != nil {
+		return nil, err
+	}
+	return NewLambdaExpression(name, parameters, body), nil
+}
+
+// CreateInvoke creates a call of lambda through target. Arguments must be
+// assignable to the parameters they're passed to.
+func CreateInvoke(target Expression, lambda *LambdaExpression, arguments []Expression) (Expression, error) {
+	if target == nil || lambda == nil {
+		return nil, errInvalidExpression
+	}
+	if len(arguments) != len(lambda.parameters) {
+		return nil, fmt.Errorf("%s takes %d arguments but got %d", lambda.name, len(lambda.parameters), len(arguments))
+	}
+	for i, argument := range arguments {
+		if argument == nil {
+			return nil, errInvalidExpression
+		}
+		parameter := lambda.parameters[i]
+		if !isAssignableKind(argument.Kind(), parameter.Kind()) && !isImplicitlyConvertible(argument, parameter.typ) {
+			return nil, fmt.Errorf("can't pass a value of kind %v as %s of %s, which is %v", argument.Kind(), parameter.name, lambda.name, parameter.Kind())
+		}
+	}
+	return NewInvokeExpression(target, lambda, arguments), nil
+}
+
+func validateParameters(name string, parameters []*ParameterExpression) error {
+	names := make(map[string]bool)
+	for _, parameter := range parameters {
+		if parameter == nil {
+			return errInvalidExpression
+		}
+		if names[parameter.name] {
+			return fmt.Errorf("%s has more than one parameter named %s", name, parameter.name)
+		}
+		names[parameter.name] = true
+	}
+	return nil
+}
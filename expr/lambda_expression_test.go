@@ -0,0 +1,138 @@
+package expr
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFunctionEvaluation(t *testing.T) {
+	parameters := map[string]interface{}{
+		"price":    100.0,
+		"shipping": 10.0,
+		"rate":     0.5,
+		"qty":      3,
+	}
+	for _, test := range []struct {
+		expression string
+		expected   interface{}
+	}{
+		{"def tax(x) = x * 0.2; tax(price) + tax(shipping)", 22.0},
+		{"def tax(double x) = x * rate; tax(qty)", 1.5},
+		{"def area(w, h) = w * h; area(qty, 2)", 6},
+		{"def fact(long n) = n <= 1 ? 1 : n * fact(n - 1); fact(5)", 120},
+		{"def fib(n) = n < 2 ? n : fib(n - 1) + fib(n - 2); fib(10)", 55},
+		{"def double(x) = x * 2; def quad(x) = double(double(x)); quad(qty)", 12},
+		{"def scaled(x) = x * rate; let rate = 10 in scaled(2)", 1.0},
+		{"def sign(x) = x switch { < 0 => -1, 0 => 0, _ => 1 }; sign(qty - 5)", -1},
+		{"def big(x) = x > 50; big(price) && !big(shipping)", true},
+	} {
+		parser, err := NewExpressionParser(test.expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		actual, err := parser.Evaluate(nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Fatalf("%s: expected %v (%T) but got %v (%T)", test.expression, test.expected, test.expected, actual, actual)
+		}
+	}
+}
+
+func TestFunctionClosures(t *testing.T) {
+	parameters := map[string]interface{}{"rate": 0.5}
+	parser, err := NewExpressionParser(`
+		var bonus = 1.0;
+		def pay(x) = x * rate + bonus;
+		bonus = 2.0;
+		rate = 0.1;
+		pay(10)
+	`, parameters)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	parser.SetMode(ProgramMode | StatementMode)
+	actual, err := parser.Evaluate(nil)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	// Closures see the current values of the variables they refer to.
+	if actual != 3.0 {
+		t.Fatalf("expected 3 but got %v", actual)
+	}
+}
+
+func TestFunctionErrors(t *testing.T) {
+	for _, test := range []struct {
+		expression string
+		expected   string
+	}{
+		{"def f(x) = x; f(1, 2)", "takes 1 arguments"},
+		{"def f(x, x) = x; f(1)", "more than one parameter"},
+		{"def f(double x) = x; f('a')", "can't pass"},
+		{"def f(x) = x f(1)", "expected Semicolon"},
+		{"def f(x) = f(x); f(1)", "maximum call depth"},
+		{"g(1)", "unknown identifier"},
+	} {
+		parser, err := NewExpressionParser(test.expression, nil)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		_, err = parser.Evaluate(nil)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("%s: expected an error containing %q but got %v", test.expression, test.expected, err)
+		}
+	}
+}
+
+func TestLibrary(t *testing.T) {
+	library := NewLibrary()
+	err := library.Define("def tax(x) = x * rate; def gross(x) = x + tax(x)", map[string]interface{}{"rate": 0.2})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if err := library.Define("def fee(x) = gross(x) > 100 ? 5 : 10", nil); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if names := library.Names(); !reflect.DeepEqual(names, []string{"fee", "gross", "tax"}) {
+		t.Fatalf("unexpected names: %v", names)
+	}
+
+	for _, test := range []struct {
+		expression string
+		expected   interface{}
+	}{
+		{"gross(price)", 120.0},
+		{"tax(price) + fee(price)", 25.0},
+		{"def tax(x) = 0; tax(price)", 0},
+	} {
+		parser, err := NewExpressionParser(test.expression, map[string]interface{}{"price": 100.0})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		parser.SetLibrary(library)
+		actual, err := parser.Evaluate(nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Fatalf("%s: expected %v (%T) but got %v (%T)", test.expression, test.expected, test.expected, actual, actual)
+		}
+	}
+
+	actual, err := library.Call("gross", 50)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if actual != 60.0 {
+		t.Fatalf("expected 60 but got %v", actual)
+	}
+	if _, err := library.Call("missing"); err == nil {
+		t.Fatalf("expected calling an unknown function to fail")
+	}
+	if err := library.Define("tax(1)", nil); err == nil {
+		t.Fatalf("expected a library to only accept definitions")
+	}
+}
@@ -0,0 +1,82 @@
+package expr
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Library holds user-defined functions which can be shared by many
+// expressions. It's safe for concurrent use.
+type Library struct {
+	mu        sync.RWMutex
+	functions map[string]*Closure
+}
+
+// NewLibrary creates an empty library.
+func NewLibrary() *Library {
+	return &Library{
+		functions: make(map[string]*Closure),
+	}
+}
+
+// Define parses one or more ;-separated function definitions, such as
+// def tax(x) = x * rate, and adds them to the library. Parameters the
+// functions refer to are bound when they're defined, and each function can
+// call those defined before it.
+func (l *Library) Define(source string, parameters map[string]interface{}) error {
+	t, err := NewTokenizer(source, parameters)
+	if err != nil {
+		return err
+	}
+	t.SetLibrary(l)
+	bindings, err := t.ParseFunctions()
+	if err != nil {
+		return err
+	}
+	scope := NewScope(NewScopeFromMap(parameters))
+	closures := make([]*Closure, len(bindings))
+	for i, binding := range bindings {
+		closures[i] = &Closure{
+			lambda: binding.Value.(*LambdaExpression),
+			scope:  scope,
+		}
+		scope.Define(binding.Variable.name, closures[i])
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, closure := range closures {
+		l.functions[closure.lambda.name] = closure
+	}
+	return nil
+}
+
+// Lookup returns the function with the provided name.
+func (l *Library) Lookup(name string) (*Closure, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	closure, ok := l.functions[name]
+	return closure, ok
+}
+
+// Names returns the names of the library's functions in sorted order.
+func (l *Library) Names() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var names []string
+	for name := range l.functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Call calls the named function with the provided arguments.
+func (l *Library) Call(name string, args ...interface{}) (interface{}, error) {
+	closure, ok := l.Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown function: %s", name)
+	}
+	return closure.Call(args...)
+}
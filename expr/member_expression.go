@@ -0,0 +1,147 @@
+package expr
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// MemberExpression accesses an exported field of a struct or an entry of a
+// map with string keys, as in order.Total.
+type MemberExpression struct {
+	self    *AbstractExpression
+	operand Expression
+	name    string
+	typ     reflect.Type
+}
+
+func NewMemberExpression(operand Expression, name string, typ reflect.Type) *MemberExpression {
+	kind := reflect.Interface
+	if typ != nil {
+		kind = valueKind(typ)
+	}
+	return &MemberExpression{
+		self: &AbstractExpression{
+			nodeType: MemberExpr,
+			kind:     kind,
+		},
+		operand: operand,
+		name:    name,
+		typ:     typ,
+	}
+}
+
+func (e *MemberExpression) Operand() Expression {
+	return e.operand
+}
+
+func (e *MemberExpression) Name() string {
+	return e.name
+}
+
+// ValueType returns the type of the member, or nil if it isn't known.
+func (e *MemberExpression) ValueType() reflect.Type {
+	return e.typ
+}
+
+func (e *MemberExpression) Kind() reflect.Kind {
+	return e.self.kind
+}
+
+func (e *MemberExpression) Type() ExpressionType {
+	return e.self.nodeType
+}
+
+func (e *MemberExpression) NodeType() string {
+	return "MemberExpression"
+}
+
+func (e *MemberExpression) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%v.%s", e.operand, e.name)
+}
+
+// CreateMember creates a member access. When the operand's type is known the
+// member must exist; otherwise it's resolved during evaluation.
+func CreateMember(operand Expression, name string) (Expression, error) {
+	if operand == nil {
+		return nil, errInvalidExpression
+	}
+	typ := staticTypeOf(operand)
+	if typ == nil {
+		if operand.Kind() != reflect.Interface && operand.Kind() != reflect.Struct &&
+			operand.Kind() != reflect.Map && operand.Kind() != reflect.Ptr {
+			return nil, fmt.Errorf("a value of kind %v has no member %s", operand.Kind(), name)
+		}
+		return NewMemberExpression(operand, name, nil), nil
+	}
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Struct:
+		field, ok := typ.FieldByName(name)
+		if !ok || field.PkgPath != "" {
+			return nil, fmt.Errorf("%v has no exported field %s", typ, name)
+		}
+		return NewMemberExpression(operand, name, field.Type), nil
+	case reflect.Map:
+		if typ.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("%v has no member %s", typ, name)
+		}
+		return NewMemberExpression(operand, name, typ.Elem()), nil
+	case reflect.Interface:
+		return NewMemberExpression(operand, name, nil), nil
+	}
+	return nil, fmt.Errorf("%v has no member %s", typ, name)
+}
+
+// staticTypeOf returns the type of an expression when it's known before
+// evaluation, or nil if only its kind is known.
+func staticTypeOf(expr Expression) reflect.Type {
+	switch e := expr.(type) {
+	case *ConstantExpression:
+		if e.typ != nil {
+			return e.typ
+		}
+		if e.value != nil {
+			return reflect.TypeOf(e.value)
+		}
+	case *ParameterExpression:
+		return e.typ
+	case *MemberExpression:
+		return e.typ
+	case *FieldExpression:
+		return e.typ
+	case *CallExpression:
+		return e.ValueType()
+	case *NullableMemberExpression:
+		return e.typ
+	case *ConvertExpression:
+		return e.typ
+	case *BinaryExpression:
+		if e.operator != nil && !IsAssignment(e.Type()) {
+			return e.operator.ResultType()
+		}
+		if e.Type() == OrExpr {
+			// Combined flags keep the type of their enum.
+			if isLiteral(e.left) {
+				return staticTypeOf(e.right)
+			}
+			return staticTypeOf(e.left)
+		}
+	case *UnaryExpression:
+		if e.operator != nil {
+			return e.operator.ResultType()
+		}
+	}
+	return nil
+}
+
+func evaluateMember(operand interface{}, name string) (interface{}, error) {
+	if val, ok := lookupMember(operand, name); ok {
+		return val, nil
+	}
+	return nil, fmt.Errorf("%T has no member %s", operand, name)
+}
@@ -0,0 +1,122 @@
+package expr
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+var jsonNumberType = reflect.TypeOf(json.Number(""))
+
+// Values supplied by the host, whether as parameters, fields of the
+// environment or members of other values, are normalised before they're
+// used:
+//   - pointers to pointers are dereferenced down to a single pointer, which
+//     for basic values is a nullable value;
+//   - pointers to interfaces and interfaces are unwrapped to the values they
+//     hold;
+//   - a json.Number becomes an int64, or a float64 if it isn't an integer.
+//
+// Named types, such as type Score int, time.Duration and time.Time, are kept
+// so that their members and operators resolve.
+
+// normalizeValue returns a value in the form expressions evaluate.
+func normalizeValue(val interface{}) interface{} {
+	switch val := val.(type) {
+	case nil:
+		return nil
+	case json.Number:
+		return normalizeNumber(val)
+	}
+	v := reflect.ValueOf(val)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		elem := v.Elem()
+		if elem.Kind() != reflect.Ptr && elem.Kind() != reflect.Interface {
+			break
+		}
+		v = elem
+		if v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return nil
+			}
+			return normalizeValue(v.Elem().Interface())
+		}
+	}
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		// A nil pointer to a pointer is null, and keeps its nullable type.
+		typ := normalizeType(v.Type())
+		if typ == nil {
+			return nil
+		}
+		return reflect.Zero(typ).Interface()
+	}
+	return v.Interface()
+}
+
+// normalizeType returns the type of the normalised values of a type, or nil
+// if it's only known once a value is normalised.
+func normalizeType(typ reflect.Type) reflect.Type {
+	if typ == nil || typ == jsonNumberType {
+		return nil
+	}
+	for typ.Kind() == reflect.Ptr {
+		switch typ.Elem().Kind() {
+		case reflect.Ptr:
+			typ = typ.Elem()
+		case reflect.Interface:
+			return nil
+		default:
+			return typ
+		}
+	}
+	if typ.Kind() == reflect.Interface {
+		return nil
+	}
+	return typ
+}
+
+// normalizeNumber converts a json.Number to an int64, or to a float64 if it
+// isn't an integer. Numbers which are neither are kept as strings.
+func normalizeNumber(n json.Number) interface{} {
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	if f, err := n.Float64(); err == nil {
+		return f
+	}
+	return string(n)
+}
+
+// denormalizeValue converts a number to a json.Number for storing in
+// a location of that type.
+func denormalizeValue(val interface{}, typ reflect.Type) (reflect.Value, bool) {
+	if typ != jsonNumberType {
+		return reflect.Value{}, false
+	}
+	switch v := reflect.ValueOf(val); {
+	case IsUnsigned(v.Kind()):
+		return reflect.ValueOf(json.Number(strconv.FormatUint(v.Uint(), 10))), true
+	case IsInteger(v.Kind()):
+		return reflect.ValueOf(json.Number(strconv.FormatInt(v.Int(), 10))), true
+	case isFloatKind(v.Kind()):
+		return reflect.ValueOf(json.Number(strconv.FormatFloat(v.Float(), 'g', -1, 64))), true
+	}
+	return reflect.Value{}, false
+}
+
+// Times are ordered, and durations can be subtracted from them, whichever
+// methods the standard library's time.Time has.
+func init() {
+	for nodeType, fn := range map[ExpressionType]interface{}{
+		LessThanExpr:           func(a, b time.Time) bool { return a.Before(b) },
+		LessThanOrEqualExpr:    func(a, b time.Time) bool { return !a.After(b) },
+		GreaterThanExpr:        func(a, b time.Time) bool { return a.After(b) },
+		GreaterThanOrEqualExpr: func(a, b time.Time) bool { return !a.Before(b) },
+		SubtractExpr:           func(t time.Time, d time.Duration) time.Time { return t.Add(-d) },
+	} {
+		if err := RegisterOperator(nodeType, fn); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package expr
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type score int
+
+type payload struct {
+	Amount json.Number
+	Extra  interface{}
+}
+
+func TestNormalizedParameters(t *testing.T) {
+	five := 5
+	pointer := &five
+	var boxed interface{} = 7
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	parameters := map[string]interface{}{
+		"p":      &pointer,
+		"none":   (**int)(nil),
+		"boxed":  &boxed,
+		"n":      json.Number("42"),
+		"f":      json.Number("1.5"),
+		"d":      2 * time.Second,
+		"s":      score(3),
+		"start":  start,
+		"end":    start.Add(48 * time.Hour),
+		"record": map[string]interface{}{"x": json.Number("3")},
+		"items":  []interface{}{json.Number("2.5")},
+	}
+	for _, test := range []struct {
+		expression string
+		expected   interface{}
+	}{
+		{"p + 1", 6},
+		{"none + 1", nil},
+		{"none == null", true},
+		{"boxed * 2", 14},
+		{"n + 1", int64(43)},
+		{"f * 2", 3.0},
+		{"n == 42", true},
+		{"d * 2", 4 * time.Second},
+		{"d > 1", true},
+		{"s + 1", score(4)},
+		{"s >= 3", true},
+		{"start < end", true},
+		{"end - start", 48 * time.Hour},
+		{"end - d > start", true},
+		{"record.x > 2", true},
+		{"items[0] * 2", 5.0},
+	} {
+		parser, err := NewExpressionParser(test.expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		actual, err := parser.Evaluate(nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Fatalf("%s: expected %v (%T) but got %v (%T)", test.expression, test.expected, test.expected, actual, actual)
+		}
+	}
+}
+
+func TestNormalizedFields(t *testing.T) {
+	parser, err := NewExpressionParserForStruct("Amount = Amount * 2 + Extra; Amount", (*payload)(nil))
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	parser.SetMode(StatementMode | ProgramMode)
+	p := &payload{Amount: json.Number("20"), Extra: json.Number("2")}
+	actual, err := parser.EvaluateStruct(p)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if actual != int64(42) || p.Amount != "42" {
+		t.Fatalf("expected the amount to be stored as a json.Number but got %v and %v", actual, p.Amount)
+	}
+}
+
+func TestCreateLiteralNormalizes(t *testing.T) {
+	five := 5
+	pointer := &five
+	for _, test := range []struct {
+		value interface{}
+		kind  reflect.Kind
+	}{
+		{&pointer, reflect.Int},
+		{json.Number("3"), reflect.Int64},
+		{json.Number("3.5"), reflect.Float64},
+		{score(1), reflect.Int},
+	} {
+		if kind := CreateLiteral(test.value, "").Kind(); kind != test.kind {
+			t.Fatalf("%T: expected kind %v but got %v", test.value, test.kind, kind)
+		}
+	}
+
+	var unknown interface{}
+	parser, err := NewExpressionParser("x == null", map[string]interface{}{"x": &unknown})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if actual, err := parser.Evaluate(nil); err != nil || actual != true {
+		t.Fatalf("expected a pointer to a nil interface to be null but got %v, %v", actual, err)
+	}
+}
@@ -0,0 +1,250 @@
+package expr
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const (
+	hasValueMember          = "HasValue"
+	valueMember             = "Value"
+	getValueOrDefaultMember = "GetValueOrDefault"
+)
+
+// Nullable values are either pointers to basic values, such as *int64, or
+// structs holding a value and a Valid flag, such as sql.NullInt64. Like
+// C#'s int?, they either hold a value of their underlying type or are null:
+// arithmetic with null is null and comparisons with null are false.
+
+// nullableType returns the underlying type of a nullable type.
+func nullableType(typ reflect.Type) (reflect.Type, bool) {
+	if typ == nil {
+		return nil, false
+	}
+	switch typ.Kind() {
+	case reflect.Ptr:
+		if elem := typ.Elem(); isBasicKind(elem.Kind()) {
+			return elem, true
+		}
+	case reflect.Struct:
+		if value, _, ok := nullStructFields(typ); ok {
+			return typ.Field(value).Type, true
+		}
+	}
+	return nil, false
+}
+
+// nullStructFields returns the indexes of the value and Valid fields of a
+// struct such as sql.NullInt64, which has exactly those two fields.
+func nullStructFields(typ reflect.Type) (value int, valid int, ok bool) {
+	if typ.NumField() != 2 {
+		return 0, 0, false
+	}
+	for i := 0; i < 2; i++ {
+		field := typ.Field(i)
+		if field.Name == "Valid" && field.Type.Kind() == reflect.Bool {
+			value = 1 - i
+			return value, i, typ.Field(value).PkgPath == ""
+		}
+	}
+	return 0, 0, false
+}
+
+func isBasicKind(kind reflect.Kind) bool {
+	return IsArithmetic(kind) || kind == reflect.Bool || kind == reflect.String
+}
+
+// valueKind returns the kind of the values of a type, which for nullable
+// types is the kind of their underlying type. Values of unknown types are
+// interfaces.
+func valueKind(typ reflect.Type) reflect.Kind {
+	if typ == nil {
+		return reflect.Interface
+	}
+	if elem, ok := nullableType(typ); ok {
+		return elem.Kind()
+	}
+	return typ.Kind()
+}
+
+// unwrapNullable returns the value a nullable value holds, or nil if it's
+// null. Other values are returned unchanged.
+func unwrapNullable(val interface{}) interface{} {
+	if val == nil {
+		return nil
+	}
+	v := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !isBasicKind(v.Type().Elem().Kind()) {
+			return val
+		}
+		if v.IsNil() {
+			return nil
+		}
+		return v.Elem().Interface()
+	case reflect.Struct:
+		value, valid, ok := nullStructFields(v.Type())
+		if !ok {
+			return val
+		}
+		if !v.Field(valid).Bool() {
+			return nil
+		}
+		return v.Field(value).Interface()
+	}
+	return val
+}
+
+// wrapNullable converts a value to a nullable type, where nil is null.
+func wrapNullable(val interface{}, typ reflect.Type) (reflect.Value, error) {
+	if val == nil {
+		return reflect.Zero(typ), nil
+	}
+	elem, _ := nullableType(typ)
+	v, err := convertValue(val, elem)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	if typ.Kind() == reflect.Ptr {
+		p := reflect.New(elem)
+		p.Elem().Set(v)
+		return p, nil
+	}
+	value, valid, _ := nullStructFields(typ)
+	s := reflect.New(typ).Elem()
+	s.Field(value).Set(v)
+	s.Field(valid).SetBool(true)
+	return s, nil
+}
+
+// NullableMemberExpression is one of the members of a nullable value:
+// HasValue, Value or GetValueOrDefault, which takes an optional default.
+type NullableMemberExpression struct {
+	self         *AbstractExpression
+	operand      Expression
+	name         string
+	defaultValue Expression
+	typ          reflect.Type
+}
+
+func NewNullableMemberExpression(operand Expression, name string, defaultValue Expression, typ reflect.Type) *NullableMemberExpression {
+	return &NullableMemberExpression{
+		self: &AbstractExpression{
+			nodeType: NullableMemberExpr,
+			kind:     typ.Kind(),
+		},
+		operand:      operand,
+		name:         name,
+		defaultValue: defaultValue,
+		typ:          typ,
+	}
+}
+
+func (e *NullableMemberExpression) Operand() Expression {
+	return e.operand
+}
+
+func (e *NullableMemberExpression) Name() string {
+	return e.name
+}
+
+// DefaultValue returns the argument of GetValueOrDefault, which may be nil.
+func (e *NullableMemberExpression) DefaultValue() Expression {
+	return e.defaultValue
+}
+
+// ValueType returns the type of the member.
+func (e *NullableMemberExpression) ValueType() reflect.Type {
+	return e.typ
+}
+
+func (e *NullableMemberExpression) Kind() reflect.Kind {
+	return e.self.kind
+}
+
+func (e *NullableMemberExpression) Type() ExpressionType {
+	return e.self.nodeType
+}
+
+func (e *NullableMemberExpression) NodeType() string {
+	return "NullableMemberExpression"
+}
+
+func (e *NullableMemberExpression) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	if e.name != getValueOrDefaultMember {
+		return fmt.Sprintf("%v.%s", e.operand, e.name)
+	}
+	if e.defaultValue == nil {
+		return fmt.Sprintf("%v.%s()", e.operand, e.name)
+	}
+	return fmt.Sprintf("%v.%s(%v)", e.operand, e.name, e.defaultValue)
+}
+
+// isNullableMember determines whether or not name is a member of nullable
+// values.
+func isNullableMember(name string) bool {
+	return name == hasValueMember || name == valueMember || name == getValueOrDefaultMember
+}
+
+// CreateNullableMember creates a member of a nullable value. Only
+// GetValueOrDefault takes an argument, which must be assignable to the
+// underlying type.
+func CreateNullableMember(operand Expression, name string, arguments []Expression) (Expression, error) {
+	if operand == nil {
+		return nil, errInvalidExpression
+	}
+	elem, ok := nullableType(staticTypeOf(operand))
+	if !ok {
+		return nil, fmt.Errorf("%v isn't nullable", operand)
+	}
+	switch name {
+	case hasValueMember:
+		return NewNullableMemberExpression(operand, name, nil, typeOfKind(reflect.Bool)), nil
+	case valueMember:
+		return NewNullableMemberExpression(operand, name, nil, elem), nil
+	case getValueOrDefaultMember:
+		if len(arguments) > 1 {
+			return nil, fmt.Errorf("%s takes at most 1 argument but got %d", name, len(arguments))
+		}
+		var defaultValue Expression
+		if len(arguments) == 1 {
+			defaultValue = arguments[0]
+			if !isAssignableKind(defaultValue.Kind(), elem.Kind()) {
+				return nil, fmt.Errorf("the default of %v can't be a value of kind %v", operand, defaultValue.Kind())
+			}
+		}
+		return NewNullableMemberExpression(operand, name, defaultValue, elem), nil
+	}
+	return nil, fmt.Errorf("nullable values have no member %s; expected one of %s", name,
+		strings.Join([]string{hasValueMember, valueMember, getValueOrDefaultMember}, ", "))
+}
+
+// evaluateNullableMember evaluates a member of a nullable value. val is the
+// value it holds, or nil if it's null.
+func evaluateNullableMember(e *NullableMemberExpression, val interface{}, scope *Scope) (interface{}, error) {
+	switch e.name {
+	case hasValueMember:
+		return val != nil, nil
+	case valueMember:
+		if val == nil {
+			return nil, fmt.Errorf("%v has no value", e.operand)
+		}
+		return val, nil
+	}
+	if val != nil {
+		return val, nil
+	}
+	if e.defaultValue == nil {
+		return reflect.Zero(e.typ).Interface(), nil
+	}
+	defaultValue, err := visitExpression(e.defaultValue, scope)
+	if err != nil {
+		return nil, err
+	}
+	return convertToKind(defaultValue, e.typ.Kind())
+}
@@ -0,0 +1,132 @@
+package expr
+
+import (
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNullableEvaluation(t *testing.T) {
+	five, zero := int64(5), int64(0)
+	parameters := map[string]interface{}{
+		"some":  &five,
+		"zero":  &zero,
+		"none":  (*int64)(nil),
+		"count": sql.NullInt64{Int64: 3, Valid: true},
+		"empty": sql.NullFloat64{},
+		"flag":  (*bool)(nil),
+	}
+	for _, test := range []struct {
+		expression string
+		expected   interface{}
+	}{
+		{"some + 1", int64(6)},
+		{"none + 1", nil},
+		{"count * some", int64(15)},
+		{"empty * 2.0", nil},
+		{"none > 1", false},
+		{"none <= 1", false},
+		{"zero < 1", true},
+		{"none == null", true},
+		{"some == null", false},
+		{"some == 5", true},
+		{"none == 5", false},
+		{"none != 5", true},
+		{"!flag", nil},
+		{"some.HasValue && !none.HasValue", true},
+		{"count.Value + 1", int64(4)},
+		{"none.GetValueOrDefault()", int64(0)},
+		{"none.GetValueOrDefault(7)", int64(7)},
+		{"some.GetValueOrDefault(7)", int64(5)},
+		{"empty.GetValueOrDefault(1.5)", 1.5},
+	} {
+		parser, err := NewExpressionParser(test.expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		actual, err := parser.Evaluate(nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Fatalf("%s: expected %v (%T) but got %v (%T)", test.expression, test.expected, test.expected, actual, actual)
+		}
+	}
+}
+
+func TestNullableTypes(t *testing.T) {
+	parser, err := NewExpressionParserWithSchema("price * 2", Schema{
+		"price": reflect.TypeOf((*float64)(nil)),
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	expression, info, err := parser.Check()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if typ := info.TypeOf(expression); typ != reflect.TypeOf((*float64)(nil)) {
+		t.Fatalf("expected a lifted operator to be nullable but got %v", typ)
+	}
+	for values, expected := range map[*float64]interface{}{nil: nil, new(float64): 0.0} {
+		actual, err := parser.Evaluate(map[string]interface{}{"price": values})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if actual != expected {
+			t.Fatalf("expected %v but got %v", expected, actual)
+		}
+	}
+}
+
+func TestNullableAssignment(t *testing.T) {
+	values := map[string]interface{}{
+		"total": (*int64)(nil),
+		"score": sql.NullInt64{},
+	}
+	parser, err := NewExpressionParser("total = 2; total += 3; score = total; total = null", values)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	parser.SetMode(StatementMode | ProgramMode)
+	if _, err := parser.Evaluate(values); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if total := values["total"].(*int64); total != nil {
+		t.Fatalf("expected total to be null but got %v", *total)
+	}
+	if score := values["score"].(sql.NullInt64); !score.Valid || score.Int64 != 5 {
+		t.Fatalf("expected score to be 5 but got %+v", score)
+	}
+}
+
+func TestNullableErrors(t *testing.T) {
+	parameters := map[string]interface{}{
+		"none":  (*int64)(nil),
+		"qty":   3,
+		"count": sql.NullInt64{},
+	}
+	for _, test := range []struct {
+		expression string
+		expected   string
+	}{
+		{"none.Value", "has no value"},
+		{"none.Missing", "has no member"},
+		{"none.GetValueOrDefault", "must be called"},
+		{"none.GetValueOrDefault(1, 2)", "at most 1 argument"},
+		{"none.GetValueOrDefault('a')", "can't be a value of kind string"},
+		{"qty.HasValue", "has no member"},
+		{"none ? 1 : 2", "must be a bool"},
+		{"def f(int x) = x; f(count)", "can't pass"},
+	} {
+		parser, err := NewExpressionParser(test.expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		_, err = parser.Evaluate(nil)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("%s: expected an error containing %q but got %v", test.expression, test.expected, err)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package expr
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// operatorMethods maps the operators Go types can implement to the names of
+// the methods which implement them. A type implements an arithmetic
+// operator with a method such as Add(other T) T or Add(other T) (T, error),
+// negation with Neg() T, the comparisons with Compare(other T) int and
+// equality with Equal(other T) bool.
+var operatorMethods = map[ExpressionType]string{
+	AddExpr:                "Add",
+	SubtractExpr:           "Sub",
+	MultiplyExpr:           "Mul",
+	DivideExpr:             "Div",
+	ModuloExpr:             "Mod",
+	NegateExpr:             "Neg",
+	LessThanExpr:           "Compare",
+	LessThanOrEqualExpr:    "Compare",
+	GreaterThanExpr:        "Compare",
+	GreaterThanOrEqualExpr: "Compare",
+	EqualExpr:              "Equal",
+	NotEqualExpr:           "Equal",
+}
+
+var (
+	operatorsMu sync.RWMutex
+	operators   = make(map[ExpressionType][]*Operator)
+)
+
+// Operator is a user-defined implementation of an operator, either a method
+// of its left operand's type or a function registered with RegisterOperator.
+type Operator struct {
+	nodeType ExpressionType
+	name     string
+	fn       reflect.Value
+	// parameters holds the types of the operands, including the receiver
+	// of a method.
+	parameters []reflect.Type
+	// compare is set when a comparison or equality is implemented by a
+	// Compare method, whose result is compared with 0.
+	compare bool
+	// negate is set when != is implemented by an Equal method.
+	negate bool
+}
+
+// RegisterOperator registers a function implementing an operator for the
+// types of its parameters, such as func(Money, Money) Money for AddExpr or
+// func(Money, Money) bool for LessThanExpr. Unary operators take one
+// parameter. Functions may also return an error. Registered functions take
+// precedence over methods.
+func RegisterOperator(nodeType ExpressionType, fn interface{}) error {
+	if _, ok := operatorMethods[nodeType]; !ok {
+		return fmt.Errorf("%v can't be overloaded", nodeType)
+	}
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return fmt.Errorf("expected a function implementing %v but got %T", nodeType, fn)
+	}
+	typ := v.Type()
+	arity := 2
+	if nodeType == NegateExpr {
+		arity = 1
+	}
+	if typ.NumIn() != arity || typ.IsVariadic() || !returnsValue(typ) {
+		return fmt.Errorf("a function implementing %v must take %d operands and return a value, optionally followed by an error; got %v", nodeType, arity, typ)
+	}
+	if isComparison(nodeType) && typ.Out(0).Kind() != reflect.Bool {
+		return fmt.Errorf("a function implementing %v must return a bool; got %v", nodeType, typ)
+	}
+	o := &Operator{
+		nodeType: nodeType,
+		name:     fmt.Sprintf("%v", typ),
+		fn:       v,
+	}
+	for i := 0; i < typ.NumIn(); i++ {
+		o.parameters = append(o.parameters, typ.In(i))
+	}
+	operatorsMu.Lock()
+	defer operatorsMu.Unlock()
+	operators[nodeType] = append([]*Operator{o}, operators[nodeType]...)
+	return nil
+}
+
+func isComparison(nodeType ExpressionType) bool {
+	switch nodeType {
+	case LessThanExpr, LessThanOrEqualExpr, GreaterThanExpr, GreaterThanOrEqualExpr, EqualExpr, NotEqualExpr:
+		return true
+	}
+	return false
+}
+
+// Name returns the name of the method or the type of the function which
+// implements the operator.
+func (o *Operator) Name() string {
+	return o.name
+}
+
+// ResultType returns the type of the operator's result.
+func (o *Operator) ResultType() reflect.Type {
+	if o.compare || isComparison(o.nodeType) {
+		return typeOfKind(reflect.Bool)
+	}
+	return o.fn.Type().Out(0)
+}
+
+// findOperator returns the user-defined implementation of an operator for
+// the provided operands, or nil if there isn't one. Operators are only
+// looked up for operands of a known type other than a basic type.
+func findOperator(nodeType ExpressionType, operands ...Expression) *Operator {
+	if !hasUserType(operands) {
+		return nil
+	}
+	operatorsMu.RLock()
+	registered := operators[nodeType]
+	operatorsMu.RUnlock()
+	for _, o := range registered {
+		if o.accepts(operands) {
+			return o
+		}
+	}
+	return findOperatorMethod(nodeType, operands)
+}
+
+func hasUserType(operands []Expression) bool {
+	for _, operand := range operands {
+		if typ := staticTypeOf(operand); typ != nil && !isBuiltin(typ) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBuiltin determines whether or not a type is one of the predeclared
+// types, whose operators can't be overloaded.
+func isBuiltin(typ reflect.Type) bool {
+	return typ.PkgPath() == "" && typ.Name() != ""
+}
+
+// findOperatorMethod returns the method of the left operand's type which
+// implements an operator.
+func findOperatorMethod(nodeType ExpressionType, operands []Expression) *Operator {
+	typ := staticTypeOf(operands[0])
+	if typ == nil || isBuiltin(typ) {
+		return nil
+	}
+	names := []string{operatorMethods[nodeType]}
+	if nodeType == EqualExpr || nodeType == NotEqualExpr {
+		names = append(names, operatorMethods[LessThanExpr])
+	}
+	for _, name := range names {
+		method, ok := typ.MethodByName(name)
+		if !ok || method.Type.IsVariadic() || method.Type.NumIn() != len(operands) || !returnsValue(method.Type) {
+			continue
+		}
+		o := &Operator{
+			nodeType: nodeType,
+			name:     name,
+			fn:       method.Func,
+			compare:  name == operatorMethods[LessThanExpr],
+			negate:   nodeType == NotEqualExpr,
+		}
+		for i := 0; i < method.Type.NumIn(); i++ {
+			o.parameters = append(o.parameters, method.Type.In(i))
+		}
+		result := method.Type.Out(0)
+		switch {
+		case o.compare && (!IsInteger(result.Kind()) || IsUnsigned(result.Kind())):
+			continue
+		case name == operatorMethods[EqualExpr] && result.Kind() != reflect.Bool:
+			continue
+		}
+		if o.accepts(operands) {
+			return o
+		}
+	}
+	return nil
+}
+
+// accepts determines whether or not the operands can be passed to the
+// operator, either directly or by an implicit conversion.
+func (o *Operator) accepts(operands []Expression) bool {
+	if len(operands) != len(o.parameters) {
+		return false
+	}
+	for i, operand := range operands {
+		parameter := o.parameters[i]
+		if isImplicitlyConvertible(operand, parameter) {
+			continue
+		}
+		if typ := staticTypeOf(operand); typ != nil && !isLiteral(operand) {
+			if !typ.AssignableTo(parameter) {
+				return false
+			}
+			continue
+		}
+		if !isAssignableKind(operand.Kind(), parameter.Kind()) {
+			return false
+		}
+	}
+	return true
+}
+
+// call applies the operator to the values of its operands.
+func (o *Operator) call(args ...interface{}) (interface{}, error) {
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		val, err := convertValue(arg, o.parameters[i])
+		if err != nil {
+			return nil, fmt.Errorf("operand %d of %s: %v", i+1, o.name, err)
+		}
+		in[i] = val
+	}
+	out := o.fn.Call(in)
+	if len(out) == 2 && !out[1].IsNil() {
+		return nil, out[1].Interface().(error)
+	}
+	result := out[0].Interface()
+	if o.compare {
+		c := out[0].Int()
+		switch o.nodeType {
+		case LessThanExpr:
+			result = c < 0
+		case LessThanOrEqualExpr:
+			result = c <= 0
+		case GreaterThanExpr:
+			result = c > 0
+		case GreaterThanOrEqualExpr:
+			result = c >= 0
+		default:
+			result = c == 0
+		}
+	}
+	if o.negate {
+		return !result.(bool), nil
+	}
+	return result, nil
+}
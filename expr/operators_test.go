@@ -0,0 +1,187 @@
+package expr
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type money struct {
+	Cents    int64
+	Currency string
+}
+
+func (m money) Add(other money) (money, error) {
+	if m.Currency != other.Currency {
+		return money{}, errors.New("mismatched currencies")
+	}
+	return money{m.Cents + other.Cents, m.Currency}, nil
+}
+
+func (m money) Sub(other money) money {
+	return money{m.Cents - other.Cents, m.Currency}
+}
+
+func (m money) Mul(factor float64) money {
+	return money{int64(float64(m.Cents) * factor), m.Currency}
+}
+
+func (m money) Neg() money {
+	return money{-m.Cents, m.Currency}
+}
+
+func (m money) Compare(other money) int {
+	switch {
+	case m.Cents < other.Cents:
+		return -1
+	case m.Cents > other.Cents:
+		return 1
+	}
+	return 0
+}
+
+type vector struct {
+	X, Y float64
+}
+
+func init() {
+	for nodeType, fn := range map[ExpressionType]interface{}{
+		AddExpr:      func(a vector, b vector) vector { return vector{a.X + b.X, a.Y + b.Y} },
+		MultiplyExpr: func(k float64, v vector) vector { return vector{k * v.X, k * v.Y} },
+		EqualExpr:    func(a vector, b vector) bool { return a == b },
+	} {
+		if err := RegisterOperator(nodeType, fn); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestUserDefinedOperators(t *testing.T) {
+	parameters := map[string]interface{}{
+		"price":    money{1000, "USD"},
+		"discount": money{250, "USD"},
+		"limit":    money{500, "USD"},
+		"euros":    money{100, "EUR"},
+		"a":        vector{1, 2},
+		"b":        vector{3, 4},
+	}
+	for _, test := range []struct {
+		expression string
+		expected   interface{}
+	}{
+		{"price + discount", money{1250, "USD"}},
+		{"price - discount - discount", money{500, "USD"}},
+		{"price * 0.5", money{500, "USD"}},
+		{"-discount", money{-250, "USD"}},
+		{"price - discount > limit", true},
+		{"discount <= limit", true},
+		{"price == limit * 2", true},
+		{"price != limit", true},
+		{"a + b", vector{4, 6}},
+		{"2 * (a + b)", vector{8, 12}},
+		{"a + b == 2 * vector", true},
+	} {
+		parameters["vector"] = vector{2, 3}
+		parser, err := NewExpressionParser(test.expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		actual, err := parser.Evaluate(nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Fatalf("%s: expected %v (%T) but got %v (%T)", test.expression, test.expected, test.expected, actual, actual)
+		}
+	}
+}
+
+func TestUserDefinedCompoundAssignment(t *testing.T) {
+	values := map[string]interface{}{
+		"total": money{0, "USD"},
+		"price": money{300, "USD"},
+	}
+	parser, err := NewExpressionParser("total += price; total += price", values)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	parser.SetMode(StatementMode | ProgramMode)
+	if _, err := parser.Evaluate(values); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if values["total"] != (money{600, "USD"}) {
+		t.Fatalf("expected a total of 600 but got %v", values["total"])
+	}
+}
+
+func TestUserDefinedOperatorErrors(t *testing.T) {
+	parameters := map[string]interface{}{
+		"price": money{1000, "USD"},
+		"euros": money{100, "EUR"},
+		"a":     vector{1, 2},
+	}
+	for _, test := range []struct {
+		expression string
+		expected   string
+	}{
+		{"price + euros", "mismatched currencies"},
+		{"price / 2", "arithmetic isn't defined for expr.money"},
+		{"a - a", "arithmetic isn't defined"},
+		{"a < a", "can't compare"},
+		{"price + a", "isn't arithmetic"},
+	} {
+		parser, err := NewExpressionParser(test.expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		_, err = parser.Evaluate(nil)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("%s: expected an error containing %q but got %v", test.expression, test.expected, err)
+		}
+	}
+
+	if err := RegisterOperator(AndAlsoExpr, func(a, b vector) bool { return true }); err == nil {
+		t.Fatalf("expected overloading && to fail")
+	}
+	if err := RegisterOperator(LessThanExpr, func(a, b vector) int { return 0 }); err == nil {
+		t.Fatalf("expected a comparison which doesn't return a bool to fail")
+	}
+	if err := RegisterOperator(NegateExpr, func(a, b vector) vector { return a }); err == nil {
+		t.Fatalf("expected a negation taking two operands to fail")
+	}
+}
+
+func TestUnaryArithmetic(t *testing.T) {
+	parameters := map[string]interface{}{"qty": 3, "price": 2.5, "count": uint(4)}
+	for _, test := range []struct {
+		expression string
+		expected   interface{}
+	}{
+		{"-qty", -3},
+		{"-price * 2", -5.0},
+		{"+qty", 3},
+		{"-(1)", -1},
+		{"0 - 1", -1},
+		{"-(qty - 5)", 2},
+	} {
+		parser, err := NewExpressionParser(test.expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		actual, err := parser.Evaluate(nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Fatalf("%s: expected %v (%T) but got %v (%T)", test.expression, test.expected, test.expected, actual, actual)
+		}
+	}
+	parser, err := NewExpressionParser("-count", parameters)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := parser.Evaluate(nil); err == nil {
+		t.Fatalf("expected negating an unsigned value to fail")
+	}
+}
@@ -0,0 +1,358 @@
+package expr
+
+import (
+	"math"
+	"reflect"
+)
+
+// Optimizing an expression folds the parts of it which don't depend on the
+// values it's evaluated with into constants and removes operations which
+// can't change the result, such as multiplying by one. Nodes are folded by
+// evaluating them with the visitors, so the optimized expression evaluates
+// with the same results; nodes whose evaluation fails, such as a division by
+// zero or an overflowing conversion, are kept so that they still fail when
+// evaluated.
+//
+// Arithmetic, comparisons, logic, conditionals and casts are optimized.
+// Other nodes, such as statements, lambdas and user-defined operators, are
+// kept as they are.
+
+// Optimize returns an optimized copy of an expression, which should have
+// been type checked with CheckTypes. The expression itself isn't modified.
+func Optimize(expression Expression) (Expression, error) {
+	if expression == nil {
+		return nil, errInvalidExpression
+	}
+	return optimize(expression), nil
+}
+
+func optimize(node Expression) Expression {
+	switch e := node.(type) {
+	case *BinaryExpression:
+		return optimizeBinary(e)
+	case *UnaryExpression:
+		return optimizeUnary(e)
+	case *ConditionalExpression:
+		return optimizeConditional(e)
+	case *ConvertExpression:
+		return optimizeConvert(e)
+	}
+	return node
+}
+
+func optimizeBinary(e *BinaryExpression) Expression {
+	if IsAssignment(e.Type()) || e.operator != nil {
+		return e
+	}
+	copied := *e
+	copied.left = optimize(e.left)
+	copied.right = optimize(e.right)
+	if e.Type() == AndAlsoExpr || e.Type() == OrElseExpr {
+		return optimizeLogical(&copied)
+	}
+	if !isFoldable(e.Type()) {
+		return &copied
+	}
+	left, lok := copied.left.(*ConstantExpression)
+	right, rok := copied.right.(*ConstantExpression)
+	if lok && rok {
+		if val, err := evaluateBinary(&copied, left.value, right.value); err == nil {
+			return fold(&copied, val, left.literal && right.literal)
+		}
+		return &copied
+	}
+	if operand := identityOperand(&copied); operand != nil {
+		return operand
+	}
+	if combined := reassociate(&copied); combined != nil {
+		return combined
+	}
+	return &copied
+}
+
+// reassociate combines the constants of nested additions or multiplications,
+// such as qty * 2 * 60 in (qty * 2) * 60, into one, as in qty * 120, or
+// returns nil. Integer arithmetic wraps, so its integer constants can always
+// be combined. Float multiplications are only combined when one of the
+// constants is a power of two no smaller than one and the other's magnitude
+// isn't smaller than one either, so that rounding can't change the result;
+// price * 2 * 60 * 60 becomes price * 120 * 60.
+func reassociate(e *BinaryExpression) Expression {
+	switch {
+	case e.Type() == MultiplyExpr && (IsInteger(e.Kind()) || isFloatKind(e.Kind())):
+	case e.Type() == AddExpr && IsInteger(e.Kind()):
+	default:
+		return nil
+	}
+	outer, inner, constantLeft := splitConstant(e)
+	nested, ok := inner.(*BinaryExpression)
+	if outer == nil || !ok || nested.Type() != e.Type() || nested.operator != nil || nested.Kind() != e.Kind() {
+		return nil
+	}
+	constant, operand, _ := splitConstant(nested)
+	if constant == nil {
+		return nil
+	}
+	if isFloatKind(e.Kind()) && !exactlyScaled(constant.value, outer.value) ||
+		IsInteger(e.Kind()) && (isFloat(constant.value) || isFloat(outer.value)) {
+		return nil
+	}
+	val, err := applyBinary(e.Type(), e.Kind(), constant.value, outer.value)
+	if err != nil {
+		return nil
+	}
+	combined := fold(e, val, constant.literal && outer.literal)
+	if constantLeft {
+		return NewBinaryExpression(e.Type(), combined, operand, e.Kind())
+	}
+	return NewBinaryExpression(e.Type(), operand, combined, e.Kind())
+}
+
+// splitConstant returns the numeric constant operand of a binary node, its
+// other operand, and whether the constant is on the left, or nils.
+func splitConstant(e *BinaryExpression) (*ConstantExpression, Expression, bool) {
+	if c, ok := e.left.(*ConstantExpression); ok && isNumber(c) {
+		if _, both := e.right.(*ConstantExpression); !both {
+			return c, e.right, true
+		}
+	}
+	if c, ok := e.right.(*ConstantExpression); ok && isNumber(c) {
+		return c, e.left, false
+	}
+	return nil, nil, false
+}
+
+// isNumber determines whether or not a constant is a number.
+func isNumber(c *ConstantExpression) bool {
+	return c.value != nil && IsArithmetic(reflect.TypeOf(c.value).Kind())
+}
+
+// exactlyScaled determines whether or not multiplying a float by x and then
+// by y always rounds the same as multiplying it by x * y: one of them is a
+// power of two, which scales exactly, and neither is smaller than one, so
+// the intermediate product can't lose precision by underflowing.
+func exactlyScaled(x interface{}, y interface{}) bool {
+	a, err := convertToFloat64(x)
+	if err != nil {
+		return false
+	}
+	b, err := convertToFloat64(y)
+	if err != nil {
+		return false
+	}
+	return math.Abs(a) >= 1 && math.Abs(b) >= 1 && (isPowerOfTwo(a) || isPowerOfTwo(b))
+}
+
+// isPowerOfTwo determines whether or not a finite float's magnitude is a
+// power of two.
+func isPowerOfTwo(x float64) bool {
+	frac, _ := math.Frexp(math.Abs(x))
+	return frac == 0.5
+}
+
+// isFoldable determines whether or not a built-in binary operator has no
+// side effects, so it can be applied when optimizing.
+func isFoldable(nodeType ExpressionType) bool {
+	switch nodeType {
+	case AddExpr, SubtractExpr, MultiplyExpr, DivideExpr, ModuloExpr, OrExpr,
+		EqualExpr, NotEqualExpr, GreaterThanExpr, GreaterThanOrEqualExpr, LessThanExpr, LessThanOrEqualExpr:
+		return true
+	}
+	return false
+}
+
+// identityOperand returns the operand of an arithmetic operation which
+// produces it unchanged, such as x in x * 1, or nil. Adding zero is only
+// removed from integers, since -0.0 + 0 is 0.
+func identityOperand(e *BinaryExpression) Expression {
+	left, right := e.left, e.right
+	switch e.Type() {
+	case AddExpr:
+		if !IsInteger(e.Kind()) {
+			return nil
+		}
+		if isConstantNumber(left, 0) {
+			return keepsValue(e, right)
+		}
+		return keepsValue(e, identityIf(right, 0, left))
+	case SubtractExpr:
+		return keepsValue(e, identityIf(right, 0, left))
+	case MultiplyExpr:
+		if isConstantNumber(left, 1) {
+			return keepsValue(e, right)
+		}
+		return keepsValue(e, identityIf(right, 1, left))
+	case DivideExpr:
+		return keepsValue(e, identityIf(right, 1, left))
+	}
+	return nil
+}
+
+// identityIf returns operand if constant is the provided number.
+func identityIf(constant Expression, number float64, operand Expression) Expression {
+	if isConstantNumber(constant, number) {
+		return operand
+	}
+	return nil
+}
+
+// keepsValue returns operand if its values are of the basic type of e's
+// kind, so that e produces them unchanged, or nil.
+func keepsValue(e Expression, operand Expression) Expression {
+	if operand == nil || operand.Kind() != e.Kind() || !IsArithmetic(e.Kind()) || !isBasicValued(operand) {
+		return nil
+	}
+	return operand
+}
+
+// isBasicValued determines whether or not a node always produces null or a
+// value of the basic type of its kind, such as a float64 rather than a
+// Celsius.
+func isBasicValued(e Expression) bool {
+	switch n := e.(type) {
+	case *ParameterExpression:
+		if elem, ok := nullableType(n.typ); ok {
+			return elem == typeOfKind(n.Kind())
+		}
+		return n.typ == typeOfKind(n.Kind())
+	case *FieldExpression:
+		return n.typ == typeOfKind(n.Kind())
+	case *BinaryExpression:
+		// Built-in arithmetic converts its results to basic types.
+		return n.operator == nil && isFoldable(n.Type()) && n.Type() != OrExpr
+	}
+	return false
+}
+
+// isConstantNumber determines whether or not a node is a numeric constant
+// equal to the provided number.
+func isConstantNumber(e Expression, number float64) bool {
+	c, ok := e.(*ConstantExpression)
+	if !ok || c.value == nil || !IsArithmetic(reflect.TypeOf(c.value).Kind()) {
+		return false
+	}
+	x, err := convertToFloat64(c.value)
+	return err == nil && x == number
+}
+
+// optimizeLogical folds && and || when their left operands decide the
+// result, and removes operands which don't affect it, such as true in
+// x && true. Operands which could be null are kept, since evaluating them
+// fails.
+func optimizeLogical(e *BinaryExpression) Expression {
+	decisive := e.Type() == OrElseExpr
+	if b, ok := constantBool(e.left); ok {
+		if b == decisive {
+			return fold(e, b, false)
+		}
+		if isBool(e.right) {
+			return e.right
+		}
+		return e
+	}
+	if b, ok := constantBool(e.right); ok && b != decisive && isBool(e.left) {
+		return e.left
+	}
+	return e
+}
+
+// constantBool returns the value of a constant bool.
+func constantBool(e Expression) (bool, bool) {
+	c, ok := e.(*ConstantExpression)
+	if !ok {
+		return false, false
+	}
+	b, ok := c.value.(bool)
+	return b, ok
+}
+
+// isBool determines whether or not a node always produces a bool, rather
+// than null.
+func isBool(e Expression) bool {
+	switch n := e.(type) {
+	case *ConstantExpression:
+		_, ok := n.value.(bool)
+		return ok
+	case *ParameterExpression:
+		return n.typ == typeOfKind(reflect.Bool)
+	case *FieldExpression:
+		return n.typ == typeOfKind(reflect.Bool)
+	case *BinaryExpression:
+		switch n.Type() {
+		case AndAlsoExpr, OrElseExpr:
+			return true
+		case EqualExpr, NotEqualExpr, GreaterThanExpr, GreaterThanOrEqualExpr, LessThanExpr, LessThanOrEqualExpr:
+			return n.operator == nil
+		}
+	case *UnaryExpression:
+		return n.Type() == NotExpr && isBool(n.operand)
+	}
+	return false
+}
+
+func optimizeUnary(e *UnaryExpression) Expression {
+	switch e.Type() {
+	case NegateExpr, UnaryPlusExpr, NotExpr:
+	default:
+		return e
+	}
+	if e.operator != nil {
+		return e
+	}
+	copied := *e
+	copied.operand = optimize(e.operand)
+	if c, ok := copied.operand.(*ConstantExpression); ok {
+		if val, err := evaluateUnary(&copied, c.value); err == nil {
+			return fold(&copied, val, c.literal)
+		}
+		return &copied
+	}
+	if inner, ok := copied.operand.(*UnaryExpression); ok && e.Type() == NotExpr &&
+		inner.Type() == NotExpr && isBool(inner.operand) {
+		return inner.operand
+	}
+	return &copied
+}
+
+// optimizeConditional replaces a conditional whose test is constant with
+// the branch it selects. Like the conditional, unary plus converts the
+// branch's value to the conditional's kind when they differ.
+func optimizeConditional(e *ConditionalExpression) Expression {
+	copied := *e
+	copied.test = optimize(e.test)
+	copied.ifTrue = optimize(e.ifTrue)
+	copied.ifFalse = optimize(e.ifFalse)
+	test, ok := constantBool(copied.test)
+	if !ok {
+		return &copied
+	}
+	branch := copied.ifFalse
+	if test {
+		branch = copied.ifTrue
+	}
+	if branch.Kind() == e.Kind() {
+		return branch
+	}
+	return optimize(NewUnaryExpression(branch, UnaryPlusExpr, e.Kind()))
+}
+
+// optimizeConvert folds casts of constants between basic types.
+func optimizeConvert(e *ConvertExpression) Expression {
+	copied := *e
+	copied.operand = optimize(e.operand)
+	c, ok := copied.operand.(*ConstantExpression)
+	if !ok || c.value == nil || e.conversion != nil || isNamed(e.typ) || isNamed(reflect.TypeOf(c.value)) {
+		return &copied
+	}
+	if val, err := evaluateConvert(&copied, c.value); err == nil {
+		return fold(e, val, false)
+	}
+	return &copied
+}
+
+// fold creates the constant a node was folded into.
+func fold(e Expression, value interface{}, literal bool) *ConstantExpression {
+	c := NewConstantExpression(value, e.Kind())
+	c.literal = literal
+	return c
+}
@@ -0,0 +1,169 @@
+package expr
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+	for _, test := range []struct {
+		expression string
+		expected   string
+	}{
+		{"2 * 60 * 60 * qty", "(value(7200) * qty)"},
+		{"qty * 2 * 60 * 60", "(qty * value(7200))"},
+		{"2 * (count + 1) * 3", "((count + value(1)) * value(6))"},
+		{"1 + qty + 2", "(qty + value(3))"},
+		// Float constants are only combined when rounding can't differ.
+		{"price * 2 * 60 * 60", "((price * value(120)) * value(60))"},
+		{"price * 0.5 * 4", "((price * value(0.5)) * value(4))"},
+		{"price + 1 + 2", "((price + value(1)) + value(2))"},
+		{"1 + 2 == 3", "value(true)"},
+		{"int64(2.5) + count", "(value(2) + count)"},
+		{"qty * 1 + 0", "qty"},
+		{"price - 0", "price"},
+		{"price * 2.0 / 1", "(price * value(2))"},
+		{"discount * 1", "discount"},
+		{"!!active", "active"},
+		{"active && true", "active"},
+		{"true && active", "active"},
+		{"false && active", "value(false)"},
+		{"active || false", "active"},
+		{"!(1 < 2) || active", "active"},
+		{"true ? price : 2", "price"},
+		{"1 > 2 ? 'a' : name", "name"},
+		{"false ? price : qty", "+qty"},
+		{"false ? 2 : price", "price"},
+		// -0.0 + 0 is 0, so adding zero to a float is kept.
+		{"price * 1 + 0", "(price + value(0))"},
+		// Celsius values are converted to float64s by the arithmetic.
+		{"indoor * 1", "(indoor * value(1))"},
+		// A nullable bool could be null, which && and || reject.
+		{"discount > 0.1 && true", "(discount > value(0.1))"},
+		// Errors are kept so they're reported when evaluating.
+		{"count / (2 - 2)", "(count / value(0))"},
+		{"qty > 0 ? count % 0 : 1", "((qty > value(0)) ? (count % value(0)) : value(1))"},
+	} {
+		parser, err := NewExpressionParserWithSchema(test.expression, compileSchema)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		expression, _, err := parser.Check()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		original := expression.String()
+		optimized, err := Optimize(expression)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if optimized.String() != test.expected {
+			t.Fatalf("%s: expected %s but got %s", test.expression, test.expected, optimized)
+		}
+		if expression.String() != original {
+			t.Fatalf("%s: expected the expression not to change but got %s", test.expression, expression)
+		}
+	}
+	if _, err := Optimize(nil); err == nil {
+		t.Fatalf("expected optimizing nil to fail")
+	}
+}
+
+func TestOptimizeMatchesVisitors(t *testing.T) {
+	half := 0.5
+	parameters := []map[string]interface{}{
+		{"price": 12.5, "qty": 3, "count": int64(7), "active": true, "discount": &half, "indoor": celsius(21)},
+		{"price": math.Copysign(0, -1), "qty": 0, "count": int64(-2), "active": false, "discount": (*float64)(nil), "indoor": celsius(-4)},
+		{"qty": 1},
+	}
+	for _, expression := range []string{
+		"2 * 60 * 60 * qty",
+		"qty * 2 * 60 * 60",
+		"price * 2 * 60 * 60",
+		"1 + qty + 2 + count",
+		"2 * (count + 1) * 3",
+		"qty * 1 + 0 - count / (3 - 3)",
+		"price * 1 - 0 + 0",
+		"discount * 1 / 1",
+		"!!active && true || false",
+		"true ? qty : price",
+		"false ? price : qty",
+		"1 > 2 ? 'a' : 'b'",
+		"indoor * 1 + 0",
+		"(discount > 0.1) && true",
+		"active && 1 == 1 ? count * 1 : -count",
+	} {
+		for _, values := range parameters {
+			parser, err := NewExpressionParserWithSchema(expression, compileSchema)
+			if err != nil {
+				t.Fatalf("%s: unexpected err: %v", expression, err)
+			}
+			checked, _, err := parser.Check()
+			if err != nil {
+				t.Fatalf("%s: unexpected err: %v", expression, err)
+			}
+			optimized, err := Optimize(checked)
+			if err != nil {
+				t.Fatalf("%s: unexpected err: %v", expression, err)
+			}
+			expected, expectedErr := visitExpression(checked, NewScopeFromMap(values))
+			actual, err := visitExpression(optimized, NewScopeFromMap(values))
+			if (err == nil) != (expectedErr == nil) || (err != nil && err.Error() != expectedErr.Error()) {
+				t.Fatalf("%s with %v: expected error %v but got %v", expression, values, expectedErr, err)
+			}
+			if !reflect.DeepEqual(actual, expected) {
+				t.Fatalf("%s with %v: expected %v (%T) but got %v (%T)", expression, values, expected, expected, actual, actual)
+			}
+		}
+	}
+}
+
+// TestOptimizeTypes checks the values and types of folded constants, and of
+// the results of the optimized expressions.
+func TestOptimizeTypes(t *testing.T) {
+	values := map[string]interface{}{"price": 1.5, "qty": -2, "count": int64(3)}
+	for _, test := range []struct {
+		expression string
+		constant   interface{}
+		expected   interface{}
+	}{
+		{"2 * 60 * 60 * qty", 7200, -14400},
+		{"qty * 2 * 60 * 60", 7200, -14400},
+		{"2 * 60 * 60 * count", 7200, int64(21600)},
+		{"2 * 60 * 60 * price", 7200, 10800.0},
+		{"price * 2 * 4", 8.0, 12.0},
+		{"1 + qty + 2", 3, 1},
+	} {
+		parser, err := NewExpressionParserWithSchema(test.expression, compileSchema)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		expression, _, err := parser.Check()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		optimized, err := Optimize(expression)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		binary, ok := optimized.(*BinaryExpression)
+		if !ok {
+			t.Fatalf("%s: expected a binary expression but got %s", test.expression, optimized)
+		}
+		constant, _, _ := splitConstant(binary)
+		if constant == nil || constant.value != test.constant {
+			t.Fatalf("%s: expected the constant %v (%T) in %s", test.expression, test.constant, test.constant, optimized)
+		}
+		if expected := reflect.TypeOf(test.expected).Kind(); optimized.Kind() != expected {
+			t.Fatalf("%s: expected the kind %v but got %v", test.expression, expected, optimized.Kind())
+		}
+		actual, err := visitExpression(optimized, NewScopeFromMap(values))
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if actual != test.expected {
+			t.Fatalf("%s: expected %v (%T) but got %v (%T)", test.expression, test.expected, test.expected, actual, actual)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package expr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Evaluator evaluates a set of programs, such as the rules of a policy,
+// against many records in parallel. A record is either the parameters the
+// programs are evaluated with, as a map[string]interface{}, or a value of
+// the struct they were compiled for, or a pointer to one. Each record is
+// evaluated by one worker, which evaluates every program against it in
+// order, and a program failing, or panicking, doesn't stop the others from
+// being evaluated.
+type Evaluator struct {
+	programs []*Program
+	workers  int
+	ordered  bool
+}
+
+// EvaluatorOptions describe how an Evaluator evaluates records.
+type EvaluatorOptions struct {
+	// Workers is the number of records evaluated at once. It defaults to
+	// GOMAXPROCS.
+	Workers int
+	// Ordered makes Stream produce results in the order of their records,
+	// rather than as soon as they're evaluated.
+	Ordered bool
+}
+
+// Result holds the results of evaluating every program against a record.
+type Result struct {
+	// Index is the position of the record in the records it came from.
+	Index  int
+	Record interface{}
+	// Values holds the value each program produced, and Errors the error
+	// each one failed with, in the order of the programs.
+	Values []interface{}
+	Errors []error
+}
+
+// Err returns nil when every program succeeded, or an error describing
+// those which failed.
+func (r *Result) Err() error {
+	var failures []string
+	for i, err := range r.Errors {
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("program %d: %v", i, err))
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	return fmt.Errorf("record %d: %s", r.Index, strings.Join(failures, "; "))
+}
+
+// NewEvaluator creates an evaluator for a set of programs.
+func NewEvaluator(programs []*Program, options EvaluatorOptions) (*Evaluator, error) {
+	if len(programs) == 0 {
+		return nil, errors.New("an evaluator needs at least one program")
+	}
+	for i, program := range programs {
+		if program == nil {
+			return nil, fmt.Errorf("program %d is nil", i)
+		}
+	}
+	workers := options.Workers
+	if workers < 0 {
+		return nil, errors.New("an evaluator can't have a negative number of workers")
+	}
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return &Evaluator{
+		programs: append([]*Program(nil), programs...),
+		workers:  workers,
+		ordered:  options.Ordered,
+	}, nil
+}
+
+// EvaluateAll evaluates the programs against every record, returning the
+// results in the order of the records.
+func (e *Evaluator) EvaluateAll(records []interface{}) []*Result {
+	results := make([]*Result, len(records))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < e.workers && i < len(records); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				results[index] = e.evaluate(index, records[index])
+			}
+		}()
+	}
+	for index := range records {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+// job is a record waiting to be evaluated, whose result is sent to done.
+type job struct {
+	index  int
+	record interface{}
+	done   chan *Result
+}
+
+// Stream evaluates the programs against each record received from records,
+// sending the results to the returned channel, which is closed once
+// records is closed and every record has been evaluated. When results are
+// ordered, a record which is slow to evaluate holds up the results of the
+// records after it, and only around twice as many records as there are
+// workers are evaluated ahead of it, so memory stays bounded.
+//
+// The caller must receive every result; the workers wait until it does.
+// Use StreamContext to be able to stop early.
+func (e *Evaluator) Stream(records <-chan interface{}) <-chan *Result {
+	return e.StreamContext(context.Background(), records)
+}
+
+// StreamContext is like Stream, but stops once ctx is done: it stops
+// receiving records, drops the results which haven't been sent yet and
+// closes the returned channel once the records being evaluated are done,
+// so the caller can stop receiving results after cancelling ctx.
+func (e *Evaluator) StreamContext(ctx context.Context, records <-chan interface{}) <-chan *Result {
+	results := make(chan *Result)
+	jobs := make(chan job)
+	// pending holds the jobs whose results haven't been sent, in order.
+	var pending chan chan *Result
+	if e.ordered {
+		pending = make(chan chan *Result, e.workers)
+	}
+	var wg sync.WaitGroup
+	wg.Add(e.workers)
+	for i := 0; i < e.workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				select {
+				case j.done <- e.evaluate(j.index, j.record):
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		if e.ordered {
+			defer close(pending)
+		}
+		for index := 0; ; index++ {
+			var record interface{}
+			select {
+			case r, ok := <-records:
+				if !ok {
+					return
+				}
+				record = r
+			case <-ctx.Done():
+				return
+			}
+			done := results
+			if e.ordered {
+				done = make(chan *Result, 1)
+				select {
+				case pending <- done:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case jobs <- job{index: index, record: record, done: done}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	if e.ordered {
+		go func() {
+			defer func() {
+				wg.Wait()
+				close(results)
+			}()
+			for done := range pending {
+				select {
+				case result := <-done:
+					select {
+					case results <- result:
+					case <-ctx.Done():
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	} else {
+		go func() {
+			wg.Wait()
+			close(results)
+		}()
+	}
+	return results
+}
+
+// evaluate evaluates every program against a record.
+func (e *Evaluator) evaluate(index int, record interface{}) *Result {
+	result := &Result{
+		Index:  index,
+		Record: record,
+		Values: make([]interface{}, len(e.programs)),
+		Errors: make([]error, len(e.programs)),
+	}
+	for i, program := range e.programs {
+		result.Values[i], result.Errors[i] = evaluateProgram(program, record)
+	}
+	return result
+}
+
+// evaluateProgram evaluates a program against a record. A panic, such as
+// one from a method of the record, becomes the program's error rather than
+// stopping the worker.
+func evaluateProgram(program *Program, record interface{}) (val interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			val, err = nil, fmt.Errorf("panic: %v", r)
+		}
+	}()
+	if parameters, ok := record.(map[string]interface{}); ok {
+		return program.Evaluate(parameters)
+	}
+	return program.EvaluateStruct(record)
+}
@@ -0,0 +1,267 @@
+package expr
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gauge tracks how many records are being evaluated at once.
+type gauge struct {
+	active int64
+	max    int64
+}
+
+type slowRecord struct {
+	ID    int64
+	gauge *gauge
+}
+
+// Wait takes longer for earlier records, so they finish out of order.
+func (r slowRecord) Wait() int64 {
+	active := atomic.AddInt64(&r.gauge.active, 1)
+	for {
+		max := atomic.LoadInt64(&r.gauge.max)
+		if active <= max || atomic.CompareAndSwapInt64(&r.gauge.max, max, active) {
+			break
+		}
+	}
+	time.Sleep(time.Duration(10-r.ID%10) * time.Millisecond)
+	atomic.AddInt64(&r.gauge.active, -1)
+	return r.ID
+}
+
+// explosive has a method which panics for some records.
+type explosive struct {
+	ID int64
+}
+
+func (r explosive) Check() bool {
+	if r.ID%3 == 2 {
+		panic(fmt.Sprintf("record %d exploded", r.ID))
+	}
+	return true
+}
+
+func compilePrograms(t *testing.T, expressions []string, compile func(string) (*ExpressionParser, error)) []*Program {
+	programs := make([]*Program, len(expressions))
+	for i, expression := range expressions {
+		parser, err := compile(expression)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", expression, err)
+		}
+		if programs[i], err = parser.Compile(); err != nil {
+			t.Fatalf("%s: unexpected err: %v", expression, err)
+		}
+	}
+	return programs
+}
+
+func TestEvaluatorEvaluateAll(t *testing.T) {
+	programs := compilePrograms(t, []string{"price * qty", "count / qty", "active && price > 2"}, func(expression string) (*ExpressionParser, error) {
+		return NewExpressionParserWithSchema(expression, compileSchema)
+	})
+	evaluator, err := NewEvaluator(programs, EvaluatorOptions{Workers: 4})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	var records []interface{}
+	for i := 0; i < 50; i++ {
+		records = append(records, map[string]interface{}{"price": float64(i), "qty": i % 5, "count": int64(i), "active": i%2 == 0})
+	}
+	results := evaluator.EvaluateAll(records)
+	if len(results) != len(records) {
+		t.Fatalf("expected %d results but got %d", len(records), len(results))
+	}
+	for i, result := range results {
+		if result.Index != i || !reflect.DeepEqual(result.Record, records[i]) {
+			t.Fatalf("expected the result of record %d but got %d", i, result.Index)
+		}
+		expected := []interface{}{float64(i * (i % 5)), nil, i%2 == 0 && i > 2}
+		if i%5 != 0 {
+			expected[1] = int64(i / (i % 5))
+		}
+		if result.Values[0] != expected[0] || result.Values[1] != expected[1] || result.Values[2] != expected[2] {
+			t.Fatalf("record %d: expected %v but got %v", i, expected, result.Values)
+		}
+		// Only the division fails, and only when qty is zero.
+		if (result.Errors[1] != nil) != (i%5 == 0) || result.Errors[0] != nil || result.Errors[2] != nil {
+			t.Fatalf("record %d: unexpected errors %v", i, result.Errors)
+		}
+		if err := result.Err(); (err != nil) != (i%5 == 0) || (err != nil && err.Error() != fmt.Sprintf("record %d: program 1: division by zero", i)) {
+			t.Fatalf("record %d: unexpected error %v", i, err)
+		}
+	}
+	if results := evaluator.EvaluateAll(nil); len(results) != 0 {
+		t.Fatalf("expected no results but got %v", results)
+	}
+}
+
+func TestEvaluatorStream(t *testing.T) {
+	programs := compilePrograms(t, []string{"Wait() * 2", "ID > 10"}, func(expression string) (*ExpressionParser, error) {
+		return NewExpressionParserForStruct(expression, slowRecord{})
+	})
+	for _, ordered := range []bool{true, false} {
+		const workers, length = 4, 40
+		evaluator, err := NewEvaluator(programs, EvaluatorOptions{Workers: workers, Ordered: ordered})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		g := &gauge{}
+		records := make(chan interface{})
+		go func() {
+			for i := 0; i < length; i++ {
+				records <- slowRecord{ID: int64(i), gauge: g}
+			}
+			close(records)
+		}()
+		seen := make(map[int]bool)
+		inOrder := true
+		for result := range evaluator.Stream(records) {
+			if err := result.Err(); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if result.Values[0] != int64(result.Index*2) || result.Values[1] != (result.Index > 10) {
+				t.Fatalf("record %d: unexpected values %v", result.Index, result.Values)
+			}
+			inOrder = inOrder && result.Index == len(seen)
+			seen[result.Index] = true
+		}
+		if len(seen) != length {
+			t.Fatalf("expected %d results but got %d", length, len(seen))
+		}
+		if ordered && !inOrder {
+			t.Fatalf("expected the results in order")
+		}
+		if max := atomic.LoadInt64(&g.max); max > workers {
+			t.Fatalf("expected at most %d records to be evaluated at once but %d were", workers, max)
+		}
+	}
+}
+
+func TestEvaluatorPanics(t *testing.T) {
+	programs := compilePrograms(t, []string{"Check()", "ID + 1"}, func(expression string) (*ExpressionParser, error) {
+		return NewExpressionParserForStruct(expression, explosive{})
+	})
+	evaluator, err := NewEvaluator(programs, EvaluatorOptions{Workers: 2})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	var records []interface{}
+	for i := 0; i < 9; i++ {
+		records = append(records, explosive{ID: int64(i)})
+	}
+	for i, result := range evaluator.EvaluateAll(records) {
+		if i%3 == 2 {
+			expected := fmt.Sprintf("panic: record %d exploded", i)
+			if result.Values[0] != nil || result.Errors[0] == nil || result.Errors[0].Error() != expected {
+				t.Fatalf("record %d: expected error %q but got %v, %v", i, expected, result.Values[0], result.Errors[0])
+			}
+		} else if result.Values[0] != true || result.Errors[0] != nil {
+			t.Fatalf("record %d: expected true but got %v, %v", i, result.Values[0], result.Errors[0])
+		}
+		// A panic only fails the program it happened in.
+		if result.Values[1] != int64(i+1) || result.Errors[1] != nil {
+			t.Fatalf("record %d: expected %d but got %v, %v", i, i+1, result.Values[1], result.Errors[1])
+		}
+	}
+}
+
+func TestEvaluatorStreamContext(t *testing.T) {
+	programs := compilePrograms(t, []string{"ID * 2"}, func(expression string) (*ExpressionParser, error) {
+		return NewExpressionParserForStruct(expression, explosive{})
+	})
+	for _, ordered := range []bool{true, false} {
+		evaluator, err := NewEvaluator(programs, EvaluatorOptions{Workers: 4, Ordered: ordered})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		// records is never closed, so only cancelling ends the stream.
+		records := make(chan interface{})
+		go func() {
+			for i := 0; ; i++ {
+				select {
+				case records <- explosive{ID: int64(i)}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		results := evaluator.StreamContext(ctx, records)
+		for i := 0; i < 10; i++ {
+			if result := <-results; result.Values[0] != 2*result.Record.(explosive).ID {
+				t.Fatalf("unexpected result %v", result.Values)
+			}
+		}
+		cancel()
+		closed := make(chan struct{})
+		go func() {
+			for range results {
+			}
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the results to be closed after cancelling")
+		}
+	}
+}
+
+func TestEvaluatorStreamContextWaitsForWorkers(t *testing.T) {
+	programs := compilePrograms(t, []string{"Wait()"}, func(expression string) (*ExpressionParser, error) {
+		return NewExpressionParserForStruct(expression, slowRecord{})
+	})
+	for _, ordered := range []bool{true, false} {
+		evaluator, err := NewEvaluator(programs, EvaluatorOptions{Workers: 2, Ordered: ordered})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		g := &gauge{}
+		records := make(chan interface{}, 1)
+		records <- slowRecord{ID: 0, gauge: g}
+		results := evaluator.StreamContext(ctx, records)
+		for atomic.LoadInt64(&g.active) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		// Cancel while the record is being evaluated, without receiving
+		// its result.
+		cancel()
+		for range results {
+		}
+		if active := atomic.LoadInt64(&g.active); active != 0 {
+			t.Fatalf("ordered %v: expected no records to be evaluated once the results were closed but got %d", ordered, active)
+		}
+	}
+}
+
+func TestNewEvaluator(t *testing.T) {
+	programs := compilePrograms(t, []string{"price * 2"}, func(expression string) (*ExpressionParser, error) {
+		return NewExpressionParserWithSchema(expression, compileSchema)
+	})
+	for _, test := range []struct {
+		programs []*Program
+		options  EvaluatorOptions
+		err      string
+	}{
+		{nil, EvaluatorOptions{}, "an evaluator needs at least one program"},
+		{[]*Program{programs[0], nil}, EvaluatorOptions{}, "program 1 is nil"},
+		{programs, EvaluatorOptions{Workers: -1}, "an evaluator can't have a negative number of workers"},
+	} {
+		if _, err := NewEvaluator(test.programs, test.options); err == nil || err.Error() != test.err {
+			t.Fatalf("expected error %q but got %v", test.err, err)
+		}
+	}
+	evaluator, err := NewEvaluator(programs, EvaluatorOptions{})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if evaluator.workers < 1 {
+		t.Fatalf("expected the workers to default to GOMAXPROCS but got %d", evaluator.workers)
+	}
+}
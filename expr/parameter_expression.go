@@ -5,6 +5,7 @@ import "reflect"
 type ParameterExpression struct {
 	self *AbstractExpression
 	name string
+	typ  reflect.Type
 }
 
 func NewParameterExpression(name string, kind reflect.Kind) *ParameterExpression {
@@ -17,10 +18,23 @@ func NewParameterExpression(name string, kind reflect.Kind) *ParameterExpression
 	}
 }
 
+// NewTypedParameterExpression creates a parameter whose full type is known,
+// which allows its members to be resolved when parsing.
+func NewTypedParameterExpression(name string, typ reflect.Type) *ParameterExpression {
+	e := NewParameterExpression(name, valueKind(typ))
+	e.typ = typ
+	return e
+}
+
 func (e *ParameterExpression) Name() string {
 	return e.name
 }
 
+// ValueType returns the type of the parameter, or nil if only its kind is known.
+func (e *ParameterExpression) ValueType() reflect.Type {
+	return e.typ
+}
+
 func (e *ParameterExpression) Kind() reflect.Kind {
 	return e.self.kind
 }
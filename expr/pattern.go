@@ -0,0 +1,451 @@
+package expr
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+type PatternType int
+
+const (
+	AndPat PatternType = iota
+	ConstantPat
+	DiscardPat
+	NotPat
+	OrPat
+	PropertyPat
+	RelationalPat
+	TypePat
+	UnknownPat
+)
+
+const (
+	AndPatString        = "AndPat"
+	ConstantPatString   = "ConstantPat"
+	DiscardPatString    = "DiscardPat"
+	NotPatString        = "NotPat"
+	OrPatString         = "OrPat"
+	PropertyPatString   = "PropertyPat"
+	RelationalPatString = "RelationalPat"
+	TypePatString       = "TypePat"
+	UnknownPatString    = "UnknownPat"
+)
+
+func (t PatternType) String() string {
+	switch t {
+	case AndPat:
+		return AndPatString
+	case ConstantPat:
+		return ConstantPatString
+	case DiscardPat:
+		return DiscardPatString
+	case NotPat:
+		return NotPatString
+	case OrPat:
+		return OrPatString
+	case PropertyPat:
+		return PropertyPatString
+	case RelationalPat:
+		return RelationalPatString
+	case TypePat:
+		return TypePatString
+	default:
+		return UnknownPatString
+	}
+}
+
+// Pattern is tested against a value by switch and is expressions.
+// Patterns only ever hold constants, so they can be matched directly.
+type Pattern interface {
+	String() string
+	Type() PatternType
+	Matches(value interface{}) (bool, error)
+}
+
+// DiscardPattern (_) matches every value.
+type DiscardPattern struct{}
+
+func NewDiscardPattern() *DiscardPattern {
+	return &DiscardPattern{}
+}
+
+func (p *DiscardPattern) Type() PatternType {
+	return DiscardPat
+}
+
+func (p *DiscardPattern) String() string {
+	return discardIdentifier
+}
+
+func (p *DiscardPattern) Matches(value interface{}) (bool, error) {
+	return true, nil
+}
+
+// ConstantPattern matches values equal to a constant. A nil constant is the
+// null pattern.
+type ConstantPattern struct {
+	value interface{}
+}
+
+func NewConstantPattern(value interface{}) *ConstantPattern {
+	return &ConstantPattern{
+		value: value,
+	}
+}
+
+func (p *ConstantPattern) Value() interface{} {
+	return p.value
+}
+
+func (p *ConstantPattern) Type() PatternType {
+	return ConstantPat
+}
+
+func (p *ConstantPattern) String() string {
+	return formatPatternValue(p.value)
+}
+
+func (p *ConstantPattern) Matches(value interface{}) (bool, error) {
+	if p.value == nil {
+		return isNil(value), nil
+	}
+	if isNil(value) {
+		return false, nil
+	}
+	return valuesEqual(value, p.value), nil
+}
+
+// RelationalPattern matches values which compare to a constant with one of
+// <, <=, > or >=.
+type RelationalPattern struct {
+	operator ExpressionType
+	value    interface{}
+}
+
+func NewRelationalPattern(operator ExpressionType, value interface{}) *RelationalPattern {
+	return &RelationalPattern{
+		operator: operator,
+		value:    value,
+	}
+}
+
+func (p *RelationalPattern) Operator() ExpressionType {
+	return p.operator
+}
+
+func (p *RelationalPattern) Value() interface{} {
+	return p.value
+}
+
+func (p *RelationalPattern) Type() PatternType {
+	return RelationalPat
+}
+
+func (p *RelationalPattern) String() string {
+	var operator string
+	switch p.operator {
+	case LessThanExpr:
+		operator = "<"
+	case LessThanOrEqualExpr:
+		operator = "<="
+	case GreaterThanExpr:
+		operator = ">"
+	case GreaterThanOrEqualExpr:
+		operator = ">="
+	}
+	return fmt.Sprintf("%s %s", operator, formatPatternValue(p.value))
+}
+
+func (p *RelationalPattern) Matches(value interface{}) (bool, error) {
+	if isNil(value) {
+		return false, nil
+	}
+	c, err := compareValues(value, p.value)
+	if err != nil {
+		// Values which can't be compared with the constant never match.
+		return false, nil
+	}
+	if c == unordered {
+		return false, nil
+	}
+	switch p.operator {
+	case LessThanExpr:
+		return c < 0, nil
+	case LessThanOrEqualExpr:
+		return c <= 0, nil
+	case GreaterThanExpr:
+		return c > 0, nil
+	case GreaterThanOrEqualExpr:
+		return c >= 0, nil
+	}
+	return false, fmt.Errorf("unknown relational operator: %v", p.operator)
+}
+
+// TypePattern matches non-nil values assignable to a type.
+type TypePattern struct {
+	name string
+	typ  reflect.Type
+}
+
+func NewTypePattern(name string, typ reflect.Type) *TypePattern {
+	return &TypePattern{
+		name: name,
+		typ:  typ,
+	}
+}
+
+func (p *TypePattern) TypeName() string {
+	return p.name
+}
+
+func (p *TypePattern) MatchedType() reflect.Type {
+	return p.typ
+}
+
+func (p *TypePattern) Type() PatternType {
+	return TypePat
+}
+
+func (p *TypePattern) String() string {
+	return p.name
+}
+
+func (p *TypePattern) Matches(value interface{}) (bool, error) {
+	if isNil(value) {
+		return false, nil
+	}
+	return reflect.TypeOf(value).AssignableTo(p.typ), nil
+}
+
+// Subpattern is a single member of a property pattern.
+type Subpattern struct {
+	Name    string
+	Pattern Pattern
+}
+
+// PropertyPattern matches non-nil values whose fields or map entries match
+// the subpatterns, optionally restricted to a type.
+type PropertyPattern struct {
+	typ         *TypePattern
+	subpatterns []*Subpattern
+}
+
+func NewPropertyPattern(typ *TypePattern, subpatterns []*Subpattern) *PropertyPattern {
+	return &PropertyPattern{
+		typ:         typ,
+		subpatterns: subpatterns,
+	}
+}
+
+func (p *PropertyPattern) Subpatterns() []*Subpattern {
+	return p.subpatterns
+}
+
+func (p *PropertyPattern) Type() PatternType {
+	return PropertyPat
+}
+
+func (p *PropertyPattern) String() string {
+	var members []string
+	for _, sub := range p.subpatterns {
+		members = append(members, fmt.Sprintf("%s: %v", sub.Name, sub.Pattern))
+	}
+	s := "{ " + strings.Join(members, ", ") + " }"
+	if len(members) == 0 {
+		s = "{ }"
+	}
+	if p.typ != nil {
+		return p.typ.String() + " " + s
+	}
+	return s
+}
+
+func (p *PropertyPattern) Matches(value interface{}) (bool, error) {
+	if isNil(value) {
+		return false, nil
+	}
+	if p.typ != nil {
+		if ok, err := p.typ.Matches(value); !ok || err != nil {
+			return ok, err
+		}
+	}
+	for _, sub := range p.subpatterns {
+		member, ok := lookupMember(value, sub.Name)
+		if !ok {
+			return false, nil
+		}
+		if ok, err := sub.Pattern.Matches(member); !ok || err != nil {
+			return ok, err
+		}
+	}
+	return true, nil
+}
+
+// BinaryPattern combines two patterns with and or or.
+type BinaryPattern struct {
+	patternType PatternType
+	left        Pattern
+	right       Pattern
+}
+
+func NewBinaryPattern(patternType PatternType, left Pattern, right Pattern) *BinaryPattern {
+	return &BinaryPattern{
+		patternType: patternType,
+		left:        left,
+		right:       right,
+	}
+}
+
+func (p *BinaryPattern) Left() Pattern {
+	return p.left
+}
+
+func (p *BinaryPattern) Right() Pattern {
+	return p.right
+}
+
+func (p *BinaryPattern) Type() PatternType {
+	return p.patternType
+}
+
+func (p *BinaryPattern) String() string {
+	operator := andIdentifier
+	if p.patternType == OrPat {
+		operator = orIdentifier
+	}
+	return fmt.Sprintf("(%v %s %v)", p.left, operator, p.right)
+}
+
+func (p *BinaryPattern) Matches(value interface{}) (bool, error) {
+	left, err := p.left.Matches(value)
+	if err != nil {
+		return false, err
+	}
+	if p.patternType == OrPat && left {
+		return true, nil
+	}
+	if p.patternType == AndPat && !left {
+		return false, nil
+	}
+	return p.right.Matches(value)
+}
+
+// NotPattern matches values which its operand doesn't match.
+type NotPattern struct {
+	operand Pattern
+}
+
+func NewNotPattern(operand Pattern) *NotPattern {
+	return &NotPattern{
+		operand: operand,
+	}
+}
+
+func (p *NotPattern) Operand() Pattern {
+	return p.operand
+}
+
+func (p *NotPattern) Type() PatternType {
+	return NotPat
+}
+
+func (p *NotPattern) String() string {
+	return fmt.Sprintf("not %v", p.operand)
+}
+
+func (p *NotPattern) Matches(value interface{}) (bool, error) {
+	matched, err := p.operand.Matches(value)
+	return !matched, err
+}
+
+// CreateConstantPattern creates a pattern which matches the value of a
+// constant expression. Patterns can only test values of a compatible kind.
+func CreateConstantPattern(expr Expression, kind reflect.Kind) (Pattern, error) {
+	c, ok := expr.(*ConstantExpression)
+	if !ok {
+		return nil, fmt.Errorf("patterns require a constant value, got %v", expr)
+	}
+	if !isPatternCompatible(c.Kind(), kind) {
+		return nil, fmt.Errorf("a constant of kind %v can't match a value of kind %v", c.Kind(), kind)
+	}
+	return NewConstantPattern(c.value), nil
+}
+
+// CreateRelationalPattern creates a <, <=, > or >= pattern.
+func CreateRelationalPattern(operator ExpressionType, expr Expression, kind reflect.Kind) (Pattern, error) {
+	c, ok := expr.(*ConstantExpression)
+	if !ok {
+		return nil, fmt.Errorf("patterns require a constant value, got %v", expr)
+	}
+	if !IsArithmetic(c.Kind()) && c.Kind() != reflect.String {
+		return nil, fmt.Errorf("relational patterns require an arithmetic or string constant, got %v", c.Kind())
+	}
+	if !isPatternCompatible(c.Kind(), kind) {
+		return nil, fmt.Errorf("a constant of kind %v can't match a value of kind %v", c.Kind(), kind)
+	}
+	return NewRelationalPattern(operator, c.value), nil
+}
+
+func isPatternCompatible(constant reflect.Kind, kind reflect.Kind) bool {
+	switch {
+	case kind == reflect.Interface, constant == kind:
+		return true
+	case IsArithmetic(constant) && IsArithmetic(kind):
+		return true
+	}
+	return false
+}
+
+func formatPatternValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return nullIdentifier
+	case string:
+		return fmt.Sprintf("%q", v)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// isNil determines whether or not a value is nil, including typed nils.
+func isNil(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+		return v.IsNil()
+	}
+	return false
+}
+
+// lookupMember returns the exported field or string-keyed map entry with
+// the provided name, dereferencing pointers along the way.
+func lookupMember(value interface{}, name string) (interface{}, bool) {
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, false
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		field := v.FieldByName(name)
+		if !field.IsValid() || !field.CanInterface() {
+			return nil, false
+		}
+		return field.Interface(), true
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		entry := v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
+		if !entry.IsValid() {
+			return nil, false
+		}
+		return entry.Interface(), true
+	}
+	return nil, false
+}
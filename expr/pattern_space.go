@@ -0,0 +1,380 @@
+package expr
+
+import (
+	"math"
+	"reflect"
+	"sort"
+)
+
+// patternBound is one end of a patternInterval. A nil value is unbounded.
+type patternBound struct {
+	value     interface{}
+	inclusive bool
+}
+
+type patternInterval struct {
+	lo patternBound
+	hi patternBound
+}
+
+// patternSpace is a sorted set of disjoint intervals describing the values
+// a pattern matches. Numbers are analysed as float64s and booleans as 0 and 1.
+// In a discrete space every bound is an inclusive integer. NaN isn't in any
+// interval, so whether a space holds it is tracked separately.
+type patternSpace struct {
+	discrete  bool
+	intervals []patternInterval
+	nan       bool
+}
+
+// patternDomain is the set of values a switch subject of some kind can take.
+// Subjects of an opaque domain can't be analysed, so only discards are
+// known to match them. Float subjects can also be NaN, which relational and
+// constant patterns never match.
+type patternDomain struct {
+	kind     reflect.Kind
+	discrete bool
+	opaque   bool
+	nan      bool
+	full     patternInterval
+}
+
+func domainOfKind(kind reflect.Kind) *patternDomain {
+	d := &patternDomain{kind: kind}
+	switch kind {
+	case reflect.Bool:
+		d.discrete = true
+		d.full = closedInterval(float64(0), float64(1))
+	case reflect.Int8:
+		d.discrete = true
+		d.full = closedInterval(float64(math.MinInt8), float64(math.MaxInt8))
+	case reflect.Int16:
+		d.discrete = true
+		d.full = closedInterval(float64(math.MinInt16), float64(math.MaxInt16))
+	case reflect.Int32:
+		d.discrete = true
+		d.full = closedInterval(float64(math.MinInt32), float64(math.MaxInt32))
+	case reflect.Uint8:
+		d.discrete = true
+		d.full = closedInterval(float64(0), float64(math.MaxUint8))
+	case reflect.Uint16:
+		d.discrete = true
+		d.full = closedInterval(float64(0), float64(math.MaxUint16))
+	case reflect.Uint32:
+		d.discrete = true
+		d.full = closedInterval(float64(0), float64(math.MaxUint32))
+	case reflect.Int, reflect.Int64:
+		d.discrete = true
+	case reflect.Uint, reflect.Uint64:
+		d.discrete = true
+		d.full.lo = patternBound{value: float64(0), inclusive: true}
+	case reflect.Float32, reflect.Float64:
+		d.nan = true
+	case reflect.String:
+		d.full.lo = patternBound{value: "", inclusive: true}
+	default:
+		d.opaque = true
+		d.discrete = true
+		d.full = closedInterval(float64(0), float64(0))
+	}
+	return d
+}
+
+func closedInterval(lo interface{}, hi interface{}) patternInterval {
+	return patternInterval{
+		lo: patternBound{value: lo, inclusive: true},
+		hi: patternBound{value: hi, inclusive: true},
+	}
+}
+
+func (d *patternDomain) all() patternSpace {
+	s := d.space(d.full)
+	s.nan = d.nan
+	return s
+}
+
+func (d *patternDomain) none() patternSpace {
+	return patternSpace{discrete: d.discrete}
+}
+
+// space creates a normalized space from the provided intervals, clipped to
+// the domain.
+func (d *patternDomain) space(intervals ...patternInterval) patternSpace {
+	s := patternSpace{discrete: d.discrete}
+	for _, iv := range intervals {
+		lo, hi := iv.lo, iv.hi
+		if compareLower(d.full.lo, lo) > 0 {
+			lo = d.full.lo
+		}
+		if compareUpper(d.full.hi, hi) < 0 {
+			hi = d.full.hi
+		}
+		s.intervals = append(s.intervals, patternInterval{lo: lo, hi: hi})
+	}
+	return s.normalize()
+}
+
+// toValue converts a pattern constant to a value in the domain.
+func (d *patternDomain) toValue(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case bool:
+		if d.kind != reflect.Bool {
+			return nil, false
+		}
+		if v {
+			return float64(1), true
+		}
+		return float64(0), true
+	case string:
+		return v, d.kind == reflect.String
+	}
+	if !IsArithmetic(d.kind) {
+		return nil, false
+	}
+	f, err := convertToFloat64(value)
+	return f, err == nil
+}
+
+// approximate returns an over-approximation and an under-approximation of
+// the values matched by a pattern. They're equal when the pattern can be
+// analysed precisely.
+func (d *patternDomain) approximate(p Pattern) (over patternSpace, under patternSpace) {
+	if p.Type() == DiscardPat {
+		return d.all(), d.all()
+	}
+	if d.opaque {
+		return d.all(), d.none()
+	}
+	switch p := p.(type) {
+	case *ConstantPattern:
+		v, ok := d.toValue(p.value)
+		if !ok {
+			return d.none(), d.none()
+		}
+		s := d.space(closedInterval(v, v))
+		return s, s
+	case *RelationalPattern:
+		v, ok := d.toValue(p.value)
+		if !ok {
+			return d.none(), d.none()
+		}
+		var iv patternInterval
+		switch p.operator {
+		case LessThanExpr:
+			iv.hi = patternBound{value: v}
+		case LessThanOrEqualExpr:
+			iv.hi = patternBound{value: v, inclusive: true}
+		case GreaterThanExpr:
+			iv.lo = patternBound{value: v}
+		case GreaterThanOrEqualExpr:
+			iv.lo = patternBound{value: v, inclusive: true}
+		}
+		s := d.space(iv)
+		return s, s
+	case *TypePattern:
+		if p.typ == objectType {
+			return d.all(), d.all()
+		}
+		if p.typ.Kind() != d.kind {
+			return d.none(), d.none()
+		}
+		// Named types share a kind, so the type only might match.
+		return d.all(), d.none()
+	case *BinaryPattern:
+		lOver, lUnder := d.approximate(p.left)
+		rOver, rUnder := d.approximate(p.right)
+		if p.patternType == OrPat {
+			return lOver.union(rOver), lUnder.union(rUnder)
+		}
+		return lOver.intersect(rOver), lUnder.intersect(rUnder)
+	case *NotPattern:
+		over, under := d.approximate(p.operand)
+		return d.complement(under), d.complement(over)
+	}
+	return d.all(), d.none()
+}
+
+func (d *patternDomain) complement(s patternSpace) patternSpace {
+	result := d.space(d.gaps(s)...)
+	result.nan = d.nan && !s.nan
+	return result
+}
+
+// gaps returns the intervals between those of a space.
+func (d *patternDomain) gaps(s patternSpace) []patternInterval {
+	var gaps []patternInterval
+	lo := patternBound{}
+	for _, iv := range s.intervals {
+		if iv.lo.value != nil {
+			gap := patternInterval{lo: lo, hi: patternBound{value: iv.lo.value, inclusive: !iv.lo.inclusive}}
+			if !gap.empty() {
+				gaps = append(gaps, gap)
+			}
+		}
+		if iv.hi.value == nil {
+			return gaps
+		}
+		lo = patternBound{value: iv.hi.value, inclusive: !iv.hi.inclusive}
+	}
+	return append(gaps, patternInterval{lo: lo})
+}
+
+func (s patternSpace) empty() bool {
+	return len(s.intervals) == 0 && !s.nan
+}
+
+// subsetOf determines whether or not every value in s is also in other.
+func (s patternSpace) subsetOf(other patternSpace, d *patternDomain) bool {
+	return s.intersect(d.complement(other)).empty()
+}
+
+func (s patternSpace) intersect(other patternSpace) patternSpace {
+	result := patternSpace{discrete: s.discrete, nan: s.nan && other.nan}
+	for _, a := range s.intervals {
+		for _, b := range other.intervals {
+			iv := patternInterval{lo: a.lo, hi: a.hi}
+			if compareLower(b.lo, iv.lo) > 0 {
+				iv.lo = b.lo
+			}
+			if compareUpper(b.hi, iv.hi) < 0 {
+				iv.hi = b.hi
+			}
+			if !iv.empty() {
+				result.intervals = append(result.intervals, iv)
+			}
+		}
+	}
+	return result
+}
+
+func (s patternSpace) union(other patternSpace) patternSpace {
+	result := patternSpace{discrete: s.discrete}
+	result.intervals = append(result.intervals, s.intervals...)
+	result.intervals = append(result.intervals, other.intervals...)
+	result = result.normalize()
+	result.nan = s.nan || other.nan
+	return result
+}
+
+// normalize makes every bound of a discrete space an inclusive integer,
+// then sorts and merges the intervals.
+func (s patternSpace) normalize() patternSpace {
+	var intervals []patternInterval
+	for _, iv := range s.intervals {
+		if s.discrete {
+			if lo, ok := iv.lo.value.(float64); ok {
+				if iv.lo.inclusive {
+					lo = math.Ceil(lo)
+				} else {
+					lo = math.Floor(lo) + 1
+				}
+				iv.lo = patternBound{value: lo, inclusive: true}
+			}
+			if hi, ok := iv.hi.value.(float64); ok {
+				if iv.hi.inclusive {
+					hi = math.Floor(hi)
+				} else {
+					hi = math.Ceil(hi) - 1
+				}
+				iv.hi = patternBound{value: hi, inclusive: true}
+			}
+		}
+		if !iv.empty() {
+			intervals = append(intervals, iv)
+		}
+	}
+	sort.Slice(intervals, func(i, j int) bool {
+		return compareLower(intervals[i].lo, intervals[j].lo) < 0
+	})
+
+	result := patternSpace{discrete: s.discrete}
+	for _, iv := range intervals {
+		n := len(result.intervals)
+		if n > 0 && s.touches(result.intervals[n-1].hi, iv.lo) {
+			if compareUpper(iv.hi, result.intervals[n-1].hi) > 0 {
+				result.intervals[n-1].hi = iv.hi
+			}
+			continue
+		}
+		result.intervals = append(result.intervals, iv)
+	}
+	return result
+}
+
+// touches determines whether or not an interval ending at hi can be merged
+// with one starting at lo.
+func (s patternSpace) touches(hi patternBound, lo patternBound) bool {
+	if hi.value == nil || lo.value == nil {
+		return true
+	}
+	c := compareBoundValues(hi.value, lo.value)
+	switch {
+	case c > 0:
+		return true
+	case c == 0:
+		return hi.inclusive || lo.inclusive
+	}
+	if s.discrete {
+		h, hOk := hi.value.(float64)
+		l, lOk := lo.value.(float64)
+		return hOk && lOk && h+1 == l
+	}
+	return false
+}
+
+func (iv patternInterval) empty() bool {
+	if iv.lo.value == nil || iv.hi.value == nil {
+		return false
+	}
+	c := compareBoundValues(iv.lo.value, iv.hi.value)
+	return c > 0 || (c == 0 && !(iv.lo.inclusive && iv.hi.inclusive))
+}
+
+// compareLower orders lower bounds, where nil is negative infinity.
+func compareLower(a patternBound, b patternBound) int {
+	switch {
+	case a.value == nil && b.value == nil:
+		return 0
+	case a.value == nil:
+		return -1
+	case b.value == nil:
+		return 1
+	}
+	if c := compareBoundValues(a.value, b.value); c != 0 {
+		return c
+	}
+	switch {
+	case a.inclusive == b.inclusive:
+		return 0
+	case a.inclusive:
+		return -1
+	}
+	return 1
+}
+
+// compareUpper orders upper bounds, where nil is positive infinity.
+func compareUpper(a patternBound, b patternBound) int {
+	switch {
+	case a.value == nil && b.value == nil:
+		return 0
+	case a.value == nil:
+		return 1
+	case b.value == nil:
+		return -1
+	}
+	if c := compareBoundValues(a.value, b.value); c != 0 {
+		return c
+	}
+	switch {
+	case a.inclusive == b.inclusive:
+		return 0
+	case a.inclusive:
+		return 1
+	}
+	return -1
+}
+
+func compareBoundValues(a interface{}, b interface{}) int {
+	c, _ := compareValues(a, b)
+	return c
+}
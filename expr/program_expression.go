@@ -0,0 +1,335 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var (
+	errEmptyProgram = errors.New("program requires at least one statement")
+)
+
+// ProgramExpression is a script of statements which are executed in order.
+// Its value is that of the first return statement executed or, failing
+// that, of the last statement.
+type ProgramExpression struct {
+	self       *AbstractExpression
+	statements []Expression
+}
+
+func NewProgramExpression(statements []Expression, kind reflect.Kind) *ProgramExpression {
+	return &ProgramExpression{
+		self: &AbstractExpression{
+			nodeType: ProgramExpr,
+			kind:     kind,
+		},
+		statements: statements,
+	}
+}
+
+func (e *ProgramExpression) Statements() []Expression {
+	return e.statements
+}
+
+func (e *ProgramExpression) Kind() reflect.Kind {
+	return e.self.kind
+}
+
+func (e *ProgramExpression) Type() ExpressionType {
+	return e.self.nodeType
+}
+
+func (e *ProgramExpression) NodeType() string {
+	return "ProgramExpression"
+}
+
+func (e *ProgramExpression) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	return joinStatements(e.statements)
+}
+
+// SequenceExpression is a { ... } block of statements. Variables declared
+// within it are only visible until the closing brace.
+type SequenceExpression struct {
+	self       *AbstractExpression
+	statements []Expression
+}
+
+func NewSequenceExpression(statements []Expression) *SequenceExpression {
+	kind := reflect.Interface
+	if n := len(statements); n > 0 {
+		kind = statements[n-1].Kind()
+	}
+	return &SequenceExpression{
+		self: &AbstractExpression{
+			nodeType: SequenceExpr,
+			kind:     kind,
+		},
+		statements: statements,
+	}
+}
+
+func (e *SequenceExpression) Statements() []Expression {
+	return e.statements
+}
+
+func (e *SequenceExpression) Kind() reflect.Kind {
+	return e.self.kind
+}
+
+func (e *SequenceExpression) Type() ExpressionType {
+	return e.self.nodeType
+}
+
+func (e *SequenceExpression) NodeType() string {
+	return "SequenceExpression"
+}
+
+func (e *SequenceExpression) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	if len(e.statements) == 0 {
+		return "{ }"
+	}
+	return fmt.Sprintf("{ %s }", joinStatements(e.statements))
+}
+
+// DeclareExpression declares a local variable of a program, as in
+// var fee = 2.5. Its value is the variable's initial value.
+type DeclareExpression struct {
+	self     *AbstractExpression
+	variable *ParameterExpression
+	value    Expression
+}
+
+func NewDeclareExpression(variable *ParameterExpression, value Expression) *DeclareExpression {
+	return &DeclareExpression{
+		self: &AbstractExpression{
+			nodeType: DeclareExpr,
+			kind:     value.Kind(),
+		},
+		variable: variable,
+		value:    value,
+	}
+}
+
+func (e *DeclareExpression) Variable() *ParameterExpression {
+	return e.variable
+}
+
+func (e *DeclareExpression) Value() Expression {
+	return e.value
+}
+
+func (e *DeclareExpression) Kind() reflect.Kind {
+	return e.self.kind
+}
+
+func (e *DeclareExpression) Type() ExpressionType {
+	return e.self.nodeType
+}
+
+func (e *DeclareExpression) NodeType() string {
+	return "DeclareExpression"
+}
+
+func (e *DeclareExpression) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%s %v = %v", varIdentifier, e.variable, e.value)
+}
+
+// IfExpression executes one of two statements depending on a condition.
+// The else statement is optional; without one the value is nil when the
+// condition is false.
+type IfExpression struct {
+	self      *AbstractExpression
+	test      Expression
+	then      Expression
+	otherwise Expression
+}
+
+func NewIfExpression(test Expression, then Expression, otherwise Expression) *IfExpression {
+	kind := reflect.Interface
+	if otherwise != nil {
+		kind = commonKind(then.Kind(), otherwise.Kind())
+	}
+	return &IfExpression{
+		self: &AbstractExpression{
+			nodeType: IfExpr,
+			kind:     kind,
+		},
+		test:      test,
+		then:      then,
+		otherwise: otherwise,
+	}
+}
+
+func (e *IfExpression) Test() Expression {
+	return e.test
+}
+
+func (e *IfExpression) Then() Expression {
+	return e.then
+}
+
+// Else returns the else statement, which may be nil.
+func (e *IfExpression) Else() Expression {
+	return e.otherwise
+}
+
+func (e *IfExpression) Kind() reflect.Kind {
+	return e.self.kind
+}
+
+func (e *IfExpression) Type() ExpressionType {
+	return e.self.nodeType
+}
+
+func (e *IfExpression) NodeType() string {
+	return "IfExpression"
+}
+
+func (e *IfExpression) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	if e.otherwise == nil {
+		return fmt.Sprintf("%s (%v) %v", ifIdentifier, e.test, e.then)
+	}
+	return fmt.Sprintf("%s (%v) %v %s %v", ifIdentifier, e.test, e.then, elseIdentifier, e.otherwise)
+}
+
+// ReturnExpression ends a program with a value, which may be nil.
+type ReturnExpression struct {
+	self  *AbstractExpression
+	value Expression
+}
+
+func NewReturnExpression(value Expression) *ReturnExpression {
+	kind := reflect.Interface
+	if value != nil {
+		kind = value.Kind()
+	}
+	return &ReturnExpression{
+		self: &AbstractExpression{
+			nodeType: ReturnExpr,
+			kind:     kind,
+		},
+		value: value,
+	}
+}
+
+// Value returns the returned expression, which may be nil.
+func (e *ReturnExpression) Value() Expression {
+	return e.value
+}
+
+func (e *ReturnExpression) Kind() reflect.Kind {
+	return e.self.kind
+}
+
+func (e *ReturnExpression) Type() ExpressionType {
+	return e.self.nodeType
+}
+
+func (e *ReturnExpression) NodeType() string {
+	return "ReturnExpression"
+}
+
+func (e *ReturnExpression) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	if e.value == nil {
+		return returnIdentifier
+	}
+	return fmt.Sprintf("%s %v", returnIdentifier, e.value)
+}
+
+// CreateProgram creates a program. Its kind is the common kind of every
+// value it can produce: those of its return statements and its last
+// statement.
+func CreateProgram(statements []Expression) (Expression, error) {
+	if len(statements) == 0 {
+		return nil, errEmptyProgram
+	}
+	for _, statement := range statements {
+		if statement == nil {
+			return nil, errInvalidExpression
+		}
+	}
+	kinds := returnKinds(statements)
+	if last := statements[len(statements)-1]; last.Type() != ReturnExpr {
+		kinds = append(kinds, last.Kind())
+	}
+	return NewProgramExpression(statements, commonKind(kinds...)), nil
+}
+
+// CreateSequence creates a { ... } block of statements.
+func CreateSequence(statements []Expression) (Expression, error) {
+	for _, statement := range statements {
+		if statement == nil {
+			return nil, errInvalidExpression
+		}
+	}
+	return NewSequenceExpression(statements), nil
+}
+
+// CreateDeclare creates var variable = value.
+func CreateDeclare(variable *ParameterExpression, value Expression) (Expression, error) {
+	if variable == nil || value == nil {
+		return nil, errInvalidExpression
+	}
+	return NewDeclareExpression(variable, value), nil
+}
+
+// CreateIf creates an if statement; otherwise may be nil.
+func CreateIf(test Expression, then Expression, otherwise Expression) (Expression, error) {
+	if test == nil || then == nil {
+		return nil, errInvalidExpression
+	}
+	if !isBoolOrUnknown(test.Kind()) {
+		return nil, fmt.Errorf("if requires a bool condition, got %v", test.Kind())
+	}
+	return NewIfExpression(test, then, otherwise), nil
+}
+
+// CreateReturn creates a return statement; value may be nil.
+func CreateReturn(value Expression) (Expression, error) {
+	return NewReturnExpression(value), nil
+}
+
+// returnKinds returns the kinds of the return statements within statements,
+// including those nested in blocks and if statements.
+func returnKinds(statements []Expression) []reflect.Kind {
+	var kinds []reflect.Kind
+	for _, statement := range statements {
+		switch e := statement.(type) {
+		case *ReturnExpression:
+			kinds = append(kinds, e.Kind())
+		case *SequenceExpression:
+			kinds = append(kinds, returnKinds(e.statements)...)
+		case *IfExpression:
+			kinds = append(kinds, returnKinds([]Expression{e.then})...)
+			if e.otherwise != nil {
+				kinds = append(kinds, returnKinds([]Expression{e.otherwise})...)
+			}
+		}
+	}
+	return kinds
+}
+
+func joinStatements(statements []Expression) string {
+	var s []string
+	for _, statement := range statements {
+		s = append(s, statement.String())
+	}
+	return strings.Join(s, "; ")
+}
@@ -0,0 +1,171 @@
+package expr
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProgramEvaluation(t *testing.T) {
+	for _, test := range []struct {
+		program  string
+		expected interface{}
+	}{
+		{"amount * 0.02", 3.0},
+		{"var fee = 2.5; fee * 2", 5.0},
+		{"var fee = 2.5; fee += amount / 100; fee;", 4.0},
+		{`
+			var fee = 0.0;
+			if (amount > 100) {
+				fee = amount * 0.02;
+			} else {
+				fee = 1.5;
+			}
+			return fee;
+		`, 3.0},
+		{`
+			if (region == 'EU') return 2.0;
+			else if (region == 'US') return 1.0;
+			return 0.5
+		`, 2.0},
+		{"if (amount > 1000) return 10; return 5", 5},
+		{"if (amount > 100 && region != 'US') { return 'premium' } 'standard'", "premium"},
+		{"var n = 1; { var n = 10; n++ } n", 1},
+		{"var total = 0; { var step = 2; total += step; } { var step = 3; total += step; } total", 5},
+		// Integer literals are signed, so variables declared with them can go
+		// negative.
+		{"var b = 0; b -= 10; b", -10},
+		{"return; amount", nil},
+		{"if (amount < 0) return 'refund'", nil},
+		{"if (amount > 100) { var m = 2; return m } else { var m = 3; return m }", 2},
+	} {
+		parser, err := NewExpressionParser(test.program, map[string]interface{}{
+			"amount": 150.0,
+			"region": "EU",
+		})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		parser.SetMode(ProgramMode)
+		actual, err := parser.Evaluate(nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.program, err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Fatalf("%s: expected %v (%T) but got %v (%T)", test.program, test.expected, test.expected, actual, actual)
+		}
+	}
+}
+
+func TestProgramWithStatementMode(t *testing.T) {
+	parameters := map[string]interface{}{
+		"amount": 150.0,
+		"fee":    0.0,
+	}
+	parser, err := NewExpressionParser("if (amount > 100) fee = 3; else fee = 1; fee * 2", parameters)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	parser.SetMode(ProgramMode | StatementMode)
+	actual, err := parser.Evaluate(nil)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if actual != 6.0 || parameters["fee"] != 3.0 {
+		t.Fatalf("expected 6 and a fee of 3 but got %v and %v", actual, parameters["fee"])
+	}
+}
+
+func TestProgramKinds(t *testing.T) {
+	for _, test := range []struct {
+		program  string
+		expected reflect.Kind
+	}{
+		{"var fee = 2.5; fee", reflect.Float64},
+		{"if (amount > 100) return 1; 2.5", reflect.Float64},
+		{"if (amount > 100) return 'a'; 2.5", reflect.Interface},
+		{"return amount > 100", reflect.Bool},
+	} {
+		parser, err := NewExpressionParser(test.program, map[string]interface{}{"amount": 150.0})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		parser.SetMode(ProgramMode)
+		expression, err := parser.ParseExpression()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.program, err)
+		}
+		if actual := expression.Kind(); actual != test.expected {
+			t.Fatalf("%s: expected %v but got %v", test.program, test.expected, actual)
+		}
+	}
+}
+
+func TestProgramToString(t *testing.T) {
+	parser, err := NewExpressionParser("var x = 1; if (x > 0) { x += 1; return x } else return 0", nil)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	parser.SetMode(ProgramMode)
+	expression, err := parser.ParseExpression()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	expected := "var x = value(1); if ((x > value(0))) { (x += value(1)); return x } else return value(0)"
+	if actual := expression.String(); actual != expected {
+		t.Fatalf("expected %v but got %v", expected, actual)
+	}
+}
+
+func TestProgramErrors(t *testing.T) {
+	for _, test := range []string{
+		"var x = 1 var y = 2",
+		"var x = 1; var x = 2",
+		"if amount > 100 return 1",
+		"if (amount) return 1",
+		"{ var x = 1; x",
+		"amount = 1",
+		"amount += 1",
+		"y = 1",
+		"var x = 1; x = 'a'",
+		"x; var x = 1",
+		"{ var x = 1 } x",
+		"def f(x) = x; def f(y) = y",
+	} {
+		parser, err := NewExpressionParser(test, map[string]interface{}{"amount": 150.0})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		parser.SetMode(ProgramMode)
+		if _, err := parser.Evaluate(nil); err == nil {
+			t.Fatalf("expected %s to error but it didn't", test)
+		}
+	}
+}
+
+func TestDeclarationsInBranches(t *testing.T) {
+	for _, test := range []string{
+		"var n = 0; if (n > 0) var m = 2; m",
+		"if (amount > 0) var m = 2 else var m = 3",
+		"if (amount > 0) return 1; else def f(x) = x",
+	} {
+		parser, err := NewExpressionParser(test, map[string]interface{}{"amount": 150.0})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		parser.SetMode(ProgramMode)
+		if _, err := parser.Evaluate(nil); err == nil || !strings.Contains(err.Error(), "must be in a block") {
+			t.Fatalf("%s: expected an error about the unbraced declaration but got %v", test, err)
+		}
+	}
+}
+
+func TestExpressionModeIsDefault(t *testing.T) {
+	parser, err := NewExpressionParser("return", nil)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := parser.ParseExpression(); err == nil {
+		t.Fatalf("expected statements to be rejected outside of ProgramMode")
+	}
+}
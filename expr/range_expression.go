@@ -0,0 +1,306 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Index is the value of an index expression. When FromEnd is set the index
+// is counted back from the end of the sequence, so ^1 is the last element.
+type Index struct {
+	Value   int
+	FromEnd bool
+}
+
+// Offset returns the offset of the index in a sequence of the provided length.
+func (i Index) Offset(length int) int {
+	if i.FromEnd {
+		return length - i.Value
+	}
+	return i.Value
+}
+
+func (i Index) String() string {
+	if i.FromEnd {
+		return fmt.Sprintf("^%d", i.Value)
+	}
+	return fmt.Sprintf("%d", i.Value)
+}
+
+// Range is the value of a range expression. Ranges follow C# semantics:
+// Start is inclusive, End is exclusive and a nil bound is open, so 1..4
+// covers 1, 2 and 3 while ..3 covers everything before 3.
+type Range struct {
+	Start interface{}
+	End   interface{}
+}
+
+// Offsets returns the inclusive start and exclusive end offsets of the range
+// in a sequence of the provided length.
+func (r Range) Offsets(length int) (start int, end int, err error) {
+	start, err = boundOffset(r.Start, 0, length)
+	if err != nil {
+		return start, end, err
+	}
+	end, err = boundOffset(r.End, length, length)
+	if err != nil {
+		return start, end, err
+	}
+	if start < 0 || end > length || start > end {
+		return start, end, fmt.Errorf("range %v is out of bounds for length %d", r, length)
+	}
+	return start, end, nil
+}
+
+func (r Range) String() string {
+	var start, end string
+	if r.Start != nil {
+		start = fmt.Sprintf("%v", r.Start)
+	}
+	if r.End != nil {
+		end = fmt.Sprintf("%v", r.End)
+	}
+	return start + ".." + end
+}
+
+func boundOffset(bound interface{}, open int, length int) (int, error) {
+	if bound == nil {
+		return open, nil
+	}
+	index, err := convertToIndex(bound)
+	if err != nil {
+		return 0, err
+	}
+	return index.Offset(length), nil
+}
+
+type RangeExpression struct {
+	self  *AbstractExpression
+	start Expression
+	end   Expression
+}
+
+func NewRangeExpression(start Expression, end Expression) *RangeExpression {
+	return &RangeExpression{
+		self: &AbstractExpression{
+			nodeType: RangeExpr,
+			kind:     reflect.Struct,
+		},
+		start: start,
+		end:   end,
+	}
+}
+
+// Start returns the start of the range, or nil if the range has no start.
+func (e *RangeExpression) Start() Expression {
+	return e.start
+}
+
+// End returns the end of the range, or nil if the range has no end.
+func (e *RangeExpression) End() Expression {
+	return e.end
+}
+
+func (e *RangeExpression) Kind() reflect.Kind {
+	return e.self.kind
+}
+
+func (e *RangeExpression) Type() ExpressionType {
+	return e.self.nodeType
+}
+
+func (e *RangeExpression) NodeType() string {
+	return "RangeExpression"
+}
+
+func (e *RangeExpression) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	var start, end string
+	if e.start != nil {
+		start = e.start.String()
+	}
+	if e.end != nil {
+		end = e.end.String()
+	}
+	return fmt.Sprintf("(%s..%s)", start, end)
+}
+
+// CreateRange creates a range between start and end. Either bound may be nil.
+func CreateRange(start Expression, end Expression) (Expression, error) {
+	for _, bound := range []Expression{start, end} {
+		if bound == nil {
+			continue
+		}
+		if !IsArithmetic(bound.Kind()) && bound.Type() != IndexFromEndExpr && bound.Kind() != reflect.Interface {
+			return nil, fmt.Errorf("range bounds must be arithmetic, got %v", bound.Kind())
+		}
+	}
+	return NewRangeExpression(start, end), nil
+}
+
+// CreateIndexFromEnd creates a ^n expression.
+func CreateIndexFromEnd(expr Expression) (Expression, error) {
+	if expr == nil {
+		return nil, errInvalidExpression
+	}
+	if !IsInteger(expr.Kind()) && expr.Kind() != reflect.Interface {
+		return nil, fmt.Errorf("index from end requires an integer, got %v", expr.Kind())
+	}
+	return NewUnaryExpression(expr, IndexFromEndExpr, reflect.Struct), nil
+}
+
+// CreateIndex creates an expression which indexes or slices the operand.
+// Strings are indexed by rune and yield strings; slices and arrays yield
+// their elements. Indexing with a range slices the operand.
+func CreateIndex(operand Expression, index Expression) (Expression, error) {
+	if err := validateLeftAndRight(operand, index); err != nil {
+		return nil, err
+	}
+	isRange := index.Type() == RangeExpr
+	if !isRange && !IsInteger(index.Kind()) && index.Type() != IndexFromEndExpr && index.Kind() != reflect.Interface {
+		return nil, fmt.Errorf("index must be an integer or a range, got %v", index.Kind())
+	}
+	switch operand.Kind() {
+	case reflect.String:
+		return NewBinaryExpression(IndexExpr, operand, index, reflect.String), nil
+	case reflect.Slice, reflect.Array:
+		if isRange {
+			return NewBinaryExpression(IndexExpr, operand, index, reflect.Slice), nil
+		}
+		return NewBinaryExpression(IndexExpr, operand, index, elementKind(operand)), nil
+	case reflect.Interface:
+		return NewBinaryExpression(IndexExpr, operand, index, reflect.Interface), nil
+	}
+	return nil, fmt.Errorf("cannot index a value of kind %v", operand.Kind())
+}
+
+// CreateIn creates a membership test. Ranges test value bounds, strings
+// test for a substring and slices or arrays test for an element.
+func CreateIn(value Expression, collection Expression) (Expression, error) {
+	if err := validateLeftAndRight(value, collection); err != nil {
+		return nil, err
+	}
+	switch {
+	case collection.Type() == RangeExpr:
+		if !IsArithmetic(value.Kind()) && value.Kind() != reflect.Interface {
+			return nil, fmt.Errorf("range membership requires an arithmetic value, got %v", value.Kind())
+		}
+	case collection.Kind() == reflect.String:
+		if value.Kind() != reflect.String && value.Kind() != reflect.Interface {
+			return nil, fmt.Errorf("string membership requires a string, got %v", value.Kind())
+		}
+	case collection.Kind() == reflect.Slice, collection.Kind() == reflect.Array, collection.Kind() == reflect.Interface:
+	default:
+		return nil, fmt.Errorf("in is not supported for %v", collection.Kind())
+	}
+	return NewBinaryExpression(InExpr, value, collection, reflect.Bool), nil
+}
+
+// elementKind returns the kind of the elements of a slice or array
+// expression, or reflect.Interface when it can't be determined.
+func elementKind(expr Expression) reflect.Kind {
+	if c, ok := expr.(*ConstantExpression); ok && c.value != nil {
+		return reflect.TypeOf(c.value).Elem().Kind()
+	}
+	return reflect.Interface
+}
+
+func convertToIndex(val interface{}) (Index, error) {
+	if index, ok := val.(Index); ok {
+		return index, nil
+	}
+	i, err := convertToInt(val)
+	if err != nil {
+		return Index{}, err
+	}
+	return Index{Value: i}, nil
+}
+
+func evaluateIndex(operand interface{}, index interface{}) (interface{}, error) {
+	v := reflect.ValueOf(operand)
+	var runes []rune
+	length := 0
+	switch v.Kind() {
+	case reflect.String:
+		runes = []rune(v.String())
+		length = len(runes)
+	case reflect.Slice, reflect.Array:
+		length = v.Len()
+	default:
+		return nil, fmt.Errorf("cannot index a value of kind %v", v.Kind())
+	}
+
+	if r, ok := index.(Range); ok {
+		start, end, err := r.Offsets(length)
+		if err != nil {
+			return nil, err
+		}
+		if v.Kind() == reflect.String {
+			return string(runes[start:end]), nil
+		}
+		if v.Kind() == reflect.Array && !v.CanAddr() {
+			copied := reflect.New(v.Type()).Elem()
+			copied.Set(v)
+			v = copied
+		}
+		return v.Slice(start, end).Interface(), nil
+	}
+
+	i, err := convertToIndex(index)
+	if err != nil {
+		return nil, err
+	}
+	offset := i.Offset(length)
+	if offset < 0 || offset >= length {
+		return nil, fmt.Errorf("index %v is out of bounds for length %d", i, length)
+	}
+	if v.Kind() == reflect.String {
+		return string(runes[offset]), nil
+	}
+	return v.Index(offset).Interface(), nil
+}
+
+func evaluateIn(value interface{}, collection interface{}) (bool, error) {
+	if r, ok := collection.(Range); ok {
+		for _, bound := range []interface{}{r.Start, r.End} {
+			if index, ok := bound.(Index); ok && index.FromEnd {
+				return false, errors.New("index from end can't be used in a membership test")
+			}
+		}
+		if r.Start != nil {
+			c, err := compareValues(value, r.Start)
+			if err != nil || c < 0 || c == unordered {
+				return false, err
+			}
+		}
+		if r.End != nil {
+			c, err := compareValues(value, r.End)
+			if err != nil || c >= 0 {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	v := reflect.ValueOf(collection)
+	switch v.Kind() {
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return false, fmt.Errorf("string membership requires a string, got %T", value)
+		}
+		return strings.Contains(v.String(), s), nil
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if valuesEqual(value, v.Index(i).Interface()) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("in is not supported for %T", collection)
+}
@@ -0,0 +1,135 @@
+package expr
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRangeExpressionToString(t *testing.T) {
+	for _, test := range []struct {
+		expr     *RangeExpression
+		expected string
+	}{
+		{nil, "<nil>"},
+		{NewRangeExpression(nil, nil), "(..)"},
+		{NewRangeExpression(NewConstantExpression(1, reflect.Int32), nil), "(1..)"},
+		{NewRangeExpression(nil, NewConstantExpression(3, reflect.Int32)), "(..3)"},
+	} {
+		if actual := test.expr.String(); actual != test.expected {
+			t.Fatalf("expected %v but got %v", test.expected, actual)
+		}
+	}
+}
+
+func TestRangeOffsets(t *testing.T) {
+	for _, test := range []struct {
+		r           Range
+		length      int
+		start       int
+		end         int
+		shouldError bool
+	}{
+		{Range{}, 5, 0, 5, false},
+		{Range{Start: 1, End: 3}, 5, 1, 3, false},
+		{Range{Start: Index{Value: 2, FromEnd: true}}, 5, 3, 5, false},
+		{Range{End: Index{Value: 1, FromEnd: true}}, 5, 0, 4, false},
+		{Range{Start: 4, End: 2}, 5, 0, 0, true},
+		{Range{End: 6}, 5, 0, 0, true},
+	} {
+		start, end, err := test.r.Offsets(test.length)
+		if test.shouldError {
+			if err == nil {
+				t.Fatalf("expected %v to error but it didn't", test.r)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if start != test.start || end != test.end {
+			t.Fatalf("expected %d..%d but got %d..%d", test.start, test.end, start, end)
+		}
+	}
+}
+
+func TestRangeEvaluation(t *testing.T) {
+	parameters := map[string]interface{}{
+		"age":    30,
+		"name":   "pop expressions",
+		"items":  []int{1, 2, 3, 4, 5},
+		"fruit":  "apple",
+		"fruits": []string{"apple", "pear"},
+	}
+	for _, test := range []struct {
+		expression string
+		expected   interface{}
+	}{
+		{"age in 18..65", true},
+		{"age in 18..30", false},
+		{"age in 30..", true},
+		{"age in ..18", false},
+		{"name[0..3]", "pop"},
+		{"name[..3]", "pop"},
+		{"name[4..]", "expressions"},
+		{"name[^3..]", "ons"},
+		{"name[^1]", "s"},
+		{"name[1]", "o"},
+		{"items[1..3]", []int{2, 3}},
+		{"items[..^1]", []int{1, 2, 3, 4}},
+		{"items[^2]", 4},
+		{"fruit in fruits", true},
+		{"'pop' in name", true},
+	} {
+		parser, err := NewExpressionParser(test.expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expression, err := parser.ParseExpression()
+		if err != nil {
+			t.Fatalf("%s: unexpected parse err: %v", test.expression, err)
+		}
+		visitor, err := CreateVisitorFromExpression(expression)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		actual, err := visitor.Visit()
+		if err != nil {
+			t.Fatalf("%s: unexpected evaluation err: %v", test.expression, err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Fatalf("%s: expected %v but got %v", test.expression, test.expected, actual)
+		}
+	}
+}
+
+func TestRangeErrors(t *testing.T) {
+	parameters := map[string]interface{}{
+		"name":  "pop",
+		"flag":  true,
+		"items": []int{1, 2, 3},
+	}
+	for _, expression := range []string{
+		"flag in 1..5",
+		"name['a']",
+		"flag[0]",
+		"name[5]",
+		"items[2..1]",
+		"1 in 1..^1",
+	} {
+		parser, err := NewExpressionParser(expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		parsed, err := parser.ParseExpression()
+		if err != nil {
+			continue
+		}
+		visitor, err := CreateVisitorFromExpression(parsed)
+		if err != nil {
+			continue
+		}
+		if _, err := visitor.Visit(); err == nil {
+			t.Fatalf("expected %s to error but it didn't", expression)
+		}
+	}
+}
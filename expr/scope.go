@@ -0,0 +1,116 @@
+package expr
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Scope holds the values of parameters and local variables during
+// evaluation. Lookups fall back to the parent scope, so inner bindings
+// shadow outer ones.
+type Scope struct {
+	parent *Scope
+	values map[string]interface{}
+	// depth counts the function calls being evaluated.
+	depth int
+	// environment is the struct whose fields and methods are visible to
+	// the expression, if any. It's only set on root scopes.
+	environment reflect.Value
+	// shared holds the values of the shared subexpressions evaluated so
+	// far. It's only set on root scopes.
+	shared *sharedValues
+}
+
+// NewScopeFromMap creates a root scope backed by the provided map, so
+// assignments to parameters write back to it.
+func NewScopeFromMap(values map[string]interface{}) *Scope {
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+	return &Scope{
+		values: values,
+	}
+}
+
+// NewScopeFromStruct creates a root scope whose environment is the provided
+// struct, described by env. When value is a pointer, assignments to its
+// fields write back to it.
+func NewScopeFromStruct(env *Environment, value interface{}) (*Scope, error) {
+	v, err := env.value(value)
+	if err != nil {
+		return nil, err
+	}
+	return &Scope{
+		values:      make(map[string]interface{}),
+		environment: v,
+	}, nil
+}
+
+// NewScope creates a new scope nested within parent, which may be nil.
+func NewScope(parent *Scope) *Scope {
+	return &Scope{
+		parent: parent,
+		values: make(map[string]interface{}),
+		depth:  parent.callDepth(),
+	}
+}
+
+// callDepth returns the number of function calls being evaluated.
+func (s *Scope) callDepth() int {
+	if s == nil {
+		return 0
+	}
+	return s.depth
+}
+
+// Environment returns the struct of the root scope, which is invalid if
+// there isn't one.
+func (s *Scope) Environment() reflect.Value {
+	for scope := s; scope != nil; scope = scope.parent {
+		if scope.environment.IsValid() {
+			return scope.environment
+		}
+	}
+	return reflect.Value{}
+}
+
+// sharedValues returns the shared subexpression values of the root scope,
+// creating them when they're first needed.
+func (s *Scope) sharedValues() *sharedValues {
+	root := s
+	for root.parent != nil {
+		root = root.parent
+	}
+	if root.shared == nil {
+		root.shared = newSharedValues(0)
+	}
+	return root.shared
+}
+
+// Define binds a value to a name in this scope.
+func (s *Scope) Define(name string, value interface{}) {
+	s.values[name] = value
+}
+
+// Lookup returns the value bound to a name in this scope or the nearest
+// enclosing scope which defines it.
+func (s *Scope) Lookup(name string) (interface{}, bool) {
+	for scope := s; scope != nil; scope = scope.parent {
+		if val, ok := scope.values[name]; ok {
+			return val, true
+		}
+	}
+	return nil, false
+}
+
+// Assign updates the value bound to a name in the nearest scope which
+// defines it. Names which aren't defined can't be assigned.
+func (s *Scope) Assign(name string, value interface{}) error {
+	for scope := s; scope != nil; scope = scope.parent {
+		if _, ok := scope.values[name]; ok {
+			scope.values[name] = value
+			return nil
+		}
+	}
+	return fmt.Errorf("can't assign to undefined variable: %s", name)
+}
@@ -0,0 +1,87 @@
+package expr
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// SharedExpression is a subexpression which occurs more than once in an
+// expression, created by ShareSubexpressions. Every occurrence is the same
+// node, and its operand is evaluated at most once per evaluation: the first
+// occurrence evaluated stores its value in the node's slot, which the others
+// read.
+type SharedExpression struct {
+	self    *AbstractExpression
+	operand Expression
+	slot    int
+}
+
+func NewSharedExpression(operand Expression, slot int) *SharedExpression {
+	return &SharedExpression{
+		self: &AbstractExpression{
+			nodeType: SharedExpr,
+			kind:     operand.Kind(),
+		},
+		operand: operand,
+		slot:    slot,
+	}
+}
+
+func (e *SharedExpression) Operand() Expression {
+	return e.operand
+}
+
+// Slot returns the index the node's value is stored at while evaluating.
+func (e *SharedExpression) Slot() int {
+	return e.slot
+}
+
+func (e *SharedExpression) Kind() reflect.Kind {
+	return e.self.kind
+}
+
+func (e *SharedExpression) Type() ExpressionType {
+	return e.self.nodeType
+}
+
+func (e *SharedExpression) NodeType() string {
+	return "SharedExpression"
+}
+
+func (e *SharedExpression) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("$%d:%v", e.slot, e.operand)
+}
+
+// sharedValues holds the values of the shared subexpressions an evaluation
+// has evaluated so far.
+type sharedValues struct {
+	values    []interface{}
+	evaluated []bool
+}
+
+func newSharedValues(slots int) *sharedValues {
+	return &sharedValues{
+		values:    make([]interface{}, slots),
+		evaluated: make([]bool, slots),
+	}
+}
+
+// get returns the value stored in a slot, if there is one.
+func (s *sharedValues) get(slot int) (interface{}, bool) {
+	if slot >= len(s.values) || !s.evaluated[slot] {
+		return nil, false
+	}
+	return s.values[slot], true
+}
+
+// set stores the value of a slot.
+func (s *sharedValues) set(slot int, val interface{}) {
+	for slot >= len(s.values) {
+		s.values = append(s.values, nil)
+		s.evaluated = append(s.evaluated, false)
+	}
+	s.values[slot], s.evaluated[slot] = val, true
+}
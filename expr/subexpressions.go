@@ -0,0 +1,349 @@
+package expr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+)
+
+// Sharing common subexpressions finds the pure subexpressions which occur
+// more than once in an expression, such as a method call repeated by a
+// generated rule, and replaces their occurrences with a SharedExpression so
+// that they're evaluated once per evaluation. Subexpressions are found by
+// hashing the structure of every node, and compared structurally when their
+// hashes match.
+//
+// A subexpression is pure when evaluating it can't change anything, so its
+// value can't change during an evaluation. Arithmetic, comparisons, logic,
+// conditionals, casts to basic types, member accesses and calls of pure
+// methods (see PureEnvironment) over parameters, fields and constants are
+// pure. User-defined operators and conversions, and methods which aren't
+// listed as pure, are not. Only subexpressions which read members or
+// collections or call methods are shared; repeated arithmetic is cheaper to
+// evaluate again than to store.
+//
+// Lambdas, let bindings, switches and statements are kept as they are.
+// Expressions which assign to parameters or fields, as they can in
+// StatementMode, aren't changed at all, since the values of subexpressions
+// could change while they're evaluated. Assignments within lambdas and let
+// bindings aren't looked for, so ExpressionParser only shares the
+// subexpressions of expressions which can't assign to anything.
+
+// ShareSubexpressions returns a copy of an expression in which the pure
+// subexpressions which occur more than once are shared. The expression
+// itself isn't modified.
+func ShareSubexpressions(expression Expression) (Expression, error) {
+	if expression == nil {
+		return nil, errInvalidExpression
+	}
+	s := &sharer{
+		classes:   make(map[uint64][]*subexpression),
+		nodes:     make(map[Expression]*subexpression),
+		uses:      make(map[*subexpression]int),
+		visited:   make(map[*subexpression]bool),
+		sharedFor: make(map[*subexpression]*SharedExpression),
+	}
+	s.hash(expression)
+	if s.assigns {
+		return expression, nil
+	}
+	s.count(expression)
+	return s.share(expression), nil
+}
+
+// subexpression is a class of structurally identical pure nodes.
+type subexpression struct {
+	node Expression
+	// occurrences counts the nodes of the class.
+	occurrences int
+}
+
+type sharer struct {
+	classes map[uint64][]*subexpression
+	nodes   map[Expression]*subexpression
+	// uses counts the occurrences of each class which aren't within a
+	// later occurrence of a class containing them.
+	uses      map[*subexpression]int
+	visited   map[*subexpression]bool
+	sharedFor map[*subexpression]*SharedExpression
+	slots     int
+	// assigns is set when the expression assigns to something.
+	assigns bool
+}
+
+// hash computes the structural hash of a node and its operands, and adds
+// the node to its class. It reports whether or not the node is pure.
+func (s *sharer) hash(e Expression) (uint64, bool) {
+	if IsAssignment(e.Type()) || isIncrement(e.Type()) {
+		s.assigns = true
+	}
+	operands, ok := operandsOf(e)
+	pure := ok && isPureNode(e)
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%v/%v/%s;", e.Type(), e.Kind(), nodeAttributes(e))
+	var buf [8]byte
+	for _, operand := range operands {
+		sum, ok := s.hash(operand)
+		pure = pure && ok
+		binary.BigEndian.PutUint64(buf[:], sum)
+		h.Write(buf[:])
+	}
+	if !pure {
+		return 0, false
+	}
+	sum := h.Sum64()
+	switch e.(type) {
+	case *ConstantExpression, *ParameterExpression, *FieldExpression:
+	default:
+		s.classify(sum, e).occurrences++
+	}
+	return sum, true
+}
+
+// classify returns the class of a node with the provided hash.
+func (s *sharer) classify(sum uint64, e Expression) *subexpression {
+	for _, class := range s.classes[sum] {
+		if sameExpression(class.node, e) {
+			s.nodes[e] = class
+			return class
+		}
+	}
+	class := &subexpression{node: e}
+	s.classes[sum] = append(s.classes[sum], class)
+	s.nodes[e] = class
+	return class
+}
+
+// count counts the uses of each class, visiting the nodes share will. Only
+// the first occurrence of a repeated class is descended into, since the
+// others will refer to its shared node.
+func (s *sharer) count(e Expression) {
+	if class, ok := s.nodes[e]; ok && class.occurrences > 1 {
+		s.uses[class]++
+		if s.visited[class] {
+			return
+		}
+		s.visited[class] = true
+	}
+	operands, _ := operandsOf(e)
+	for _, operand := range operands {
+		s.count(operand)
+	}
+}
+
+func (s *sharer) share(e Expression) Expression {
+	class, ok := s.nodes[e]
+	if !ok || s.uses[class] < 2 || !worthSharing(e) {
+		return s.shareOperands(e)
+	}
+	shared, ok := s.sharedFor[class]
+	if !ok {
+		shared = NewSharedExpression(s.shareOperands(e), s.slots)
+		s.sharedFor[class] = shared
+		s.slots++
+	}
+	return shared
+}
+
+// shareOperands returns a node whose operands have been shared.
+func (s *sharer) shareOperands(e Expression) Expression {
+	operands, _ := operandsOf(e)
+	if len(operands) == 0 {
+		return e
+	}
+	shared := make([]Expression, len(operands))
+	changed := false
+	for i, operand := range operands {
+		shared[i] = s.share(operand)
+		changed = changed || shared[i] != operand
+	}
+	if !changed {
+		return e
+	}
+	return withOperands(e, shared)
+}
+
+// operandsOf returns the operands of the nodes which subexpressions are
+// shared within. It reports false for other nodes, which are kept as they
+// are.
+func operandsOf(e Expression) ([]Expression, bool) {
+	switch n := e.(type) {
+	case *ConstantExpression, *ParameterExpression, *FieldExpression:
+		return nil, true
+	case *BinaryExpression:
+		return []Expression{n.left, n.right}, true
+	case *UnaryExpression:
+		return []Expression{n.operand}, true
+	case *ConditionalExpression:
+		return []Expression{n.test, n.ifTrue, n.ifFalse}, true
+	case *ConvertExpression:
+		return []Expression{n.operand}, true
+	case *MemberExpression:
+		return []Expression{n.operand}, true
+	case *CallExpression:
+		return n.arguments, true
+	case *SharedExpression:
+		return []Expression{n.operand}, true
+	}
+	return nil, false
+}
+
+// withOperands returns a copy of a node with different operands.
+func withOperands(e Expression, operands []Expression) Expression {
+	switch n := e.(type) {
+	case *BinaryExpression:
+		copied := *n
+		copied.left, copied.right = operands[0], operands[1]
+		return &copied
+	case *UnaryExpression:
+		copied := *n
+		copied.operand = operands[0]
+		return &copied
+	case *ConditionalExpression:
+		copied := *n
+		copied.test, copied.ifTrue, copied.ifFalse = operands[0], operands[1], operands[2]
+		return &copied
+	case *ConvertExpression:
+		copied := *n
+		copied.operand = operands[0]
+		return &copied
+	case *MemberExpression:
+		copied := *n
+		copied.operand = operands[0]
+		return &copied
+	case *CallExpression:
+		copied := *n
+		copied.arguments = operands
+		return &copied
+	case *SharedExpression:
+		copied := *n
+		copied.operand = operands[0]
+		return &copied
+	}
+	return e
+}
+
+// isPureNode determines whether or not evaluating a node, other than its
+// operands, can't change anything.
+func isPureNode(e Expression) bool {
+	switch n := e.(type) {
+	case *BinaryExpression:
+		return n.operator == nil && !IsAssignment(n.Type())
+	case *UnaryExpression:
+		return n.operator == nil && !isIncrement(n.Type())
+	case *ConvertExpression:
+		return n.conversion == nil && !isNamed(n.typ)
+	case *CallExpression:
+		return n.method.pure
+	case *SharedExpression:
+		return false
+	}
+	return true
+}
+
+func isIncrement(nodeType ExpressionType) bool {
+	switch nodeType {
+	case PreIncrementAssignExpr, PreDecrementAssignExpr, PostIncrementAssignExpr, PostDecrementAssignExpr:
+		return true
+	}
+	return false
+}
+
+// worthSharing determines whether or not a subexpression reads a member or
+// an element of a collection or calls a method.
+func worthSharing(e Expression) bool {
+	switch n := e.(type) {
+	case *MemberExpression, *CallExpression:
+		return true
+	case *BinaryExpression:
+		if n.Type() == IndexExpr || n.Type() == InExpr {
+			return true
+		}
+	}
+	operands, _ := operandsOf(e)
+	for _, operand := range operands {
+		if worthSharing(operand) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeAttributes describes what tells a node apart from others of the same
+// type and kind with the same operands.
+func nodeAttributes(e Expression) string {
+	switch n := e.(type) {
+	case *ConstantExpression:
+		return fmt.Sprintf("%T %v %v", n.value, n.value, n.typ)
+	case *ParameterExpression:
+		return fmt.Sprintf("%s %v", n.name, n.typ)
+	case *FieldExpression:
+		return fmt.Sprintf("%s %v", n.name, n.index)
+	case *ConvertExpression:
+		return n.typ.String()
+	case *MemberExpression:
+		return n.name
+	case *CallExpression:
+		return n.name
+	}
+	return ""
+}
+
+// sameExpression determines whether or not two pure nodes are structurally
+// identical.
+func sameExpression(a Expression, b Expression) bool {
+	if a.Type() != b.Type() || a.Kind() != b.Kind() {
+		return false
+	}
+	switch x := a.(type) {
+	case *ConstantExpression:
+		y := b.(*ConstantExpression)
+		return x.typ == y.typ && reflect.TypeOf(x.value) == reflect.TypeOf(y.value) && reflect.DeepEqual(x.value, y.value)
+	case *ParameterExpression:
+		y := b.(*ParameterExpression)
+		return x.name == y.name && x.typ == y.typ
+	case *FieldExpression:
+		y := b.(*FieldExpression)
+		return x.name == y.name && reflect.DeepEqual(x.index, y.index)
+	case *ConvertExpression:
+		if x.typ != b.(*ConvertExpression).typ {
+			return false
+		}
+	case *MemberExpression:
+		if x.name != b.(*MemberExpression).name {
+			return false
+		}
+	case *CallExpression:
+		if x.method != b.(*CallExpression).method {
+			return false
+		}
+	}
+	left, _ := operandsOf(a)
+	right, _ := operandsOf(b)
+	if len(left) != len(right) {
+		return false
+	}
+	for i := range left {
+		if !sameExpression(left[i], right[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// sharedSlots returns the number of slots the shared subexpressions of an
+// expression use.
+func sharedSlots(e Expression) int {
+	slots := 0
+	if shared, ok := e.(*SharedExpression); ok {
+		slots = shared.slot + 1
+	}
+	operands, _ := operandsOf(e)
+	for _, operand := range operands {
+		if n := sharedSlots(operand); n > slots {
+			slots = n
+		}
+	}
+	return slots
+}
@@ -0,0 +1,199 @@
+package expr
+
+import (
+	"strings"
+	"testing"
+)
+
+type cart struct {
+	Items []float64
+	Rate  float64
+	calls *int
+}
+
+func (c cart) Total() float64 {
+	*c.calls++
+	total := 0.0
+	for _, item := range c.Items {
+		total += item
+	}
+	return total
+}
+
+func (c cart) Discounted(x float64) float64 {
+	return x * (1 - c.Rate)
+}
+
+func (c cart) Sample() float64 {
+	*c.calls++
+	return c.Rate
+}
+
+func (cart) PureMethods() []string {
+	return []string{"Total", "Discounted"}
+}
+
+type impureCart struct {
+	cart
+}
+
+func (impureCart) PureMethods() []string {
+	return []string{"Missing"}
+}
+
+func TestShareSubexpressions(t *testing.T) {
+	for _, test := range []struct {
+		expression string
+		expected   string
+	}{
+		{"Total() > 10 && Total() < 100", "(($0:Total() > value(10)) && ($0:Total() < value(100)))"},
+		{"Discounted(Total()) > 5 || Discounted(Total()) < 1 || Total() == 3",
+			"((($1:Discounted($0:Total()) > value(5)) || ($1:Discounted($0:Total()) < value(1))) || ($0:Total() = value(3)))"},
+		{"Rate > 0.5 ? Total() : Total() * 2", "((Rate > value(0.5)) ? $0:Total() : ($0:Total() * value(2)))"},
+		{"Items[0] + Items[0]", "($0:Items[value(0)] + $0:Items[value(0)])"},
+		// Sample isn't pure, so each call is evaluated.
+		{"Sample() > 1 && Sample() < 2", "((Sample() > value(1)) && (Sample() < value(2)))"},
+		// Arithmetic is evaluated again rather than stored.
+		{"Rate * 2 > 1 || Rate * 2 < 0", "(((Rate * value(2)) > value(1)) || ((Rate * value(2)) < value(0)))"},
+	} {
+		parser, err := NewExpressionParserForStruct(test.expression, cart{})
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		expression, _, err := parser.Check()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		original := expression.String()
+		shared, err := ShareSubexpressions(expression)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if shared.String() != test.expected {
+			t.Fatalf("%s: expected %s but got %s", test.expression, test.expected, shared)
+		}
+		if expression.String() != original {
+			t.Fatalf("%s: expected the expression not to change but got %s", test.expression, expression)
+		}
+	}
+
+	parser, err := NewExpressionParserForStruct("Rate = Discounted(Total()) + Discounted(Total())", cart{})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	parser.SetMode(StatementMode)
+	expression, _, err := parser.Check()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if shared, err := ShareSubexpressions(expression); err != nil || shared != expression {
+		t.Fatalf("expected an assignment not to be shared but got %v, %v", shared, err)
+	}
+	if _, err := ShareSubexpressions(nil); err == nil {
+		t.Fatalf("expected sharing nil to fail")
+	}
+}
+
+func TestSharedSubexpressionsEvaluateOnce(t *testing.T) {
+	for _, test := range []struct {
+		expression string
+		rate       float64
+		expected   bool
+	}{
+		{"Discounted(Total()) > 5 || Discounted(Total()) < 1 || Total() == 6", 0.5, true},
+		{"Discounted(Total()) > 5 || Discounted(Total()) < 1 || Total() == 3", 0.5, false},
+		{"Discounted(Total()) > 2 || Total() == 7", 0.5, true},
+		// The first call isn't evaluated, so the second one is.
+		{"Rate > 0.5 && Total() > 1 || Total() < 10", 0.1, true},
+		{"Rate > 0.5 ? Total() == 6 : Total() * 2 == 12", 0.1, true},
+	} {
+		parser, err := NewExpressionParserForStruct(test.expression, cart{})
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		program, err := parser.Compile()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		b, err := parser.CompileBytecode()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		data, err := b.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		loaded, err := LoadBytecode(data, program.environment)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		expression, err := ShareSubexpressions(program.Expression())
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		for name, evaluate := range map[string]func(interface{}) (interface{}, error){
+			"visitor": func(env interface{}) (interface{}, error) {
+				scope, err := NewScopeFromStruct(program.environment, env)
+				if err != nil {
+					return nil, err
+				}
+				return visitExpression(expression, scope)
+			},
+			"program":  program.EvaluateStruct,
+			"bytecode": b.EvaluateStruct,
+			"loaded":   loaded.EvaluateStruct,
+		} {
+			calls := 0
+			actual, err := evaluate(cart{Items: []float64{1, 2, 3}, Rate: test.rate, calls: &calls})
+			if err != nil {
+				t.Fatalf("%s with the %s: unexpected err: %v", test.expression, name, err)
+			}
+			if actual != test.expected {
+				t.Fatalf("%s with the %s: expected %v but got %v", test.expression, name, test.expected, actual)
+			}
+			if calls != 1 {
+				t.Fatalf("%s with the %s: expected Total to be called once but it was called %d times", test.expression, name, calls)
+			}
+		}
+	}
+}
+
+func TestPureEnvironment(t *testing.T) {
+	env, err := NewEnvironment(cart{})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if !env.methods["Total"].pure || env.methods["Sample"].pure {
+		t.Fatalf("expected only the listed methods to be pure")
+	}
+	if _, ok := env.methods["PureMethods"]; ok {
+		t.Fatalf("expected PureMethods not to be callable")
+	}
+	if _, err := NewEnvironment(impureCart{}); err == nil || !strings.Contains(err.Error(), "has no method Missing") {
+		t.Fatalf("expected listing a missing method to fail but got %v", err)
+	}
+}
+
+func TestLoadBytecodeSharedSlots(t *testing.T) {
+	parser, err := NewExpressionParserForStruct("Total() > 1 && Total() < 10", cart{})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	b, err := parser.CompileBytecode()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	data, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	// The first instruction loads slot 0.
+	code := data[len(data)-len(b.code):]
+	if Opcode(code[0]) != OpLoadShared {
+		t.Fatalf("expected %v but got %v", OpLoadShared, Opcode(code[0]))
+	}
+	code[4] = maxSharedSlots
+	if _, err := LoadBytecode(data, b.environment); err == nil || !strings.Contains(err.Error(), "no such shared slot") {
+		t.Fatalf("expected an error but got %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// SwitchArm is a single pattern => body arm of a switch expression.
+type SwitchArm struct {
+	Pattern Pattern
+	Body    Expression
+}
+
+func (a *SwitchArm) String() string {
+	return fmt.Sprintf("%v => %v", a.Pattern, a.Body)
+}
+
+type SwitchExpression struct {
+	self       *AbstractExpression
+	subject    Expression
+	arms       []*SwitchArm
+	exhaustive bool
+}
+
+func NewSwitchExpression(subject Expression, arms []*SwitchArm, kind reflect.Kind) *SwitchExpression {
+	return &SwitchExpression{
+		self: &AbstractExpression{
+			nodeType: SwitchExpr,
+			kind:     kind,
+		},
+		subject: subject,
+		arms:    arms,
+	}
+}
+
+func (e *SwitchExpression) Subject() Expression {
+	return e.subject
+}
+
+func (e *SwitchExpression) Arms() []*SwitchArm {
+	return e.arms
+}
+
+// Exhaustive determines whether or not the arms are known to match every
+// possible value of the subject.
+func (e *SwitchExpression) Exhaustive() bool {
+	return e.exhaustive
+}
+
+func (e *SwitchExpression) Kind() reflect.Kind {
+	return e.self.kind
+}
+
+func (e *SwitchExpression) Type() ExpressionType {
+	return e.self.nodeType
+}
+
+func (e *SwitchExpression) NodeType() string {
+	return "SwitchExpression"
+}
+
+func (e *SwitchExpression) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	var arms []string
+	for _, arm := range e.arms {
+		arms = append(arms, arm.String())
+	}
+	return fmt.Sprintf("(%v switch { %s })", e.subject, strings.Join(arms, ", "))
+}
+
+// SwitchAnalysis is the result of analysing the arms of a switch.
+type SwitchAnalysis struct {
+	// Exhaustive is set when the arms are known to match every value.
+	Exhaustive bool
+	// Unreachable holds the indices of arms which can never be selected
+	// because the arms before them already match everything they do.
+	Unreachable []int
+}
+
+// AnalyzeSwitch analyses the arms of a switch over a subject of the provided
+// kind. Numeric, string and bool subjects are analysed precisely; for other
+// kinds only discards are known to match.
+func AnalyzeSwitch(kind reflect.Kind, arms []*SwitchArm) *SwitchAnalysis {
+	analysis := &SwitchAnalysis{}
+	domain := domainOfKind(kind)
+	covered := domain.none()
+	for i, arm := range arms {
+		over, under := domain.approximate(arm.Pattern)
+		if over.subsetOf(covered, domain) {
+			analysis.Unreachable = append(analysis.Unreachable, i)
+		}
+		covered = covered.union(under)
+	}
+	analysis.Exhaustive = domain.all().subsetOf(covered, domain)
+	return analysis
+}
+
+// CreateSwitch creates a switch expression. Arms which can never be selected
+// are an error; switches which aren't exhaustive fail at evaluation when no
+// arm matches.
+func CreateSwitch(subject Expression, arms []*SwitchArm) (Expression, error) {
+	if subject == nil {
+		return nil, errInvalidExpression
+	}
+	if len(arms) == 0 {
+		return nil, errors.New("switch requires at least one arm")
+	}
+	var kinds []reflect.Kind
+	for _, arm := range arms {
+		if arm.Pattern == nil || arm.Body == nil {
+			return nil, errors.New("switch arms require a pattern and a body")
+		}
+		kinds = append(kinds, arm.Body.Kind())
+	}
+	analysis := AnalyzeSwitch(subject.Kind(), arms)
+	if len(analysis.Unreachable) > 0 {
+		i := analysis.Unreachable[0]
+		return nil, fmt.Errorf("switch arm %d (%v) is unreachable", i, arms[i])
+	}
+	e := NewSwitchExpression(subject, arms, commonKind(kinds...))
+	e.exhaustive = analysis.Exhaustive
+	return e, nil
+}
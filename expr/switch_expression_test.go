@@ -0,0 +1,171 @@
+package expr
+
+import (
+	"reflect"
+	"testing"
+)
+
+type customer struct {
+	Country string
+	Age     int
+}
+
+func TestSwitchEvaluation(t *testing.T) {
+	parameters := map[string]interface{}{
+		"tier":     "silver",
+		"quantity": 7,
+		"score":    3.5,
+		"member":   true,
+		"customer": customer{Country: "US", Age: 42},
+		"values":   []interface{}{int64(12), nil},
+	}
+	for _, test := range []struct {
+		expression string
+		expected   interface{}
+	}{
+		{`tier switch { "gold" => 0.2, "silver" => 0.1, _ => 0 }`, 0.1},
+		{`tier switch { "gold" => 0.2, _ => 0 }`, float64(0)},
+		{`quantity switch { < 5 => 1, >= 5 and < 10 => 2, _ => 3 }`, 2},
+		{`quantity switch { 1 or 2 or 3 => 1, not (< 5) => 2, _ => 0 }`, 2},
+		{`score switch { < 0.0 => "negative", >= 0.0 => "positive" }`, "positive"},
+		{`member switch { true => 1, false => 2 }`, 1},
+		{`customer switch { { Country: "US", Age: > 40 } => 1, { Country: "US" } => 2, _ => 3 }`, 1},
+		{`customer switch { { Country: "CA" } => 1, _ => 3 }`, 3},
+		{`values[0] switch { string => 1, int64 => 2, _ => 3 }`, 2},
+		{`values[0] switch { null => 0, _ => 1 }`, 1},
+		{`values[1] switch { null => 0, _ => 1 }`, 0},
+		{`quantity switch { < 10 => 10, _ => 0 } * 2`, 20},
+	} {
+		parser, err := NewExpressionParser(test.expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expression, err := parser.ParseExpression()
+		if err != nil {
+			t.Fatalf("%s: unexpected parse err: %v", test.expression, err)
+		}
+		visitor, err := CreateVisitorFromExpression(expression)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		actual, err := visitor.Visit()
+		if err != nil {
+			t.Fatalf("%s: unexpected evaluation err: %v", test.expression, err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Fatalf("%s: expected %v (%T) but got %v (%T)", test.expression, test.expected, test.expected, actual, actual)
+		}
+	}
+}
+
+func TestSwitchParseErrors(t *testing.T) {
+	parameters := map[string]interface{}{
+		"quantity": 7,
+		"tier":     "gold",
+	}
+	for _, expression := range []string{
+		`quantity switch { }`,
+		`quantity switch { _ => 1, 2 => 2 }`,
+		`quantity switch { < 5 => 1, < 3 => 2 }`,
+		`quantity switch { >= 0 => 1, < 0 => 2, 5 => 3 }`,
+		`quantity switch { "gold" => 1 }`,
+		`quantity switch { null => 1, _ => 2 }`,
+		`tier switch { < 5 => 1 }`,
+		`quantity switch { 1 => 1`,
+		`quantity switch { 1 2 }`,
+		`quantity switch { string => 1, _ => 2 }`,
+	} {
+		parser, err := NewExpressionParser(expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, err := parser.ParseExpression(); err == nil {
+			t.Fatalf("expected %s to error but it didn't", expression)
+		}
+	}
+}
+
+func TestSwitchWithoutMatchingArm(t *testing.T) {
+	parser, err := NewExpressionParser(`quantity switch { < 5 => 1 }`, map[string]interface{}{"quantity": 7})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	expression, err := parser.ParseExpression()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	visitor, err := CreateVisitorFromExpression(expression)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := visitor.Visit(); err == nil {
+		t.Fatal("expected evaluation to error but it didn't")
+	}
+}
+
+func TestAnalyzeSwitch(t *testing.T) {
+	arm := func(p Pattern) *SwitchArm {
+		return &SwitchArm{Pattern: p, Body: NewConstantExpression(1, reflect.Int)}
+	}
+	lt := func(v interface{}) Pattern { return NewRelationalPattern(LessThanExpr, v) }
+	ge := func(v interface{}) Pattern { return NewRelationalPattern(GreaterThanOrEqualExpr, v) }
+	gt := func(v interface{}) Pattern { return NewRelationalPattern(GreaterThanExpr, v) }
+	c := func(v interface{}) Pattern { return NewConstantPattern(v) }
+	for _, test := range []struct {
+		name        string
+		kind        reflect.Kind
+		arms        []*SwitchArm
+		exhaustive  bool
+		unreachable []int
+	}{
+		{"discard", reflect.Int, []*SwitchArm{arm(c(1)), arm(NewDiscardPattern())}, true, nil},
+		{"split", reflect.Int, []*SwitchArm{arm(lt(0)), arm(ge(0))}, true, nil},
+		{"integer gap", reflect.Int, []*SwitchArm{arm(lt(0)), arm(gt(0))}, false, nil},
+		{"integer filled", reflect.Int, []*SwitchArm{arm(lt(0)), arm(c(0)), arm(gt(0))}, true, nil},
+		{"integer adjacency", reflect.Int, []*SwitchArm{arm(lt(5)), arm(gt(4))}, true, nil},
+		// NaN matches neither < nor >=, so floats also need an arm for it.
+		{"float gap", reflect.Float64, []*SwitchArm{arm(lt(5)), arm(gt(4)), arm(c(4.5))}, false, []int{2}},
+		{"float split", reflect.Float64, []*SwitchArm{arm(lt(5)), arm(ge(5))}, false, nil},
+		{"float NaN", reflect.Float64, []*SwitchArm{arm(lt(5)), arm(ge(5)), arm(NewDiscardPattern())}, true, nil},
+		{"float not", reflect.Float64, []*SwitchArm{arm(lt(5)), arm(NewNotPattern(lt(5)))}, true, nil},
+		{"float32 not", reflect.Float32, []*SwitchArm{arm(NewNotPattern(ge(0))), arm(ge(0))}, true, nil},
+		{"bool", reflect.Bool, []*SwitchArm{arm(c(true)), arm(c(false))}, true, nil},
+		{"uint8", reflect.Uint8, []*SwitchArm{arm(lt(128)), arm(ge(128))}, true, nil},
+		{"unsigned", reflect.Uint, []*SwitchArm{arm(c(0)), arm(gt(0))}, true, nil},
+		{"not", reflect.Int, []*SwitchArm{arm(NewNotPattern(c(3))), arm(c(3))}, true, nil},
+		{"subsumed", reflect.Int, []*SwitchArm{arm(lt(10)), arm(NewBinaryPattern(AndPat, gt(2), lt(5)))}, false, []int{1}},
+		{"strings", reflect.String, []*SwitchArm{arm(c("gold")), arm(c("silver")), arm(c("gold"))}, false, []int{2}},
+		{"opaque", reflect.Struct, []*SwitchArm{arm(NewPropertyPattern(nil, nil)), arm(NewDiscardPattern())}, true, nil},
+		{"opaque unknown", reflect.Struct, []*SwitchArm{arm(NewPropertyPattern(nil, nil))}, false, nil},
+	} {
+		analysis := AnalyzeSwitch(test.kind, test.arms)
+		if analysis.Exhaustive != test.exhaustive {
+			t.Fatalf("%s: expected exhaustive to be %v but got %v", test.name, test.exhaustive, analysis.Exhaustive)
+		}
+		if !reflect.DeepEqual(analysis.Unreachable, test.unreachable) {
+			t.Fatalf("%s: expected unreachable arms %v but got %v", test.name, test.unreachable, analysis.Unreachable)
+		}
+	}
+}
+
+func TestPatternToString(t *testing.T) {
+	for _, test := range []struct {
+		pattern  Pattern
+		expected string
+	}{
+		{NewDiscardPattern(), "_"},
+		{NewConstantPattern(nil), "null"},
+		{NewConstantPattern("gold"), `"gold"`},
+		{NewRelationalPattern(LessThanOrEqualExpr, 10), "<= 10"},
+		{NewNotPattern(NewConstantPattern(1)), "not 1"},
+		{NewBinaryPattern(OrPat, NewConstantPattern(1), NewConstantPattern(2)), "(1 or 2)"},
+		{
+			NewPropertyPattern(nil, []*Subpattern{{Name: "Country", Pattern: NewConstantPattern("US")}}),
+			`{ Country: "US" }`,
+		},
+	} {
+		if actual := test.pattern.String(); actual != test.expected {
+			t.Fatalf("expected %v but got %v", test.expected, actual)
+		}
+	}
+}
@@ -5,16 +5,50 @@ import (
 )
 
 const (
-	orIdentifier  = "or"
-	andIdentifier = "and"
-	modIdentifier = "mod"
+	orIdentifier      = "or"
+	andIdentifier     = "and"
+	modIdentifier     = "mod"
+	inIdentifier      = "in"
+	isIdentifier      = "is"
+	switchIdentifier  = "switch"
+	notIdentifier     = "not"
+	trueIdentifier    = "true"
+	falseIdentifier   = "false"
+	nullIdentifier    = "null"
+	discardIdentifier = "_"
+	letIdentifier     = "let"
+	varIdentifier     = "var"
+	ifIdentifier      = "if"
+	elseIdentifier    = "else"
+	returnIdentifier  = "return"
+	defIdentifier     = "def"
 )
 
+var keywords = []string{
+	orIdentifier, andIdentifier, modIdentifier, inIdentifier, isIdentifier,
+	switchIdentifier, notIdentifier, trueIdentifier, falseIdentifier,
+	nullIdentifier, discardIdentifier, letIdentifier, varIdentifier,
+	ifIdentifier, elseIdentifier, returnIdentifier, defIdentifier,
+}
+
+// isKeyword determines whether or not an identifier is reserved.
+func isKeyword(name string) bool {
+	for _, keyword := range keywords {
+		if strings.EqualFold(name, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
 // Token represents a single parsed token.
 type Token struct {
-	Type     TokenType
-	Text     string
+	Type TokenType
+	Text string
+	// Position is the offset of the token in the text in runes, and Offset
+	// in bytes.
 	Position int
+	Offset   int
 }
 
 func (t *Token) Equals(u *Token) bool {
@@ -41,28 +75,41 @@ const (
 	Exclamation
 	ExclamationEqual
 	Percent
+	PercentEqual
 	DoubleAmpersand
 	Ampersand
 	OpenParenthesis
 	CloseParenthesis
 	Asterisk
+	AsteriskEqual
 	Plus
+	DoublePlus
+	PlusEqual
 	Minus
+	DoubleMinus
+	MinusEqual
 	Slash
+	SlashEqual
 	LessThan
 	LessThanEqual
 	Equal
 	DoubleEqual
+	Arrow
 	GreaterThan
 	GreaterThanEqual
 	Bar
 	DoubleBar
 	Comma
 	Dot
+	DoubleDot
 	Colon
+	Semicolon
 	Question
 	OpenBracket
 	CloseBracket
+	Caret
+	OpenBrace
+	CloseBrace
 	Identifier
 	End
 	IntegerLiteral
@@ -74,28 +121,41 @@ const (
 	ExclamationString      = "Exclamation"
 	ExclamationEqualString = "ExclamationEqual"
 	PercentString          = "Percent"
+	PercentEqualString     = "PercentEqual"
 	DoubleAmpersandString  = "DoubleAmpersand"
 	AmpersandString        = "Ampersand"
 	OpenParenthesisString  = "OpenParenthesis"
 	CloseParenthesisString = "CloseParenthesis"
 	AsteriskString         = "Asterisk"
+	AsteriskEqualString    = "AsteriskEqual"
 	PlusString             = "Plus"
+	DoublePlusString       = "DoublePlus"
+	PlusEqualString        = "PlusEqual"
 	MinusString            = "Minus"
+	DoubleMinusString      = "DoubleMinus"
+	MinusEqualString       = "MinusEqual"
 	SlashString            = "Slash"
+	SlashEqualString       = "SlashEqual"
 	LessThanString         = "LessThan"
 	LessThanEqualString    = "LessThanEqual"
 	EqualString            = "Equal"
 	DoubleEqualString      = "DoubleEqual"
+	ArrowString            = "Arrow"
 	GreaterThanString      = "GreaterThan"
 	GreaterThanEqualString = "GreaterThanEqual"
 	BarString              = "Bar"
 	DoubleBarString        = "DoubleBar"
 	CommaString            = "Comma"
 	DotString              = "Dot"
+	DoubleDotString        = "DoubleDot"
 	ColonString            = "Colon"
+	SemicolonString        = "Semicolon"
 	QuestionString         = "Question"
 	OpenBracketString      = "OpenBracket"
 	CloseBracketString     = "CloseBracket"
+	CaretString            = "Caret"
+	OpenBraceString        = "OpenBrace"
+	CloseBraceString       = "CloseBrace"
 	IdentifierString       = "Identifier"
 	EndString              = "End"
 	IntegerLiteralString   = "IntegerLiteral"
@@ -112,6 +172,8 @@ func (t TokenType) String() string {
 		return ExclamationEqualString
 	case Percent:
 		return PercentString
+	case PercentEqual:
+		return PercentEqualString
 	case DoubleAmpersand:
 		return DoubleAmpersandString
 	case Ampersand:
@@ -122,12 +184,24 @@ func (t TokenType) String() string {
 		return CloseParenthesisString
 	case Asterisk:
 		return AsteriskString
+	case AsteriskEqual:
+		return AsteriskEqualString
 	case Plus:
 		return PlusString
+	case DoublePlus:
+		return DoublePlusString
+	case PlusEqual:
+		return PlusEqualString
 	case Minus:
 		return MinusString
+	case DoubleMinus:
+		return DoubleMinusString
+	case MinusEqual:
+		return MinusEqualString
 	case Slash:
 		return SlashString
+	case SlashEqual:
+		return SlashEqualString
 	case LessThan:
 		return LessThanString
 	case LessThanEqual:
@@ -136,6 +210,8 @@ func (t TokenType) String() string {
 		return EqualString
 	case DoubleEqual:
 		return DoubleEqualString
+	case Arrow:
+		return ArrowString
 	case GreaterThan:
 		return GreaterThanString
 	case GreaterThanEqual:
@@ -148,14 +224,24 @@ func (t TokenType) String() string {
 		return CommaString
 	case Dot:
 		return DotString
+	case DoubleDot:
+		return DoubleDotString
 	case Colon:
 		return ColonString
+	case Semicolon:
+		return SemicolonString
 	case Question:
 		return QuestionString
 	case OpenBracket:
 		return OpenBracketString
 	case CloseBracket:
 		return CloseBracketString
+	case Caret:
+		return CaretString
+	case OpenBrace:
+		return OpenBraceString
+	case CloseBrace:
+		return CloseBraceString
 	case Identifier:
 		return IdentifierString
 	case End:
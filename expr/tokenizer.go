@@ -4,9 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 var (
@@ -15,14 +17,58 @@ var (
 	errUnimplemented         = errors.New("unimplemented")
 )
 
+// Mode controls the grammar accepted by a Tokenizer. The zero value parses
+// read-only expressions.
+type Mode uint
+
+const (
+	// StatementMode allows =, +=, -=, *=, /=, %=, ++ and -- to write to
+	// parameters, local variables, fields, map entries and slice elements.
+	// Parameters are bound by reference rather than by value, and = is
+	// assignment rather than equality.
+	StatementMode Mode = 1 << iota
+	// ProgramMode parses scripts of statements separated by semicolons,
+	// including var declarations, if/else and return, rather than a single
+	// expression. Local variables can be assigned, but parameters are only
+	// writable in StatementMode.
+	ProgramMode
+)
+
+// Tokenizer reads tokens directly from the UTF-8 text of an expression,
+// decoding one rune at a time, so the text isn't copied and the text of each
+// token is a substring of it.
 type Tokenizer struct {
-	text     []rune
+	text string
+	// offset is the byte offset of ch in the text, and position its offset
+	// in runes. width is the number of bytes ch is encoded in.
+	offset   int
 	position int
-	length   int
+	width    int
 
 	parameters map[string]interface{}
-	token      *Token
+	token      Token
 	ch         rune
+
+	// locals holds the variables of each enclosing block, innermost last.
+	locals []map[string]*ParameterExpression
+	// noIn is set while parsing a let binding, where in ends the binding
+	// rather than being the membership operator.
+	noIn bool
+	mode Mode
+
+	// lambdas holds the definitions of the functions declared with def,
+	// keyed by the variables they're bound to.
+	lambdas map[*ParameterExpression]*LambdaExpression
+	library *Library
+
+	// positions holds the offset in the text at which each node starts.
+	positions map[Expression]int
+
+	// declarations holds the types of the declared parameters. Once any
+	// parameter is declared, identifiers must be declared or have a value.
+	declarations map[string]reflect.Type
+	// environment is the struct whose fields and methods are identifiers.
+	environment *Environment
 }
 
 // NewTokenizer creates a new Tokenizer for the provided expression.
@@ -30,13 +76,8 @@ func NewTokenizer(expression string, parameters map[string]interface{}) (t *Toke
 	if expression == "" {
 		return t, errMissingExpression
 	}
-	var text []rune
-	for _, ch := range expression {
-		text = append(text, ch)
-	}
 	t = &Tokenizer{
-		text:   text,
-		length: len(text),
+		text: expression,
 	}
 	if parameters == nil {
 		t.parameters = make(map[string]interface{})
@@ -48,14 +89,23 @@ func NewTokenizer(expression string, parameters map[string]interface{}) (t *Toke
 }
 
 func (t *Tokenizer) NextChar() {
-	if t.position < t.length {
+	if t.offset < len(t.text) {
+		t.offset += t.width
 		t.position++
 	}
-	if t.position < t.length {
-		t.ch = t.text[t.position]
-	} else {
-		t.ch = '\000'
+	t.ch, t.width = t.decode(t.offset)
+}
+
+// decode returns the rune at a byte offset in the text and the number of
+// bytes it's encoded in, or '\000' at the end of the text.
+func (t *Tokenizer) decode(offset int) (rune, int) {
+	if offset >= len(t.text) {
+		return '\000', 0
+	}
+	if b := t.text[offset]; b < utf8.RuneSelf {
+		return rune(b), 1
 	}
+	return utf8.DecodeRuneInString(t.text[offset:])
 }
 
 // NextToken returns the next available token and advances the cursor.
@@ -64,12 +114,8 @@ func (t *Tokenizer) NextToken() (err error) {
 		t.NextChar()
 	}
 
-	token := &Token{
-		Type: Unknown,
-	}
-
 	var tokenType TokenType
-	tokenPos := t.position
+	tokenPos, tokenOffset := t.position, t.offset
 	switch t.ch {
 	case '!':
 		t.NextChar()
@@ -81,7 +127,12 @@ func (t *Tokenizer) NextToken() (err error) {
 		}
 	case '%':
 		t.NextChar()
-		tokenType = Percent
+		if t.ch == '=' && t.allowsAssignment() {
+			t.NextChar()
+			tokenType = PercentEqual
+		} else {
+			tokenType = Percent
+		}
 	case '&':
 		t.NextChar()
 		if t.ch == '&' {
@@ -98,16 +149,42 @@ func (t *Tokenizer) NextToken() (err error) {
 		tokenType = CloseParenthesis
 	case '*':
 		t.NextChar()
-		tokenType = Asterisk
+		if t.ch == '=' && t.allowsAssignment() {
+			t.NextChar()
+			tokenType = AsteriskEqual
+		} else {
+			tokenType = Asterisk
+		}
 	case '+':
 		t.NextChar()
-		tokenType = Plus
+		if t.ch == '=' && t.allowsAssignment() {
+			t.NextChar()
+			tokenType = PlusEqual
+		} else if t.ch == '+' && t.allowsAssignment() {
+			t.NextChar()
+			tokenType = DoublePlus
+		} else {
+			tokenType = Plus
+		}
 	case '-':
 		t.NextChar()
-		tokenType = Minus
+		if t.ch == '=' && t.allowsAssignment() {
+			t.NextChar()
+			tokenType = MinusEqual
+		} else if t.ch == '-' && t.allowsAssignment() {
+			t.NextChar()
+			tokenType = DoubleMinus
+		} else {
+			tokenType = Minus
+		}
 	case '/':
 		t.NextChar()
-		tokenType = Slash
+		if t.ch == '=' && t.allowsAssignment() {
+			t.NextChar()
+			tokenType = SlashEqual
+		} else {
+			tokenType = Slash
+		}
 	case '<':
 		t.NextChar()
 		if t.ch == '=' {
@@ -121,6 +198,9 @@ func (t *Tokenizer) NextToken() (err error) {
 		if t.ch == '=' {
 			t.NextChar()
 			tokenType = DoubleEqual
+		} else if t.ch == '>' {
+			t.NextChar()
+			tokenType = Arrow
 		} else {
 			tokenType = Equal
 		}
@@ -137,10 +217,18 @@ func (t *Tokenizer) NextToken() (err error) {
 		tokenType = Comma
 	case '.':
 		t.NextChar()
-		tokenType = Dot
+		if t.ch == '.' {
+			t.NextChar()
+			tokenType = DoubleDot
+		} else {
+			tokenType = Dot
+		}
 	case ':':
 		t.NextChar()
 		tokenType = Colon
+	case ';':
+		t.NextChar()
+		tokenType = Semicolon
 	case '?':
 		t.NextChar()
 		tokenType = Question
@@ -150,6 +238,15 @@ func (t *Tokenizer) NextToken() (err error) {
 	case ']':
 		t.NextChar()
 		tokenType = CloseBracket
+	case '^':
+		t.NextChar()
+		tokenType = Caret
+	case '{':
+		t.NextChar()
+		tokenType = OpenBrace
+	case '}':
+		t.NextChar()
+		tokenType = CloseBrace
 	case '|':
 		t.NextChar()
 		if t.ch == '|' {
@@ -164,10 +261,10 @@ func (t *Tokenizer) NextToken() (err error) {
 		quote := t.ch
 		for {
 			t.NextChar()
-			for tokenPos < t.length && t.ch != quote {
+			for t.offset < len(t.text) && t.ch != quote {
 				t.NextChar()
 			}
-			if tokenPos == t.length {
+			if t.offset == len(t.text) {
 				return errors.New("unterminated string literal")
 			}
 			t.NextChar()
@@ -196,7 +293,8 @@ func (t *Tokenizer) NextToken() (err error) {
 					break
 				}
 			}
-			if t.ch == '.' {
+			// 1..5 is a range, not the start of a real literal.
+			if t.ch == '.' && t.peek() != '.' {
 				tokenType = RealLiteral
 				t.NextChar()
 
@@ -229,43 +327,399 @@ func (t *Tokenizer) NextToken() (err error) {
 			}
 			break
 		}
-		if t.position == t.length {
+		if t.offset == len(t.text) {
 			tokenType = End
 			break
 		}
 		return fmt.Errorf("parsing error at position %d, rune: %v", t.position, t.ch)
 	}
-	token.Text = string(t.text[tokenPos:t.position])
-	token.Position = tokenPos
-	token.Type = tokenType
-	t.token = token
+	t.token = Token{
+		Type:     tokenType,
+		Text:     t.text[tokenOffset:t.offset],
+		Position: tokenPos,
+		Offset:   tokenOffset,
+	}
+	return nil
+}
+
+// SetMode sets the grammar accepted by the tokenizer.
+func (t *Tokenizer) SetMode(mode Mode) {
+	t.mode = mode
+}
+
+// Positions returns the offset in the text at which each node of the last
+// parsed expression starts.
+func (t *Tokenizer) Positions() map[Expression]int {
+	return t.positions
+}
+
+// at returns a function which records that the node it's passed starts at
+// pos, so errors found after parsing can refer back to the text.
+func (t *Tokenizer) at(pos int) func(Expression, error) (Expression, error) {
+	return func(expr Expression, err error) (Expression, error) {
+		if err != nil || expr == nil {
+			return expr, err
+		}
+		if t.positions == nil {
+			t.positions = make(map[Expression]int)
+		}
+		if _, ok := t.positions[expr]; !ok {
+			t.positions[expr] = pos
+		}
+		return expr, nil
+	}
+}
+
+// SetLibrary makes the functions of a library callable by name.
+func (t *Tokenizer) SetLibrary(library *Library) {
+	t.library = library
+}
+
+// SetEnvironment makes the fields and methods of a struct identifiers.
+func (t *Tokenizer) SetEnvironment(env *Environment) {
+	t.environment = env
+}
+
+// Declare declares a parameter by its type rather than by a sample value.
+// It's parsed as a ParameterExpression of that type, so the expression can
+// be parsed and type checked before any values are known; the values are
+// provided when evaluating.
+func (t *Tokenizer) Declare(name string, typ reflect.Type) error {
+	if name == "" || typ == nil {
+		return errInvalidExpression
+	}
+	if isKeyword(name) {
+		return fmt.Errorf("can't declare a parameter named %s, which is a keyword", name)
+	}
+	if declared, ok := t.declarations[name]; ok && declared != typ {
+		return fmt.Errorf("%s is already declared as %v", name, declared)
+	}
+	if t.declarations == nil {
+		t.declarations = make(map[string]reflect.Type)
+	}
+	t.declarations[name] = typ
 	return nil
 }
 
-// SetPosition sets the tokenizer's position.
+// Declarations returns the types of the declared parameters.
+func (t *Tokenizer) Declarations() map[string]reflect.Type {
+	return t.declarations
+}
+
+func (t *Tokenizer) statementMode() bool {
+	return t.mode&StatementMode != 0
+}
+
+func (t *Tokenizer) programMode() bool {
+	return t.mode&ProgramMode != 0
+}
+
+// boundNames returns the names of the parameters whose values are bound
+// into the expression as constants when it's parsed, rather than read when
+// it's evaluated. Outside StatementMode, that's the parameters which have
+// values but aren't declared.
+func (t *Tokenizer) boundNames() map[string]bool {
+	if t.statementMode() || len(t.parameters) == 0 {
+		return nil
+	}
+	names := make(map[string]bool, len(t.parameters))
+	for name := range t.parameters {
+		if _, ok := t.declarations[name]; !ok {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// checkUnbound returns an error when parameters provides a value for one of
+// the bound names, which evaluating would otherwise silently ignore.
+func checkUnbound(bound map[string]bool, parameters map[string]interface{}) error {
+	if len(bound) == 0 || len(parameters) == 0 {
+		return nil
+	}
+	var names []string
+	for name := range parameters {
+		if bound[name] {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	return fmt.Errorf("parameter %s was bound by value when parsing, so it can't be provided when evaluating; declare it to provide it then", names[0])
+}
+
+// allowsAssignment determines whether or not =, the compound assignments,
+// ++ and -- write to their operand.
+func (t *Tokenizer) allowsAssignment() bool {
+	return t.statementMode() || t.programMode()
+}
+
+// peek returns the character after the current one without advancing.
+func (t *Tokenizer) peek() rune {
+	ch, _ := t.decode(t.offset + t.width)
+	return ch
+}
+
+// SetPosition sets the tokenizer's position, in runes. Positions are found
+// by decoding the text from its start, or from the current position when
+// it's further on.
 func (t *Tokenizer) SetPosition(position int) {
-	t.position = position
-	if t.position < t.length {
-		t.ch = t.text[t.position]
-	} else {
-		t.ch = '\000'
+	if position < t.position {
+		t.offset, t.position = 0, 0
 	}
+	t.ch, t.width = t.decode(t.offset)
+	for t.position < position && t.offset < len(t.text) {
+		t.NextChar()
+	}
+	if t.offset == len(t.text) {
+		t.position = position
+	}
+}
+
+// Offset returns the tokenizer's offset in the text, in bytes.
+func (t *Tokenizer) Offset() int {
+	return t.offset
 }
 
 // HasNext returns true or false if the tokenizer can be advanced.
 func (t *Tokenizer) HasNext() bool {
-	return t.position < t.length
+	return t.offset < len(t.text)
 }
 
 func (t *Tokenizer) Parse() (Expression, error) {
+	t.SetPosition(0)
+	t.locals = nil
+	t.lambdas = nil
+	t.positions = nil
 	if err := t.NextToken(); err != nil {
 		return nil, err
 	}
-	return t.ParseExpression()
+	if t.programMode() {
+		return t.ParseProgram()
+	}
+	expr, err := t.ParseExpression()
+	if err != nil {
+		return nil, err
+	}
+	// Tokens which no rule consumed, such as ^ 2 in x ^ 2, are an error
+	// rather than being ignored.
+	if t.token.Type != End {
+		return nil, fmt.Errorf("expected the end of the expression but got %q at position %d", t.token.Text, t.token.Position)
+	}
+	return expr, nil
 }
 
-// ? : ternary operator
+var assignmentOperators = map[TokenType]ExpressionType{
+	Equal:         AssignExpr,
+	PlusEqual:     AddAssignExpr,
+	MinusEqual:    SubtractAssignExpr,
+	AsteriskEqual: MultiplyAssignExpr,
+	SlashEqual:    DivideAssignExpr,
+	PercentEqual:  ModuloAssignExpr,
+}
+
+// =, +=, -=, *=, /=, %= (StatementMode and ProgramMode only)
 func (t *Tokenizer) ParseExpression() (Expression, error) {
+	pos := t.token.Position
+	if t.token.IsIdentifierWithName(letIdentifier) {
+		return t.ParseLet()
+	}
+	if t.token.IsIdentifierWithName(defIdentifier) {
+		return t.ParseDef()
+	}
+	expr, err := t.ParseConditional()
+	if err != nil || !t.allowsAssignment() {
+		return expr, err
+	}
+	nodeType, ok := assignmentOperators[t.token.Type]
+	if !ok {
+		return expr, nil
+	}
+	if t.isParameter(expr) && !t.statementMode() {
+		return nil, fmt.Errorf("can't assign to %v; parameters can only be assigned in StatementMode", expr)
+	}
+	if err = t.NextToken(); err != nil {
+		return nil, err
+	}
+	value, err := t.ParseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if nodeType == AssignExpr {
+		return t.at(pos)(CreateAssign(expr, value))
+	}
+	return t.at(pos)(CreateCompoundAssign(nodeType, expr, value))
+}
+
+// ParseProgram parses a script of statements up to the end of the input.
+//
+//	program   = { statement } .
+//	statement = "var" name "=" expression ";"
+//	          | "if" "(" expression ")" statement [ "else" statement ]
+//	          | "return" [ expression ] ";"
+//	          | "{" { statement } "}"
+//	          | expression ";" .
+//
+// The semicolon after the last statement of a program or block is optional.
+func (t *Tokenizer) ParseProgram() (Expression, error) {
+	pos := t.token.Position
+	t.pushLocals()
+	defer t.popLocals()
+	var statements []Expression
+	for t.token.Type != End {
+		statement, err := t.ParseStatement()
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, statement)
+	}
+	return t.at(pos)(CreateProgram(statements))
+}
+
+// ParseStatement parses a single statement of a program.
+func (t *Tokenizer) ParseStatement() (Expression, error) {
+	var statement Expression
+	var err error
+	switch {
+	case t.token.Type == OpenBrace:
+		return t.parseStatementBlock()
+	case t.token.IsIdentifierWithName(ifIdentifier):
+		return t.ParseIf()
+	case t.token.IsIdentifierWithName(varIdentifier):
+		statement, err = t.ParseDeclare()
+	case t.token.IsIdentifierWithName(defIdentifier):
+		statement, err = t.parseFunctionDeclaration()
+	case t.token.IsIdentifierWithName(returnIdentifier):
+		statement, err = t.ParseReturn()
+	default:
+		statement, err = t.ParseExpression()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return statement, t.parseStatementEnd()
+}
+
+// parseStatementEnd consumes the semicolon which ends a statement.
+func (t *Tokenizer) parseStatementEnd() error {
+	switch t.token.Type {
+	case Semicolon:
+		return t.NextToken()
+	case CloseBrace, End:
+		return nil
+	}
+	return fmt.Errorf("expected %v as the token type but got %v", Semicolon, t.token.Type)
+}
+
+// { statement ... }
+func (t *Tokenizer) parseStatementBlock() (Expression, error) {
+	pos := t.token.Position
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	t.pushLocals()
+	defer t.popLocals()
+	var statements []Expression
+	for t.token.Type != CloseBrace {
+		if t.token.Type == End {
+			return nil, fmt.Errorf("expected %v as the token type but got %v", CloseBrace, t.token.Type)
+		}
+		statement, err := t.ParseStatement()
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, statement)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	return t.at(pos)(CreateSequence(statements))
+}
+
+// var name = expression
+func (t *Tokenizer) ParseDeclare() (Expression, error) {
+	pos := t.token.Position
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	if _, ok := t.locals[len(t.locals)-1][t.token.Text]; t.token.Type == Identifier && ok {
+		return nil, fmt.Errorf("variable %s is already defined in this block", t.token.Text)
+	}
+	binding, err := t.parseBinding(false)
+	if err != nil {
+		return nil, err
+	}
+	return t.at(pos)(CreateDeclare(binding.Variable, binding.Value))
+}
+
+// def name(parameter, ...) = expression
+func (t *Tokenizer) parseFunctionDeclaration() (Expression, error) {
+	pos := t.token.Position
+	binding, err := t.parseFunction()
+	if err != nil {
+		return nil, err
+	}
+	return t.at(pos)(CreateDeclare(binding.Variable, binding.Value))
+}
+
+// if (expression) statement [else statement]
+func (t *Tokenizer) ParseIf() (Expression, error) {
+	pos := t.token.Position
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	test, err := t.ParseParenthesesExpression()
+	if err != nil {
+		return nil, err
+	}
+	then, err := t.parseBranch()
+	if err != nil {
+		return nil, err
+	}
+	var otherwise Expression
+	if t.token.IsIdentifierWithName(elseIdentifier) {
+		if err = t.NextToken(); err != nil {
+			return nil, err
+		}
+		if otherwise, err = t.parseBranch(); err != nil {
+			return nil, err
+		}
+	}
+	return t.at(pos)(CreateIf(test, then, otherwise))
+}
+
+// parseBranch parses the body of an if or else. Like in C#, a declaration
+// must be in a block: on its own it would be declared in the enclosing
+// scope whether or not the branch ran.
+func (t *Tokenizer) parseBranch() (Expression, error) {
+	if t.token.IsIdentifierWithName(varIdentifier) || t.token.IsIdentifierWithName(defIdentifier) {
+		return nil, fmt.Errorf("%s at position %d must be in a block to be the body of an if or else", t.token.Text, t.token.Position)
+	}
+	return t.ParseStatement()
+}
+
+// return [expression]
+func (t *Tokenizer) ParseReturn() (Expression, error) {
+	pos := t.token.Position
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	switch t.token.Type {
+	case Semicolon, CloseBrace, End:
+		return t.at(pos)(CreateReturn(nil))
+	}
+	value, err := t.ParseExpression()
+	if err != nil {
+		return nil, err
+	}
+	return t.at(pos)(CreateReturn(value))
+}
+
+// ? : ternary operator
+func (t *Tokenizer) ParseConditional() (Expression, error) {
+	pos := t.token.Position
 	var err error
 	expr, err := t.ParseLogicalOr()
 	if err != nil {
@@ -293,91 +747,513 @@ func (t *Tokenizer) ParseExpression() (Expression, error) {
 			return nil, err
 		}
 
-		expr, err = t.GenerateConditional(expr, expr1, expr2, errPos)
+		expr, err = t.at(pos)(t.GenerateConditional(expr, expr1, expr2, errPos))
 	}
 	return expr, err
 }
 
-// ||, or
-func (t *Tokenizer) ParseLogicalOr() (Expression, error) {
-	left, err := t.ParseLogicalAnd()
-	if err != nil {
-		return left, err
+// parseNestedExpression parses an expression enclosed by brackets of some
+// kind, within which in is always the membership operator.
+func (t *Tokenizer) parseNestedExpression() (Expression, error) {
+	noIn := t.noIn
+	t.noIn = false
+	defer func() {
+		t.noIn = noIn
+	}()
+	return t.ParseExpression()
+}
+
+// let name = expression[, name = expression] in expression
+func (t *Tokenizer) ParseLet() (Expression, error) {
+	pos := t.token.Position
+	if !t.token.IsIdentifierWithName(letIdentifier) {
+		return nil, fmt.Errorf("expected %s but got %v", letIdentifier, t.token.Text)
 	}
-	for t.token.Type == DoubleBar || t.token.IsIdentifierWithName(orIdentifier) {
-		if err := t.NextToken(); err != nil {
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	t.pushLocals()
+	defer t.popLocals()
+	var bindings []*Binding
+	for {
+		binding, err := t.parseBinding(true)
+		if err != nil {
 			return nil, err
 		}
-		right, err := t.ParseLogicalAnd()
-		if err != nil {
-			return right, err
+		bindings = append(bindings, binding)
+		if t.token.Type != Comma {
+			break
+		}
+		if err := t.NextToken(); err != nil {
+			return nil, err
 		}
-		// TODO: CheckAndPromote for short-circuiting
 	}
-	return left, nil
+	if !t.token.IsIdentifierWithName(inIdentifier) {
+		return nil, fmt.Errorf("expected %s but got %v", inIdentifier, t.token.Type)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	body, err := t.ParseExpression()
+	if err != nil {
+		return nil, err
+	}
+	return t.at(pos)(CreateBlock(bindings, body))
 }
 
-// &&, and
-func (t *Tokenizer) ParseLogicalAnd() (Expression, error) {
-	left, err := t.ParseComparison()
+// def name(parameter, ...) = expression; expression
+//
+// The function is visible to the expression after it, as with let.
+func (t *Tokenizer) ParseDef() (Expression, error) {
+	pos := t.token.Position
+	t.pushLocals()
+	defer t.popLocals()
+	binding, err := t.parseFunction()
 	if err != nil {
 		return nil, err
 	}
-	for t.token.Type == DoubleAmpersand || t.token.IsIdentifierWithName(andIdentifier) {
-		if err = t.NextToken(); err != nil {
-			return nil, err
+	if t.token.Type != Semicolon {
+		return nil, fmt.Errorf("expected %v as the token type but got %v", Semicolon, t.token.Type)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	body, err := t.ParseExpression()
+	if err != nil {
+		return nil, err
+	}
+	return t.at(pos)(CreateBlock([]*Binding{binding}, body))
+}
+
+// ParseFunctions parses a sequence of ;-separated function definitions,
+// as held by a Library.
+func (t *Tokenizer) ParseFunctions() ([]*Binding, error) {
+	t.SetPosition(0)
+	t.locals = nil
+	t.lambdas = nil
+	t.positions = nil
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	t.pushLocals()
+	defer t.popLocals()
+	var bindings []*Binding
+	for t.token.Type != End {
+		if !t.token.IsIdentifierWithName(defIdentifier) {
+			return nil, fmt.Errorf("expected %s but got %v", defIdentifier, t.token.Text)
 		}
-		var right Expression
-		right, err = t.ParseComparison()
+		binding, err := t.parseFunction()
 		if err != nil {
-			return right, err
+			return nil, err
+		}
+		bindings = append(bindings, binding)
+		if err := t.parseStatementEnd(); err != nil {
+			return nil, err
 		}
-		// TODO: CheckAndPromote for short-circuiting
 	}
-	return left, err
+	return bindings, nil
 }
 
-// =, ==, !=, >, >=, <, <= operators
-func (t *Tokenizer) ParseComparison() (Expression, error) {
-	left, err := t.ParseAdditive()
-	if err != nil {
-		return left, err
+// def name(parameter, ...) = expression
+//
+// Parameters are either untyped, taking the kind of each argument, or
+// preceded by a type name as in def tax(double x) = x * 0.2. The function
+// is visible within its own body, so it can call itself, and its body can
+// refer to the parameters and variables in scope where it's defined.
+func (t *Tokenizer) parseFunction() (*Binding, error) {
+	if err := t.NextToken(); err != nil {
+		return nil, err
 	}
-	for t.token.Type == Equal ||
-		t.token.Type == DoubleEqual ||
-		t.token.Type == ExclamationEqual ||
-		t.token.Type == GreaterThan ||
-		t.token.Type == GreaterThanEqual ||
-		t.token.Type == LessThan ||
-		t.token.Type == LessThanEqual {
+	if t.token.Type != Identifier {
+		return nil, fmt.Errorf("expected %v as the token type but got %v", Identifier, t.token.Type)
+	}
+	name := t.token.Text
+	if _, ok := t.locals[len(t.locals)-1][name]; ok {
+		return nil, fmt.Errorf("%s is already defined in this block", name)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	if t.token.Type != OpenParenthesis {
+		return nil, fmt.Errorf("expected %v as the token type but got %v", OpenParenthesis, t.token.Type)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	var parameters []*ParameterExpression
+	for t.token.Type != CloseParenthesis {
+		if len(parameters) > 0 {
+			if t.token.Type != Comma {
+				return nil, fmt.Errorf("expected %v as the token type but got %v", Comma, t.token.Type)
+			}
+			if err := t.NextToken(); err != nil {
+				return nil, err
+			}
+		}
+		parameter, err := t.parseFunctionParameter()
+		if err != nil {
+			return nil, err
+		}
+		parameters = append(parameters, parameter)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	if t.token.Type != Equal {
+		return nil, fmt.Errorf("expected %v as the token type but got %v", Equal, t.token.Type)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	if err := validateParameters(name, parameters); err != nil {
+		return nil, err
+	}
+
+	// The body is filled in once it's parsed; until then recursive calls
+	// see a function with an unknown result.
+	lambda := NewLambdaExpression(name, parameters, nil)
+	variable := NewParameterExpression(name, reflect.Func)
+	t.locals[len(t.locals)-1][name] = variable
+	if t.lambdas == nil {
+		t.lambdas = make(map[*ParameterExpression]*LambdaExpression)
+	}
+	t.lambdas[variable] = lambda
+
+	t.pushLocals()
+	for _, parameter := range parameters {
+		t.locals[len(t.locals)-1][parameter.name] = parameter
+	}
+	body, err := t.parseNestedExpression()
+	t.popLocals()
+	if err != nil {
+		return nil, err
+	}
+	lambda.body = body
+	return &Binding{Variable: variable, Value: lambda}, nil
+}
+
+// [type] name
+func (t *Tokenizer) parseFunctionParameter() (*ParameterExpression, error) {
+	if t.token.Type != Identifier {
+		return nil, fmt.Errorf("expected %v as the token type but got %v", Identifier, t.token.Type)
+	}
+	name := t.token.Text
+	if t.isTypeName() {
+		typ, err := t.ParseTypeName()
+		if err != nil {
+			return nil, err
+		}
+		if t.token.Type != Identifier {
+			// The type name was the parameter's name.
+			return NewParameterExpression(name, reflect.Interface), nil
+		}
+		name = t.token.Text
+		if err := t.NextToken(); err != nil {
+			return nil, err
+		}
+		return NewTypedParameterExpression(name, typ), nil
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	return NewParameterExpression(name, reflect.Interface), nil
+}
+
+// (expression, ...)
+func (t *Tokenizer) ParseInvoke(target Expression, lambda *LambdaExpression) (Expression, error) {
+	if t.token.Type != OpenParenthesis {
+		return nil, fmt.Errorf("expected %v as the token type but got %v", OpenParenthesis, t.token.Type)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	arguments, err := t.parseArguments()
+	if err != nil {
+		return nil, err
+	}
+	return CreateInvoke(target, lambda, arguments)
+}
+
+// parseArguments parses the ,-separated arguments of a call up to and
+// including its closing parenthesis.
+func (t *Tokenizer) parseArguments() ([]Expression, error) {
+	var arguments []Expression
+	for t.token.Type != CloseParenthesis {
+		if len(arguments) > 0 {
+			if t.token.Type != Comma {
+				return nil, fmt.Errorf("expected %v as the token type but got %v", Comma, t.token.Type)
+			}
+			if err := t.NextToken(); err != nil {
+				return nil, err
+			}
+		}
+		argument, err := t.parseNestedExpression()
+		if err != nil {
+			return nil, err
+		}
+		arguments = append(arguments, argument)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	return arguments, nil
+}
+
+// name(arguments), a call of a method of the environment
+func (t *Tokenizer) ParseCall(name string) (Expression, error) {
+	if t.token.Type != OpenParenthesis {
+		return nil, fmt.Errorf("%s is a method and must be called", name)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	arguments, err := t.parseArguments()
+	if err != nil {
+		return nil, err
+	}
+	return CreateCall(t.environment, name, arguments)
+}
+
+// type(expression), a cast such as int64(x)
+func (t *Tokenizer) ParseConvert(typ reflect.Type) (Expression, error) {
+	if t.token.Type != OpenParenthesis {
+		return nil, fmt.Errorf("expected %v as the token type but got %v", OpenParenthesis, t.token.Type)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	arguments, err := t.parseArguments()
+	if err != nil {
+		return nil, err
+	}
+	if len(arguments) != 1 {
+		return nil, fmt.Errorf("a conversion to %v takes 1 argument but got %d", typ, len(arguments))
+	}
+	return CreateConvert(arguments[0], typ)
+}
+
+// { var name = expression; ... expression }
+func (t *Tokenizer) ParseBlock() (Expression, error) {
+	pos := t.token.Position
+	if t.token.Type != OpenBrace {
+		return nil, fmt.Errorf("expected %v as the token type but got %v", OpenBrace, t.token.Type)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	t.pushLocals()
+	defer t.popLocals()
+	var bindings []*Binding
+	for t.token.IsIdentifierWithName(varIdentifier) {
+		if err := t.NextToken(); err != nil {
+			return nil, err
+		}
+		binding, err := t.parseBinding(false)
+		if err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, binding)
+		if t.token.Type != Semicolon {
+			return nil, fmt.Errorf("expected %v as the token type but got %v", Semicolon, t.token.Type)
+		}
+		if err := t.NextToken(); err != nil {
+			return nil, err
+		}
+	}
+	body, err := t.parseNestedExpression()
+	if err != nil {
+		return nil, err
+	}
+	if t.token.Type == Semicolon {
+		if err := t.NextToken(); err != nil {
+			return nil, err
+		}
+	}
+	if t.token.Type != CloseBrace {
+		return nil, fmt.Errorf("expected %v as the token type but got %v", CloseBrace, t.token.Type)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	return t.at(pos)(CreateBlock(bindings, body))
+}
+
+// name = expression
+//
+// The variable's kind is inferred from its value, and it's only visible
+// after the binding, so let x = x + 1 refers to an outer x.
+func (t *Tokenizer) parseBinding(noIn bool) (*Binding, error) {
+	if t.token.Type != Identifier {
+		return nil, fmt.Errorf("expected %v as the token type but got %v", Identifier, t.token.Type)
+	}
+	name := t.token.Text
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	if t.token.Type != Equal {
+		return nil, fmt.Errorf("expected %v as the token type but got %v", Equal, t.token.Type)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	outer := t.noIn
+	t.noIn = noIn
+	value, err := t.ParseExpression()
+	t.noIn = outer
+	if err != nil {
+		return nil, err
+	}
+	variable := NewParameterExpression(name, value.Kind())
+	if typ := staticTypeOf(value); typ != nil {
+		variable = NewTypedParameterExpression(name, typ)
+	}
+	t.locals[len(t.locals)-1][name] = variable
+	return &Binding{Variable: variable, Value: value}, nil
+}
+
+func (t *Tokenizer) pushLocals() {
+	t.locals = append(t.locals, make(map[string]*ParameterExpression))
+}
+
+func (t *Tokenizer) popLocals() {
+	t.locals = t.locals[:len(t.locals)-1]
+}
+
+// lookupLocal returns the innermost local variable with the provided name.
+func (t *Tokenizer) lookupLocal(name string) (*ParameterExpression, bool) {
+	for i := len(t.locals) - 1; i >= 0; i-- {
+		if variable, ok := t.locals[i][name]; ok {
+			return variable, true
+		}
+	}
+	return nil, false
+}
+
+// ||, or
+func (t *Tokenizer) ParseLogicalOr() (Expression, error) {
+	pos := t.token.Position
+	left, err := t.ParseLogicalAnd()
+	if err != nil {
+		return left, err
+	}
+	for t.token.Type == DoubleBar || t.token.IsIdentifierWithName(orIdentifier) {
+		if err := t.NextToken(); err != nil {
+			return nil, err
+		}
+		right, err := t.ParseLogicalAnd()
+		if err != nil {
+			return right, err
+		}
+		if left, err = t.at(pos)(CreateOrElse(left, right)); err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
+
+// &&, and
+func (t *Tokenizer) ParseLogicalAnd() (Expression, error) {
+	pos := t.token.Position
+	left, err := t.ParseBitwiseOr()
+	if err != nil {
+		return nil, err
+	}
+	for t.token.Type == DoubleAmpersand || t.token.IsIdentifierWithName(andIdentifier) {
+		if err = t.NextToken(); err != nil {
+			return nil, err
+		}
+		var right Expression
+		right, err = t.ParseBitwiseOr()
+		if err != nil {
+			return right, err
+		}
+		if left, err = t.at(pos)(CreateAndAlso(left, right)); err != nil {
+			return nil, err
+		}
+	}
+	return left, err
+}
+
+// |
+func (t *Tokenizer) ParseBitwiseOr() (Expression, error) {
+	pos := t.token.Position
+	left, err := t.ParseComparison()
+	if err != nil {
+		return nil, err
+	}
+	for t.token.Type == Bar {
+		if err := t.NextToken(); err != nil {
+			return nil, err
+		}
+		right, err := t.ParseComparison()
+		if err != nil {
+			return right, err
+		}
+		if left, err = t.at(pos)(CreateOr(left, right)); err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
+
+// =, ==, !=, >, >=, <, <=, in, is operators
+func (t *Tokenizer) ParseComparison() (Expression, error) {
+	pos := t.token.Position
+	left, err := t.ParseAdditive()
+	if err != nil {
+		return left, err
+	}
+	for (t.token.Type == Equal && !t.allowsAssignment()) ||
+		t.token.Type == DoubleEqual ||
+		t.token.Type == ExclamationEqual ||
+		t.token.Type == GreaterThan ||
+		t.token.Type == GreaterThanEqual ||
+		t.token.Type == LessThan ||
+		t.token.Type == LessThanEqual ||
+		(t.token.IsIdentifierWithName(inIdentifier) && !t.noIn) ||
+		t.token.IsIdentifierWithName(isIdentifier) {
 
 		operator := t.token
 		if err = t.NextToken(); err != nil {
 			return nil, err
 		}
 
+		if operator.IsIdentifierWithName(isIdentifier) {
+			var pattern Pattern
+			pattern, err = t.ParsePattern(left.Kind())
+			if err != nil {
+				return nil, err
+			}
+			left, err = t.at(pos)(CreateIs(left, pattern))
+			if err != nil {
+				return left, err
+			}
+			continue
+		}
+
 		var right Expression
 		right, err = t.ParseAdditive()
 		if err != nil {
 			return nil, err
 		}
 
-		// TODO: validation of left and right types
 		switch operator.Type {
 		case Equal:
 			fallthrough
 		case DoubleEqual:
-			left, err = CreateEqual(left, right)
+			left, err = t.at(pos)(CreateEqual(left, right))
 		case ExclamationEqual:
-			left, err = CreateNotEqual(left, right)
+			left, err = t.at(pos)(CreateNotEqual(left, right))
 		case GreaterThan:
-			left, err = CreateGreaterThan(left, right)
+			left, err = t.at(pos)(CreateGreaterThan(left, right))
 		case GreaterThanEqual:
-			left, err = CreateGreaterThanOrEqual(left, right)
+			left, err = t.at(pos)(CreateGreaterThanOrEqual(left, right))
 		case LessThan:
-			left, err = CreateLessThan(left, right)
+			left, err = t.at(pos)(CreateLessThan(left, right))
 		case LessThanEqual:
-			left, err = CreateLessThanOrEqual(left, right)
+			left, err = t.at(pos)(CreateLessThanOrEqual(left, right))
+		case Identifier:
+			left, err = t.at(pos)(CreateIn(left, right))
 		}
 
 		if err != nil {
@@ -389,6 +1265,7 @@ func (t *Tokenizer) ParseComparison() (Expression, error) {
 
 // +, -
 func (t *Tokenizer) ParseAdditive() (Expression, error) {
+	pos := t.token.Position
 	left, err := t.ParseMultiplicative()
 	if err != nil {
 		return left, err
@@ -406,9 +1283,9 @@ func (t *Tokenizer) ParseAdditive() (Expression, error) {
 		}
 		switch operator.Type {
 		case Plus:
-			left, err = CreateAdd(left, right)
+			left, err = t.at(pos)(CreateAdd(left, right))
 		case Minus:
-			left, err = CreateSubtract(left, right)
+			left, err = t.at(pos)(CreateSubtract(left, right))
 		}
 		if err != nil {
 			return left, err
@@ -419,7 +1296,8 @@ func (t *Tokenizer) ParseAdditive() (Expression, error) {
 
 // *, /, %, mod
 func (t *Tokenizer) ParseMultiplicative() (Expression, error) {
-	left, err := t.ParseUnary()
+	pos := t.token.Position
+	left, err := t.ParseSwitch()
 	if err != nil {
 		return left, err
 	}
@@ -432,20 +1310,20 @@ func (t *Tokenizer) ParseMultiplicative() (Expression, error) {
 			return nil, err
 		}
 		var right Expression
-		right, err = t.ParseUnary()
+		right, err = t.ParseSwitch()
 		if err != nil {
 			return left, err
 		}
 		// TODO: Promote
 		switch operator.Type {
 		case Asterisk:
-			left, err = CreateMultiply(left, right)
+			left, err = t.at(pos)(CreateMultiply(left, right))
 		case Slash:
-			left, err = CreateDivide(left, right)
+			left, err = t.at(pos)(CreateDivide(left, right))
 		case Percent:
 			fallthrough
 		case Identifier:
-			left, err = CreateModulus(left, right)
+			left, err = t.at(pos)(CreateModulus(left, right))
 		}
 		if err != nil {
 			return left, err
@@ -454,8 +1332,133 @@ func (t *Tokenizer) ParseMultiplicative() (Expression, error) {
 	return left, err
 }
 
-// -, !, +
+// switch { pattern => expression, ... }
+func (t *Tokenizer) ParseSwitch() (Expression, error) {
+	pos := t.token.Position
+	subject, err := t.ParseRange()
+	if err != nil {
+		return subject, err
+	}
+	for t.token.IsIdentifierWithName(switchIdentifier) {
+		if err = t.NextToken(); err != nil {
+			return nil, err
+		}
+		if t.token.Type != OpenBrace {
+			return nil, fmt.Errorf("expected %v as the token type but got %v", OpenBrace, t.token.Type)
+		}
+		if err = t.NextToken(); err != nil {
+			return nil, err
+		}
+		var arms []*SwitchArm
+		for t.token.Type != CloseBrace {
+			var pattern Pattern
+			pattern, err = t.ParsePattern(subject.Kind())
+			if err != nil {
+				return nil, err
+			}
+			if t.token.Type != Arrow {
+				return nil, fmt.Errorf("expected %v as the token type but got %v", Arrow, t.token.Type)
+			}
+			if err = t.NextToken(); err != nil {
+				return nil, err
+			}
+			var body Expression
+			body, err = t.parseNestedExpression()
+			if err != nil {
+				return nil, err
+			}
+			arms = append(arms, &SwitchArm{Pattern: pattern, Body: body})
+			if t.token.Type != Comma {
+				break
+			}
+			if err = t.NextToken(); err != nil {
+				return nil, err
+			}
+		}
+		if t.token.Type != CloseBrace {
+			return nil, fmt.Errorf("expected %v as the token type but got %v", CloseBrace, t.token.Type)
+		}
+		if err = t.NextToken(); err != nil {
+			return nil, err
+		}
+		subject, err = t.at(pos)(CreateSwitch(subject, arms))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return subject, nil
+}
+
+// .. (start and end are both optional)
+func (t *Tokenizer) ParseRange() (Expression, error) {
+	pos := t.token.Position
+	var start Expression
+	var err error
+	if t.token.Type != DoubleDot {
+		start, err = t.ParseUnary()
+		if err != nil {
+			return start, err
+		}
+		if t.token.Type != DoubleDot {
+			return start, nil
+		}
+	}
+	if err = t.NextToken(); err != nil {
+		return nil, err
+	}
+	var end Expression
+	if t.startsOperand() {
+		end, err = t.ParseUnary()
+		if err != nil {
+			return end, err
+		}
+	}
+	return t.at(pos)(CreateRange(start, end))
+}
+
+// startsOperand determines whether or not the current token can begin
+// a unary expression. It's used to detect open-ended ranges such as 1..
+func (t *Tokenizer) startsOperand() bool {
+	switch t.token.Type {
+	case IntegerLiteral, RealLiteral, StringLiteral, OpenParenthesis,
+		Minus, Plus, Exclamation, Caret:
+		return true
+	case Identifier:
+		return !t.token.IsIdentifierWithName(orIdentifier) &&
+			!t.token.IsIdentifierWithName(andIdentifier) &&
+			!t.token.IsIdentifierWithName(modIdentifier) &&
+			!t.token.IsIdentifierWithName(inIdentifier)
+	}
+	return false
+}
+
+// -, !, +, ^, ++, --
 func (t *Tokenizer) ParseUnary() (Expression, error) {
+	pos := t.token.Position
+	if t.token.Type == DoublePlus || t.token.Type == DoubleMinus {
+		operator := t.token
+		if err := t.NextToken(); err != nil {
+			return nil, err
+		}
+		expr, err := t.ParseUnary()
+		if err != nil {
+			return expr, err
+		}
+		if operator.Type == DoublePlus {
+			return t.at(pos)(CreatePreIncrementAssign(expr))
+		}
+		return t.at(pos)(CreatePreDecrementAssign(expr))
+	}
+	if t.token.Type == Caret {
+		if err := t.NextToken(); err != nil {
+			return nil, err
+		}
+		expr, err := t.ParseUnary()
+		if err != nil {
+			return expr, err
+		}
+		return t.at(pos)(CreateIndexFromEnd(expr))
+	}
 	if t.token.Type == Minus || t.token.Type == Exclamation || t.token.Type == Plus {
 		operator := t.token
 		if err := t.NextToken(); err != nil {
@@ -473,11 +1476,11 @@ func (t *Tokenizer) ParseUnary() (Expression, error) {
 		}
 		// TODO: Promote
 		if operator.Type == Minus {
-			expr, err = CreateUnaryNegate(expr)
+			expr, err = t.at(pos)(CreateUnaryNegate(expr))
 		} else if operator.Type == Plus {
-			expr, err = CreateUnaryPlus(expr)
+			expr, err = t.at(pos)(CreateUnaryPlus(expr))
 		} else {
-			expr, err = CreateUnaryNot(expr)
+			expr, err = t.at(pos)(CreateUnaryNot(expr))
 		}
 		return expr, err
 	}
@@ -486,6 +1489,95 @@ func (t *Tokenizer) ParseUnary() (Expression, error) {
 }
 
 func (t *Tokenizer) ParsePrimary() (Expression, error) {
+	pos := t.token.Position
+	expr, err := t.parsePrimaryStart()
+	if err != nil {
+		return expr, err
+	}
+	for {
+		switch t.token.Type {
+		case OpenBracket:
+			expr, err = t.at(pos)(t.ParseIndex(expr))
+		case Dot:
+			expr, err = t.at(pos)(t.ParseMember(expr))
+		case DoublePlus:
+			if err = t.NextToken(); err == nil {
+				expr, err = t.at(pos)(CreatePostIncrementAssign(expr))
+			}
+		case DoubleMinus:
+			if err = t.NextToken(); err == nil {
+				expr, err = t.at(pos)(CreatePostDecrementAssign(expr))
+			}
+		default:
+			return expr, nil
+		}
+		if err != nil {
+			return expr, err
+		}
+	}
+}
+
+// .
+func (t *Tokenizer) ParseMember(operand Expression) (Expression, error) {
+	if t.token.Type != Dot {
+		return nil, fmt.Errorf("expected %v as the token type but got %v", Dot, t.token.Type)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	if t.token.Type != Identifier {
+		return nil, fmt.Errorf("expected %v as the token type but got %v", Identifier, t.token.Type)
+	}
+	name := t.token.Text
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	if _, ok := nullableType(staticTypeOf(operand)); ok && isNullableMember(name) {
+		return t.parseNullableMember(operand, name)
+	}
+	if e, ok := enumOf(staticTypeOf(operand)); ok && e.flags && name == hasFlagMember {
+		return t.parseHasFlag(operand)
+	}
+	return CreateMember(operand, name)
+}
+
+// x.HasValue, x.Value, x.GetValueOrDefault([default])
+func (t *Tokenizer) parseNullableMember(operand Expression, name string) (Expression, error) {
+	if name != getValueOrDefaultMember {
+		return CreateNullableMember(operand, name, nil)
+	}
+	if t.token.Type != OpenParenthesis {
+		return nil, fmt.Errorf("%s is a method and must be called", name)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	arguments, err := t.parseArguments()
+	if err != nil {
+		return nil, err
+	}
+	return CreateNullableMember(operand, name, arguments)
+}
+
+// x.HasFlag(flag)
+func (t *Tokenizer) parseHasFlag(operand Expression) (Expression, error) {
+	if t.token.Type != OpenParenthesis {
+		return nil, fmt.Errorf("%s is a method and must be called", hasFlagMember)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	arguments, err := t.parseArguments()
+	if err != nil {
+		return nil, err
+	}
+	if len(arguments) != 1 {
+		return nil, fmt.Errorf("%s takes 1 argument but got %d", hasFlagMember, len(arguments))
+	}
+	return CreateHasFlag(operand, arguments[0])
+}
+
+func (t *Tokenizer) parsePrimaryStart() (Expression, error) {
 	switch t.token.Type {
 	case Identifier:
 		return t.ParseIdentifier()
@@ -497,13 +1589,221 @@ func (t *Tokenizer) ParsePrimary() (Expression, error) {
 		return t.ParseRealLiteral()
 	case OpenParenthesis:
 		return t.ParseParenthesesExpression()
+	case OpenBrace:
+		return t.ParseBlock()
 	default:
 		break
 	}
 	return nil, errMiscomputedExpression
 }
 
+// or patterns. kind is the kind of the value being matched.
+func (t *Tokenizer) ParsePattern(kind reflect.Kind) (Pattern, error) {
+	left, err := t.parseConjunctivePattern(kind)
+	if err != nil {
+		return nil, err
+	}
+	for t.token.IsIdentifierWithName(orIdentifier) {
+		if err = t.NextToken(); err != nil {
+			return nil, err
+		}
+		var right Pattern
+		right, err = t.parseConjunctivePattern(kind)
+		if err != nil {
+			return nil, err
+		}
+		left = NewBinaryPattern(OrPat, left, right)
+	}
+	return left, nil
+}
+
+// and patterns
+func (t *Tokenizer) parseConjunctivePattern(kind reflect.Kind) (Pattern, error) {
+	left, err := t.parseNegatedPattern(kind)
+	if err != nil {
+		return nil, err
+	}
+	for t.token.IsIdentifierWithName(andIdentifier) {
+		if err = t.NextToken(); err != nil {
+			return nil, err
+		}
+		var right Pattern
+		right, err = t.parseNegatedPattern(kind)
+		if err != nil {
+			return nil, err
+		}
+		left = NewBinaryPattern(AndPat, left, right)
+	}
+	return left, nil
+}
+
+// not patterns
+func (t *Tokenizer) parseNegatedPattern(kind reflect.Kind) (Pattern, error) {
+	if !t.token.IsIdentifierWithName(notIdentifier) {
+		return t.parsePrimaryPattern(kind)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	operand, err := t.parseNegatedPattern(kind)
+	if err != nil {
+		return nil, err
+	}
+	return NewNotPattern(operand), nil
+}
+
+var relationalPatternOperators = map[TokenType]ExpressionType{
+	LessThan:         LessThanExpr,
+	LessThanEqual:    LessThanOrEqualExpr,
+	GreaterThan:      GreaterThanExpr,
+	GreaterThanEqual: GreaterThanOrEqualExpr,
+}
+
+// (pattern), relational, property, discard, null, type and constant patterns
+func (t *Tokenizer) parsePrimaryPattern(kind reflect.Kind) (Pattern, error) {
+	if operator, ok := relationalPatternOperators[t.token.Type]; ok {
+		if err := t.NextToken(); err != nil {
+			return nil, err
+		}
+		value, err := t.ParseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return CreateRelationalPattern(operator, value, kind)
+	}
+	switch t.token.Type {
+	case OpenParenthesis:
+		if err := t.NextToken(); err != nil {
+			return nil, err
+		}
+		pattern, err := t.ParsePattern(kind)
+		if err != nil {
+			return nil, err
+		}
+		if t.token.Type != CloseParenthesis {
+			return nil, fmt.Errorf("expected %v as the token type but got %v", CloseParenthesis, t.token.Type)
+		}
+		if err := t.NextToken(); err != nil {
+			return nil, err
+		}
+		return pattern, nil
+	case OpenBrace:
+		return t.parsePropertyPattern(nil)
+	case Identifier:
+		text := t.token.Text
+		if text == discardIdentifier {
+			return NewDiscardPattern(), t.NextToken()
+		}
+		if t.token.IsIdentifierWithName(nullIdentifier) {
+			return NewConstantPattern(nil), t.NextToken()
+		}
+		if _, isParameter := t.parameters[text]; !isParameter && t.isTypeName() {
+			typ, err := t.ParseTypeName()
+			if err != nil {
+				return nil, err
+			}
+			typePattern := NewTypePattern(text, typ)
+			if t.token.Type == OpenBrace {
+				return t.parsePropertyPattern(typePattern)
+			}
+			return typePattern, nil
+		}
+	}
+	value, err := t.ParseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	return CreateConstantPattern(value, kind)
+}
+
+// isTypeName determines whether or not the current token names a type.
+func (t *Tokenizer) isTypeName() bool {
+	if t.token.Type != Identifier {
+		return false
+	}
+	_, ok := LookupTypeName(t.token.Text)
+	return ok
+}
+
+// ParseTypeName parses a type name such as int64, string or double.
+func (t *Tokenizer) ParseTypeName() (reflect.Type, error) {
+	if t.token.Type != Identifier {
+		return nil, fmt.Errorf("expected %v as the token type but got %v", Identifier, t.token.Type)
+	}
+	typ, ok := LookupTypeName(t.token.Text)
+	if !ok {
+		return nil, fmt.Errorf("unknown type: %s", t.token.Text)
+	}
+	return typ, t.NextToken()
+}
+
+// { Name: pattern, ... }
+func (t *Tokenizer) parsePropertyPattern(typ *TypePattern) (Pattern, error) {
+	if t.token.Type != OpenBrace {
+		return nil, fmt.Errorf("expected %v as the token type but got %v", OpenBrace, t.token.Type)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	var subpatterns []*Subpattern
+	for t.token.Type != CloseBrace {
+		if t.token.Type != Identifier {
+			return nil, fmt.Errorf("expected %v as the token type but got %v", Identifier, t.token.Type)
+		}
+		name := t.token.Text
+		if err := t.NextToken(); err != nil {
+			return nil, err
+		}
+		if t.token.Type != Colon {
+			return nil, fmt.Errorf("expected %v as the token type but got %v", Colon, t.token.Type)
+		}
+		if err := t.NextToken(); err != nil {
+			return nil, err
+		}
+		pattern, err := t.ParsePattern(reflect.Interface)
+		if err != nil {
+			return nil, err
+		}
+		subpatterns = append(subpatterns, &Subpattern{Name: name, Pattern: pattern})
+		if t.token.Type != Comma {
+			break
+		}
+		if err := t.NextToken(); err != nil {
+			return nil, err
+		}
+	}
+	if t.token.Type != CloseBrace {
+		return nil, fmt.Errorf("expected %v as the token type but got %v", CloseBrace, t.token.Type)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	return NewPropertyPattern(typ, subpatterns), nil
+}
+
+// [ ]
+func (t *Tokenizer) ParseIndex(operand Expression) (Expression, error) {
+	if t.token.Type != OpenBracket {
+		return nil, fmt.Errorf("expected %v as the token type but got %v", OpenBracket, t.token.Type)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	index, err := t.parseNestedExpression()
+	if err != nil {
+		return index, err
+	}
+	if t.token.Type != CloseBracket {
+		return nil, fmt.Errorf("expected %v as the token type but got %v", CloseBracket, t.token.Type)
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	return CreateIndex(operand, index)
+}
+
 func (t *Tokenizer) ParseIdentifier() (Expression, error) {
+	pos := t.token.Position
 	if t.token.Type != Identifier {
 		return nil, fmt.Errorf("expected %v as the token type but got %v", Identifier, t.token.Type)
 	}
@@ -511,13 +1811,138 @@ func (t *Tokenizer) ParseIdentifier() (Expression, error) {
 	if err := t.NextToken(); err != nil {
 		return nil, err
 	}
+	if variable, ok := t.lookupLocal(text); ok {
+		if lambda, ok := t.lambdas[variable]; ok {
+			return t.at(pos)(t.ParseInvoke(variable, lambda))
+		}
+		return variable, nil
+	}
+	if t.library != nil && t.token.Type == OpenParenthesis {
+		if closure, ok := t.library.Lookup(text); ok {
+			return t.at(pos)(t.ParseInvoke(NewConstantExpression(closure, reflect.Func), closure.lambda))
+		}
+	}
+	if t.environment != nil {
+		if _, ok := t.environment.fields[text]; ok {
+			return t.at(pos)(CreateField(t.environment, text))
+		}
+		if _, ok := t.environment.methods[text]; ok {
+			return t.at(pos)(t.ParseCall(text))
+		}
+	}
+	if typ, ok := t.declarations[text]; ok {
+		return t.at(pos)(NewTypedParameterExpression(text, typ), nil)
+	}
 	if val, ok := t.parameters[text]; ok {
-		return CreateLiteral(val, text), nil
+		if t.statementMode() {
+			return t.at(pos)(createParameterReference(text, val), nil)
+		}
+		return t.at(pos)(createParameterValue(val), nil)
 	}
-	return nil, fmt.Errorf("unknown identifier: %s", text)
+	if e, ok := LookupEnum(text); ok {
+		return t.at(pos)(t.parseEnumMember(e))
+	}
+	if typ, ok := LookupTypeName(text); ok && t.token.Type == OpenParenthesis {
+		return t.at(pos)(t.ParseConvert(typ))
+	}
+	if strings.EqualFold(text, trueIdentifier) || strings.EqualFold(text, falseIdentifier) {
+		return t.at(pos)(CreateLiteral(strings.EqualFold(text, trueIdentifier), text), nil)
+	}
+	if strings.EqualFold(text, nullIdentifier) {
+		null := NewConstantExpression(nil, reflect.Interface)
+		null.literal = true
+		return t.at(pos)(null, nil)
+	}
+	suggestion := suggest(text, t.identifiers())
+	if t.declarations != nil || t.environment != nil {
+		return nil, fmt.Errorf("undeclared identifier: %s%s", text, suggestion)
+	}
+	return nil, fmt.Errorf("unknown identifier: %s%s", text, suggestion)
+}
+
+// Enum.Member
+func (t *Tokenizer) parseEnumMember(e *Enum) (Expression, error) {
+	if t.token.Type != Dot {
+		members := e.Members()
+		return nil, fmt.Errorf("%s is an enum; refer to one of its members, such as %s.%s", e.name, e.name, members[0])
+	}
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	if t.token.Type != Identifier {
+		return nil, fmt.Errorf("expected %v as the token type but got %v", Identifier, t.token.Type)
+	}
+	member := t.token.Text
+	if err := t.NextToken(); err != nil {
+		return nil, err
+	}
+	return createEnumMember(e, member)
+}
+
+// identifiers returns the names identifiers can refer to: local variables,
+// library functions, fields and methods of the environment, declared
+// parameters, parameters and enums.
+func (t *Tokenizer) identifiers() []string {
+	var names []string
+	for _, locals := range t.locals {
+		for name := range locals {
+			names = append(names, name)
+		}
+	}
+	if t.library != nil {
+		names = append(names, t.library.Names()...)
+	}
+	if t.environment != nil {
+		names = append(names, t.environment.Names()...)
+	}
+	for name := range t.declarations {
+		names = append(names, name)
+	}
+	for name := range t.parameters {
+		names = append(names, name)
+	}
+	return append(names, enumNames()...)
+}
+
+// Completions returns the identifiers which start with prefix in sorted
+// order. A prefix naming an enum followed by a dot, such as OrderStatus.Sh,
+// completes the enum's members.
+func (t *Tokenizer) Completions(prefix string) []string {
+	if i := strings.IndexRune(prefix, '.'); i >= 0 {
+		if e, ok := LookupEnum(prefix[:i]); ok {
+			return enumCompletions(e, prefix[i+1:])
+		}
+		return nil
+	}
+	seen := make(map[string]bool)
+	var completions []string
+	for _, name := range t.identifiers() {
+		if strings.HasPrefix(name, prefix) && !seen[name] {
+			seen[name] = true
+			completions = append(completions, name)
+		}
+	}
+	sort.Strings(completions)
+	return completions
+}
+
+// isParameter determines whether or not an expression refers to a
+// parameter or a field of the environment, as opposed to a local variable.
+func (t *Tokenizer) isParameter(expr Expression) bool {
+	switch e := expr.(type) {
+	case *ConstantExpression:
+		return true
+	case *ParameterExpression:
+		local, ok := t.lookupLocal(e.name)
+		return !ok || local != e
+	case *FieldExpression:
+		return true
+	}
+	return false
 }
 
 func (t *Tokenizer) ParseStringLiteral() (Expression, error) {
+	pos := t.token.Position
 	if t.token.Type != StringLiteral {
 		return nil, fmt.Errorf("expected %v as the token type but got %v", StringLiteral, t.token.Type)
 	}
@@ -526,21 +1951,25 @@ func (t *Tokenizer) ParseStringLiteral() (Expression, error) {
 	if err := t.NextToken(); err != nil {
 		return nil, err
 	}
-	return CreateLiteral(s, s), nil
+	return t.at(pos)(CreateLiteral(s, s), nil)
 }
 
 func (t *Tokenizer) ParseIntegerLiteral() (Expression, error) {
+	pos := t.token.Position
 	if t.token.Type != IntegerLiteral {
 		return nil, fmt.Errorf("expected %v as the token type but got %v", IntegerLiteral, t.token.Type)
 	}
 	text := t.token.Text
 	var value interface{}
 	var err error
-	if text[0] != '-' {
-		// TODO: support parsing as 32, 16, etc.
+	// Integer literals are ints, like Go's untyped integer constants default
+	// to, unless they're too large for one.
+	if i, parseErr := strconv.ParseInt(text, 10, 0); parseErr == nil {
+		value = int(i)
+	} else if text[0] != '-' {
 		value, err = strconv.ParseUint(text, 10, 64)
 	} else {
-		value, err = strconv.ParseInt(text, 10, 64)
+		err = parseErr
 	}
 	if err != nil {
 		return nil, err
@@ -548,10 +1977,11 @@ func (t *Tokenizer) ParseIntegerLiteral() (Expression, error) {
 	if err := t.NextToken(); err != nil {
 		return nil, err
 	}
-	return CreateLiteral(value, text), nil
+	return t.at(pos)(CreateLiteral(value, text), nil)
 }
 
 func (t *Tokenizer) ParseRealLiteral() (Expression, error) {
+	pos := t.token.Position
 	if t.token.Type != RealLiteral {
 		return nil, fmt.Errorf("expected %v as the token type but got %v", RealLiteral, t.token.Type)
 	}
@@ -570,7 +2000,7 @@ func (t *Tokenizer) ParseRealLiteral() (Expression, error) {
 		return nil, err
 	}
 
-	return CreateLiteral(value, text), nil
+	return t.at(pos)(CreateLiteral(value, text), nil)
 }
 
 func (t *Tokenizer) ParseParenthesesExpression() (Expression, error) {
@@ -580,7 +2010,7 @@ func (t *Tokenizer) ParseParenthesesExpression() (Expression, error) {
 	if err := t.NextToken(); err != nil {
 		return nil, err
 	}
-	expr, err := t.ParseExpression()
+	expr, err := t.parseNestedExpression()
 	if err != nil {
 		return expr, err
 	}
@@ -598,11 +2028,49 @@ func (t *Tokenizer) GenerateConditional(
 	expr1 Expression,
 	expr2 Expression,
 	errorPos int) (Expression, error) {
-	// TODO: impl
-	return nil, errUnimplemented
+	conditional, err := CreateConditional(expr, expr1, expr2)
+	if err != nil {
+		return nil, fmt.Errorf("invalid conditional at position %d: %v", errorPos, err)
+	}
+	return conditional, nil
+}
+
+// createParameterReference creates a parameter whose value is looked up
+// when evaluating, typed after its current value.
+func createParameterReference(name string, value interface{}) Expression {
+	typ := normalizeType(reflect.TypeOf(value))
+	if typ == nil {
+		return NewParameterExpression(name, reflect.Interface)
+	}
+	return NewTypedParameterExpression(name, typ)
+}
+
+// createParameterValue creates a constant holding the value a parameter has
+// when parsing. Unlike a literal it keeps the parameter's type.
+func createParameterValue(value interface{}) Expression {
+	return newValueConstant(normalizeValue(value))
+}
+
+// newValueConstant creates a constant for a normalised value. Nullable
+// values are held unwrapped.
+func newValueConstant(value interface{}) *ConstantExpression {
+	if value == nil {
+		return NewConstantExpression(nil, reflect.Interface)
+	}
+	typ := reflect.TypeOf(value)
+	if elem, ok := nullableType(typ); ok {
+		e := NewConstantExpression(unwrapNullable(value), elem.Kind())
+		e.typ = typ
+		return e
+	}
+	return NewConstantExpression(value, typ.Kind())
 }
 
+// CreateLiteral creates a constant for a literal written in the source.
+// Values are normalised like those of parameters.
 // TODO: text is unused for now -- maintain a literals map?
 func CreateLiteral(value interface{}, text string) Expression {
-	return NewConstantExpression(value, reflect.TypeOf(value).Kind())
+	e := newValueConstant(normalizeValue(value))
+	e.literal = true
+	return e
 }
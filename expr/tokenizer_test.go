@@ -1,18 +1,23 @@
 package expr
 
 import (
-	"reflect"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 func TestNewTokenizer(t *testing.T) {
 	for _, test := range []struct {
 		expression  string
-		text        []rune
+		ch          rune
+		width       int
 		shouldError bool
 	}{
-		{"", []rune{}, true},
-		{"1 > 0", []rune{49, 32, 62, 32, 48}, false},
+		{"", 0, 0, true},
+		{"1 > 0", '1', 1, false},
+		{"é > 0", 'é', 2, false},
 	} {
 		tokenizer, err := NewTokenizer(test.expression, nil)
 		if test.shouldError && err != nil {
@@ -22,11 +27,11 @@ func TestNewTokenizer(t *testing.T) {
 		} else if !test.shouldError && err != nil {
 			t.Fatal("expected test to succeed but it didn't")
 		}
-		if !reflect.DeepEqual(test.text, tokenizer.text) {
-			t.Fatalf("expected %v but got %v for text", test.text, tokenizer.text)
+		if tokenizer.text != test.expression {
+			t.Fatalf("expected %q but got %q for text", test.expression, tokenizer.text)
 		}
-		if len(test.text) != tokenizer.length {
-			t.Fatalf("expected %v but got %v for length", test.text, tokenizer.length)
+		if tokenizer.ch != test.ch || tokenizer.width != test.width {
+			t.Fatalf("expected %q of width %d but got %q of width %d", test.ch, test.width, tokenizer.ch, tokenizer.width)
 		}
 	}
 }
@@ -38,6 +43,8 @@ func TestNextChar(t *testing.T) {
 	}{
 		{"abc", []rune{'a', 'b', 'c', '\000', '\000'}},
 		{"1 > 0", []rune{'1', ' ', '>', ' ', '0', '\000'}},
+		{"ü+日", []rune{'ü', '+', '日', '\000', '\000'}},
+		{"a\xffb", []rune{'a', utf8.RuneError, 'b', '\000'}},
 	} {
 		tokenizer, err := NewTokenizer(test.expression, nil)
 		if err != nil {
@@ -53,20 +60,58 @@ func TestNextChar(t *testing.T) {
 }
 
 func TestSetPosition(t *testing.T) {
+	tokenizer, err := NewTokenizer("ä < 日本", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
 	for _, test := range []struct {
 		position int
+		offset   int
+		ch       rune
 	}{
-		{50},
-		{0},
+		{50, 11, '\000'},
+		{0, 0, 'ä'},
+		{5, 8, '本'},
+		{4, 5, '日'},
+		{1, 2, ' '},
+		{6, 11, '\000'},
 	} {
-		tokenizer, err := NewTokenizer("1 > 0", nil)
-		if err != nil {
-			t.Fatalf("unexpected error: %v", err)
-		}
 		tokenizer.SetPosition(test.position)
 		if tokenizer.position != test.position {
 			t.Fatalf("expected %v as the position but got %v", test.position, tokenizer.position)
 		}
+		if tokenizer.Offset() != test.offset || tokenizer.ch != test.ch {
+			t.Fatalf("position %d: expected %q at offset %d but got %q at %d", test.position, test.ch, test.offset, tokenizer.ch, tokenizer.Offset())
+		}
+	}
+}
+
+func TestTokenOffsets(t *testing.T) {
+	tokenizer, err := NewTokenizer("größe + '日本' * 2", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, expected := range []Token{
+		{Type: Identifier, Text: "größe", Position: 0, Offset: 0},
+		{Type: Plus, Text: "+", Position: 6, Offset: 8},
+		{Type: StringLiteral, Text: "'日本'", Position: 8, Offset: 10},
+		{Type: Asterisk, Text: "*", Position: 13, Offset: 19},
+		{Type: IntegerLiteral, Text: "2", Position: 15, Offset: 21},
+		{Type: End, Text: "", Position: 16, Offset: 22},
+	} {
+		if err := tokenizer.NextToken(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if tokenizer.token != expected {
+			t.Fatalf("expected %+v but got %+v", expected, tokenizer.token)
+		}
+	}
+	tokenizer, err = NewTokenizer("'abc", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := tokenizer.NextToken(); err == nil || err.Error() != "unterminated string literal" {
+		t.Fatalf("expected an unterminated string literal but got %v", err)
 	}
 }
 
@@ -85,9 +130,87 @@ func TestHasNext(t *testing.T) {
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
-		tokenizer.position = test.position
+		tokenizer.SetPosition(test.position)
 		if actual := tokenizer.HasNext(); actual != test.expected {
 			t.Fatalf("expected %v but got %v", test.expected, actual)
 		}
 	}
 }
+
+// largeExpression sums terms, like generated expressions do.
+func largeExpression(terms int) string {
+	var b strings.Builder
+	for i := 0; i < terms; i++ {
+		if i > 0 {
+			b.WriteString(" + ")
+		}
+		fmt.Fprintf(&b, "(a * %d - b / 2.5)", i)
+	}
+	return b.String()
+}
+
+// parseTime returns the shortest of a few times taken to parse an
+// expression.
+func parseTime(t *testing.T, expression string) time.Duration {
+	var shortest time.Duration
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		tokenizer, err := NewTokenizer(expression, map[string]interface{}{"a": 1, "b": 2.0})
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if _, err := tokenizer.Parse(); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if elapsed := time.Since(start); i == 0 || elapsed < shortest {
+			shortest = elapsed
+		}
+	}
+	return shortest
+}
+
+func TestParseTimeIsLinear(t *testing.T) {
+	if testing.Short() {
+		t.Skip("times parsing large expressions")
+	}
+	small, large := parseTime(t, largeExpression(1000)), parseTime(t, largeExpression(4000))
+	// Four times the terms should take about four times as long; quadratic
+	// parsing takes sixteen.
+	if large > 10*small {
+		t.Fatalf("parsing 4000 terms took %v, more than 10 times the %v 1000 terms took", large, small)
+	}
+}
+
+func BenchmarkTokenizeLargeExpression(b *testing.B) {
+	expression := largeExpression(5000)
+	b.SetBytes(int64(len(expression)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tokenizer, err := NewTokenizer(expression, nil)
+		if err != nil {
+			b.Fatalf("unexpected err: %v", err)
+		}
+		for tokenizer.HasNext() {
+			if err := tokenizer.NextToken(); err != nil {
+				b.Fatalf("unexpected err: %v", err)
+			}
+		}
+	}
+}
+
+func BenchmarkParseLargeExpression(b *testing.B) {
+	expression := largeExpression(5000)
+	b.SetBytes(int64(len(expression)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tokenizer, err := NewTokenizer(expression, map[string]interface{}{"a": 1, "b": 2.0})
+		if err != nil {
+			b.Fatalf("unexpected err: %v", err)
+		}
+		if _, err := tokenizer.Parse(); err != nil {
+			b.Fatalf("unexpected err: %v", err)
+		}
+	}
+}
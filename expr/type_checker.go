@@ -0,0 +1,735 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+var (
+	closureType = reflect.TypeOf((*Closure)(nil))
+	indexType   = reflect.TypeOf(Index{})
+	rangeType   = reflect.TypeOf(Range{})
+)
+
+// TypeError is a type error found by CheckTypes.
+type TypeError struct {
+	// Position is the offset in the text at which the erroneous expression
+	// starts, or -1 if it isn't known.
+	Position int
+	Message  string
+}
+
+func (e *TypeError) Error() string {
+	if e.Position < 0 {
+		return fmt.Sprintf("type error: %s", e.Message)
+	}
+	return fmt.Sprintf("type error at position %d: %s", e.Position, e.Message)
+}
+
+// TypeErrors holds every type error found in an expression, in the order
+// they were found.
+type TypeErrors []*TypeError
+
+func (e TypeErrors) Error() string {
+	switch len(e) {
+	case 0:
+		return "no type errors"
+	case 1:
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", e[0], len(e)-1)
+}
+
+// TypeInfo holds the type of every node of a checked expression. Values
+// whose type can only be known when evaluating have the interface{} type.
+type TypeInfo struct {
+	Types map[Expression]reflect.Type
+}
+
+// TypeOf returns the type of a node, or nil if it wasn't checked.
+func (info *TypeInfo) TypeOf(e Expression) reflect.Type {
+	return info.Types[e]
+}
+
+// CheckTypes checks that the operands of every node of an expression have
+// compatible types and annotates each node with its type. Unlike kinds,
+// types tell named types such as type Celsius float64 apart from their
+// underlying types, so Celsius + Fahrenheit is an error. As in Go, numeric
+// literals take the type of the value they're used with.
+//
+// positions maps nodes to their offsets in the text, as returned by
+// Tokenizer.Positions, and may be nil. Every error is reported, as a
+// TypeErrors.
+func CheckTypes(root Expression, positions map[Expression]int) (*TypeInfo, error) {
+	if root == nil {
+		return nil, errInvalidExpression
+	}
+	c := &typeChecker{
+		info: &TypeInfo{
+			Types: make(map[Expression]reflect.Type),
+		},
+		positions: positions,
+		variables: make(map[*ParameterExpression]reflect.Type),
+		results:   make(map[*LambdaExpression]reflect.Type),
+		checking:  make(map[*LambdaExpression]bool),
+	}
+	c.check(root)
+	if len(c.errors) > 0 {
+		return c.info, c.errors
+	}
+	return c.info, nil
+}
+
+type typeChecker struct {
+	info      *TypeInfo
+	positions map[Expression]int
+	errors    TypeErrors
+
+	// variables holds the types of local variables and function parameters.
+	variables map[*ParameterExpression]reflect.Type
+	// results holds the result types of the functions checked so far, and
+	// checking the functions whose bodies are being checked.
+	results  map[*LambdaExpression]reflect.Type
+	checking map[*LambdaExpression]bool
+}
+
+func (c *typeChecker) errorf(e Expression, format string, args ...interface{}) {
+	pos, ok := c.positions[e]
+	if !ok {
+		pos = -1
+	}
+	c.errors = append(c.errors, &TypeError{
+		Position: pos,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// check returns the type of a node after checking it and its operands.
+func (c *typeChecker) check(e Expression) reflect.Type {
+	if e == nil {
+		return objectType
+	}
+	typ := c.typeOf(e)
+	if typ == nil {
+		typ = objectType
+	}
+	c.info.Types[e] = typ
+	return typ
+}
+
+func (c *typeChecker) typeOf(e Expression) reflect.Type {
+	switch e := e.(type) {
+	case *ConstantExpression:
+		if e.typ != nil {
+			return e.typ
+		}
+		if e.value == nil {
+			return objectType
+		}
+		return reflect.TypeOf(e.value)
+	case *ParameterExpression:
+		if typ, ok := c.variables[e]; ok {
+			return typ
+		}
+		if e.typ != nil {
+			return e.typ
+		}
+		if e.Kind() == reflect.Func {
+			return closureType
+		}
+		return typeOfKind(e.Kind())
+	case *BinaryExpression:
+		return c.checkBinary(e)
+	case *UnaryExpression:
+		return c.checkUnary(e)
+	case *MemberExpression:
+		return c.checkMember(e)
+	case *RangeExpression:
+		for _, bound := range []Expression{e.start, e.end} {
+			if bound == nil {
+				continue
+			}
+			if typ := c.check(bound); !isDynamic(typ) && !IsInteger(typ.Kind()) && typ != indexType {
+				c.errorf(bound, "range bounds must be integers, got %v", typ)
+			}
+		}
+		return rangeType
+	case *SwitchExpression:
+		c.check(e.subject)
+		var types []reflect.Type
+		for _, arm := range e.arms {
+			types = append(types, c.check(arm.Body))
+		}
+		return commonType(types...)
+	case *IsExpression:
+		c.check(e.operand)
+		return typeOfKind(reflect.Bool)
+	case *ConditionalExpression:
+		c.checkCondition(e.test)
+		return commonType(c.check(e.ifTrue), c.check(e.ifFalse))
+	case *BlockExpression:
+		for _, binding := range e.bindings {
+			c.variables[binding.Variable] = c.check(binding.Value)
+		}
+		return c.check(e.body)
+	case *ProgramExpression:
+		typ := c.checkStatements(e.statements)
+		types := c.returnTypes(e.statements)
+		if last := e.statements[len(e.statements)-1]; last.Type() != ReturnExpr {
+			types = append(types, typ)
+		}
+		return commonType(types...)
+	case *SequenceExpression:
+		return c.checkStatements(e.statements)
+	case *DeclareExpression:
+		typ := c.check(e.value)
+		c.variables[e.variable] = typ
+		return typ
+	case *IfExpression:
+		c.checkCondition(e.test)
+		then := c.check(e.then)
+		if e.otherwise == nil {
+			return objectType
+		}
+		return commonType(then, c.check(e.otherwise))
+	case *ReturnExpression:
+		return c.check(e.value)
+	case *LambdaExpression:
+		c.checkLambda(e)
+		return closureType
+	case *InvokeExpression:
+		return c.checkInvoke(e)
+	case *FieldExpression:
+		return e.typ
+	case *CallExpression:
+		c.checkCall(e)
+		return e.ValueType()
+	case *NullableMemberExpression:
+		c.check(e.operand)
+		if e.defaultValue != nil {
+			if typ := c.check(e.defaultValue); !c.assignable(e.defaultValue, typ, e.typ) {
+				c.errorf(e.defaultValue, "the default of %v can't be a %v", e.operand, typ)
+			}
+		}
+		return e.typ
+	case *ConvertExpression:
+		return c.checkConvert(e)
+	case *HasFlagExpression:
+		c.check(e.operand)
+		c.check(e.flag)
+		return typeOfKind(reflect.Bool)
+	case *SharedExpression:
+		return c.check(e.operand)
+	}
+	c.errorf(e, "unsupported expression %v", e.NodeType())
+	return objectType
+}
+
+func (c *typeChecker) checkStatements(statements []Expression) reflect.Type {
+	typ := objectType
+	for _, statement := range statements {
+		typ = c.check(statement)
+	}
+	return typ
+}
+
+// returnTypes returns the types of the return statements within statements.
+func (c *typeChecker) returnTypes(statements []Expression) []reflect.Type {
+	var types []reflect.Type
+	for _, statement := range statements {
+		switch e := statement.(type) {
+		case *ReturnExpression:
+			types = append(types, c.info.Types[e])
+		case *SequenceExpression:
+			types = append(types, c.returnTypes(e.statements)...)
+		case *IfExpression:
+			types = append(types, c.returnTypes([]Expression{e.then})...)
+			if e.otherwise != nil {
+				types = append(types, c.returnTypes([]Expression{e.otherwise})...)
+			}
+		}
+	}
+	return types
+}
+
+func (c *typeChecker) checkCondition(test Expression) {
+	if typ := c.check(test); !isUnknown(test, typ) && (typ == nil || typ.Kind() != reflect.Bool) {
+		c.errorf(test, "condition must be a bool, got %v", typ)
+	}
+}
+
+func (c *typeChecker) checkBinary(e *BinaryExpression) reflect.Type {
+	left, right := c.check(e.left), c.check(e.right)
+	operator := e.GetOperator()
+	if e.operator != nil {
+		if IsAssignment(e.Type()) {
+			if typ := e.operator.ResultType(); !c.assignable(nil, typ, left) {
+				c.errorf(e, "can't assign %v to %v of type %v", typ, e.left, left)
+			}
+			return left
+		}
+		return e.operator.ResultType()
+	}
+	switch e.Type() {
+	case AddExpr, SubtractExpr, MultiplyExpr, DivideExpr, ModuloExpr:
+		return c.arithmeticType(e, e.left, e.right, left, right)
+	case LessThanExpr, LessThanOrEqualExpr, GreaterThanExpr, GreaterThanOrEqualExpr:
+		left, right := lift(left), lift(right)
+		if !isDynamic(left) && !isDynamic(right) {
+			ordered := (IsArithmetic(left.Kind()) && IsArithmetic(right.Kind())) ||
+				(left.Kind() == reflect.String && right.Kind() == reflect.String)
+			mismatched := mismatchedNamedTypes(left, right) && !isUntyped(e.left) && !isUntyped(e.right)
+			if !ordered || mismatched {
+				c.errorf(e, "can't compare %v %s %v", left, operator, right)
+			}
+		}
+		return typeOfKind(reflect.Bool)
+	case EqualExpr, NotEqualExpr:
+		if !c.comparable(e.left, left, e.right, right) {
+			c.errorf(e, "mismatched types %v and %v in %v", left, right, e)
+		}
+		return typeOfKind(reflect.Bool)
+	case OrExpr:
+		return c.checkOr(e, left, right)
+	case AndAlsoExpr, OrElseExpr:
+		for _, operand := range []Expression{e.left, e.right} {
+			if typ := c.info.Types[operand]; !isUnknown(operand, typ) && (typ == nil || typ.Kind() != reflect.Bool) {
+				c.errorf(operand, "operator %s requires bools, got %v", operator, typ)
+			}
+		}
+		return typeOfKind(reflect.Bool)
+	case InExpr:
+		c.checkIn(e, left, right)
+		return typeOfKind(reflect.Bool)
+	case IndexExpr:
+		return c.checkIndex(e, left, right)
+	case AssignExpr:
+		if !c.assignable(e.right, right, left) {
+			c.errorf(e, "can't assign %v to %v of type %v", right, e.left, left)
+		}
+		return left
+	case AddAssignExpr, SubtractAssignExpr, MultiplyAssignExpr, DivideAssignExpr, ModuloAssignExpr:
+		c.arithmeticType(e, e.left, e.right, left, right)
+		if !c.assignable(e.right, right, left) {
+			c.errorf(e, "can't assign %v to %v of type %v", right, e.left, left)
+		}
+		return left
+	}
+	c.errorf(e, "unsupported expression %v", e.Type())
+	return objectType
+}
+
+// arithmeticType returns the type of an arithmetic operation. Untyped
+// constants take the type of the other operand, and must be representable
+// in it. Other operands of different numeric types are promoted to their
+// common type, like arithmeticKind, unless either has a named type.
+func (c *typeChecker) arithmeticType(e Expression, l Expression, r Expression, left reflect.Type, right reflect.Type) reflect.Type {
+	if isDynamic(left) || isDynamic(right) {
+		return objectType
+	}
+	if isNullable(left) || isNullable(right) {
+		return nullableOf(c.arithmeticType(e, l, r, lift(left), lift(right)))
+	}
+	for _, typ := range []reflect.Type{left, right} {
+		if !IsArithmetic(typ.Kind()) {
+			c.errorf(e, "arithmetic isn't defined for %v in %v", typ, e)
+			return objectType
+		}
+	}
+	switch {
+	case left == right:
+		return left
+	case isConstant(r) && !isConstant(l):
+		c.checkRepresentable(e, r, left)
+		return left
+	case isConstant(l) && !isConstant(r):
+		c.checkRepresentable(e, l, right)
+		return right
+	case isNamed(left) || isNamed(right):
+		c.errorf(e, "mismatched types %v and %v in %v", left, right, e)
+		return objectType
+	}
+	result := typeOfKind(e.Kind())
+	if result == nil {
+		return objectType
+	}
+	if !isFloatKind(result.Kind()) && (isFloatKind(left.Kind()) || isFloatKind(right.Kind())) {
+		c.errorf(e, "mismatched types %v and %v in %v truncate to %v", left, right, e, result)
+	}
+	return result
+}
+
+func (c *typeChecker) checkUnary(e *UnaryExpression) reflect.Type {
+	operand := c.check(e.operand)
+	if e.operator != nil {
+		return e.operator.ResultType()
+	}
+	switch e.Type() {
+	case NotExpr:
+		if !isUnknown(e.operand, operand) && (operand == nil || lift(operand).Kind() != reflect.Bool) {
+			c.errorf(e, "operator ! requires a bool, got %v", operand)
+		}
+		if isNullable(operand) {
+			return operand
+		}
+		return typeOfKind(reflect.Bool)
+	case NegateExpr, UnaryPlusExpr,
+		PreIncrementAssignExpr, PreDecrementAssignExpr, PostIncrementAssignExpr, PostDecrementAssignExpr:
+		if !isDynamic(operand) && !IsArithmetic(lift(operand).Kind()) {
+			c.errorf(e, "arithmetic isn't defined for %v in %v", operand, e)
+			return objectType
+		}
+		return operand
+	case IndexFromEndExpr:
+		if !isDynamic(operand) && !IsInteger(operand.Kind()) {
+			c.errorf(e, "index from end requires an integer, got %v", operand)
+		}
+		return indexType
+	}
+	c.errorf(e, "unsupported expression %v", e.Type())
+	return objectType
+}
+
+func (c *typeChecker) checkMember(e *MemberExpression) reflect.Type {
+	operand := c.check(e.operand)
+	if e.typ != nil {
+		return e.typ
+	}
+	typ := operand
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Struct:
+		field, ok := typ.FieldByName(e.name)
+		if !ok || field.PkgPath != "" {
+			c.errorf(e, "%v has no exported field %s", typ, e.name)
+			return objectType
+		}
+		return field.Type
+	case reflect.Map:
+		if typ.Key().Kind() != reflect.String {
+			c.errorf(e, "%v has no member %s", typ, e.name)
+			return objectType
+		}
+		return typ.Elem()
+	case reflect.Interface:
+		return objectType
+	}
+	c.errorf(e, "%v has no member %s", typ, e.name)
+	return objectType
+}
+
+func (c *typeChecker) checkIn(e *BinaryExpression, value reflect.Type, collection reflect.Type) {
+	switch {
+	case isDynamic(value), isDynamic(collection):
+	case collection == rangeType:
+		if !IsArithmetic(value.Kind()) {
+			c.errorf(e, "range membership requires an arithmetic value, got %v", value)
+		}
+	case collection.Kind() == reflect.String:
+		if value.Kind() != reflect.String {
+			c.errorf(e, "string membership requires a string, got %v", value)
+		}
+	case collection.Kind() == reflect.Slice, collection.Kind() == reflect.Array:
+		if !c.comparable(e.left, value, nil, collection.Elem()) {
+			c.errorf(e, "a value of type %v is never in %v", value, collection)
+		}
+	default:
+		c.errorf(e, "in is not supported for %v", collection)
+	}
+}
+
+func (c *typeChecker) checkIndex(e *BinaryExpression, operand reflect.Type, index reflect.Type) reflect.Type {
+	if !isDynamic(index) && index != rangeType && index != indexType && !IsInteger(index.Kind()) {
+		c.errorf(e.right, "index must be an integer or a range, got %v", index)
+	}
+	if isDynamic(operand) {
+		return objectType
+	}
+	switch operand.Kind() {
+	case reflect.String:
+		return typeOfKind(reflect.String)
+	case reflect.Slice:
+		if index == rangeType {
+			return operand
+		}
+		return operand.Elem()
+	case reflect.Array:
+		if index == rangeType {
+			return reflect.SliceOf(operand.Elem())
+		}
+		return operand.Elem()
+	}
+	c.errorf(e, "can't index a value of type %v", operand)
+	return objectType
+}
+
+func (c *typeChecker) checkLambda(e *LambdaExpression) reflect.Type {
+	if typ, ok := c.results[e]; ok {
+		return typ
+	}
+	for _, parameter := range e.parameters {
+		c.variables[parameter] = c.typeOf(parameter)
+	}
+	c.checking[e] = true
+	typ := c.check(e.body)
+	delete(c.checking, e)
+	c.results[e] = typ
+	return typ
+}
+
+func (c *typeChecker) checkInvoke(e *InvokeExpression) reflect.Type {
+	c.check(e.target)
+	for i, argument := range e.arguments {
+		typ := c.check(argument)
+		parameter := e.lambda.parameters[i]
+		if parameter.typ != nil && !c.assignable(argument, typ, parameter.typ) {
+			c.errorf(argument, "can't pass %v as %s of %s, which is %v", typ, parameter.name, e.lambda.name, parameter.typ)
+		}
+	}
+	if c.checking[e.lambda] {
+		// Recursive calls have the type found by the parser.
+		return typeOfKind(e.Kind())
+	}
+	if typ, ok := c.results[e.lambda]; ok {
+		return typ
+	}
+	// Library functions are checked when they're defined.
+	return typeOfKind(e.Kind())
+}
+
+func (c *typeChecker) checkCall(e *CallExpression) {
+	typ := e.method.method.Type
+	for i, argument := range e.arguments {
+		if parameter := typ.In(i + 1); !c.assignable(argument, c.check(argument), parameter) {
+			c.errorf(argument, "can't pass %v as argument %d of %s, which is %v", c.info.Types[argument], i+1, e.name, parameter)
+		}
+	}
+}
+
+// checkOr checks a bitwise or, which combines integers of the same type or
+// the flags of a flags enum.
+func (c *typeChecker) checkOr(e *BinaryExpression, left reflect.Type, right reflect.Type) reflect.Type {
+	for _, typ := range []reflect.Type{left, right} {
+		if !isDynamic(typ) && !IsInteger(typ.Kind()) {
+			c.errorf(e, "operator | requires integers, got %v", typ)
+			return objectType
+		}
+	}
+	switch {
+	case isDynamic(left) || isDynamic(right):
+		return objectType
+	case isLiteral(e.left) && !isLiteral(e.right):
+		return right
+	case mismatchedNamedTypes(left, right) && !isLiteral(e.right):
+		c.errorf(e, "mismatched types %v and %v in %v", left, right, e)
+	}
+	return left
+}
+
+// checkConvert checks a cast of a value whose type the parser didn't know.
+// Casts of nullable values are nullable.
+func (c *typeChecker) checkConvert(e *ConvertExpression) reflect.Type {
+	operand := c.check(e.operand)
+	from := lift(operand)
+	if e.conversion == nil && !isDynamic(from) && !isBuiltinConversion(from, e.typ) {
+		conversion, err := lookupConversion(from, literalOf(e.operand), e.typ, true)
+		switch {
+		case err != nil:
+			c.errorf(e, "%v", err)
+		case conversion == nil:
+			c.errorf(e, "can't convert %v to %v", from, e.typ)
+		}
+	}
+	if isNullable(operand) {
+		return nullableOf(e.typ)
+	}
+	return e.typ
+}
+
+// implicitlyConvertible determines whether or not a registered implicit
+// conversion converts value, of type from, to type to. Ambiguous
+// conversions are reported.
+func (c *typeChecker) implicitlyConvertible(value Expression, from reflect.Type, to reflect.Type) bool {
+	conversion, err := lookupConversion(from, literalOf(value), to, false)
+	if err != nil {
+		c.errorf(value, "%v", err)
+		return true
+	}
+	return conversion != nil
+}
+
+// assignable determines whether or not value, of type from, can be stored
+// in a location of type to without losing information, or converted to it
+// by a registered implicit conversion.
+func (c *typeChecker) assignable(value Expression, from reflect.Type, to reflect.Type) bool {
+	switch {
+	case isNilConstant(value):
+		return isDynamic(to) || isNillable(to)
+	case isDynamic(from), isDynamic(to), from.AssignableTo(to):
+		return true
+	case isNullable(to):
+		// Values can be stored in nullables, but nullables can only be
+		// stored in other nullables: their values must be taken explicitly.
+		return c.assignable(value, lift(from), lift(to))
+	case isNullable(from):
+		return false
+	case IsArithmetic(from.Kind()) && IsArithmetic(to.Kind()):
+		if isConstant(value) {
+			return representable(value, to)
+		}
+		if isNamed(from) || isNamed(to) {
+			return c.implicitlyConvertible(value, from, to)
+		}
+		return !isFloatKind(from.Kind()) || isFloatKind(to.Kind())
+	}
+	return c.implicitlyConvertible(value, from, to)
+}
+
+// comparable determines whether or not values of two types can be equal.
+// Either expression may be nil.
+func (c *typeChecker) comparable(l Expression, left reflect.Type, r Expression, right reflect.Type) bool {
+	switch {
+	case isNilConstant(l):
+		return isDynamic(right) || isNillable(right)
+	case isNilConstant(r):
+		return isDynamic(left) || isNillable(left)
+	case isDynamic(left), isDynamic(right), left == right:
+		return true
+	case isNullable(left) || isNullable(right):
+		return c.comparable(l, lift(left), r, lift(right))
+	case IsArithmetic(left.Kind()) && IsArithmetic(right.Kind()):
+		return !mismatchedNamedTypes(left, right) || isUntyped(l) || isUntyped(r)
+	}
+	return left.AssignableTo(right) || right.AssignableTo(left)
+}
+
+// commonType returns the type values of all the provided types can be
+// converted to, which is interface{} when they don't share one.
+func commonType(types ...reflect.Type) reflect.Type {
+	if len(types) == 0 {
+		return objectType
+	}
+	var kinds []reflect.Kind
+	var elems []reflect.Type
+	same, nullable := true, false
+	for _, typ := range types {
+		if isDynamic(typ) {
+			return objectType
+		}
+		nullable = nullable || isNullable(typ)
+		elems = append(elems, lift(typ))
+		same = same && typ == types[0]
+		kinds = append(kinds, typ.Kind())
+	}
+	if same {
+		return types[0]
+	}
+	if nullable {
+		return nullableOf(commonType(elems...))
+	}
+	if typ := typeOfKind(commonKind(kinds...)); typ != nil {
+		return typ
+	}
+	return objectType
+}
+
+// checkRepresentable reports an error when an untyped constant can't be
+// converted to the type of the value it's used with.
+func (c *typeChecker) checkRepresentable(e Expression, constant Expression, typ reflect.Type) {
+	value, err := constantValue(constant)
+	if err != nil {
+		c.errorf(e, "constant %v can't be evaluated: %v", constant, err)
+		return
+	}
+	if !representable(constant, typ) {
+		c.errorf(e, "constant %v is truncated to %v in %v", value, typ, e)
+	}
+}
+
+// representable determines whether or not a literal or an untyped constant
+// can be converted to a type without losing information.
+func representable(constant Expression, typ reflect.Type) bool {
+	value, err := constantValue(constant)
+	if err != nil {
+		return false
+	}
+	f, err := convertToFloat64(value)
+	if err != nil {
+		return false
+	}
+	switch {
+	case isFloatKind(typ.Kind()):
+		return true
+	case IsUnsigned(typ.Kind()):
+		return f >= 0 && f == math.Trunc(f)
+	case IsInteger(typ.Kind()):
+		return f == math.Trunc(f)
+	}
+	return false
+}
+
+func isDynamic(typ reflect.Type) bool {
+	return typ == nil || typ.Kind() == reflect.Interface
+}
+
+// isUnknown determines whether or not the type of an expression's value is
+// only known at run time. null has no type, but its value is known: it's
+// never a bool or a number.
+func isUnknown(e Expression, typ reflect.Type) bool {
+	return isDynamic(typ) && !isNilConstant(e)
+}
+
+// isNamed determines whether or not a type is a named type declared in
+// a package, such as type Celsius float64, rather than a basic type.
+func isNamed(typ reflect.Type) bool {
+	return typ.PkgPath() != "" && typ.Name() != ""
+}
+
+func mismatchedNamedTypes(left reflect.Type, right reflect.Type) bool {
+	return left != right && (isNamed(left) || isNamed(right))
+}
+
+func isFloatKind(kind reflect.Kind) bool {
+	return kind == reflect.Float32 || kind == reflect.Float64
+}
+
+func isNilConstant(expr Expression) bool {
+	c, ok := expr.(*ConstantExpression)
+	return ok && c.value == nil && c.typ == nil
+}
+
+func isNillable(typ reflect.Type) bool {
+	if isNullable(typ) {
+		return true
+	}
+	switch typ.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+		return true
+	}
+	return false
+}
+
+func isNullable(typ reflect.Type) bool {
+	_, ok := nullableType(typ)
+	return ok
+}
+
+// lift returns the underlying type of a nullable type, or the type itself.
+func lift(typ reflect.Type) reflect.Type {
+	if elem, ok := nullableType(typ); ok {
+		return elem
+	}
+	return typ
+}
+
+// nullableOf returns the nullable type of the results of lifted operators,
+// which is a pointer to the underlying type.
+func nullableOf(typ reflect.Type) reflect.Type {
+	if isDynamic(typ) || isNullable(typ) {
+		return typ
+	}
+	return reflect.PtrTo(typ)
+}
@@ -0,0 +1,186 @@
+package expr
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type celsius float64
+type fahrenheit float64
+
+func TestCheckTypes(t *testing.T) {
+	parameters := map[string]interface{}{
+		"indoor":  celsius(21),
+		"outdoor": celsius(5),
+		"oven":    fahrenheit(350),
+		"qty":     3,
+		"price":   2.5,
+		"name":    "widget",
+		"items":   []string{"a", "b"},
+	}
+	for _, test := range []struct {
+		expression string
+		expected   reflect.Type
+	}{
+		{"indoor - outdoor", reflect.TypeOf(celsius(0))},
+		{"indoor + 1.5", reflect.TypeOf(celsius(0))},
+		{"2 * oven", reflect.TypeOf(fahrenheit(0))},
+		{"indoor > outdoor", reflect.TypeOf(false)},
+		{"price * qty", reflect.TypeOf(0.0)},
+		{"qty * price", reflect.TypeOf(0.0)},
+		{"2 * 60 * 60 * price", reflect.TypeOf(0.0)},
+		{"(1 + 1) * oven", reflect.TypeOf(fahrenheit(0))},
+		{"qty + 1", reflect.TypeOf(0)},
+		{"items[0]", reflect.TypeOf("")},
+		{"items[0..1]", reflect.TypeOf([]string{})},
+		{"name == 'widget' ? indoor : outdoor", reflect.TypeOf(celsius(0))},
+		{"let x = indoor in x - 1", reflect.TypeOf(celsius(0))},
+	} {
+		parser, err := NewExpressionParser(test.expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		expression, info, err := parser.Check()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if actual := info.TypeOf(expression); actual != test.expected {
+			t.Fatalf("%s: expected %v but got %v", test.expression, test.expected, actual)
+		}
+	}
+}
+
+func TestTypeErrors(t *testing.T) {
+	parameters := map[string]interface{}{
+		"indoor": celsius(21),
+		"oven":   fahrenheit(350),
+		"qty":    3,
+		"price":  2.5,
+		"name":   "widget",
+	}
+	for _, test := range []struct {
+		expression string
+		expected   []string
+	}{
+		{"indoor + oven", []string{"position 0: mismatched types expr.celsius and expr.fahrenheit"}},
+		{"indoor < oven", []string{"position 0: can't compare"}},
+		{"qty + 1.5", []string{"position 0: constant 1.5 is truncated to int"}},
+		{"qty * (1 + 0.5)", []string{"position 0: constant 1.5 is truncated to int"}},
+		{"name - 1", []string{"position 0: arithmetic isn't defined for string"}},
+		{"1 + (indoor + oven) * 2 - (name - 1)", []string{
+			"position 5: mismatched types",
+			"position 27: arithmetic isn't defined for string",
+		}},
+		{"indoor == oven", []string{"position 0: mismatched types"}},
+		{"(price + 1) ? 1 : 2", []string{"the condition of ?: must be a bool"}},
+		{"null ? 1 : 2", []string{"position 0: condition must be a bool"}},
+		{"!null", []string{"position 0: operator ! requires a bool"}},
+		{"null && name == 'widget'", []string{"position 0: operator && requires bools"}},
+		{"qty == null", []string{"position 0: mismatched types int and interface {}"}},
+	} {
+		parser, err := NewExpressionParser(test.expression, parameters)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		_, err = parser.Evaluate(nil)
+		if err == nil {
+			t.Fatalf("%s: expected an error", test.expression)
+		}
+		var messages []string
+		if errs, ok := err.(TypeErrors); ok {
+			for _, e := range errs {
+				messages = append(messages, e.Error())
+			}
+		} else {
+			messages = []string{err.Error()}
+		}
+		if len(messages) != len(test.expected) {
+			t.Fatalf("%s: expected %d errors but got %v", test.expression, len(test.expected), messages)
+		}
+		for i, expected := range test.expected {
+			if !strings.Contains(messages[i], expected) {
+				t.Fatalf("%s: expected an error containing %q but got %q", test.expression, expected, messages[i])
+			}
+		}
+	}
+}
+
+func TestEvaluateKeepsNamedTypes(t *testing.T) {
+	parser, err := NewExpressionParser("indoor + 1.5", map[string]interface{}{"indoor": celsius(20)})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	actual, err := parser.Evaluate(nil)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if actual != celsius(21.5) {
+		t.Fatalf("expected celsius(21.5) but got %v (%T)", actual, actual)
+	}
+}
+
+func TestArithmeticTypes(t *testing.T) {
+	schema := Schema{
+		"qty":   reflect.TypeOf(0),
+		"count": reflect.TypeOf(int64(0)),
+		"small": reflect.TypeOf(int8(0)),
+		"units": reflect.TypeOf(uint(0)),
+		"price": reflect.TypeOf(float64(0)),
+	}
+	parameters := map[string]interface{}{
+		"qty":   -1,
+		"count": int64(1000),
+		"small": int8(2),
+		"units": uint(3),
+		"price": 1.5,
+	}
+	for _, test := range []struct {
+		expression string
+		expected   interface{}
+	}{
+		{"2 * 3 * qty", -6},
+		{"(1 + 1) * qty < 0", true},
+		{"-(2 * 3) + qty", -7},
+		{"2 * 3 * count", int64(6000)},
+		{"small * count", int64(2000)},
+		{"units + -5 * -qty", int64(-2)},
+		{"units - 5", uint(18446744073709551614)},
+		{"2 * 60 * 60 * price", 10800.0},
+		{"qty * price", -1.5},
+		{"qty + count", int64(999)},
+	} {
+		parser, err := NewExpressionParserWithSchema(test.expression, schema)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		expression, info, err := parser.Check()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if actual, expected := info.TypeOf(expression), reflect.TypeOf(test.expected); actual != expected {
+			t.Fatalf("%s: expected the type %v but got %v", test.expression, expected, actual)
+		}
+		actual, err := parser.Evaluate(parameters)
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if actual != test.expected {
+			t.Fatalf("%s: expected %v (%T) but got %v (%T)", test.expression, test.expected, test.expected, actual, actual)
+		}
+		program, err := parser.Compile()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if actual, err := program.Evaluate(parameters); err != nil || actual != test.expected {
+			t.Fatalf("%s: expected the program to return %v (%T) but got %v (%T), %v", test.expression, test.expected, test.expected, actual, actual, err)
+		}
+		bytecode, err := parser.CompileBytecode()
+		if err != nil {
+			t.Fatalf("%s: unexpected err: %v", test.expression, err)
+		}
+		if actual, err := bytecode.Evaluate(parameters); err != nil || actual != test.expected {
+			t.Fatalf("%s: expected the bytecode to return %v (%T) but got %v (%T), %v", test.expression, test.expected, test.expected, actual, actual, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package expr
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var objectType = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// typeNames maps the type names usable in type patterns to their Go types.
+// Both Go names and their C# equivalents are accepted.
+var typeNames = map[string]reflect.Type{
+	"bool":    reflect.TypeOf(false),
+	"string":  reflect.TypeOf(""),
+	"int":     reflect.TypeOf(int(0)),
+	"int8":    reflect.TypeOf(int8(0)),
+	"int16":   reflect.TypeOf(int16(0)),
+	"int32":   reflect.TypeOf(int32(0)),
+	"int64":   reflect.TypeOf(int64(0)),
+	"uint":    reflect.TypeOf(uint(0)),
+	"uint8":   reflect.TypeOf(uint8(0)),
+	"uint16":  reflect.TypeOf(uint16(0)),
+	"uint32":  reflect.TypeOf(uint32(0)),
+	"uint64":  reflect.TypeOf(uint64(0)),
+	"float32": reflect.TypeOf(float32(0)),
+	"float64": reflect.TypeOf(float64(0)),
+	"object":  objectType,
+
+	// C# aliases
+	"sbyte":  reflect.TypeOf(int8(0)),
+	"byte":   reflect.TypeOf(uint8(0)),
+	"short":  reflect.TypeOf(int16(0)),
+	"ushort": reflect.TypeOf(uint16(0)),
+	"long":   reflect.TypeOf(int64(0)),
+	"ulong":  reflect.TypeOf(uint64(0)),
+	"float":  reflect.TypeOf(float32(0)),
+	"double": reflect.TypeOf(float64(0)),
+}
+
+// LookupTypeName returns the type with the provided name, which is either
+// a basic type or a type registered with RegisterTypeName.
+func LookupTypeName(name string) (reflect.Type, bool) {
+	name = strings.ToLower(name)
+	if typ, ok := typeNames[name]; ok {
+		return typ, true
+	}
+	typeNamesMu.RLock()
+	defer typeNamesMu.RUnlock()
+	typ, ok := registeredTypes[name]
+	return typ, ok
+}
+
+// typeOfKind returns the canonical type for a basic kind, or nil if the
+// kind has no canonical type.
+func typeOfKind(kind reflect.Kind) reflect.Type {
+	switch kind {
+	case reflect.Bool:
+		return typeNames["bool"]
+	case reflect.String:
+		return typeNames["string"]
+	case reflect.Int:
+		return typeNames["int"]
+	case reflect.Int8:
+		return typeNames["int8"]
+	case reflect.Int16:
+		return typeNames["int16"]
+	case reflect.Int32:
+		return typeNames["int32"]
+	case reflect.Int64:
+		return typeNames["int64"]
+	case reflect.Uint:
+		return typeNames["uint"]
+	case reflect.Uint8:
+		return typeNames["uint8"]
+	case reflect.Uint16:
+		return typeNames["uint16"]
+	case reflect.Uint32:
+		return typeNames["uint32"]
+	case reflect.Uint64:
+		return typeNames["uint64"]
+	case reflect.Float32:
+		return typeNames["float32"]
+	case reflect.Float64:
+		return typeNames["float64"]
+	case reflect.Interface:
+		return objectType
+	}
+	return nil
+}
+
+// convertToKind converts an arithmetic value to the provided arithmetic kind.
+// Values of any other kind are returned unchanged.
+func convertToKind(val interface{}, kind reflect.Kind) (interface{}, error) {
+	typ := typeOfKind(kind)
+	if val == nil || typ == nil || !IsArithmetic(kind) {
+		return val, nil
+	}
+	v := reflect.ValueOf(val)
+	if v.Kind() == kind {
+		return val, nil
+	}
+	if !IsArithmetic(v.Kind()) {
+		return nil, fmt.Errorf("unable to convert %v to %v", val, kind)
+	}
+	return v.Convert(typ).Interface(), nil
+}
+
+// commonKind returns the kind that values of all the provided kinds can be
+// converted to. Mixed arithmetic kinds widen to int64 or float64.
+func commonKind(kinds ...reflect.Kind) reflect.Kind {
+	if len(kinds) == 0 {
+		return reflect.Interface
+	}
+	common := kinds[0]
+	for _, kind := range kinds[1:] {
+		switch {
+		case kind == common:
+		case IsArithmetic(kind) && IsArithmetic(common):
+			if kind == reflect.Float32 || kind == reflect.Float64 ||
+				common == reflect.Float32 || common == reflect.Float64 {
+				common = reflect.Float64
+			} else {
+				common = reflect.Int64
+			}
+		default:
+			return reflect.Interface
+		}
+	}
+	return common
+}
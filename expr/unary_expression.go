@@ -13,6 +13,10 @@ var (
 type UnaryExpression struct {
 	self    *AbstractExpression
 	operand Expression
+	// operator is the user-defined implementation of the operator, if any.
+	operator *Operator
+	// constant is set for a builtin sign applied to an untyped constant.
+	constant bool
 }
 
 func NewUnaryExpression(operand Expression, nodeType ExpressionType, kind reflect.Kind) *UnaryExpression {
@@ -21,10 +25,17 @@ func NewUnaryExpression(operand Expression, nodeType ExpressionType, kind reflec
 			nodeType: nodeType,
 			kind:     kind,
 		},
-		operand: operand,
+		operand:  operand,
+		constant: (nodeType == NegateExpr || nodeType == UnaryPlusExpr) && isConstant(operand),
 	}
 }
 
+// Operator returns the user-defined implementation of the operator, or nil
+// if it's built in.
+func (e *UnaryExpression) Operator() *Operator {
+	return e.operator
+}
+
 func (e *UnaryExpression) Kind() reflect.Kind {
 	return e.self.kind
 }
@@ -48,6 +59,16 @@ func (e *UnaryExpression) String() string {
 		return fmt.Sprintf("-%v", e.operand)
 	case UnaryPlusExpr:
 		return fmt.Sprintf("+%v", e.operand)
+	case IndexFromEndExpr:
+		return fmt.Sprintf("^%v", e.operand)
+	case PreIncrementAssignExpr:
+		return fmt.Sprintf("++%v", e.operand)
+	case PreDecrementAssignExpr:
+		return fmt.Sprintf("--%v", e.operand)
+	case PostIncrementAssignExpr:
+		return fmt.Sprintf("%v++", e.operand)
+	case PostDecrementAssignExpr:
+		return fmt.Sprintf("%v--", e.operand)
 	default:
 		return fmt.Sprintf("unary(%v)", e.operand)
 	}
@@ -63,14 +84,23 @@ func CreateUnaryPlus(expr Expression) (Expression, error) {
 	return nil, errors.New("unary plus not supported for non-arithmetic values")
 }
 
+// CreateUnaryNegate creates -expr. Unsigned values can't be negated, except
+// for literals, which are negated as int64s.
 func CreateUnaryNegate(expr Expression) (Expression, error) {
 	if expr == nil {
 		return nil, errInvalidExpression
 	}
-	if IsArithmetic(expr.Kind()) && IsUnsigned(expr.Kind()) {
+	if o := findOperator(NegateExpr, expr); o != nil {
+		e := NewUnaryExpression(expr, NegateExpr, valueKind(o.ResultType()))
+		e.operator, e.constant = o, false
+		return e, nil
+	}
+	switch {
+	case expr.Kind() == reflect.Interface, IsArithmetic(expr.Kind()) && !IsUnsigned(expr.Kind()):
 		return NewUnaryExpression(expr, NegateExpr, expr.Kind()), nil
+	case IsUnsigned(expr.Kind()) && isLiteral(expr):
+		return NewUnaryExpression(expr, NegateExpr, reflect.Int64), nil
 	}
-	// TODO: get user defined operator or throw
 	return nil, errors.New("unary negate not supported for non-arithmetic or unsigned values")
 }
 
@@ -3,7 +3,13 @@ package expr
 import (
 	"errors"
 	"fmt"
-	"log"
+	"math"
+	"reflect"
+	"strings"
+)
+
+var (
+	errDivideByZero = errors.New("division by zero")
 )
 
 type Visitor interface {
@@ -11,37 +17,102 @@ type Visitor interface {
 }
 
 func CreateVisitorFromExpression(node Expression) (Visitor, error) {
+	return CreateVisitorWithScope(node, nil)
+}
+
+// CreateVisitorWithScope creates a visitor which resolves parameters and
+// local variables from the provided scope.
+func CreateVisitorWithScope(node Expression, scope *Scope) (Visitor, error) {
 	switch node.Type() {
 	case UnknownExpr:
 		return nil, errors.New("unable to create visitor for unknown expression")
 	case ConstantExpr:
-		return NewConstantVisitor(node.(*ConstantExpression)), nil
+		return NewConstantVisitor(node.(*ConstantExpression), scope), nil
 	case ParameterExpr:
-		return NewParameterVisitor(node.(*ParameterExpression)), nil
+		return NewParameterVisitor(node.(*ParameterExpression), scope), nil
+	case RangeExpr:
+		return NewRangeVisitor(node.(*RangeExpression), scope), nil
+	case SwitchExpr:
+		return NewSwitchVisitor(node.(*SwitchExpression), scope), nil
+	case BlockExpr:
+		return NewBlockVisitor(node.(*BlockExpression), scope), nil
+	case MemberExpr:
+		return NewMemberVisitor(node.(*MemberExpression), scope), nil
+	case IsExpr:
+		return NewIsVisitor(node.(*IsExpression), scope), nil
+	case ConditionalExpr:
+		return NewConditionalVisitor(node.(*ConditionalExpression), scope), nil
+	case LambdaExpr:
+		return NewLambdaVisitor(node.(*LambdaExpression), scope), nil
+	case InvokeExpr:
+		return NewInvokeVisitor(node.(*InvokeExpression), scope), nil
+	case ProgramExpr:
+		return NewProgramVisitor(node.(*ProgramExpression), scope), nil
+	case SequenceExpr:
+		return NewSequenceVisitor(node.(*SequenceExpression), scope), nil
+	case DeclareExpr:
+		return NewDeclareVisitor(node.(*DeclareExpression), scope), nil
+	case IfExpr:
+		return NewIfVisitor(node.(*IfExpression), scope), nil
+	case ReturnExpr:
+		return NewReturnVisitor(node.(*ReturnExpression), scope), nil
+	case FieldExpr:
+		return NewFieldVisitor(node.(*FieldExpression), scope), nil
+	case CallExpr:
+		return NewCallVisitor(node.(*CallExpression), scope), nil
+	case NullableMemberExpr:
+		return NewNullableMemberVisitor(node.(*NullableMemberExpression), scope), nil
+	case ConvertExpr:
+		return NewConvertVisitor(node.(*ConvertExpression), scope), nil
+	case HasFlagExpr:
+		return NewHasFlagVisitor(node.(*HasFlagExpression), scope), nil
+	case SharedExpr:
+		return NewSharedVisitor(node.(*SharedExpression), scope), nil
 	case NegateExpr:
 		fallthrough
 	case UnaryPlusExpr:
 		fallthrough
+	case IndexFromEndExpr:
+		fallthrough
+	case PreIncrementAssignExpr, PreDecrementAssignExpr, PostIncrementAssignExpr, PostDecrementAssignExpr:
+		fallthrough
 	case NotExpr:
-		return NewUnaryVisitor(node.(*UnaryExpression)), nil
+		return NewUnaryVisitor(node.(*UnaryExpression), scope), nil
 	default:
-		return NewBinaryVisitor(node.(*BinaryExpression)), nil
+		return NewBinaryVisitor(node.(*BinaryExpression), scope), nil
+	}
+}
+
+// visitExpression creates a visitor for node and visits it.
+func visitExpression(node Expression, scope *Scope) (interface{}, error) {
+	visitor, err := CreateVisitorWithScope(node, scope)
+	if err != nil {
+		return nil, err
 	}
+	return visitor.Visit()
 }
 
 type BinaryVisitor struct {
-	root *BinaryExpression
+	root  *BinaryExpression
+	scope *Scope
 }
 
-func NewBinaryVisitor(root *BinaryExpression) *BinaryVisitor {
+func NewBinaryVisitor(root *BinaryExpression, scope *Scope) *BinaryVisitor {
 	return &BinaryVisitor{
-		root: root,
+		root:  root,
+		scope: scope,
 	}
 }
 
 func (v *BinaryVisitor) Visit() (interface{}, error) {
+	if IsAssignment(v.root.Type()) {
+		return v.visitAssignment()
+	}
+	if v.root.Type() == AndAlsoExpr || v.root.Type() == OrElseExpr {
+		return v.visitLogical()
+	}
 	var left Visitor
-	left, err := CreateVisitorFromExpression(v.root.left)
+	left, err := CreateVisitorWithScope(v.root.left, v.scope)
 	if err != nil {
 		return nil, err
 	}
@@ -50,7 +121,7 @@ func (v *BinaryVisitor) Visit() (interface{}, error) {
 		return nil, lErr
 	}
 	var right Visitor
-	right, err = CreateVisitorFromExpression(v.root.right)
+	right, err = CreateVisitorWithScope(v.root.right, v.scope)
 	if err != nil {
 		return nil, err
 	}
@@ -58,71 +129,170 @@ func (v *BinaryVisitor) Visit() (interface{}, error) {
 	if rErr != nil {
 		return nil, rErr
 	}
-	log.Println(v.root.String())
+	return evaluateBinary(v.root, lVal, rVal)
+}
 
-	switch v.root.Type() {
+// evaluateBinary applies a binary operator other than an assignment, && or
+// || to the values of its operands.
+func evaluateBinary(e *BinaryExpression, lVal interface{}, rVal interface{}) (interface{}, error) {
+	if e.operator != nil {
+		return e.operator.call(lVal, rVal)
+	}
+	return applyBinary(e.Type(), e.Kind(), lVal, rVal)
+}
+
+// applyBinary applies a built-in binary operator, producing a value of the
+// provided kind where it's arithmetic.
+func applyBinary(nodeType ExpressionType, kind reflect.Kind, lVal interface{}, rVal interface{}) (interface{}, error) {
+	switch nodeType {
 	case AddExpr:
-		lInt, rInt, err := convertExpressionToInt(lVal, rVal)
-		if err != nil {
-			return nil, err
-		}
-		return lInt + rInt, nil
+		return evaluateArithmetic(nodeType, lVal, rVal, kind)
 	case AddCheckedExpr:
 		return nil, errors.New("unimplemented")
-	case AndAlsoExpr:
-		return nil, errors.New("unimplemented")
 	case DivideExpr:
-		lInt, rInt, err := convertExpressionToInt(lVal, rVal)
-		if err != nil {
-			return nil, err
-		}
-		return lInt / rInt, nil
+		return evaluateArithmetic(nodeType, lVal, rVal, kind)
 	case EqualExpr:
-		return true, errors.New("unimplemented")
+		return valuesEqual(lVal, rVal), nil
 	case ExclusiveOrExpr:
 		return nil, errors.New("unimplemented")
-	case GreaterThanExpr:
-		return true, errors.New("unimplemented")
-	case GreaterThanOrEqualExpr:
-		return true, errors.New("unimplemented")
-	case LessThanExpr:
-		return true, errors.New("unimplemented")
-	case LessThanOrEqualExpr:
-		return true, errors.New("unimplemented")
-	case MultiplyExpr:
-		lInt, rInt, err := convertExpressionToInt(lVal, rVal)
+	case GreaterThanExpr, GreaterThanOrEqualExpr, LessThanExpr, LessThanOrEqualExpr:
+		return evaluateComparison(nodeType, lVal, rVal)
+	case IndexExpr:
+		val, err := evaluateIndex(lVal, rVal)
 		if err != nil {
 			return nil, err
 		}
-		return lInt * rInt, nil
+		return normalizeValue(val), nil
+	case InExpr:
+		return evaluateIn(lVal, rVal)
+	case MultiplyExpr:
+		return evaluateArithmetic(nodeType, lVal, rVal, kind)
+	case NotEqualExpr:
+		return !valuesEqual(lVal, rVal), nil
+	case ModuloExpr:
+		return evaluateArithmetic(nodeType, lVal, rVal, kind)
 	case MultiplyCheckedExpr:
 		return nil, errors.New("unimplemented")
 	case OrExpr:
-		return true, errors.New("unimplemented")
-	case OrElseExpr:
-		return true, errors.New("unimplemented")
+		return evaluateOr(lVal, rVal, kind)
 	case PowerExpr:
 		return nil, errors.New("unimplemented")
 	case SubtractExpr:
-		lInt, rInt, err := convertExpressionToInt(lVal, rVal)
+		return evaluateArithmetic(nodeType, lVal, rVal, kind)
+	case SubtractCheckedExpr:
+		return nil, errors.New("unimplemented")
+	}
+
+	return nil, fmt.Errorf("unknown expression type: %v", nodeType)
+}
+
+// visitLogical evaluates && and ||, only evaluating the right operand when
+// the left one doesn't decide the result.
+func (v *BinaryVisitor) visitLogical() (interface{}, error) {
+	left, err := visitBool(v.root.left, v.scope)
+	if err != nil {
+		return nil, err
+	}
+	if left == (v.root.Type() == OrElseExpr) {
+		return left, nil
+	}
+	return visitBool(v.root.right, v.scope)
+}
+
+// visitAssignment evaluates the value and stores it in the left operand.
+// Compound assignments first combine it with the left operand's value.
+func (v *BinaryVisitor) visitAssignment() (interface{}, error) {
+	value, err := visitExpression(v.root.right, v.scope)
+	if err != nil {
+		return nil, err
+	}
+	if operator, ok := compoundAssignments[v.root.Type()]; ok {
+		current, err := visitExpression(v.root.left, v.scope)
+		if err != nil {
+			return nil, err
+		}
+		if v.root.operator != nil {
+			value, err = v.root.operator.call(current, value)
+		} else {
+			value, err = evaluateArithmetic(operator, current, value, v.root.Kind())
+		}
 		if err != nil {
 			return nil, err
 		}
-		return lInt - rInt, nil
-	case SubtractCheckedExpr:
-		return nil, errors.New("unimplemented")
 	}
+	return assignTo(v.root.left, value, v.scope)
+}
 
-	return nil, fmt.Errorf("unknown expression type: %v", v.root.Type())
+type BlockVisitor struct {
+	root  *BlockExpression
+	scope *Scope
+}
+
+func NewBlockVisitor(root *BlockExpression, scope *Scope) *BlockVisitor {
+	return &BlockVisitor{
+		root:  root,
+		scope: scope,
+	}
+}
+
+// Visit evaluates each binding once, in order, and then the body.
+func (v *BlockVisitor) Visit() (interface{}, error) {
+	scope := NewScope(v.scope)
+	for _, binding := range v.root.bindings {
+		value, err := CreateVisitorWithScope(binding.Value, scope)
+		if err != nil {
+			return nil, err
+		}
+		val, err := value.Visit()
+		if err != nil {
+			return nil, err
+		}
+		scope.Define(binding.Variable.name, val)
+	}
+	body, err := CreateVisitorWithScope(v.root.body, scope)
+	if err != nil {
+		return nil, err
+	}
+	return body.Visit()
+}
+
+type ConditionalVisitor struct {
+	root  *ConditionalExpression
+	scope *Scope
+}
+
+func NewConditionalVisitor(root *ConditionalExpression, scope *Scope) *ConditionalVisitor {
+	return &ConditionalVisitor{
+		root:  root,
+		scope: scope,
+	}
+}
+
+func (v *ConditionalVisitor) Visit() (interface{}, error) {
+	test, err := visitBool(v.root.test, v.scope)
+	if err != nil {
+		return nil, err
+	}
+	branch := v.root.ifFalse
+	if test {
+		branch = v.root.ifTrue
+	}
+	val, err := visitExpression(branch, v.scope)
+	if err != nil {
+		return nil, err
+	}
+	return convertToKind(val, v.root.Kind())
 }
 
 type ConstantVisitor struct {
-	root *ConstantExpression
+	root  *ConstantExpression
+	scope *Scope
 }
 
-func NewConstantVisitor(root *ConstantExpression) *ConstantVisitor {
+func NewConstantVisitor(root *ConstantExpression, scope *Scope) *ConstantVisitor {
 	return &ConstantVisitor{
-		root: root,
+		root:  root,
+		scope: scope,
 	}
 }
 
@@ -130,41 +300,595 @@ func (v *ConstantVisitor) Visit() (interface{}, error) {
 	return v.root.value, nil
 }
 
+type DeclareVisitor struct {
+	root  *DeclareExpression
+	scope *Scope
+}
+
+func NewDeclareVisitor(root *DeclareExpression, scope *Scope) *DeclareVisitor {
+	return &DeclareVisitor{
+		root:  root,
+		scope: scope,
+	}
+}
+
+// Visit defines the variable in the enclosing scope.
+func (v *DeclareVisitor) Visit() (interface{}, error) {
+	val, err := visitExpression(v.root.value, v.scope)
+	if err != nil {
+		return nil, err
+	}
+	v.scope.Define(v.root.variable.name, val)
+	return val, nil
+}
+
+type IfVisitor struct {
+	root  *IfExpression
+	scope *Scope
+}
+
+func NewIfVisitor(root *IfExpression, scope *Scope) *IfVisitor {
+	return &IfVisitor{
+		root:  root,
+		scope: scope,
+	}
+}
+
+func (v *IfVisitor) Visit() (interface{}, error) {
+	test, err := visitBool(v.root.test, v.scope)
+	if err != nil {
+		return nil, err
+	}
+	if test {
+		return visitExpression(v.root.then, v.scope)
+	}
+	if v.root.otherwise == nil {
+		return nil, nil
+	}
+	return visitExpression(v.root.otherwise, v.scope)
+}
+
+type InvokeVisitor struct {
+	root  *InvokeExpression
+	scope *Scope
+}
+
+func NewInvokeVisitor(root *InvokeExpression, scope *Scope) *InvokeVisitor {
+	return &InvokeVisitor{
+		root:  root,
+		scope: scope,
+	}
+}
+
+// Visit evaluates the arguments in order and then calls the function.
+func (v *InvokeVisitor) Visit() (interface{}, error) {
+	target, err := visitExpression(v.root.target, v.scope)
+	if err != nil {
+		return nil, err
+	}
+	closure, ok := target.(*Closure)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a function", v.root.target)
+	}
+	args := make([]interface{}, len(v.root.arguments))
+	for i, argument := range v.root.arguments {
+		if args[i], err = visitExpression(argument, v.scope); err != nil {
+			return nil, err
+		}
+	}
+	result, err := closure.call(args, v.scope.callDepth())
+	if err != nil {
+		return nil, err
+	}
+	return convertToKind(result, v.root.Kind())
+}
+
+type FieldVisitor struct {
+	root  *FieldExpression
+	scope *Scope
+}
+
+func NewFieldVisitor(root *FieldExpression, scope *Scope) *FieldVisitor {
+	return &FieldVisitor{
+		root:  root,
+		scope: scope,
+	}
+}
+
+func (v *FieldVisitor) Visit() (interface{}, error) {
+	field, err := evaluateField(v.root, v.scope)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapNullable(normalizeValue(field.Interface())), nil
+}
+
+type CallVisitor struct {
+	root  *CallExpression
+	scope *Scope
+}
+
+func NewCallVisitor(root *CallExpression, scope *Scope) *CallVisitor {
+	return &CallVisitor{
+		root:  root,
+		scope: scope,
+	}
+}
+
+// Visit evaluates the arguments in order and then calls the method.
+func (v *CallVisitor) Visit() (interface{}, error) {
+	args := make([]interface{}, len(v.root.arguments))
+	for i, argument := range v.root.arguments {
+		var err error
+		if args[i], err = visitExpression(argument, v.scope); err != nil {
+			return nil, err
+		}
+	}
+	return evaluateCall(v.root, v.scope, args)
+}
+
+type NullableMemberVisitor struct {
+	root  *NullableMemberExpression
+	scope *Scope
+}
+
+func NewNullableMemberVisitor(root *NullableMemberExpression, scope *Scope) *NullableMemberVisitor {
+	return &NullableMemberVisitor{
+		root:  root,
+		scope: scope,
+	}
+}
+
+func (v *NullableMemberVisitor) Visit() (interface{}, error) {
+	val, err := visitExpression(v.root.operand, v.scope)
+	if err != nil {
+		return nil, err
+	}
+	return evaluateNullableMember(v.root, val, v.scope)
+}
+
+type ConvertVisitor struct {
+	root  *ConvertExpression
+	scope *Scope
+}
+
+func NewConvertVisitor(root *ConvertExpression, scope *Scope) *ConvertVisitor {
+	return &ConvertVisitor{
+		root:  root,
+		scope: scope,
+	}
+}
+
+func (v *ConvertVisitor) Visit() (interface{}, error) {
+	val, err := visitExpression(v.root.operand, v.scope)
+	if err != nil {
+		return nil, err
+	}
+	return evaluateConvert(v.root, val)
+}
+
+type HasFlagVisitor struct {
+	root  *HasFlagExpression
+	scope *Scope
+}
+
+func NewHasFlagVisitor(root *HasFlagExpression, scope *Scope) *HasFlagVisitor {
+	return &HasFlagVisitor{
+		root:  root,
+		scope: scope,
+	}
+}
+
+func (v *HasFlagVisitor) Visit() (interface{}, error) {
+	val, err := visitExpression(v.root.operand, v.scope)
+	if err != nil {
+		return nil, err
+	}
+	flag, err := visitExpression(v.root.flag, v.scope)
+	if err != nil {
+		return nil, err
+	}
+	return evaluateHasFlag(val, flag)
+}
+
+type SharedVisitor struct {
+	root  *SharedExpression
+	scope *Scope
+}
+
+func NewSharedVisitor(root *SharedExpression, scope *Scope) *SharedVisitor {
+	return &SharedVisitor{
+		root:  root,
+		scope: scope,
+	}
+}
+
+// Visit evaluates the operand the first time the node is visited, and
+// returns the stored value afterwards.
+func (v *SharedVisitor) Visit() (interface{}, error) {
+	shared := v.scope.sharedValues()
+	if val, ok := shared.get(v.root.slot); ok {
+		return val, nil
+	}
+	val, err := visitExpression(v.root.operand, v.scope)
+	if err != nil {
+		return nil, err
+	}
+	shared.set(v.root.slot, val)
+	return val, nil
+}
+
+type IsVisitor struct {
+	root  *IsExpression
+	scope *Scope
+}
+
+func NewIsVisitor(root *IsExpression, scope *Scope) *IsVisitor {
+	return &IsVisitor{
+		root:  root,
+		scope: scope,
+	}
+}
+
+func (v *IsVisitor) Visit() (interface{}, error) {
+	operand, err := CreateVisitorWithScope(v.root.operand, v.scope)
+	if err != nil {
+		return nil, err
+	}
+	val, err := operand.Visit()
+	if err != nil {
+		return nil, err
+	}
+	return v.root.pattern.Matches(val)
+}
+
+type LambdaVisitor struct {
+	root  *LambdaExpression
+	scope *Scope
+}
+
+func NewLambdaVisitor(root *LambdaExpression, scope *Scope) *LambdaVisitor {
+	return &LambdaVisitor{
+		root:  root,
+		scope: scope,
+	}
+}
+
+// Visit creates a closure over the current scope.
+func (v *LambdaVisitor) Visit() (interface{}, error) {
+	return &Closure{
+		lambda: v.root,
+		scope:  v.scope,
+	}, nil
+}
+
+type MemberVisitor struct {
+	root  *MemberExpression
+	scope *Scope
+}
+
+func NewMemberVisitor(root *MemberExpression, scope *Scope) *MemberVisitor {
+	return &MemberVisitor{
+		root:  root,
+		scope: scope,
+	}
+}
+
+func (v *MemberVisitor) Visit() (interface{}, error) {
+	operand, err := visitExpression(v.root.operand, v.scope)
+	if err != nil {
+		return nil, err
+	}
+	val, err := evaluateMember(operand, v.root.name)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapNullable(normalizeValue(val)), nil
+}
+
 type ParameterVisitor struct {
-	root *ParameterExpression
+	root  *ParameterExpression
+	scope *Scope
 }
 
-func NewParameterVisitor(root *ParameterExpression) *ParameterVisitor {
+func NewParameterVisitor(root *ParameterExpression, scope *Scope) *ParameterVisitor {
 	return &ParameterVisitor{
-		root: root,
+		root:  root,
+		scope: scope,
 	}
 }
 
+// Visit returns the parameter's value, converted to its type when that's
+// known. Nullable values evaluate to the value they hold, or nil.
 func (v *ParameterVisitor) Visit() (interface{}, error) {
-	return false, nil
+	val, ok := v.scope.Lookup(v.root.name)
+	if !ok {
+		return nil, fmt.Errorf("unbound parameter: %s", v.root.name)
+	}
+	return evaluateParameter(v.root, val)
+}
+
+// evaluateParameter normalises the value bound to a parameter and converts
+// it to the parameter's type.
+func evaluateParameter(e *ParameterExpression, val interface{}) (interface{}, error) {
+	val = unwrapNullable(normalizeValue(val))
+	typ := e.typ
+	if elem, ok := nullableType(typ); ok {
+		if val == nil {
+			return nil, nil
+		}
+		typ = elem
+	}
+	if typ == nil || (val != nil && reflect.TypeOf(val) == typ) {
+		return val, nil
+	}
+	converted, err := convertValue(val, typ)
+	if err != nil {
+		return nil, fmt.Errorf("parameter %s: %v", e.name, err)
+	}
+	return converted.Interface(), nil
+}
+
+type ProgramVisitor struct {
+	root  *ProgramExpression
+	scope *Scope
+}
+
+func NewProgramVisitor(root *ProgramExpression, scope *Scope) *ProgramVisitor {
+	return &ProgramVisitor{
+		root:  root,
+		scope: scope,
+	}
+}
+
+// Visit executes the statements in order within a new scope, stopping at
+// the first return statement.
+func (v *ProgramVisitor) Visit() (interface{}, error) {
+	result, err := visitStatements(v.root.statements, NewScope(v.scope))
+	if r, ok := err.(*returnSignal); ok {
+		result, err = r.value, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return convertToKind(result, v.root.Kind())
+}
+
+// returnSignal unwinds the statements enclosing a return statement up to
+// the program.
+type returnSignal struct {
+	value interface{}
+}
+
+func (r *returnSignal) Error() string {
+	return "return outside of a program"
+}
+
+// visitStatements executes statements in order and returns the value of
+// the last one.
+func visitStatements(statements []Expression, scope *Scope) (result interface{}, err error) {
+	for _, statement := range statements {
+		if result, err = visitExpression(statement, scope); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+type RangeVisitor struct {
+	root  *RangeExpression
+	scope *Scope
+}
+
+func NewRangeVisitor(root *RangeExpression, scope *Scope) *RangeVisitor {
+	return &RangeVisitor{
+		root:  root,
+		scope: scope,
+	}
+}
+
+func (v *RangeVisitor) Visit() (interface{}, error) {
+	var r Range
+	for _, bound := range []struct {
+		expr Expression
+		val  *interface{}
+	}{
+		{v.root.start, &r.Start},
+		{v.root.end, &r.End},
+	} {
+		if bound.expr == nil {
+			continue
+		}
+		visitor, err := CreateVisitorWithScope(bound.expr, v.scope)
+		if err != nil {
+			return nil, err
+		}
+		if *bound.val, err = visitor.Visit(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+type ReturnVisitor struct {
+	root  *ReturnExpression
+	scope *Scope
+}
+
+func NewReturnVisitor(root *ReturnExpression, scope *Scope) *ReturnVisitor {
+	return &ReturnVisitor{
+		root:  root,
+		scope: scope,
+	}
+}
+
+func (v *ReturnVisitor) Visit() (interface{}, error) {
+	if v.root.value == nil {
+		return nil, &returnSignal{}
+	}
+	val, err := visitExpression(v.root.value, v.scope)
+	if err != nil {
+		return nil, err
+	}
+	return nil, &returnSignal{value: val}
+}
+
+type SequenceVisitor struct {
+	root  *SequenceExpression
+	scope *Scope
+}
+
+func NewSequenceVisitor(root *SequenceExpression, scope *Scope) *SequenceVisitor {
+	return &SequenceVisitor{
+		root:  root,
+		scope: scope,
+	}
+}
+
+func (v *SequenceVisitor) Visit() (interface{}, error) {
+	return visitStatements(v.root.statements, NewScope(v.scope))
+}
+
+type SwitchVisitor struct {
+	root  *SwitchExpression
+	scope *Scope
+}
+
+func NewSwitchVisitor(root *SwitchExpression, scope *Scope) *SwitchVisitor {
+	return &SwitchVisitor{
+		root:  root,
+		scope: scope,
+	}
+}
+
+func (v *SwitchVisitor) Visit() (interface{}, error) {
+	subject, err := CreateVisitorWithScope(v.root.subject, v.scope)
+	if err != nil {
+		return nil, err
+	}
+	val, err := subject.Visit()
+	if err != nil {
+		return nil, err
+	}
+	for _, arm := range v.root.arms {
+		matched, err := arm.Pattern.Matches(val)
+		if err != nil {
+			return nil, err
+		}
+		if !matched {
+			continue
+		}
+		body, err := CreateVisitorWithScope(arm.Body, v.scope)
+		if err != nil {
+			return nil, err
+		}
+		result, err := body.Visit()
+		if err != nil {
+			return nil, err
+		}
+		return convertToKind(result, v.root.Kind())
+	}
+	return nil, fmt.Errorf("no switch arm matched the value %v", val)
 }
 
 type UnaryVisitor struct {
-	root *UnaryExpression
+	root  *UnaryExpression
+	scope *Scope
 }
 
-func NewUnaryVisitor(root *UnaryExpression) *UnaryVisitor {
+func NewUnaryVisitor(root *UnaryExpression, scope *Scope) *UnaryVisitor {
 	return &UnaryVisitor{
-		root: root,
+		root:  root,
+		scope: scope,
 	}
 }
 
 func (v *UnaryVisitor) Visit() (interface{}, error) {
 	switch v.root.Type() {
+	case PreIncrementAssignExpr, PreDecrementAssignExpr, PostIncrementAssignExpr, PostDecrementAssignExpr:
+		current, err := visitExpression(v.root.operand, v.scope)
+		if err != nil {
+			return nil, err
+		}
+		operator := AddExpr
+		if v.root.Type() == PreDecrementAssignExpr || v.root.Type() == PostDecrementAssignExpr {
+			operator = SubtractExpr
+		}
+		updated, err := evaluateArithmetic(operator, current, 1, v.root.Kind())
+		if err != nil {
+			return nil, err
+		}
+		stored, err := assignTo(v.root.operand, updated, v.scope)
+		if err != nil {
+			return nil, err
+		}
+		if v.root.Type() == PostIncrementAssignExpr || v.root.Type() == PostDecrementAssignExpr {
+			return current, nil
+		}
+		return stored, nil
+	case IndexFromEndExpr:
+		operand, err := CreateVisitorWithScope(v.root.operand, v.scope)
+		if err != nil {
+			return nil, err
+		}
+		val, err := operand.Visit()
+		if err != nil {
+			return nil, err
+		}
+		i, err := convertToInt(val)
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 {
+			return nil, fmt.Errorf("index from end can't be negative: %d", i)
+		}
+		return Index{Value: i, FromEnd: true}, nil
+	case NegateExpr, UnaryPlusExpr, NotExpr:
+		val, err := visitExpression(v.root.operand, v.scope)
+		if err != nil {
+			return nil, err
+		}
+		return evaluateUnary(v.root, val)
+	}
+
+	return nil, fmt.Errorf("unknown expression type: %v", v.root.Type())
+}
+
+// evaluateUnary applies -, + or ! to the value of its operand.
+func evaluateUnary(e *UnaryExpression, val interface{}) (interface{}, error) {
+	switch e.Type() {
 	case NegateExpr:
-		return nil, errors.New("unimplemented")
+		if e.operator != nil {
+			return e.operator.call(val)
+		}
+		return evaluateArithmetic(SubtractExpr, 0, val, e.Kind())
 	case UnaryPlusExpr:
-		return nil, errors.New("unimplemented")
+		return convertToKind(val, e.Kind())
 	case NotExpr:
-		return nil, errors.New("unimplemented")
+		// Like arithmetic, ! is lifted: !null is null.
+		if val == nil {
+			return nil, nil
+		}
+		b, ok := val.(bool)
+		if !ok {
+			return nil, fmt.Errorf("expected %v to be a bool but got %T", e.operand, val)
+		}
+		return !b, nil
 	}
+	return nil, fmt.Errorf("unknown expression type: %v", e.Type())
+}
 
-	return nil, fmt.Errorf("unknown expression type: %v", v.root.Type())
+// visitBool evaluates an expression which must produce a bool.
+func visitBool(node Expression, scope *Scope) (bool, error) {
+	val, err := visitExpression(node, scope)
+	if err != nil {
+		return false, err
+	}
+	b, ok := val.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected a bool but got %T: %v", val, node)
+	}
+	return b, nil
 }
 
 func convertToInt(val interface{}) (int, error) {
@@ -195,6 +919,10 @@ func convertToInt(val interface{}) (int, error) {
 		return int(t), nil
 	}
 
+	// Named types, such as type Count int, have arithmetic kinds.
+	if v := reflect.ValueOf(val); IsArithmetic(v.Kind()) {
+		return int(v.Convert(typeNames["int"]).Int()), nil
+	}
 	return 0, fmt.Errorf("unable to convert value to integer: %v", val)
 }
 
@@ -206,3 +934,232 @@ func convertExpressionToInt(leftVal interface{}, rightVal interface{}) (left int
 	right, err = convertToInt(rightVal)
 	return left, right, err
 }
+
+// evaluateArithmetic applies an arithmetic operator and converts the result
+// to the kind of the expression. Operands are computed as float64s when
+// either of them, or the result, is a float and as ints otherwise. The
+// operators are lifted: when either operand is null, so is the result.
+func evaluateArithmetic(nodeType ExpressionType, lVal interface{}, rVal interface{}, kind reflect.Kind) (interface{}, error) {
+	if lVal == nil || rVal == nil {
+		return nil, nil
+	}
+	if isFloat(lVal) || isFloat(rVal) || kind == reflect.Float32 || kind == reflect.Float64 {
+		l, err := convertToFloat64(lVal)
+		if err != nil {
+			return nil, err
+		}
+		r, err := convertToFloat64(rVal)
+		if err != nil {
+			return nil, err
+		}
+		var result float64
+		switch nodeType {
+		case AddExpr:
+			result = l + r
+		case SubtractExpr:
+			result = l - r
+		case MultiplyExpr:
+			result = l * r
+		case DivideExpr:
+			result = l / r
+		case ModuloExpr:
+			result = math.Mod(l, r)
+		default:
+			return nil, fmt.Errorf("%v is not an arithmetic expression", nodeType)
+		}
+		return convertToKind(result, kind)
+	}
+
+	l, r, err := convertExpressionToInt(lVal, rVal)
+	if err != nil {
+		return nil, err
+	}
+	var result int
+	switch nodeType {
+	case AddExpr:
+		result = l + r
+	case SubtractExpr:
+		result = l - r
+	case MultiplyExpr:
+		result = l * r
+	case DivideExpr, ModuloExpr:
+		if r == 0 {
+			return nil, errDivideByZero
+		}
+		if nodeType == DivideExpr {
+			result = l / r
+		} else {
+			result = l % r
+		}
+	default:
+		return nil, fmt.Errorf("%v is not an arithmetic expression", nodeType)
+	}
+	return convertToKind(result, kind)
+}
+
+func isFloat(val interface{}) bool {
+	switch val.(type) {
+	case float32, float64:
+		return true
+	}
+	return isFloatKind(reflect.ValueOf(val).Kind())
+}
+
+func convertToFloat64(val interface{}) (float64, error) {
+	switch t := val.(type) {
+	case int:
+		return float64(t), nil
+	case uint:
+		return float64(t), nil
+	case int8:
+		return float64(t), nil
+	case uint8:
+		return float64(t), nil
+	case int16:
+		return float64(t), nil
+	case uint16:
+		return float64(t), nil
+	case int32:
+		return float64(t), nil
+	case uint32:
+		return float64(t), nil
+	case int64:
+		return float64(t), nil
+	case uint64:
+		return float64(t), nil
+	case float32:
+		return float64(t), nil
+	case float64:
+		return t, nil
+	}
+
+	if v := reflect.ValueOf(val); IsArithmetic(v.Kind()) {
+		return v.Convert(typeNames["float64"]).Float(), nil
+	}
+	return 0, fmt.Errorf("unable to convert value to float: %v", val)
+}
+
+// unordered is the result of comparing NaN with a number, which like in Go
+// is neither less than, equal to nor greater than it.
+const unordered = 2
+
+// compareValues returns -1, 0 or 1 when left is less than, equal to or
+// greater than right, or unordered when either is NaN. Numbers of any kind
+// compare by value and strings compare lexically.
+func compareValues(left interface{}, right interface{}) (int, error) {
+	if l, ok := left.(string); ok {
+		r, ok := right.(string)
+		if !ok {
+			return 0, fmt.Errorf("unable to compare %T with %T", left, right)
+		}
+		return strings.Compare(l, r), nil
+	}
+	lv, rv := reflect.ValueOf(left), reflect.ValueOf(right)
+	if IsInteger(lv.Kind()) && IsInteger(rv.Kind()) {
+		return compareIntegers(lv, rv), nil
+	}
+	l, err := convertToFloat64(left)
+	if err != nil {
+		return 0, err
+	}
+	r, err := convertToFloat64(right)
+	if err != nil {
+		return 0, err
+	}
+	return compareFloats(l, r), nil
+}
+
+// compareFloats compares two floats like compareValues.
+func compareFloats(x float64, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	case x == y:
+		return 0
+	}
+	return unordered
+}
+
+// evaluateComparison applies <, <=, > or >=. Comparisons with null are
+// false.
+func evaluateComparison(nodeType ExpressionType, lVal interface{}, rVal interface{}) (bool, error) {
+	if lVal == nil || rVal == nil {
+		return false, nil
+	}
+	switch nodeType {
+	case LessThanExpr, LessThanOrEqualExpr, GreaterThanExpr, GreaterThanOrEqualExpr:
+	default:
+		return false, fmt.Errorf("%v is not a comparison", nodeType)
+	}
+	c, err := compareValues(lVal, rVal)
+	if err != nil {
+		return false, err
+	}
+	return comparisonHolds(nodeType, c), nil
+}
+
+// comparisonHolds determines whether or not a comparison, or == or !=,
+// holds for operands which compareValues compared as c. Like in Go, only
+// != holds for unordered operands.
+func comparisonHolds(nodeType ExpressionType, c int) bool {
+	switch {
+	case nodeType == EqualExpr:
+		return c == 0
+	case nodeType == NotEqualExpr:
+		return c != 0
+	case c == unordered:
+		return false
+	case nodeType == LessThanExpr:
+		return c < 0
+	case nodeType == LessThanOrEqualExpr:
+		return c <= 0
+	case nodeType == GreaterThanExpr:
+		return c > 0
+	}
+	return c >= 0
+}
+
+func compareIntegers(left reflect.Value, right reflect.Value) int {
+	lNeg := !IsUnsigned(left.Kind()) && left.Int() < 0
+	rNeg := !IsUnsigned(right.Kind()) && right.Int() < 0
+	switch {
+	case lNeg && !rNeg:
+		return -1
+	case !lNeg && rNeg:
+		return 1
+	case lNeg && rNeg:
+		l, r := left.Int(), right.Int()
+		if l < r {
+			return -1
+		} else if l > r {
+			return 1
+		}
+		return 0
+	}
+	l, r := integerMagnitude(left), integerMagnitude(right)
+	if l < r {
+		return -1
+	} else if l > r {
+		return 1
+	}
+	return 0
+}
+
+func integerMagnitude(v reflect.Value) uint64 {
+	if IsUnsigned(v.Kind()) {
+		return v.Uint()
+	}
+	return uint64(v.Int())
+}
+
+// valuesEqual determines whether or not two values are equal. Numbers
+// compare by value regardless of their kind.
+func valuesEqual(left interface{}, right interface{}) bool {
+	if IsArithmetic(reflect.ValueOf(left).Kind()) && IsArithmetic(reflect.ValueOf(right).Kind()) {
+		c, err := compareValues(left, right)
+		return err == nil && c == 0
+	}
+	return reflect.DeepEqual(left, right)
+}
@@ -0,0 +1,457 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// cell is a value on the virtual machine's stack. Unboxed ints and floats
+// are held as the bits of an int64 or float64 and bools as 0 or 1; other
+// values are boxed.
+type cell struct {
+	bits uint64
+	val  interface{}
+}
+
+// stackSize is the depth of the stack the machine keeps on the Go stack.
+// Deeper bytecode allocates its stack.
+const stackSize = 32
+
+// Evaluate evaluates the bytecode with the provided parameters. As with
+// ExpressionParser.Evaluate, when they're nil the parameters the parser was
+// created with are used.
+func (b *Bytecode) Evaluate(parameters map[string]interface{}) (interface{}, error) {
+	if err := checkUnbound(b.bound, parameters); err != nil {
+		return nil, err
+	}
+	result, err := b.run(b.frame(parameters))
+	if err != nil {
+		return nil, err
+	}
+	return convertToNamedType(b.box(result), b.typ), nil
+}
+
+// EvaluateStruct evaluates the bytecode against a value of the struct it
+// was compiled for, or a pointer to one.
+func (b *Bytecode) EvaluateStruct(env interface{}) (interface{}, error) {
+	f, err := b.structFrame(env)
+	if err != nil {
+		return nil, err
+	}
+	result, err := b.run(f)
+	if err != nil {
+		return nil, err
+	}
+	return convertToNamedType(b.box(result), b.typ), nil
+}
+
+// EvaluateBool evaluates bytecode which produces a bool, such as a rule.
+func (b *Bytecode) EvaluateBool(parameters map[string]interface{}) (bool, error) {
+	if err := checkUnbound(b.bound, parameters); err != nil {
+		return false, err
+	}
+	result, err := b.run(b.frame(parameters))
+	if err != nil {
+		return false, err
+	}
+	return b.boolOf(result)
+}
+
+// EvaluateStructBool evaluates bytecode which produces a bool against
+// a value of the struct it was compiled for, or a pointer to one.
+func (b *Bytecode) EvaluateStructBool(env interface{}) (bool, error) {
+	f, err := b.structFrame(env)
+	if err != nil {
+		return false, err
+	}
+	result, err := b.run(f)
+	if err != nil {
+		return false, err
+	}
+	return b.boolOf(result)
+}
+
+// EvaluateFloat64 evaluates bytecode which produces a number, converting it
+// to a float64.
+func (b *Bytecode) EvaluateFloat64(parameters map[string]interface{}) (float64, error) {
+	if err := checkUnbound(b.bound, parameters); err != nil {
+		return 0, err
+	}
+	result, err := b.run(b.frame(parameters))
+	if err != nil {
+		return 0, err
+	}
+	switch b.result {
+	case unboxedFloat:
+		return math.Float64frombits(result.bits), nil
+	case unboxedInt:
+		return float64(int64(result.bits)), nil
+	}
+	if result.val == nil {
+		return 0, fmt.Errorf("expected a number but got null")
+	}
+	return convertToFloat64(result.val)
+}
+
+func (b *Bytecode) frame(parameters map[string]interface{}) frame {
+	if parameters == nil {
+		parameters = b.parameters
+	}
+	return frame{parameters: parameters}
+}
+
+func (b *Bytecode) structFrame(env interface{}) (frame, error) {
+	if b.environment == nil {
+		return frame{}, errNoEnvironment
+	}
+	v, err := b.environment.value(env)
+	if err != nil {
+		return frame{}, err
+	}
+	return frame{environment: v}, nil
+}
+
+// boolOf returns a result which must be a bool.
+func (b *Bytecode) boolOf(result cell) (bool, error) {
+	if b.result == unboxedBool {
+		return result.bits != 0, nil
+	}
+	val, ok := result.val.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected a bool but got %T", result.val)
+	}
+	return val, nil
+}
+
+// box returns the result as a value of its kind.
+func (b *Bytecode) box(result cell) interface{} {
+	switch b.result {
+	case unboxedInt:
+		return boxInt(int64(result.bits), b.kind)
+	case unboxedFloat:
+		return math.Float64frombits(result.bits)
+	case unboxedBool:
+		return result.bits != 0
+	}
+	return result.val
+}
+
+// boxInt converts an int64 to a value of the provided integer kind.
+func boxInt(x int64, kind reflect.Kind) interface{} {
+	switch kind {
+	case reflect.Int:
+		return int(x)
+	case reflect.Int64:
+		return x
+	}
+	if typ := typeOfKind(kind); typ != nil && IsArithmetic(kind) {
+		return reflect.ValueOf(x).Convert(typ).Interface()
+	}
+	return x
+}
+
+func boolBits(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// run executes the bytecode and returns the value it leaves on the stack.
+func (b *Bytecode) run(f frame) (cell, error) {
+	var buf [stackSize]cell
+	stack := buf[:]
+	if b.maxStack > stackSize {
+		stack = make([]cell, b.maxStack)
+	}
+	sp := 0
+	// shared holds the values of shared subexpressions, and evaluated has
+	// a bit set for each slot which holds one.
+	var shared [maxSharedSlots]cell
+	var evaluated uint64
+	code := b.code
+	for pc := 0; pc < len(code); {
+		op := Opcode(code[pc])
+		var arg int
+		if op < opcodeCount && opcodeInfo[op].operands > 0 {
+			arg = int(code[pc+1])<<8 | int(code[pc+2])
+		}
+		if op < opcodeCount {
+			pc += 1 + 2*opcodeInfo[op].operands
+		}
+		switch op {
+		case OpConst:
+			stack[sp] = cell{val: b.constants[arg]}
+			sp++
+		case OpConstInt:
+			stack[sp] = cell{bits: uint64(b.constants[arg].(int64))}
+			sp++
+		case OpConstFloat:
+			stack[sp] = cell{bits: math.Float64bits(b.constants[arg].(float64))}
+			sp++
+		case OpTrue, OpFalse:
+			stack[sp] = cell{bits: boolBits(op == OpTrue)}
+			sp++
+		case OpParam:
+			val, err := b.param(f, arg)
+			if err != nil {
+				return cell{}, err
+			}
+			stack[sp] = cell{val: val}
+			sp++
+		case OpParamInt:
+			p := b.params[arg]
+			val := f.parameters[p.name]
+			x, ok := val.(int64)
+			if p.Kind() == reflect.Int {
+				var i int
+				i, ok = val.(int)
+				x = int64(i)
+			}
+			if !ok {
+				val, err := b.param(f, arg)
+				if err != nil {
+					return cell{}, err
+				}
+				x = reflect.ValueOf(val).Int()
+			}
+			stack[sp] = cell{bits: uint64(x)}
+			sp++
+		case OpParamFloat:
+			x, ok := f.parameters[b.params[arg].name].(float64)
+			if !ok {
+				val, err := b.param(f, arg)
+				if err != nil {
+					return cell{}, err
+				}
+				x = val.(float64)
+			}
+			stack[sp] = cell{bits: math.Float64bits(x)}
+			sp++
+		case OpParamBool:
+			x, ok := f.parameters[b.params[arg].name].(bool)
+			if !ok {
+				val, err := b.param(f, arg)
+				if err != nil {
+					return cell{}, err
+				}
+				x = val.(bool)
+			}
+			stack[sp] = cell{bits: boolBits(x)}
+			sp++
+		case OpField, OpFieldInt, OpFieldFloat, OpFieldBool:
+			field, err := fieldOf(f.environment, b.fields[arg])
+			if err != nil {
+				return cell{}, err
+			}
+			switch op {
+			case OpFieldInt:
+				stack[sp] = cell{bits: uint64(field.Int())}
+			case OpFieldFloat:
+				stack[sp] = cell{bits: math.Float64bits(field.Float())}
+			case OpFieldBool:
+				stack[sp] = cell{bits: boolBits(field.Bool())}
+			default:
+				stack[sp] = cell{val: unwrapNullable(normalizeValue(field.Interface()))}
+			}
+			sp++
+		case OpCallHost:
+			argc := int(code[pc-2])<<8 | int(code[pc-1])
+			args := make([]interface{}, argc)
+			for i := range args {
+				args[i] = stack[sp-argc+i].val
+			}
+			sp -= argc
+			val, err := callMethod(f.environment, b.methods[arg], args)
+			if err != nil {
+				return cell{}, err
+			}
+			stack[sp] = cell{val: val}
+			sp++
+		case OpAddInt, OpSubtractInt, OpMultiplyInt, OpDivideInt, OpModuloInt:
+			l, r := int64(stack[sp-2].bits), int64(stack[sp-1].bits)
+			var x int64
+			switch op {
+			case OpAddInt:
+				x = l + r
+			case OpSubtractInt:
+				x = l - r
+			case OpMultiplyInt:
+				x = l * r
+			default:
+				if r == 0 {
+					return cell{}, errDivideByZero
+				}
+				if op == OpDivideInt {
+					x = l / r
+				} else {
+					x = l % r
+				}
+			}
+			sp--
+			stack[sp-1] = cell{bits: uint64(x)}
+		case OpAddFloat, OpSubtractFloat, OpMultiplyFloat, OpDivideFloat, OpModuloFloat:
+			l, r := math.Float64frombits(stack[sp-2].bits), math.Float64frombits(stack[sp-1].bits)
+			var x float64
+			switch op {
+			case OpAddFloat:
+				x = l + r
+			case OpSubtractFloat:
+				x = l - r
+			case OpMultiplyFloat:
+				x = l * r
+			case OpDivideFloat:
+				x = l / r
+			default:
+				x = math.Mod(l, r)
+			}
+			sp--
+			stack[sp-1] = cell{bits: math.Float64bits(x)}
+		case OpNegateInt:
+			stack[sp-1].bits = uint64(-int64(stack[sp-1].bits))
+		case OpNegateFloat:
+			stack[sp-1].bits = math.Float64bits(-math.Float64frombits(stack[sp-1].bits))
+		case OpEqualInt, OpLessInt, OpLessOrEqualInt, OpGreaterInt, OpGreaterOrEqualInt:
+			l, r := int64(stack[sp-2].bits), int64(stack[sp-1].bits)
+			var x bool
+			switch op {
+			case OpEqualInt:
+				x = l == r
+			case OpLessInt:
+				x = l < r
+			case OpLessOrEqualInt:
+				x = l <= r
+			case OpGreaterInt:
+				x = l > r
+			default:
+				x = l >= r
+			}
+			sp--
+			stack[sp-1] = cell{bits: boolBits(x)}
+		case OpEqualFloat, OpLessFloat, OpLessOrEqualFloat, OpGreaterFloat, OpGreaterOrEqualFloat:
+			l, r := math.Float64frombits(stack[sp-2].bits), math.Float64frombits(stack[sp-1].bits)
+			var x bool
+			switch op {
+			case OpEqualFloat:
+				x = l == r
+			case OpLessFloat:
+				x = l < r
+			case OpLessOrEqualFloat:
+				x = l <= r
+			case OpGreaterFloat:
+				x = l > r
+			default:
+				x = l >= r
+			}
+			sp--
+			stack[sp-1] = cell{bits: boolBits(x)}
+		case OpEqualBool:
+			sp--
+			stack[sp-1] = cell{bits: boolBits(stack[sp-1].bits == stack[sp].bits)}
+		case OpNot:
+			stack[sp-1].bits ^= 1
+		case OpIntToFloat:
+			stack[sp-1].bits = math.Float64bits(float64(int64(stack[sp-1].bits)))
+		case OpFloatToInt:
+			stack[sp-1].bits = uint64(int64(math.Float64frombits(stack[sp-1].bits)))
+		case OpBoxInt:
+			stack[sp-1] = cell{val: boxInt(int64(stack[sp-1].bits), reflect.Kind(arg))}
+		case OpBoxFloat:
+			stack[sp-1] = cell{val: math.Float64frombits(stack[sp-1].bits)}
+		case OpBoxBool:
+			stack[sp-1] = cell{val: stack[sp-1].bits != 0}
+		case OpUnboxBool:
+			x, ok := stack[sp-1].val.(bool)
+			if !ok {
+				return cell{}, fmt.Errorf("expected a bool but got %T", stack[sp-1].val)
+			}
+			stack[sp-1] = cell{bits: boolBits(x)}
+		case OpUnboxFloat:
+			val := stack[sp-1].val
+			if val == nil {
+				return cell{}, fmt.Errorf("expected a number but got null")
+			}
+			x, err := convertToFloat64(val)
+			if err != nil {
+				return cell{}, err
+			}
+			stack[sp-1] = cell{bits: math.Float64bits(x)}
+		case OpAdd, OpSubtract, OpMultiply, OpDivide, OpModulo,
+			OpEqual, OpNotEqual, OpLess, OpLessOrEqual, OpGreater, OpGreaterOrEqual,
+			OpIndex, OpIn, OpOr:
+			val, err := applyBinary(boxedOpcodes[op], reflect.Kind(arg), stack[sp-2].val, stack[sp-1].val)
+			if err != nil {
+				return cell{}, err
+			}
+			sp--
+			stack[sp-1] = cell{val: val}
+		case OpNegate:
+			val, err := evaluateArithmetic(SubtractExpr, 0, stack[sp-1].val, reflect.Kind(arg))
+			if err != nil {
+				return cell{}, err
+			}
+			stack[sp-1] = cell{val: val}
+		case OpPlus, OpToKind:
+			val, err := convertToKind(stack[sp-1].val, reflect.Kind(arg))
+			if err != nil {
+				return cell{}, err
+			}
+			stack[sp-1] = cell{val: val}
+		case OpNotBoxed:
+			// Like arithmetic, ! is lifted: !null is null.
+			switch val := stack[sp-1].val.(type) {
+			case nil:
+			case bool:
+				stack[sp-1] = cell{val: !val}
+			default:
+				return cell{}, fmt.Errorf("expected a bool but got %T", val)
+			}
+		case OpConvert:
+			val, err := evaluateConvert(&ConvertExpression{typ: typeOfKind(reflect.Kind(arg))}, stack[sp-1].val)
+			if err != nil {
+				return cell{}, err
+			}
+			stack[sp-1] = cell{val: val}
+		case OpJump:
+			pc = arg
+		case OpJumpIfFalse:
+			sp--
+			if stack[sp].bits == 0 {
+				pc = arg
+			}
+		case OpJumpIfFalseOrPop, OpJumpIfTrueOrPop:
+			if (stack[sp-1].bits != 0) == (op == OpJumpIfTrueOrPop) {
+				pc = arg
+			} else {
+				sp--
+			}
+		case OpLoadShared:
+			slot := uint(code[pc-2])<<8 | uint(code[pc-1])
+			if evaluated&(1<<slot) != 0 {
+				stack[sp] = shared[slot]
+				sp++
+				pc = arg
+			}
+		case OpStoreShared:
+			shared[arg] = stack[sp-1]
+			evaluated |= 1 << uint(arg)
+		default:
+			return cell{}, fmt.Errorf("invalid opcode %v at %d", op, pc)
+		}
+	}
+	if sp != 1 {
+		return cell{}, fmt.Errorf("invalid bytecode leaves %d values on the stack", sp)
+	}
+	return stack[0], nil
+}
+
+// param returns the value of a parameter, converted to its type.
+func (b *Bytecode) param(f frame, index int) (interface{}, error) {
+	p := b.params[index]
+	val, ok := f.parameters[p.name]
+	if !ok {
+		return nil, fmt.Errorf("unbound parameter: %s", p.name)
+	}
+	return evaluateParameter(p, val)
+}